@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// callStatus is the admin API's view of a call.
+type callStatus struct {
+	ID                string     `json:"id"`
+	RemoteAddr        string     `json:"remote_addr,omitempty"`
+	CallerID          string     `json:"caller_id,omitempty"`
+	CalledNumber      string     `json:"called_number,omitempty"`
+	StartedAt         time.Time  `json:"started_at"`
+	DurationSeconds   float64    `json:"duration_seconds"`
+	Turns             int        `json:"turns"`
+	LastActivity      *time.Time `json:"last_activity,omitempty"`
+	LastTranscription string     `json:"last_transcription,omitempty"`
+	Paused            bool       `json:"paused"`
+	// Interruptions counts the barge-ins per source.
+	Interruptions    map[InterruptSource]int `json:"interruptions,omitempty"`
+	LastInterruption InterruptSource         `json:"last_interruption,omitempty"`
+}
+
+func statusOf(call *Call) callStatus {
+	turns, last, transcription := call.Activity()
+	leg := call.Leg()
+	interruptions, lastInterruption := call.Interrupter.Interruptions()
+	status := callStatus{
+		ID:                call.ID,
+		RemoteAddr:        call.RemoteAddr,
+		CallerID:          leg.CallerID,
+		CalledNumber:      leg.CalledNumber,
+		StartedAt:         call.Started,
+		DurationSeconds:   since(call.Started).Seconds(),
+		Turns:             turns,
+		LastTranscription: transcription,
+		Paused:            call.Paused(),
+		Interruptions:     interruptions,
+		LastInterruption:  lastInterruption,
+	}
+	if !last.IsZero() {
+		status.LastActivity = &last
+	}
+	return status
+}
+
+// adminError is the body of a failed admin request.
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// adminHandler serves the admin API for the calls in registry:
+//
+//	GET  /calls                 list the active calls
+//	GET  /calls/{id}            inspect one call
+//	POST /calls/{id}/pause      stop the assistant from responding
+//	POST /calls/{id}/resume     let it respond again
+//	POST /calls/{id}/interrupt  cut off the reply being played
+//	POST /calls/{id}/hangup     end the call
+func adminHandler(registry *CallRegistry) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/calls", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, adminError{"method not allowed"})
+			return
+		}
+		statuses := []callStatus{}
+		for _, call := range registry.List() {
+			statuses = append(statuses, statusOf(call))
+		}
+		writeJSON(w, http.StatusOK, statuses)
+	})
+	mux.HandleFunc("/calls/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/calls/"), "/")
+		if len(parts) > 2 || parts[0] == "" {
+			writeJSON(w, http.StatusNotFound, adminError{"not found"})
+			return
+		}
+		id := parts[0]
+
+		call := registry.Get(id)
+		if call == nil {
+			writeJSON(w, http.StatusNotFound, adminError{"no active call " + id})
+			return
+		}
+		if len(parts) == 1 {
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", http.MethodGet)
+				writeJSON(w, http.StatusMethodNotAllowed, adminError{"method not allowed"})
+				return
+			}
+			writeJSON(w, http.StatusOK, statusOf(call))
+			return
+		}
+
+		action := parts[1]
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, adminError{"method not allowed"})
+			return
+		}
+		switch action {
+		case "pause":
+			call.Pause()
+		case "resume":
+			call.Resume()
+		case "interrupt":
+			if !call.Interrupter.Interrupt(InterruptAPI) {
+				writeJSON(w, http.StatusConflict, adminError{"nothing to interrupt or API barge-in disabled"})
+				return
+			}
+		case "hangup":
+			// Answer once the call is canceled; Handle exits on its own
+			call.Hangup()
+		default:
+			writeJSON(w, http.StatusNotFound, adminError{"not found"})
+			return
+		}
+		log.Printf("call %s: %s requested through the admin API", id, action)
+		writeJSON(w, http.StatusOK, statusOf(call))
+	})
+	return mux
+}
+
+// serveAdmin runs the admin API on addr until ctx is canceled.
+func serveAdmin(ctx context.Context, addr string) {
+	srv := &http.Server{Addr: addr, Handler: adminHandler(calls)}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	log.Printf("serving the admin API on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Println("admin server failed:", err)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// hangupOrderStream records whether the call was still up when the
+// hangup was written.
+type hangupOrderStream struct {
+	*ScriptedStream
+	ctx           context.Context
+	canceledFirst bool
+}
+
+func (s *hangupOrderStream) WriteHangup() error {
+	s.canceledFirst = s.ctx.Err() != nil
+	return s.ScriptedStream.WriteHangup()
+}
+
+// serveAdminFor registers call in a new registry and serves the admin API
+// for it.
+func serveAdminFor(t *testing.T, call *Call) *httptest.Server {
+	t.Helper()
+	registry := NewCallRegistry()
+	registry.Register(call)
+	srv := httptest.NewServer(adminHandler(registry))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestAdminHangup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &hangupOrderStream{ScriptedStream: NewScriptedStream(), ctx: ctx}
+	srv := serveAdminFor(t, NewCall("call", stream, cancel))
+
+	resp, err := http.Post(srv.URL+"/calls/call/hangup", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if ctx.Err() == nil {
+		t.Error("call context not canceled")
+	}
+	if !stream.HungUp() {
+		t.Error("no hangup sent")
+	}
+	if stream.canceledFirst {
+		t.Error("call canceled before the hangup was sent")
+	}
+}
+
+func TestAdminUnknownCall(t *testing.T) {
+	srv := serveAdminFor(t, NewCall("call", NewScriptedStream(), func() {}))
+	for _, tt := range []struct{ method, path string }{
+		{http.MethodGet, "/calls/other"},
+		{http.MethodPost, "/calls/other/hangup"},
+	} {
+		req, _ := http.NewRequest(tt.method, srv.URL+tt.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s %s: status = %d, want 404", tt.method, tt.path, resp.StatusCode)
+		}
+	}
+}
+
+// postAdmin posts action for the call named id and decodes its status.
+func postAdmin(t *testing.T, srv *httptest.Server, id, action string) (int, callStatus) {
+	t.Helper()
+	resp, err := http.Post(srv.URL+"/calls/"+id+"/"+action, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status callStatus
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, status
+}
+
+func TestAdminPauseResume(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Webhook.StateEvents = true })
+	events := withWebhookQueue(t)
+	tts := newTTSServer(t, make([]byte, 640), 320)
+	withTTS(t, tts)
+	ollama := &fakeOllama{}
+	_, store := newTestChat(t, "call", testSettings(0.7), ollama)
+	call := NewCall("call", NewScriptedStream(), func() {})
+	call.ChatStore = store
+	srv := serveAdminFor(t, call)
+
+	code, status := postAdmin(t, srv, "call", "pause")
+	if code != http.StatusOK || !status.Paused || !call.Paused() {
+		t.Fatalf("pause: status %d, %+v, want the call paused", code, status)
+	}
+	// The caller is still heard while paused, but not answered
+	handleTranscription(context.Background(), call, "are you there")
+	if n := len(ollama.Requests()); n != 0 {
+		t.Errorf("%d LLM requests while paused", n)
+	}
+	if n := len(tts.Requests()); n != 0 {
+		t.Errorf("%d synthesis requests while paused", n)
+	}
+	if _, _, heard := call.Activity(); heard != "are you there" {
+		t.Errorf("last transcription = %q, want the one heard while paused", heard)
+	}
+
+	code, status = postAdmin(t, srv, "call", "resume")
+	if code != http.StatusOK || status.Paused || call.Paused() {
+		t.Fatalf("resume: status %d, %+v, want the call resumed", code, status)
+	}
+	handleTranscription(context.Background(), call, "hello")
+	waitForState(t, events, stateListening)
+	if n := len(ollama.Requests()); n != 1 {
+		t.Errorf("%d LLM requests after resuming, want 1", n)
+	}
+	if requests := tts.Requests(); len(requests) != 1 || requests[0]["message"] != "ok" {
+		t.Errorf("synthesis requests = %v, want the reply spoken", requests)
+	}
+}
+
+func TestAdminInterrupt(t *testing.T) {
+	withConfig(t, func(c *Config) { c.BargeIn.API = true })
+	call := NewCall("call", NewScriptedStream(), func() {})
+	srv := serveAdminFor(t, call)
+
+	if code, _ := postAdmin(t, srv, "call", "interrupt"); code != http.StatusConflict {
+		t.Errorf("interrupt with nothing playing: status %d, want 409", code)
+	}
+
+	ctx, _, finish := call.Interrupter.StartPlayback(context.Background())
+	defer finish()
+	code, status := postAdmin(t, srv, "call", "interrupt")
+	if code != http.StatusOK {
+		t.Fatalf("interrupt: status %d, want 200", code)
+	}
+	if ctx.Err() == nil {
+		t.Error("playback not canceled")
+	}
+	if status.Interruptions[InterruptAPI] != 1 || status.LastInterruption != InterruptAPI {
+		t.Errorf("interruptions = %v, last %q, want one through the API", status.Interruptions, status.LastInterruption)
+	}
+}
+
+func TestAdminInterruptDisabled(t *testing.T) {
+	withConfig(t, func(c *Config) { c.BargeIn.API = false })
+	call := NewCall("call", NewScriptedStream(), func() {})
+	srv := serveAdminFor(t, call)
+
+	ctx, _, finish := call.Interrupter.StartPlayback(context.Background())
+	defer finish()
+	if code, _ := postAdmin(t, srv, "call", "interrupt"); code != http.StatusConflict {
+		t.Errorf("interrupt with API barge-in disabled: status %d, want 409", code)
+	}
+	if ctx.Err() != nil {
+		t.Error("playback canceled with API barge-in disabled")
+	}
+}
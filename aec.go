@@ -0,0 +1,137 @@
+package main
+
+import "sync"
+
+// aecMaxBacklog bounds the reference audio waiting to be matched with
+// inbound audio, in seconds. Anything older can't be in the echo tail
+// anymore.
+const aecMaxBacklog = 5
+
+// aecRegularization keeps the NLMS step finite while the reference is
+// silent.
+const aecRegularization = 1e-6
+
+// AECConfig configures acoustic echo cancellation.
+type AECConfig struct {
+	Enabled bool `json:"enabled"`
+	// TailMs is the longest echo path the filter can model.
+	TailMs int `json:"tail_ms"`
+	// StepSize is the NLMS adaptation rate, between 0 and 2; higher adapts
+	// faster but less precisely.
+	StepSize float64 `json:"step_size"`
+}
+
+// EchoCanceller removes the echo of played audio from inbound audio with a
+// normalized least mean squares adaptive filter. Played audio is queued as
+// reference and consumed in step with the inbound audio, so audio written
+// faster than real time still lines up. It is safe for concurrent use; a
+// nil EchoCanceller passes audio through unchanged.
+type EchoCanceller struct {
+	mu        sync.Mutex
+	config    AECConfig
+	weights   []float64
+	history   []float64 // the most recent reference samples, newest first
+	energy    float64   // sum of squares of history
+	backlog   []float32
+	maxQueued int
+}
+
+// NewEchoCanceller creates an EchoCanceller for audio at sampleRate.
+func NewEchoCanceller(cfg AECConfig, sampleRate int) *EchoCanceller {
+	e := &EchoCanceller{config: cfg}
+	e.SetSampleRate(sampleRate)
+	return e
+}
+
+// SetSampleRate resizes the filter for audio at sampleRate, resetting what
+// it has learned.
+func (e *EchoCanceller) SetSampleRate(sampleRate int) {
+	if e == nil {
+		return
+	}
+	taps := sampleRate * e.config.TailMs / 1000
+	if taps < 1 {
+		taps = 1
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.weights = make([]float64, taps)
+	e.history = make([]float64, taps)
+	e.energy = 0
+	e.backlog = nil
+	e.maxQueued = sampleRate * aecMaxBacklog
+}
+
+// newEchoCanceller returns an EchoCanceller if cfg enables one, or nil.
+func newEchoCanceller(cfg AECConfig, sampleRate int) *EchoCanceller {
+	if !cfg.Enabled {
+		return nil
+	}
+	return NewEchoCanceller(cfg, sampleRate)
+}
+
+// Reference queues SLIN audio played to the caller.
+func (e *EchoCanceller) Reference(pcm []byte) {
+	if e == nil {
+		return
+	}
+	samples, err := pcmToFloat32Array(pcm)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.backlog = append(e.backlog, samples...)
+	if over := len(e.backlog) - e.maxQueued; over > 0 {
+		e.backlog = append(e.backlog[:0], e.backlog[over:]...)
+	}
+}
+
+// Cancel returns inbound SLIN audio with the estimated echo removed.
+func (e *EchoCanceller) Cancel(pcm []byte) []byte {
+	if e == nil {
+		return pcm
+	}
+	samples, err := pcmToFloat32Array(pcm)
+	if err != nil {
+		return pcm
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, mic := range samples {
+		samples[i] = float32(e.process(float64(mic)))
+	}
+	return float32ArrayToPCM(samples)
+}
+
+// process cancels the echo from one inbound sample and adapts the filter.
+// e.mu must be held.
+func (e *EchoCanceller) process(mic float64) float64 {
+	var ref float64
+	if len(e.backlog) > 0 {
+		ref = float64(e.backlog[0])
+		e.backlog = e.backlog[1:]
+	}
+	last := e.history[len(e.history)-1]
+	e.energy += ref*ref - last*last
+	if e.energy < 0 {
+		e.energy = 0
+	}
+	copy(e.history[1:], e.history)
+	e.history[0] = ref
+
+	// Without reference energy there is no echo to cancel or learn from
+	if e.energy < aecRegularization {
+		return mic
+	}
+	var estimate float64
+	for k, w := range e.weights {
+		estimate += w * e.history[k]
+	}
+	residual := mic - estimate
+	step := e.config.StepSize * residual / (e.energy + aecRegularization)
+	for k := range e.weights {
+		e.weights[k] += step * e.history[k]
+	}
+	return residual
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// echoPath returns a synthetic echo of reference: attenuated by gain and
+// delayed by delay samples.
+func echoPath(reference []float32, delay int, gain float32) []float32 {
+	echo := make([]float32, len(reference))
+	for i := delay; i < len(echo); i++ {
+		echo[i] = gain * reference[i-delay]
+	}
+	return echo
+}
+
+func energy(samples []float32) float64 {
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+	return sum
+}
+
+func TestEchoCancellerAttenuatesEcho(t *testing.T) {
+	const rate, seconds, frame = 8000, 4, 160
+	e := NewEchoCanceller(AECConfig{Enabled: true, TailMs: 16, StepSize: 0.5}, rate)
+	rnd := rand.New(rand.NewSource(1))
+	reference := make([]float32, rate*seconds)
+	for i := range reference {
+		reference[i] = float32(rnd.Float64()*0.6 - 0.3)
+	}
+	// 5 ms of delay, inside the 16 ms tail
+	echo := echoPath(reference, 40, 0.6)
+
+	var residual []float32
+	for i := 0; i < len(reference); i += frame {
+		e.Reference(float32ArrayToPCM(reference[i : i+frame]))
+		out, err := pcmToFloat32Array(e.Cancel(float32ArrayToPCM(echo[i : i+frame])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		residual = append(residual, out...)
+	}
+
+	// Once converged, the last second keeps little of the echo
+	last := len(echo) - rate
+	if ratio := energy(residual[last:]) / energy(echo[last:]); ratio > 0.01 {
+		t.Errorf("residual keeps %.1f%% of the echo energy, want under 1%%", ratio*100)
+	}
+}
+
+func TestEchoCancellerWithoutReference(t *testing.T) {
+	e := NewEchoCanceller(AECConfig{Enabled: true, TailMs: 16, StepSize: 0.5}, 8000)
+	mic := float32ArrayToPCM(sine(300, 8000, 0.02))
+	if got := e.Cancel(mic); string(got) != string(mic) {
+		t.Error("inbound audio changed with nothing played")
+	}
+}
+
+func TestNilEchoCanceller(t *testing.T) {
+	e := newEchoCanceller(AECConfig{Enabled: false}, 8000)
+	if e != nil {
+		t.Fatal("echo canceller created while disabled")
+	}
+	mic := float32ArrayToPCM(sine(300, 8000, 0.02))
+	e.Reference(mic)
+	if got := e.Cancel(mic); string(got) != string(mic) {
+		t.Error("disabled echo canceller changed inbound audio")
+	}
+}
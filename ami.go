@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"go-ast-client/api"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultAMIPort is the port of the Asterisk Manager Interface.
+const defaultAMIPort = 5038
+
+// AMIConfig configures the Asterisk Manager Interface, through which calls
+// are transferred. Unlike ARI, which only controls channels in a Stasis
+// application, AMI can redirect any channel, including one running
+// AudioSocket from the dialplan.
+type AMIConfig struct {
+	// Addr is the host:port of AMI, e.g. "asterisk:5038". If empty it is
+	// derived from the chat's AsteriskHost.
+	Addr     string `json:"addr"`
+	Username string `json:"username"`
+	Secret   string `json:"secret"`
+}
+
+// AMIClient is a minimal client for the AMI actions the bridge uses. Each
+// call logs in on a connection of its own.
+type AMIClient struct {
+	Addr     string
+	Username string
+	Secret   string
+}
+
+// amiClientFor returns the AMI client for a chat, using the configured
+// address or else the chat's Asterisk host.
+func amiClientFor(settings api.AsteriskSettings) (*AMIClient, error) {
+	addr := config.AMI.Addr
+	if addr == "" {
+		if settings.AsteriskHost == "" {
+			return nil, fmt.Errorf("no AMI addr configured and no asterisk_host in chat settings")
+		}
+		addr = net.JoinHostPort(settings.AsteriskHost, strconv.Itoa(defaultAMIPort))
+	}
+	return &AMIClient{
+		Addr:     addr,
+		Username: config.AMI.Username,
+		Secret:   config.AMI.Secret,
+	}, nil
+}
+
+// Redirect sets vars on channel and moves it to priority 1 of exten in
+// dialplanContext, taking it out of whatever application it runs, e.g.
+// AudioSocket. channel is a channel name or unique ID.
+func (c *AMIClient) Redirect(ctx context.Context, channel, dialplanContext, exten string, vars map[string]string) error {
+	s, err := c.login(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := s.run("Setvar", "Channel", channel, "Variable", name, "Value", vars[name]); err != nil {
+			return fmt.Errorf("failed to set %s: %w", name, err)
+		}
+	}
+	if err := s.run("Redirect", "Channel", channel, "Context", dialplanContext, "Exten", exten, "Priority", "1"); err != nil {
+		return fmt.Errorf("failed to redirect channel: %w", err)
+	}
+	return nil
+}
+
+// amiSession is a logged in AMI connection.
+type amiSession struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	actionID int
+}
+
+// login connects to AMI and logs in with events off. The connection is
+// bounded by the deadline of ctx.
+func (c *AMIClient) login(ctx context.Context) (*amiSession, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	s := &amiSession{conn: conn, r: bufio.NewReader(conn)}
+	// Asterisk greets with its version, e.g. "Asterisk Call Manager/7.0.3"
+	if _, err := s.r.ReadString('\n'); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := s.run("Login", "Username", c.Username, "Secret", c.Secret, "Events", "off"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("AMI login failed: %w", err)
+	}
+	return s, nil
+}
+
+// run sends action with the given header name and value pairs and waits
+// for its response, failing unless it is a success.
+func (s *amiSession) run(action string, fields ...string) error {
+	s.actionID++
+	id := strconv.Itoa(s.actionID)
+	var b strings.Builder
+	fmt.Fprintf(&b, "Action: %s\r\nActionID: %s\r\n", action, id)
+	for i := 0; i+1 < len(fields); i += 2 {
+		// A line break would smuggle in headers of its own
+		if strings.ContainsAny(fields[i+1], "\r\n") {
+			return fmt.Errorf("invalid %s %q", fields[i], fields[i+1])
+		}
+		fmt.Fprintf(&b, "%s: %s\r\n", fields[i], fields[i+1])
+	}
+	b.WriteString("\r\n")
+	if _, err := s.conn.Write([]byte(b.String())); err != nil {
+		return err
+	}
+	for {
+		message, err := s.read()
+		if err != nil {
+			return err
+		}
+		// Events and responses to other actions are skipped
+		if message["ActionID"] != id || message["Response"] == "" {
+			continue
+		}
+		if message["Response"] != "Success" {
+			return fmt.Errorf("%s: %s", action, message["Message"])
+		}
+		return nil
+	}
+}
+
+// read returns the headers of the next message.
+func (s *amiSession) read() (map[string]string, error) {
+	message := make(map[string]string)
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if len(message) > 0 {
+				return message, nil
+			}
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		message[name] = strings.TrimSpace(value)
+	}
+}
+
+// close logs off, not waiting for the goodbye, and closes the connection.
+func (s *amiSession) close() {
+	s.conn.Write([]byte("Action: Logoff\r\n\r\n"))
+	s.conn.Close()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-ast-client/api"
+)
+
+// fakeAMI is an AMI server recording the actions it receives.
+type fakeAMI struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	actions []map[string]string
+	// fail holds the actions answered with an error.
+	fail map[string]bool
+}
+
+func newFakeAMI(t *testing.T) *fakeAMI {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ami := &fakeAMI{ln: ln, fail: make(map[string]bool)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go ami.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	withConfig(t, func(c *Config) {
+		c.AMI = AMIConfig{Addr: ln.Addr().String(), Username: "bridge", Secret: "secret"}
+	})
+	return ami
+}
+
+func (ami *fakeAMI) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.Write([]byte("Asterisk Call Manager/7.0.3\r\n"))
+	// An event the client must skip
+	conn.Write([]byte("Event: FullyBooted\r\nStatus: Fully Booted\r\n\r\n"))
+	r := bufio.NewReader(conn)
+	action := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" {
+			name, value, _ := strings.Cut(line, ":")
+			action[name] = strings.TrimSpace(value)
+			continue
+		}
+		ami.mu.Lock()
+		ami.actions = append(ami.actions, action)
+		failed := ami.fail[action["Action"]]
+		ami.mu.Unlock()
+		switch {
+		case action["Action"] == "Logoff":
+			conn.Write([]byte("Response: Goodbye\r\n\r\n"))
+			return
+		case failed:
+			conn.Write([]byte("Response: Error\r\nActionID: " + action["ActionID"] + "\r\nMessage: Channel not found\r\n\r\n"))
+		default:
+			conn.Write([]byte("Response: Success\r\nActionID: " + action["ActionID"] + "\r\n\r\n"))
+		}
+		action = make(map[string]string)
+	}
+}
+
+// Fail has action answered with an error, or not.
+func (ami *fakeAMI) Fail(action string, fail bool) {
+	ami.mu.Lock()
+	defer ami.mu.Unlock()
+	ami.fail[action] = fail
+}
+
+// Actions returns the actions received so far.
+func (ami *fakeAMI) Actions() []map[string]string {
+	ami.mu.Lock()
+	defer ami.mu.Unlock()
+	return append([]map[string]string(nil), ami.actions...)
+}
+
+// actionNames returns the Action header of each of actions.
+func actionNames(actions []map[string]string) string {
+	names := make([]string, len(actions))
+	for i, action := range actions {
+		names[i] = action["Action"]
+	}
+	return strings.Join(names, " ")
+}
+
+// waitForActions waits until ami received n actions and returns them.
+func waitForActions(t *testing.T, ami *fakeAMI, n int) []map[string]string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if actions := ami.Actions(); len(actions) >= n {
+			return actions
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("AMI got %s, want %d actions", actionNames(ami.Actions()), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAMIRedirect(t *testing.T) {
+	ami := newFakeAMI(t)
+	client, err := amiClientFor(api.AsteriskSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Redirect(context.Background(), "1700000000.42", "audiosocket-transfer", "s", map[string]string{"TRANSFER_ENDPOINT": "PJSIP/200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := waitForActions(t, ami, 4)
+	if got := actionNames(actions); got != "Login Setvar Redirect Logoff" {
+		t.Fatalf("AMI actions = %s, want Login Setvar Redirect Logoff", got)
+	}
+	if login := actions[0]; login["Username"] != "bridge" || login["Secret"] != "secret" || login["Events"] != "off" {
+		t.Errorf("login = %v, want the configured credentials with events off", login)
+	}
+	if setvar := actions[1]; setvar["Channel"] != "1700000000.42" || setvar["Variable"] != "TRANSFER_ENDPOINT" || setvar["Value"] != "PJSIP/200" {
+		t.Errorf("setvar = %v, want the endpoint set on the channel", setvar)
+	}
+	redirect := actions[2]
+	if redirect["Channel"] != "1700000000.42" || redirect["Context"] != "audiosocket-transfer" || redirect["Exten"] != "s" || redirect["Priority"] != "1" {
+		t.Errorf("redirect = %v, want the channel sent to audiosocket-transfer,s,1", redirect)
+	}
+}
+
+func TestAMIRedirectFailures(t *testing.T) {
+	ami := newFakeAMI(t)
+	client, _ := amiClientFor(api.AsteriskSettings{})
+
+	ami.Fail("Login", true)
+	if err := client.Redirect(context.Background(), "1700000000.42", "transfer", "s", nil); err == nil || !strings.Contains(err.Error(), "login") {
+		t.Errorf("Redirect() with bad credentials = %v, want a login error", err)
+	}
+
+	ami.Fail("Login", false)
+	ami.Fail("Redirect", true)
+	if err := client.Redirect(context.Background(), "1700000000.42", "transfer", "s", nil); err == nil || !strings.Contains(err.Error(), "Channel not found") {
+		t.Errorf("Redirect() of a missing channel = %v, want Asterisk's error", err)
+	}
+
+	if err := client.Redirect(context.Background(), "1700000000.42\r\nAction: Hangup", "transfer", "s", nil); err == nil {
+		t.Error("channel with a line break sent to AMI")
+	}
+}
+
+func TestAMIClientFor(t *testing.T) {
+	withConfig(t, func(c *Config) { c.AMI.Addr = "" })
+	client, err := amiClientFor(api.AsteriskSettings{AsteriskHost: "pbx.local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Addr != "pbx.local:5038" {
+		t.Errorf("Addr = %q, want one derived from the Asterisk host", client.Addr)
+	}
+	if _, err := amiClientFor(api.AsteriskSettings{}); err == nil {
+		t.Error("client without any AMI address")
+	}
+}
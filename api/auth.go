@@ -0,0 +1,101 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// TokenFunc returns the bearer token to send to the backend. refresh is set
+// when the previous token was rejected and a fresh one should be obtained.
+type TokenFunc func(refresh bool) (string, error)
+
+// StaticToken returns a TokenFunc that always returns token.
+func StaticToken(token string) TokenFunc {
+	return func(bool) (string, error) {
+		return token, nil
+	}
+}
+
+// AuthTransport is an http.RoundTripper that sets the Authorization header
+// on every request. When the backend answers 401 the token is refreshed and
+// the request retried once.
+type AuthTransport struct {
+	Base  http.RoundTripper
+	Token TokenFunc
+
+	mu      sync.Mutex
+	current string
+}
+
+// NewAuthClient returns an http.Client authenticating with token.
+func NewAuthClient(token TokenFunc) *http.Client {
+	return &http.Client{Transport: &AuthTransport{Token: token}}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *AuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.token(false)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base().RoundTrip(withToken(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// The body has been consumed by the first attempt; only retry requests
+	// that can be replayed.
+	retry := req
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return resp, nil
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry = req.Clone(req.Context())
+		retry.Body = body
+	}
+
+	if token, err = t.token(true); err != nil {
+		return resp, nil
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return t.base().RoundTrip(withToken(retry, token))
+}
+
+func (t *AuthTransport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+// token returns the cached token, fetching a new one when refresh is set or
+// none has been fetched yet.
+func (t *AuthTransport) token(refresh bool) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current != "" && !refresh {
+		return t.current, nil
+	}
+	token, err := t.Token(refresh)
+	if err != nil {
+		return "", fmt.Errorf("failed to get auth token: %w", err)
+	}
+	t.current = token
+	return token, nil
+}
+
+// withToken returns a copy of req carrying token, as RoundTrippers must not
+// modify the request they are given.
+func withToken(req *http.Request, token string) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
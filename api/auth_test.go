@@ -0,0 +1,149 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// authServer accepts requests bearing the token it currently expects.
+type authServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	valid    string
+	requests []string
+	bodies   []string
+}
+
+func newAuthServer(t *testing.T, valid string) *authServer {
+	t.Helper()
+	s := &authServer{valid: valid}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, r.Header.Get("Authorization"))
+		s.bodies = append(s.bodies, string(body))
+		if r.Header.Get("Authorization") != "Bearer "+s.valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"id":"chat"}`))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Requests returns the Authorization header of every request received.
+func (s *authServer) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// refreshingToken hands out numbered tokens, a new one on every refresh.
+type refreshingToken struct {
+	mu        sync.Mutex
+	issued    int
+	refreshes int
+}
+
+func (r *refreshingToken) Token(refresh bool) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if refresh {
+		r.refreshes++
+	}
+	r.issued++
+	return fmt.Sprintf("token-%d", r.issued), nil
+}
+
+func TestAuthTransportSetsHeader(t *testing.T) {
+	srv := newAuthServer(t, "secret")
+	client := NewAuthClient(StaticToken("secret"))
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("status %d", resp.StatusCode)
+		}
+	}
+	for i, header := range srv.Requests() {
+		if header != "Bearer secret" {
+			t.Errorf("request %d has Authorization %q", i, header)
+		}
+	}
+}
+
+func TestAuthTransportRefreshesOn401(t *testing.T) {
+	// The first token has expired; its refresh is accepted
+	srv := newAuthServer(t, "token-2")
+	tokens := &refreshingToken{}
+	client := NewAuthClient(tokens.Token)
+
+	resp, err := client.Post(srv.URL, "application/json", strings.NewReader(`{"id":"chat"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d after refresh", resp.StatusCode)
+	}
+	if got := srv.Requests(); len(got) != 2 || got[0] != "Bearer token-1" || got[1] != "Bearer token-2" {
+		t.Errorf("requests carried %q, want token-1 then token-2", got)
+	}
+	if tokens.refreshes != 1 {
+		t.Errorf("%d refreshes, want 1", tokens.refreshes)
+	}
+	srv.mu.Lock()
+	if srv.bodies[1] != `{"id":"chat"}` {
+		t.Errorf("retried body = %q", srv.bodies[1])
+	}
+	srv.mu.Unlock()
+
+	// The refreshed token is kept for later requests
+	resp, err = client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := srv.Requests(); len(got) != 3 || got[2] != "Bearer token-2" {
+		t.Errorf("requests carried %q, want token-2 reused", got)
+	}
+}
+
+func TestAuthTransportRetriesOnce(t *testing.T) {
+	srv := newAuthServer(t, "never")
+	tokens := &refreshingToken{}
+	client := NewAuthClient(tokens.Token)
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status %d, want 401", resp.StatusCode)
+	}
+	if got := len(srv.Requests()); got != 2 {
+		t.Errorf("%d requests, want the original and one retry", got)
+	}
+}
+
+func TestAuthTransportTokenError(t *testing.T) {
+	srv := newAuthServer(t, "secret")
+	client := NewAuthClient(func(bool) (string, error) { return "", fmt.Errorf("vault sealed") })
+	if _, err := client.Get(srv.URL); err == nil {
+		t.Error("request sent without a token")
+	}
+	if got := len(srv.Requests()); got != 0 {
+		t.Errorf("%d requests reached the server", got)
+	}
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// CachingOllamaClient wraps an OllamaAPIClient and reuses responses for
+// requests whose recent conversation context is identical. It targets
+// deterministic, menu-style flows where callers walk the same dialog paths.
+type CachingOllamaClient struct {
+	Inner OllamaAPIClient
+	// Window is the number of trailing messages (including the new input)
+	// that make up the cache key. Zero or less uses the whole conversation.
+	Window int
+	TTL    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	response OllamaChatResponse
+	expires  time.Time
+}
+
+// NewCachingOllamaClient creates a new instance of CachingOllamaClient.
+func NewCachingOllamaClient(inner OllamaAPIClient, window int, ttl time.Duration) *CachingOllamaClient {
+	return &CachingOllamaClient{
+		Inner:   inner,
+		Window:  window,
+		TTL:     ttl,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+// Chat returns a cached response for the request's context if one is still
+// fresh, otherwise it forwards the request and caches the result.
+func (c *CachingOllamaClient) Chat(ctx context.Context, request OllamaChatRequest) (OllamaChatResponse, error) {
+	key, err := c.key(request)
+	if err != nil {
+		return c.Inner.Chat(ctx, request)
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && Now().Before(entry.expires) {
+		c.mu.Unlock()
+		log.Println("Response cache hit")
+		return entry.response, nil
+	}
+	delete(c.entries, key)
+	c.mu.Unlock()
+
+	response, err := c.Inner.Chat(ctx, request)
+	if err != nil {
+		return response, err
+	}
+
+	now := Now()
+	c.mu.Lock()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{response: response, expires: now.Add(c.TTL)}
+	c.mu.Unlock()
+	return response, nil
+}
+
+// key hashes the model, options, tools, system messages and the trailing
+// window of conversation messages of request. Everything the chat settings
+// put into a request is part of the key, so a settings change never hits
+// responses cached under the old settings.
+func (c *CachingOllamaClient) key(request OllamaChatRequest) (string, error) {
+	var system, conversation []OllamaMessage
+	for _, msg := range request.Messages {
+		if msg.Role == string(SenderSystem) {
+			system = append(system, msg)
+		} else {
+			conversation = append(conversation, msg)
+		}
+	}
+	if c.Window > 0 && len(conversation) > c.Window {
+		conversation = conversation[len(conversation)-c.Window:]
+	}
+
+	data, err := json.Marshal(struct {
+		Model        string                 `json:"model"`
+		Options      map[string]interface{} `json:"options"`
+		Tools        []ToolSpec             `json:"tools"`
+		System       []OllamaMessage        `json:"system"`
+		Conversation []OllamaMessage        `json:"conversation"`
+	}{request.Model, request.Options, request.Tools, system, conversation})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCachingOllamaClient(t *testing.T) {
+	inner := &fakeOllama{}
+	cache := NewCachingOllamaClient(inner, 2, time.Minute)
+
+	request := func(options map[string]interface{}, messages ...string) OllamaChatRequest {
+		r := OllamaChatRequest{
+			Model:    "model",
+			Options:  options,
+			Messages: []OllamaMessage{{Role: "system", Content: "menu"}},
+		}
+		for _, m := range messages {
+			r.Messages = append(r.Messages, OllamaMessage{Role: "user", Content: m})
+		}
+		return r
+	}
+	cold := map[string]interface{}{"temperature": 0.1}
+
+	tests := []struct {
+		name     string
+		request  OllamaChatRequest
+		forwards int
+	}{
+		{"first request", request(cold, "hi", "press 1"), 1},
+		{"identical context hits", request(cold, "hi", "press 1"), 1},
+		{"earlier messages outside the window hit", request(cold, "other", "hi", "press 1"), 1},
+		{"different context misses", request(cold, "hi", "press 2"), 2},
+		{"changed settings miss", request(map[string]interface{}{"temperature": 0.9}, "hi", "press 1"), 3},
+	}
+	for _, tt := range tests {
+		if _, err := cache.Chat(context.Background(), tt.request); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := len(inner.Requests()); got != tt.forwards {
+			t.Errorf("%s: %d requests forwarded, want %d", tt.name, got, tt.forwards)
+		}
+	}
+}
+
+// fakeNow has Now read a time that only moves with the returned advance,
+// restoring Now when the test ends.
+func fakeNow(t *testing.T) (advance func(time.Duration)) {
+	t.Helper()
+	saved := Now
+	t.Cleanup(func() { Now = saved })
+	now := time.Unix(0, 0)
+	Now = func() time.Time { return now }
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestCachingOllamaClientExpires(t *testing.T) {
+	advance := fakeNow(t)
+	inner := &fakeOllama{}
+	cache := NewCachingOllamaClient(inner, 0, time.Minute)
+	request := OllamaChatRequest{Model: "model", Messages: []OllamaMessage{{Role: "user", Content: "hi"}}}
+
+	for _, step := range []time.Duration{0, time.Minute - time.Second, 2 * time.Second} {
+		advance(step)
+		if _, err := cache.Chat(context.Background(), request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(inner.Requests()); got != 2 {
+		t.Errorf("%d requests forwarded, want 2 after the entry expired", got)
+	}
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// CachingChatAPI wraps a ChatAPI and caches GetChat results, which carry
+// the chat settings, for TTL. Concurrent fetches of the same chat are
+// collapsed into one request. Writes made through the wrapper invalidate
+// the chat, so the cached messages stay in sync with what this process
+// sent; use Invalidate for changes made elsewhere.
+type CachingChatAPI struct {
+	Inner ChatAPI
+	TTL   time.Duration
+
+	mu       sync.Mutex
+	entries  map[string]chatCacheEntry
+	inflight map[string]*chatFetch
+}
+
+type chatCacheEntry struct {
+	chat    Chat
+	expires time.Time
+}
+
+// chatFetch is a GetChat request shared by concurrent callers.
+type chatFetch struct {
+	done chan struct{}
+	chat *Chat
+	err  error
+}
+
+// NewCachingChatAPI creates a new instance of CachingChatAPI.
+func NewCachingChatAPI(inner ChatAPI, ttl time.Duration) *CachingChatAPI {
+	return &CachingChatAPI{
+		Inner:    inner,
+		TTL:      ttl,
+		entries:  make(map[string]chatCacheEntry),
+		inflight: make(map[string]*chatFetch),
+	}
+}
+
+// GetChat returns the cached chat if it is still fresh, otherwise it
+// fetches it, joining a fetch already in flight.
+func (c *CachingChatAPI) GetChat(chatID string) (*Chat, error) {
+	c.mu.Lock()
+	if entry, ok := c.entries[chatID]; ok && Now().Before(entry.expires) {
+		c.mu.Unlock()
+		return copyChat(entry.chat), nil
+	}
+	if fetch, ok := c.inflight[chatID]; ok {
+		c.mu.Unlock()
+		<-fetch.done
+		if fetch.err != nil {
+			return nil, fetch.err
+		}
+		return copyChat(*fetch.chat), nil
+	}
+	fetch := &chatFetch{done: make(chan struct{})}
+	c.inflight[chatID] = fetch
+	c.mu.Unlock()
+
+	fetch.chat, fetch.err = c.Inner.GetChat(chatID)
+
+	c.mu.Lock()
+	delete(c.inflight, chatID)
+	if fetch.err == nil {
+		c.entries[chatID] = chatCacheEntry{chat: *copyChat(*fetch.chat), expires: Now().Add(c.TTL)}
+	}
+	c.mu.Unlock()
+	close(fetch.done)
+
+	if fetch.err != nil {
+		return nil, fetch.err
+	}
+	return copyChat(*fetch.chat), nil
+}
+
+// Invalidate drops the cached chat.
+func (c *CachingChatAPI) Invalidate(chatID string) {
+	c.mu.Lock()
+	delete(c.entries, chatID)
+	c.mu.Unlock()
+}
+
+// SendMessage implements ChatAPI and invalidates the chat.
+func (c *CachingChatAPI) SendMessage(chatID string, sender Sender, content string) (*Message, error) {
+	defer c.Invalidate(chatID)
+	return c.Inner.SendMessage(chatID, sender, content)
+}
+
+// UpdateChat implements ChatAPI and invalidates the chat.
+func (c *CachingChatAPI) UpdateChat(chatID string, updates map[string]interface{}) (*Chat, error) {
+	defer c.Invalidate(chatID)
+	return c.Inner.UpdateChat(chatID, updates)
+}
+
+// GetMessages implements ChatAPI.
+func (c *CachingChatAPI) GetMessages(chatID string) ([]Message, error) {
+	return c.Inner.GetMessages(chatID)
+}
+
+// StartChat implements ChatAPI and invalidates the chat.
+func (c *CachingChatAPI) StartChat(chatID string) (*Chat, error) {
+	defer c.Invalidate(chatID)
+	return c.Inner.StartChat(chatID)
+}
+
+// copyChat returns a copy of chat whose message slice can be modified
+// without affecting the cache.
+func copyChat(chat Chat) *Chat {
+	chat.Messages = append([]Message(nil), chat.Messages...)
+	return &chat
+}
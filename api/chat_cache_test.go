@@ -0,0 +1,126 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chatServer is a chat backend counting the chats fetched from it. While
+// hold is set, fetches wait for it to be closed.
+type chatServer struct {
+	*httptest.Server
+	hold chan struct{}
+
+	mu      sync.Mutex
+	fetches int
+}
+
+func newChatServer(t *testing.T) *chatServer {
+	t.Helper()
+	s := &chatServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			s.mu.Lock()
+			s.fetches++
+			s.mu.Unlock()
+			if s.hold != nil {
+				<-s.hold
+			}
+		}
+		w.Write([]byte(`{"id":"chat","settings":{"llmSettings":{"model":"llama3"}},"messages":[{"id":1,"role":"user","content":"hi"}]}`))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Fetches returns the number of GET requests received.
+func (s *chatServer) Fetches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+func TestCachingChatAPIHit(t *testing.T) {
+	srv := newChatServer(t)
+	cache := NewCachingChatAPI(NewHTTPChatAPI(srv.URL), time.Minute)
+	for i := 0; i < 3; i++ {
+		chat, err := cache.GetChat("chat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if model := chat.Settings.LLMSettings.Model; model == nil || *model != "llama3" {
+			t.Errorf("cached settings lost the model: %v", model)
+		}
+		// Callers may modify what they get
+		chat.Messages = append(chat.Messages[:0], Message{Content: "changed"})
+	}
+	if n := srv.Fetches(); n != 1 {
+		t.Errorf("%d fetches within the TTL, want 1", n)
+	}
+	chat, _ := cache.GetChat("chat")
+	if chat.Messages[0].Content != "hi" {
+		t.Errorf("cached message = %q, changed by a caller", chat.Messages[0].Content)
+	}
+}
+
+func TestCachingChatAPIExpires(t *testing.T) {
+	advance := fakeNow(t)
+	srv := newChatServer(t)
+	cache := NewCachingChatAPI(NewHTTPChatAPI(srv.URL), time.Minute)
+	cache.GetChat("chat")
+	advance(time.Minute - time.Second)
+	cache.GetChat("chat")
+	if n := srv.Fetches(); n != 1 {
+		t.Errorf("%d fetches within the TTL, want 1", n)
+	}
+	advance(2 * time.Second)
+	cache.GetChat("chat")
+	if n := srv.Fetches(); n != 2 {
+		t.Errorf("%d fetches, want a refetch after expiry", n)
+	}
+}
+
+func TestCachingChatAPIInvalidates(t *testing.T) {
+	srv := newChatServer(t)
+	cache := NewCachingChatAPI(NewHTTPChatAPI(srv.URL), time.Minute)
+	cache.GetChat("chat")
+	if _, err := cache.UpdateChat("chat", map[string]interface{}{"title": "t"}); err != nil {
+		t.Fatal(err)
+	}
+	cache.GetChat("chat")
+	cache.Invalidate("chat")
+	cache.GetChat("chat")
+	if n := srv.Fetches(); n != 3 {
+		t.Errorf("%d fetches, want one after every invalidation", n)
+	}
+}
+
+func TestCachingChatAPISingleFlight(t *testing.T) {
+	srv := newChatServer(t)
+	srv.hold = make(chan struct{})
+	cache := NewCachingChatAPI(NewHTTPChatAPI(srv.URL), time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.GetChat("chat"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for srv.Fetches() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Give the other callers time to join the fetch in flight
+	time.Sleep(20 * time.Millisecond)
+	close(srv.hold)
+	wg.Wait()
+	if n := srv.Fetches(); n != 1 {
+		t.Errorf("%d fetches for concurrent callers, want 1", n)
+	}
+}
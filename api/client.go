@@ -2,13 +2,19 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"go-ast-client/settings"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
 )
 
 // Sender represents the role of the message sender.
@@ -47,46 +53,19 @@ type Message struct {
 
 // Settings represents the settings for a chat.
 type Settings struct {
-	STTSettings      STTSettings      `json:"sttSettings"`
-	LLMSettings      LLMSettings      `json:"llmSettings"`
-	TTSSettings      TTSSettings      `json:"ttsSettings"`
-	AsteriskSettings AsteriskSettings `json:"asteriskSettings"`
-}
-
-// STTSettings represents the settings for speech-to-text.
-type STTSettings struct {
-	Language                      *string  `json:"language"`
-	BeamSize                      *int     `json:"beam_size"`
-	BestOf                        *int     `json:"best_of"`
-	Patience                      *int     `json:"patience"`
-	NoSpeechThreshold             *int     `json:"no_speech_threshold"`
-	Temperature                   *float64 `json:"temperature"`
-	HallucinationSilenceThreshold *int     `json:"hallucination_silence_threshold"`
-}
-
-// LLMSettings represents the settings for the language model.
-type LLMSettings struct {
-	Seed          *int     `json:"seed"`
-	Model         *string  `json:"model"`
-	SystemPrompt  *string  `json:"system_prompt"`
-	Mirostat      *int     `json:"mirostat"`
-	MirostatEta   *float64 `json:"mirostat_eta"`
-	MirostatTau   *float64 `json:"mirostat_tau"`
-	NumCtx        *int     `json:"num_ctx"`
-	RepeatLastN   *int     `json:"repeat_last_n"`
-	RepeatPenalty *float64 `json:"repeat_penalty"`
-	Temperature   *float64 `json:"temperature"`
-	TfsZ          *float64 `json:"tfs_z"`
-	NumPredict    *int     `json:"num_predict"`
-	TopK          *int     `json:"top_k"`
-	TopP          *float64 `json:"top_p"`
-	MinP          *float64 `json:"min_p"`
+	STTSettings      settings.STTSettings `json:"sttSettings"`
+	LLMSettings      settings.LLMSettings `json:"llmSettings"`
+	TTSSettings      TTSSettings          `json:"ttsSettings"`
+	AsteriskSettings AsteriskSettings     `json:"asteriskSettings"`
 }
 
 // TTSSettings represents the settings for text-to-speech.
 type TTSSettings struct {
 	Voice string   `json:"voice"`
 	Speed *float64 `json:"speed"`
+	// AwaitTime tunes the pacing between chunks on the TTS side, in
+	// seconds. Nil uses the bridge's default.
+	AwaitTime *float64 `json:"await_time,omitempty"`
 }
 
 // AsteriskSettings represents the settings for Asterisk.
@@ -95,6 +74,26 @@ type AsteriskSettings struct {
 	AsteriskSilenceThreshold *int   `json:"asterisk_silence_threshold"`
 	AsteriskHost             string `json:"asterisk_host"`
 	AsteriskNumber           string `json:"asterisk_number"`
+	// AsteriskIdleTimeout is the number of seconds without detected speech
+	// after which the call is hung up. Zero or nil disables the timeout.
+	AsteriskIdleTimeout *int `json:"asterisk_idle_timeout"`
+	// AsteriskMaxCallDuration caps the length of a call in seconds. Zero or
+	// nil means no limit.
+	AsteriskMaxCallDuration *int `json:"asterisk_max_call_duration"`
+	// AsteriskClosingMessage, if set, is spoken before hanging up a call that
+	// reached AsteriskMaxCallDuration.
+	AsteriskClosingMessage string `json:"asterisk_closing_message"`
+	// AsteriskSegment names the caller segment used to pick an STT endpoint.
+	AsteriskSegment string `json:"asterisk_segment"`
+	// AsteriskNoiseGateThreshold, if set, zeroes inbound samples whose
+	// amplitude is below it before VAD and transcription.
+	AsteriskNoiseGateThreshold *int16 `json:"asterisk_noise_gate_threshold"`
+	// AsteriskDetectLanguage makes the assistant answer in the language the
+	// caller speaks instead of the configured one.
+	AsteriskDetectLanguage bool `json:"asterisk_detect_language"`
+	// AsteriskSampleRate is the rate of the SLIN audio Asterisk sends. If
+	// nil it is detected from the frame size.
+	AsteriskSampleRate *int `json:"asterisk_sample_rate"`
 }
 
 // ChatAPI defines the methods required to interact with the chat backend.
@@ -103,13 +102,15 @@ type ChatAPI interface {
 	UpdateChat(chatID string, updates map[string]interface{}) (*Chat, error)
 	GetChat(chatID string) (*Chat, error)
 	GetMessages(chatID string) ([]Message, error)
+	// StartChat creates the chat with ID chatID, or returns it if it
+	// already exists.
 	StartChat(chatID string) (*Chat, error)
 	// Add other necessary methods
 }
 
 // OllamaAPIClient defines the methods to interact with Ollama API.
 type OllamaAPIClient interface {
-	Chat(request OllamaChatRequest) (OllamaChatResponse, error)
+	Chat(ctx context.Context, request OllamaChatRequest) (OllamaChatResponse, error)
 	// Add other necessary methods
 }
 
@@ -119,26 +120,58 @@ type OllamaChatRequest struct {
 	Messages []OllamaMessage        `json:"messages"`
 	Stream   bool                   `json:"stream,omitempty"`
 	Options  map[string]interface{} `json:"options,omitempty"`
+	Tools    []ToolSpec             `json:"tools,omitempty"`
 }
 
 // OllamaMessage represents a single message in the Ollama chat request.
 type OllamaMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+}
+
+// OllamaResponseMessage is the message in a response from Ollama's chat
+// endpoint.
+type OllamaResponseMessage struct {
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
 }
 
 // OllamaChatResponse represents the response from Ollama's chat endpoint.
 type OllamaChatResponse struct {
-	Message struct {
-		Content string `json:"content"`
-	} `json:"message"`
-	// Add other relevant fields
+	Model     string                `json:"model"`
+	CreatedAt time.Time             `json:"created_at"`
+	Message   OllamaResponseMessage `json:"message"`
+	Done      bool                  `json:"done"`
+	// DoneReason tells why generation stopped, e.g. "stop" or "length".
+	DoneReason string `json:"done_reason,omitempty"`
+	// Token counts and timings (in nanoseconds). Backends that don't report
+	// them leave these zero.
+	TotalDuration      int64 `json:"total_duration,omitempty"`
+	LoadDuration       int64 `json:"load_duration,omitempty"`
+	PromptEvalCount    int   `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64 `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int   `json:"eval_count,omitempty"`
+	EvalDuration       int64 `json:"eval_duration,omitempty"`
+}
+
+// Usage returns the token usage reported in the response.
+func (r OllamaChatResponse) Usage() TokenUsage {
+	return TokenUsage{
+		PromptTokens:   r.PromptEvalCount,
+		ResponseTokens: r.EvalCount,
+		Turns:          1,
+	}
 }
 
 // HTTPChatAPI is an implementation of ChatAPI using HTTP.
 type HTTPChatAPI struct {
 	BaseURL    string
 	HTTPClient *http.Client
+	// RequestIDHeader, if set, names the header that carries the chat ID
+	// on every request, so backend logs can be correlated with the call.
+	RequestIDHeader string
 }
 
 // NewHTTPChatAPI creates a new instance of HTTPChatAPI.
@@ -156,27 +189,35 @@ func (api *HTTPChatAPI) SendMessage(chatID string, sender Sender, content string
 		"role":    sender,
 		"content": content,
 	}
-	log.Println("Payload:", payload)
-	log.Println("content:", content)
+	log.Printf("sending %s message to chat %s: %s", sender, chatID, Redact(content))
 	body, err := json.Marshal(payload)
 	if err != nil {
 		log.Println("Error marshalling payload:", err)
 		return nil, err
 	}
 
-	resp, err := api.HTTPClient.Post(fmt.Sprintf("%s/messages", api.BaseURL), "application/json", bytes.NewBuffer(body))
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/messages", api.BaseURL), bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := api.do(req, chatID)
 	if err != nil {
 		log.Println("Error sending message:", err)
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if err := StatusError(resp.StatusCode); err != nil {
+		return nil, err
+	}
 
 	var msg Message
 	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
 		log.Println("Error decoding response:", err)
 		return nil, err
 	}
-	log.Println("Message sent:", msg)
+	log.Printf("message %d sent: %s", msg.ID, Redact(msg.Content))
 	return &msg, nil
 }
 
@@ -193,11 +234,14 @@ func (api *HTTPChatAPI) UpdateChat(chatID string, updates map[string]interface{}
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := api.HTTPClient.Do(req)
+	resp, err := api.do(req, chatID)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if err := StatusError(resp.StatusCode); err != nil {
+		return nil, err
+	}
 
 	var chat Chat
 	if err := json.NewDecoder(resp.Body).Decode(&chat); err != nil {
@@ -209,11 +253,14 @@ func (api *HTTPChatAPI) UpdateChat(chatID string, updates map[string]interface{}
 
 // GetChat retrieves a chat by its ID.
 func (api *HTTPChatAPI) GetChat(chatID string) (*Chat, error) {
-	resp, err := api.HTTPClient.Get(fmt.Sprintf("%s/chats/%s", api.BaseURL, chatID))
+	resp, err := api.get(fmt.Sprintf("%s/chats/%s", api.BaseURL, chatID), chatID)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if err := StatusError(resp.StatusCode); err != nil {
+		return nil, err
+	}
 
 	var chat Chat
 	if err := json.NewDecoder(resp.Body).Decode(&chat); err != nil {
@@ -223,13 +270,31 @@ func (api *HTTPChatAPI) GetChat(chatID string) (*Chat, error) {
 	return &chat, nil
 }
 
-// StartChat starts a new chat session.
+// StartChat creates the chat with ID chatID. If the backend reports that it
+// already exists, e.g. created by a concurrent call, the existing chat is
+// returned.
 func (api *HTTPChatAPI) StartChat(chatID string) (*Chat, error) {
-	resp, err := api.HTTPClient.Post(fmt.Sprintf("%s/chats", api.BaseURL), "application/json", nil)
+	body, err := json.Marshal(map[string]string{"id": chatID})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/chats", api.BaseURL), bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := api.do(req, chatID)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if err := StatusError(resp.StatusCode); err != nil {
+		if errors.Is(err, ErrChatExists) {
+			return api.GetChat(chatID)
+		}
+		return nil, err
+	}
 
 	var chat Chat
 	if err := json.NewDecoder(resp.Body).Decode(&chat); err != nil {
@@ -241,11 +306,14 @@ func (api *HTTPChatAPI) StartChat(chatID string) (*Chat, error) {
 
 // GetMessages retrieves messages for a specific chat.
 func (api *HTTPChatAPI) GetMessages(chatID string) ([]Message, error) {
-	resp, err := api.HTTPClient.Get(fmt.Sprintf("%s/chats/%s/messages", api.BaseURL, chatID))
+	resp, err := api.get(fmt.Sprintf("%s/chats/%s/messages", api.BaseURL, chatID), chatID)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if err := StatusError(resp.StatusCode); err != nil {
+		return nil, err
+	}
 
 	var messages []Message
 	if err := json.NewDecoder(resp.Body).Decode(&messages); err != nil {
@@ -255,6 +323,23 @@ func (api *HTTPChatAPI) GetMessages(chatID string) ([]Message, error) {
 	return messages, nil
 }
 
+// get sends a GET request for url about chatID.
+func (api *HTTPChatAPI) get(url, chatID string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return api.do(req, chatID)
+}
+
+// do sends req, tagged with chatID when a request ID header is configured.
+func (api *HTTPChatAPI) do(req *http.Request, chatID string) (*http.Response, error) {
+	if api.RequestIDHeader != "" {
+		req.Header.Set(api.RequestIDHeader, chatID)
+	}
+	return api.HTTPClient.Do(req)
+}
+
 // HTTPollamaAPIClient is an implementation of OllamaAPIClient using HTTP.
 type HTTPollamaAPIClient struct {
 	BaseURL    string
@@ -270,42 +355,132 @@ func NewHTTPollamaAPIClient(baseURL string) *HTTPollamaAPIClient {
 }
 
 // Chat sends a chat request to Ollama API.
-func (api *HTTPollamaAPIClient) Chat(request OllamaChatRequest) (OllamaChatResponse, error) {
+func (api *HTTPollamaAPIClient) Chat(ctx context.Context, request OllamaChatRequest) (OllamaChatResponse, error) {
 	var response OllamaChatResponse
 
-	body, err := json.Marshal(request)
+	request.Stream = false
+	resp, err := api.post(ctx, request)
 	if err != nil {
 		return response, err
 	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return response, err
+	}
+
+	return response, nil
+}
+
+// ChatStream sends a chat request with streaming enabled and calls fn with
+// every chunk of the newline-delimited JSON stream as it arrives. An error
+// from fn stops reading. The returned response is the final chunk, carrying
+// the token counts, with the content of all chunks assembled.
+func (api *HTTPollamaAPIClient) ChatStream(ctx context.Context, request OllamaChatRequest, fn func(chunk OllamaChatResponse) error) (OllamaChatResponse, error) {
+	var response OllamaChatResponse
 
-	resp, err := api.HTTPClient.Post(fmt.Sprintf("%s/ollama/chat", api.BaseURL), "application/json", bytes.NewBuffer(body))
+	request.Stream = true
+	resp, err := api.post(ctx, request)
 	if err != nil {
 		return response, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return response, errors.New("failed to get valid response from Ollama API")
+	var content strings.Builder
+	var toolCalls []ToolCall
+	decoder := json.NewDecoder(resp.Body)
+	for !response.Done {
+		// Ollama reports failures after the stream started as an
+		// error chunk
+		var chunk struct {
+			OllamaChatResponse
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&chunk); err == io.EOF {
+			return response, errors.New("ollama stream ended before the response was done")
+		} else if err != nil {
+			return response, err
+		}
+		if chunk.Error != "" {
+			return response, ollamaStatusError(resp.StatusCode, chunk.Error)
+		}
+		content.WriteString(chunk.Message.Content)
+		toolCalls = append(toolCalls, chunk.Message.ToolCalls...)
+		if fn != nil {
+			if err := fn(chunk.OllamaChatResponse); err != nil {
+				return response, err
+			}
+		}
+		response = chunk.OllamaChatResponse
 	}
+	response.Message.Content = content.String()
+	response.Message.ToolCalls = toolCalls
+	return response, nil
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return response, err
+// post sends request to the chat endpoint, returning the response if its
+// status is OK.
+func (api *HTTPollamaAPIClient) post(ctx context.Context, request OllamaChatRequest) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
 	}
 
-	return response, nil
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/ollama/chat", api.BaseURL), bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := api.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, ollamaStatusError(resp.StatusCode, string(body))
+	}
+	return resp, nil
 }
 
-// ChatStore manages the chat state.
+// ChatStore manages the chat state. Messages, Pending and Error change while
+// SendMessage runs, so once a ChatStore is in use they must only be read
+// through Snapshot, MessageCount and LastError. The settings are read
+// through Settings and changed through SetSettings and UpdateSettings.
 type ChatStore struct {
+	// sendMu serializes SendMessage and Flush so messages reach the
+	// backend in order. mu guards the fields below and is never held
+	// across a request, so the accessors don't wait for one.
+	sendMu      sync.Mutex
 	mu          sync.Mutex
 	User        *User
 	Chat        Chat
 	CurrentChat string
 	Messages    []Message
-	Settings    Settings
+	Pending     []Message // Messages that failed to reach the chat backend
 	Error       string
 	ChatAPI     ChatAPI
 	OllamaAPI   OllamaAPIClient
+	// Trim fits the history into the model's context; nil means DropOldest.
+	Trim TrimStrategy
+	// Tools are offered to the model. Their calls and results only live
+	// for the message that caused them; just the final answer is kept.
+	Tools *ToolRegistry
+	// MaxToolCalls bounds the rounds of tool calls per message; zero means
+	// DefaultMaxToolCalls.
+	MaxToolCalls int
+	// FallbackModels are tried in order when the chat's model is
+	// unavailable.
+	FallbackModels []string
+
+	leg CallLeg
+
+	// settingsMu guards settings and promptTemplate. It is separate from
+	// mu so reading the settings never waits for an LLM request.
+	settingsMu     sync.RWMutex
+	settings       Settings
+	promptTemplate *template.Template
 }
 
 // NewChatStore creates a new instance of ChatStore.
@@ -313,7 +488,6 @@ func NewChatStore(chatAPI ChatAPI, ollamaAPI OllamaAPIClient) *ChatStore {
 	return &ChatStore{
 		ChatAPI:   chatAPI,
 		OllamaAPI: ollamaAPI,
-		Settings:  Settings{}, // Initialize with default settings if necessary
 	}
 }
 
@@ -328,46 +502,115 @@ func LoadChatStore(chatID string, chatAPI ChatAPI, ollamaAPI OllamaAPIClient) (*
 	chatStore.CurrentChat = chatID
 	chatStore.Chat = *chat
 	chatStore.Messages = chat.Messages
-	chatStore.Settings = chat.Settings
+	chatStore.SetSettings(chat.Settings)
 
 	return chatStore, nil
 }
 
-// SendMessage sends a message and handles the response from Ollama API.
-func (cs *ChatStore) SendMessage(content string) (*OllamaChatResponse, error) {
+// Sync brings a ChatStore kept from an earlier connection up to date with
+// chat as loaded from the backend. Messages it already holds are kept, and
+// only backend messages it doesn't know by ID are appended.
+func (cs *ChatStore) Sync(chat *Chat) {
 	cs.mu.Lock()
-	defer cs.mu.Unlock()
+	known := make(map[int]bool, len(cs.Messages))
+	for _, msg := range cs.Messages {
+		known[msg.ID] = true
+	}
+	added := 0
+	for _, msg := range chat.Messages {
+		if msg.ID != 0 && known[msg.ID] {
+			continue
+		}
+		cs.Messages = append(cs.Messages, msg)
+		known[msg.ID] = true
+		added++
+	}
+	cs.Chat = *chat
+	cs.mu.Unlock()
+
+	log.Printf("chat %s: reused in-memory history, synced %d new messages", cs.CurrentChat, added)
+	cs.SetSettings(chat.Settings)
+}
+
+// SetSettings replaces the chat settings, validating the system prompt
+// template. An invalid template is logged and the prompt used as plain text.
+func (cs *ChatStore) SetSettings(settings Settings) {
+	cs.settingsMu.Lock()
+	defer cs.settingsMu.Unlock()
+	cs.setSettings(settings)
+}
+
+// UpdateSettings replaces the chat settings with update applied to the
+// current ones, without another update slipping in between.
+func (cs *ChatStore) UpdateSettings(update func(Settings) Settings) {
+	cs.settingsMu.Lock()
+	defer cs.settingsMu.Unlock()
+	cs.setSettings(update(cs.settings))
+}
+
+// Settings returns the chat settings.
+func (cs *ChatStore) Settings() Settings {
+	cs.settingsMu.RLock()
+	defer cs.settingsMu.RUnlock()
+	return cs.settings
+}
+
+// setSettings replaces the settings and parses the system prompt template.
+// settingsMu must be held.
+func (cs *ChatStore) setSettings(settings Settings) {
+	cs.settings = settings
+	cs.promptTemplate = nil
+	if prompt := settings.LLMSettings.SystemPrompt; prompt != nil {
+		var err error
+		if cs.promptTemplate, err = parsePrompt(*prompt); err != nil {
+			log.Printf("chat %s: %v; using the prompt as plain text", cs.CurrentChat, err)
+		}
+	}
+}
+
+// SendMessage sends a message and handles the response from Ollama API.
+// ctx bounds the LLM request.
+func (cs *ChatStore) SendMessage(ctx context.Context, content string) (*OllamaChatResponse, error) {
+	cs.sendMu.Lock()
+	defer cs.sendMu.Unlock()
 
-	log.Println("SendMessage called with content:", content)
+	log.Println("SendMessage called with content:", Redact(content))
 
 	if strings.TrimSpace(cs.CurrentChat) == "" || strings.TrimSpace(content) == "" {
 		err := errors.New("current chat ID or content is empty")
 		log.Println("Error:", err)
 		return nil, err
 	}
+	llmSettings := cs.Settings().LLMSettings
+	if model := llmSettings.Model; model == nil || *model == "" {
+		err := errors.New("no LLM model set in the chat settings")
+		cs.fail(err, nil)
+		log.Println("Error:", err)
+		return nil, err
+	}
 
 	// Send user message
 	log.Println("Sending user message to ChatAPI")
 	userMsg, err := cs.ChatAPI.SendMessage(cs.CurrentChat, SenderUser, content)
 	if err != nil {
-		cs.Error = err.Error()
+		cs.fail(err, &Message{ChatID: cs.CurrentChat, Role: SenderUser, Content: content})
 		log.Println("Send Message Error:", err)
 		return nil, err
 	}
-	cs.Messages = append(cs.Messages, *userMsg)
-	log.Println("User message sent successfully:", userMsg)
+	log.Println("User message sent successfully:", userMsg.ID)
 
-	llmSettings := cs.Settings.LLMSettings
 	systemPrompt := llmSettings.SystemPrompt
 	if systemPrompt == nil {
 		systemPrompt = new(string)
 		*systemPrompt = ""
 	}
 
+	cs.mu.Lock()
+	cs.Messages = append(cs.Messages, *userMsg)
 	var ollamaMessages []OllamaMessage
 	ollamaMessages = append(ollamaMessages, OllamaMessage{
 		Role:    "system",
-		Content: *systemPrompt,
+		Content: cs.renderPrompt(*systemPrompt),
 	})
 
 	for _, msg := range cs.Messages {
@@ -387,40 +630,43 @@ func (cs *ChatStore) SendMessage(content string) (*OllamaChatResponse, error) {
 			Content: msg.Content,
 		})
 	}
+	cs.mu.Unlock()
 
-	fullMessages := ollamaMessages
-	log.Println("Prepared full messages for Ollama API:", fullMessages)
-
-	// Filter out nil values from llmSettings
-	llmNotNullSettings := make(map[string]interface{})
-	if llmSettings.Model != nil {
-		llmNotNullSettings["model"] = *llmSettings.Model
+	trim := cs.Trim
+	if trim == nil {
+		trim = DropOldest{}
+	}
+	fullMessages := trim.Trim(ctx, ollamaMessages, ContextBudget(llmSettings.NumCtx, llmSettings.NumPredict))
+	log.Printf("Prepared %d messages for Ollama API", len(fullMessages))
+	if LogContent {
+		log.Println("Prepared full messages for Ollama API:", fullMessages)
 	}
-	// Add other settings as needed, ensuring to check for non-nil
 
 	// Prepare Ollama chat request
-	log.Println("llmNotNullSettings:", llmNotNullSettings)
+	options := OllamaOptions(llmSettings)
+	log.Println("Ollama options:", options)
 	ollamaRequest := OllamaChatRequest{
 		Model:    *llmSettings.Model,
 		Messages: fullMessages,
 		Stream:   false,
-		Options:  llmNotNullSettings,
+		Options:  options,
+		Tools:    cs.Tools.Specs(),
 	}
 
 	// Send request to Ollama API
-	log.Println("Sending request to Ollama API with request:", ollamaRequest)
-	response, err := cs.OllamaAPI.Chat(ollamaRequest)
+	log.Println("Sending request to Ollama API with model", ollamaRequest.Model)
+	response, err := cs.chatWithFallback(ctx, ollamaRequest)
 	if err != nil {
-		cs.Error = err.Error()
+		cs.fail(err, nil)
 		log.Println("Ollama Chat Error:", err)
 		return nil, err
 	}
-	log.Println("Received response from Ollama API:", response)
+	log.Println("Received response from Ollama API:", Redact(response.Message.Content))
 
 	assistantContent := strings.TrimSpace(response.Message.Content)
 	if assistantContent == "" {
 		err := errors.New("received empty response from Ollama API")
-		cs.Error = err.Error()
+		cs.fail(err, nil)
 		log.Println("Empty Response Error:", err)
 		return nil, err
 	}
@@ -429,12 +675,178 @@ func (cs *ChatStore) SendMessage(content string) (*OllamaChatResponse, error) {
 	log.Println("Sending assistant message to ChatAPI")
 	assistantMsg, err := cs.ChatAPI.SendMessage(cs.CurrentChat, SenderAssistant, assistantContent)
 	if err != nil {
-		cs.Error = err.Error()
+		cs.fail(err, &Message{ChatID: cs.CurrentChat, Role: SenderAssistant, Content: assistantContent})
 		log.Println("Send Assistant Message Error:", err)
 		return nil, err
 	}
+	cs.mu.Lock()
 	cs.Messages = append(cs.Messages, *assistantMsg)
-	log.Println("Assistant message sent successfully:", assistantMsg)
+	cs.mu.Unlock()
+	log.Println("Assistant message sent successfully:", assistantMsg.ID)
 
 	return &response, nil
 }
+
+// fail records err as the last error and, if not nil, pending as a
+// message to send again on the next Flush.
+func (cs *ChatStore) fail(err error, pending *Message) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.Error = err.Error()
+	if pending != nil {
+		cs.Pending = append(cs.Pending, *pending)
+	}
+}
+
+// Summarize asks the chat's model to summarize the conversation following
+// prompt, or DefaultSummaryPrompt if it is empty. It returns an empty
+// summary without asking if the user never said anything.
+func (cs *ChatStore) Summarize(ctx context.Context, prompt string) (string, error) {
+	cs.mu.Lock()
+	var messages []OllamaMessage
+	spoke := false
+	for _, msg := range cs.Messages {
+		spoke = spoke || msg.Role == SenderUser
+		messages = append(messages, OllamaMessage{Role: string(msg.Role), Content: msg.Content})
+	}
+	cs.mu.Unlock()
+	model := cs.Settings().LLMSettings.Model
+
+	if !spoke {
+		return "", nil
+	}
+	if model == nil || *model == "" {
+		return "", errors.New("no LLM model set in the chat settings")
+	}
+	if prompt == "" {
+		prompt = DefaultSummaryPrompt
+	}
+	return summarize(ctx, cs.OllamaAPI, *model, prompt, messages)
+}
+
+// chatWithFallback sends request to its model and, while the model is
+// unavailable, to each of the fallback models in turn.
+func (cs *ChatStore) chatWithFallback(ctx context.Context, request OllamaChatRequest) (OllamaChatResponse, error) {
+	models := append([]string{request.Model}, cs.FallbackModels...)
+	var response OllamaChatResponse
+	var err error
+	for i, model := range models {
+		request.Model = model
+		response, err = cs.chatWithTools(ctx, request)
+		if !errors.Is(err, ErrModelUnavailable) || ctx.Err() != nil {
+			break
+		}
+		if i < len(models)-1 {
+			log.Printf("chat %s: model %s is unavailable, falling back to %s: %v", cs.CurrentChat, model, models[i+1], err)
+		}
+	}
+	if err == nil {
+		log.Printf("chat %s: response served by model %s", cs.CurrentChat, request.Model)
+	}
+	return response, err
+}
+
+// chatWithTools sends request and runs the tools the model calls, feeding
+// their results back until it answers. The returned response carries the
+// token counts of all rounds.
+func (cs *ChatStore) chatWithTools(ctx context.Context, request OllamaChatRequest) (OllamaChatResponse, error) {
+	maxCalls := cs.MaxToolCalls
+	if maxCalls <= 0 {
+		maxCalls = DefaultMaxToolCalls
+	}
+	var promptTokens, responseTokens int
+	for round := 0; ; round++ {
+		response, err := cs.OllamaAPI.Chat(ctx, request)
+		if err != nil {
+			return response, err
+		}
+		promptTokens += response.PromptEvalCount
+		responseTokens += response.EvalCount
+		response.PromptEvalCount, response.EvalCount = promptTokens, responseTokens
+
+		calls := toolCalls(response, cs.Tools)
+		if len(calls) == 0 {
+			return response, nil
+		}
+		if round >= maxCalls {
+			return response, ErrTooManyToolCalls
+		}
+
+		request.Messages = append(request.Messages, OllamaMessage{
+			Role:      "assistant",
+			Content:   response.Message.Content,
+			ToolCalls: calls,
+		})
+		for _, call := range calls {
+			log.Printf("chat %s: calling tool %s with %s", cs.CurrentChat, call.Function.Name, Redact(fmt.Sprint(call.Function.Arguments)))
+			request.Messages = append(request.Messages, OllamaMessage{
+				Role:    "tool",
+				Content: cs.Tools.Call(ctx, call),
+			})
+		}
+		if ctx.Err() != nil {
+			return response, ctx.Err()
+		}
+	}
+}
+
+// Flush retries sending messages that previously failed to reach the chat
+// backend. Messages that still fail are kept for the next attempt.
+func (cs *ChatStore) Flush() error {
+	cs.sendMu.Lock()
+	defer cs.sendMu.Unlock()
+
+	cs.mu.Lock()
+	pending := cs.Pending
+	cs.mu.Unlock()
+
+	var remaining []Message
+	var firstErr error
+	for _, msg := range pending {
+		sent, err := cs.ChatAPI.SendMessage(cs.CurrentChat, msg.Role, msg.Content)
+		if err != nil {
+			remaining = append(remaining, msg)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		cs.mu.Lock()
+		cs.Messages = append(cs.Messages, *sent)
+		cs.mu.Unlock()
+	}
+	cs.mu.Lock()
+	cs.Pending = remaining
+	cs.mu.Unlock()
+	return firstErr
+}
+
+// Snapshot returns a copy of the chat's messages.
+func (cs *ChatStore) Snapshot() []Message {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return append([]Message(nil), cs.Messages...)
+}
+
+// DropHistory forgets the messages loaded so far, so the LLM only sees the
+// system prompt and what is said from now on. The backend keeps them.
+func (cs *ChatStore) DropHistory() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.Messages = nil
+}
+
+// MessageCount returns the number of messages in the chat.
+func (cs *ChatStore) MessageCount() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return len(cs.Messages)
+}
+
+// LastError returns the error of the last failed operation, or an empty
+// string if none failed.
+func (cs *ChatStore) LastError() string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.Error
+}
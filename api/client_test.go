@@ -0,0 +1,381 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go-ast-client/settings"
+)
+
+// fakeOllama answers chat requests with reply.
+type fakeOllama struct {
+	mu       sync.Mutex
+	requests []OllamaChatRequest
+	reply    func(OllamaChatRequest) (OllamaChatResponse, error)
+}
+
+func (f *fakeOllama) Chat(ctx context.Context, request OllamaChatRequest) (OllamaChatResponse, error) {
+	f.mu.Lock()
+	f.requests = append(f.requests, request)
+	f.mu.Unlock()
+	if f.reply != nil {
+		return f.reply(request)
+	}
+	return OllamaChatResponse{Message: OllamaResponseMessage{Role: "assistant", Content: "ok"}, Done: true}, nil
+}
+
+func (f *fakeOllama) Requests() []OllamaChatRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]OllamaChatRequest(nil), f.requests...)
+}
+
+func strPtr(s string) *string { return &s }
+
+// newTestStore returns a ChatStore on an in-memory chat with model set.
+func newTestStore(t *testing.T, ollama OllamaAPIClient) *ChatStore {
+	t.Helper()
+	chats := NewMemoryChatAPI()
+	if _, err := chats.StartChat("chat"); err != nil {
+		t.Fatal(err)
+	}
+	cs := NewChatStore(chats, ollama)
+	cs.CurrentChat = "chat"
+	cs.SetSettings(Settings{LLMSettings: settings.LLMSettings{Model: strPtr("model")}})
+	return cs
+}
+
+func TestChatStoreConcurrentAccess(t *testing.T) {
+	cs := newTestStore(t, &fakeOllama{})
+
+	const turns = 20
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < turns; i++ {
+			if _, err := cs.SendMessage(context.Background(), fmt.Sprintf("message %d", i)); err != nil {
+				t.Errorf("SendMessage: %v", err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < turns; i++ {
+			_ = cs.Snapshot()
+			_ = cs.MessageCount()
+			_ = cs.LastError()
+			_ = cs.Settings()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < turns; i++ {
+			cs.UpdateSettings(func(s Settings) Settings {
+				s.LLMSettings.SystemPrompt = strPtr(fmt.Sprintf("prompt %d", i))
+				return s
+			})
+		}
+	}()
+	wg.Wait()
+
+	if got := cs.MessageCount(); got != 2*turns {
+		t.Errorf("MessageCount() = %d, want %d", got, 2*turns)
+	}
+	snapshot := cs.Snapshot()
+	snapshot[0].Content = "changed"
+	if cs.Snapshot()[0].Content == "changed" {
+		t.Error("Snapshot() shares its slice with the store")
+	}
+}
+
+func TestChatStoreAccessorsDuringRequest(t *testing.T) {
+	asked := make(chan struct{})
+	release := make(chan struct{})
+	cs := newTestStore(t, &fakeOllama{reply: func(OllamaChatRequest) (OllamaChatResponse, error) {
+		close(asked)
+		<-release
+		return OllamaChatResponse{Message: OllamaResponseMessage{Role: "assistant", Content: "ok"}, Done: true}, nil
+	}})
+	sent := make(chan error)
+	go func() {
+		_, err := cs.SendMessage(context.Background(), "hello")
+		sent <- err
+	}()
+	<-asked
+
+	read := make(chan int)
+	go func() {
+		_ = cs.Snapshot()
+		_ = cs.LastError()
+		read <- cs.MessageCount()
+	}()
+	select {
+	case n := <-read:
+		if n != 1 {
+			t.Errorf("MessageCount() = %d during the request, want the user message", n)
+		}
+	case <-time.After(time.Second):
+		t.Error("accessors blocked behind the LLM request")
+	}
+
+	close(release)
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	if n := cs.MessageCount(); n != 2 {
+		t.Errorf("MessageCount() = %d, want both messages", n)
+	}
+}
+
+func TestChatStoreUpdateSettingsKeepsConcurrentUpdates(t *testing.T) {
+	cs := newTestStore(t, &fakeOllama{})
+
+	const updates = 50
+	var wg sync.WaitGroup
+	for i := 0; i < updates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cs.UpdateSettings(func(s Settings) Settings {
+				n := 0
+				if s.LLMSettings.NumCtx != nil {
+					n = *s.LLMSettings.NumCtx
+				}
+				n++
+				s.LLMSettings.NumCtx = &n
+				return s
+			})
+		}()
+	}
+	wg.Wait()
+
+	if got := cs.Settings().LLMSettings.NumCtx; got == nil || *got != updates {
+		t.Errorf("NumCtx = %v, want %d", got, updates)
+	}
+}
+
+func TestSettingsJSON(t *testing.T) {
+	const sample = `{"sttSettings":{"language":"en","patience":1.5},"llmSettings":{"model":"llama3","top_k":40},"ttsSettings":{"voice":"anna","speed":1.2},"asteriskSettings":{"asterisk_number":"100"}}`
+
+	var s Settings
+	if err := json.Unmarshal([]byte(sample), &s); err != nil {
+		t.Fatal(err)
+	}
+	if *s.STTSettings.Language != "en" || *s.STTSettings.Patience != 1.5 {
+		t.Errorf("STT settings = %+v", s.STTSettings)
+	}
+	if *s.LLMSettings.Model != "llama3" || *s.LLMSettings.TopK != 40 {
+		t.Errorf("LLM settings = %+v", s.LLMSettings)
+	}
+	if s.TTSSettings.Voice != "anna" || s.AsteriskSettings.AsteriskNumber != "100" {
+		t.Errorf("settings = %+v", s)
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again Settings
+	if err := json.Unmarshal(data, &again); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, s) {
+		t.Errorf("round trip gave %+v, want %+v", again, s)
+	}
+}
+
+// modelsAsked returns the model of each request ollama received.
+func modelsAsked(ollama *fakeOllama) string {
+	var models []string
+	for _, request := range ollama.Requests() {
+		models = append(models, request.Model)
+	}
+	return fmt.Sprint(models)
+}
+
+func TestFallbackModel(t *testing.T) {
+	ollama := &fakeOllama{reply: func(request OllamaChatRequest) (OllamaChatResponse, error) {
+		if request.Model != "backup" {
+			return OllamaChatResponse{}, ollamaStatusError(404, fmt.Sprintf(`model "%s" not found, try pulling it first`, request.Model))
+		}
+		return OllamaChatResponse{Message: OllamaResponseMessage{Role: "assistant", Content: "hi"}, Done: true}, nil
+	}}
+	cs := newTestStore(t, ollama)
+	cs.FallbackModels = []string{"missing", "backup"}
+
+	response, err := cs.SendMessage(context.Background(), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Message.Content != "hi" {
+		t.Errorf("reply = %q, want the fallback's", response.Message.Content)
+	}
+	if got := modelsAsked(ollama); got != "[model missing backup]" {
+		t.Errorf("models asked = %s, want the primary then each fallback in order", got)
+	}
+}
+
+func TestFallbackModelOnlyWhenUnavailable(t *testing.T) {
+	ollama := &fakeOllama{reply: func(request OllamaChatRequest) (OllamaChatResponse, error) {
+		return OllamaChatResponse{}, ollamaStatusError(500, "out of memory")
+	}}
+	cs := newTestStore(t, ollama)
+	cs.FallbackModels = []string{"backup"}
+
+	if _, err := cs.SendMessage(context.Background(), "hello"); err == nil {
+		t.Fatal("SendMessage() succeeded with the LLM failing")
+	}
+	if got := modelsAsked(ollama); got != "[model]" {
+		t.Errorf("models asked = %s, want no fallback for a server failure", got)
+	}
+}
+
+func TestFallbackModelsExhausted(t *testing.T) {
+	ollama := &fakeOllama{reply: func(request OllamaChatRequest) (OllamaChatResponse, error) {
+		return OllamaChatResponse{}, ollamaStatusError(404, "model not found")
+	}}
+	cs := newTestStore(t, ollama)
+	cs.FallbackModels = []string{"backup"}
+
+	if _, err := cs.SendMessage(context.Background(), "hello"); !errors.Is(err, ErrModelUnavailable) {
+		t.Errorf("SendMessage() error = %v, want ErrModelUnavailable", err)
+	}
+	if got := modelsAsked(ollama); got != "[model backup]" {
+		t.Errorf("models asked = %s, want the primary and the fallback", got)
+	}
+}
+
+func TestOllamaChatResponseUnmarshal(t *testing.T) {
+	var response OllamaChatResponse
+	if err := json.Unmarshal([]byte(cannedOllamaResponse), &response); err != nil {
+		t.Fatal(err)
+	}
+	want := OllamaChatResponse{
+		Model:              "llama3",
+		CreatedAt:          time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		Message:            OllamaResponseMessage{Role: "assistant", Content: "Hello!"},
+		Done:               true,
+		DoneReason:         "stop",
+		TotalDuration:      5191566416,
+		LoadDuration:       2154458,
+		PromptEvalCount:    26,
+		PromptEvalDuration: 383809000,
+		EvalCount:          298,
+		EvalDuration:       4799921000,
+	}
+	if !reflect.DeepEqual(response, want) {
+		t.Errorf("unmarshalled %+v, want %+v", response, want)
+	}
+}
+
+func TestHTTPOllamaChatDecodesResponse(t *testing.T) {
+	var sent OllamaChatRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		w.Write([]byte(cannedOllamaResponse))
+	}))
+	defer srv.Close()
+
+	client := &HTTPollamaAPIClient{BaseURL: srv.URL, HTTPClient: srv.Client()}
+	response, err := client.Chat(context.Background(), OllamaChatRequest{Model: "llama3", Stream: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.Stream {
+		t.Error("Chat() asked for a stream")
+	}
+	if response.Model != "llama3" || response.Message.Content != "Hello!" || response.DoneReason != "stop" || response.EvalCount != 298 {
+		t.Errorf("Chat() = %+v, want the canned response", response)
+	}
+}
+
+// ndjsonServer answers chat requests with chunks, one JSON object per
+// line, recording whether streaming was asked for.
+func ndjsonServer(t *testing.T, stream *bool, chunks ...string) *HTTPollamaAPIClient {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request OllamaChatRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		*stream = request.Stream
+		for _, chunk := range chunks {
+			fmt.Fprintln(w, chunk)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return &HTTPollamaAPIClient{BaseURL: srv.URL, HTTPClient: srv.Client()}
+}
+
+func TestChatStream(t *testing.T) {
+	var stream bool
+	client := ndjsonServer(t, &stream,
+		`{"model":"llama3","message":{"role":"assistant","content":"Hel"},"done":false}`,
+		`{"model":"llama3","message":{"role":"assistant","content":"lo, "},"done":false}`,
+		`{"model":"llama3","message":{"role":"assistant","content":"world!"},"done":false}`,
+		`{"model":"llama3","message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":26,"eval_count":3}`,
+	)
+
+	var seen []string
+	response, err := client.ChatStream(context.Background(), OllamaChatRequest{Model: "llama3"}, func(chunk OllamaChatResponse) error {
+		seen = append(seen, chunk.Message.Content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stream {
+		t.Error("ChatStream() didn't ask for a stream")
+	}
+	if fmt.Sprintf("%q", seen) != `["Hel" "lo, " "world!" ""]` {
+		t.Errorf("callback saw %q, want each chunk in order", seen)
+	}
+	if response.Message.Content != "Hello, world!" {
+		t.Errorf("assembled %q, want the content of all chunks", response.Message.Content)
+	}
+	if !response.Done || response.DoneReason != "stop" || response.EvalCount != 3 {
+		t.Errorf("response = %+v, want the final chunk's fields", response)
+	}
+}
+
+func TestChatStreamCallbackError(t *testing.T) {
+	var stream bool
+	client := ndjsonServer(t, &stream,
+		`{"message":{"role":"assistant","content":"one"},"done":false}`,
+		`{"message":{"role":"assistant","content":"two"},"done":false}`,
+		`{"message":{"role":"assistant","content":""},"done":true}`,
+	)
+	stop := errors.New("stop")
+	calls := 0
+	_, err := client.ChatStream(context.Background(), OllamaChatRequest{}, func(OllamaChatResponse) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("ChatStream() error = %v after %d chunks, want the callback's error after one", err, calls)
+	}
+}
+
+func TestChatStreamErrors(t *testing.T) {
+	var stream bool
+	client := ndjsonServer(t, &stream,
+		`{"message":{"role":"assistant","content":"one"},"done":false}`,
+		`{"error":"model \"llama3\" not found"}`,
+	)
+	if _, err := client.ChatStream(context.Background(), OllamaChatRequest{}, nil); !errors.Is(err, ErrModelUnavailable) {
+		t.Errorf("ChatStream() error = %v, want the error chunk's", err)
+	}
+
+	client = ndjsonServer(t, &stream, `{"message":{"role":"assistant","content":"one"},"done":false}`)
+	if _, err := client.ChatStream(context.Background(), OllamaChatRequest{}, nil); err == nil {
+		t.Error("stream ending before done gave no error")
+	}
+}
@@ -0,0 +1,7 @@
+package api
+
+import "time"
+
+// Now returns the current time for cache expiry and the prompt's date and
+// time. The bridge points it at its own clock so tests can move it.
+var Now = time.Now
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Errors returned by the chat backend clients, based on the HTTP status of
+// the response. Use errors.Is to check for them.
+var (
+	ErrChatNotFound = errors.New("chat not found")
+	ErrChatExists   = errors.New("chat already exists")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrServerError  = errors.New("chat backend server error")
+	// ErrModelUnavailable means Ollama doesn't have the requested model
+	// or failed to load it.
+	ErrModelUnavailable = errors.New("model unavailable")
+)
+
+// modelUnavailableMarkers are found in the errors Ollama returns for models
+// that aren't pulled or can't be loaded.
+var modelUnavailableMarkers = []string{"not found", "try pulling", "failed to load", "error loading model"}
+
+// ollamaStatusError describes a failed Ollama response with status code and
+// body, wrapping ErrModelUnavailable if the body says the model is missing
+// or couldn't be loaded.
+func ollamaStatusError(code int, body string) error {
+	body = strings.TrimSpace(body)
+	lower := strings.ToLower(body)
+	for _, marker := range modelUnavailableMarkers {
+		if strings.Contains(lower, marker) {
+			return fmt.Errorf("%w: received status code %d: %s", ErrModelUnavailable, code, body)
+		}
+	}
+	return fmt.Errorf("failed to get valid response from Ollama API: received status code %d: %s", code, body)
+}
+
+// StatusError maps an HTTP status code to one of the sentinel errors. It
+// returns nil for successful responses.
+func StatusError(code int) error {
+	switch {
+	case code >= 200 && code < 300:
+		return nil
+	case code == http.StatusNotFound:
+		return ErrChatNotFound
+	case code == http.StatusConflict:
+		return ErrChatExists
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return ErrUnauthorized
+	case code >= 500:
+		return fmt.Errorf("%w: received status code %d", ErrServerError, code)
+	default:
+		return fmt.Errorf("unexpected status code %d", code)
+	}
+}
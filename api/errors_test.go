@@ -0,0 +1,104 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		code int
+		want error
+	}{
+		{http.StatusOK, nil},
+		{http.StatusCreated, nil},
+		{http.StatusNotFound, ErrChatNotFound},
+		{http.StatusConflict, ErrChatExists},
+		{http.StatusUnauthorized, ErrUnauthorized},
+		{http.StatusForbidden, ErrUnauthorized},
+		{http.StatusInternalServerError, ErrServerError},
+		{http.StatusBadGateway, ErrServerError},
+		{http.StatusServiceUnavailable, ErrServerError},
+	}
+	for _, tt := range tests {
+		err := StatusError(tt.code)
+		if tt.want == nil {
+			if err != nil {
+				t.Errorf("StatusError(%d) = %v, want nil", tt.code, err)
+			}
+			continue
+		}
+		if !errors.Is(err, tt.want) {
+			t.Errorf("StatusError(%d) = %v, want %v", tt.code, err, tt.want)
+		}
+	}
+
+	// Other failures match none of the sentinels
+	err := StatusError(http.StatusBadRequest)
+	for _, sentinel := range []error{ErrChatNotFound, ErrChatExists, ErrUnauthorized, ErrServerError} {
+		if errors.Is(err, sentinel) {
+			t.Errorf("StatusError(400) = %v, matches %v", err, sentinel)
+		}
+	}
+}
+
+func TestOllamaStatusError(t *testing.T) {
+	if err := ollamaStatusError(404, `model "llama9" not found, try pulling it first`); !errors.Is(err, ErrModelUnavailable) {
+		t.Errorf("missing model gave %v, want ErrModelUnavailable", err)
+	}
+	if err := ollamaStatusError(500, "out of memory"); errors.Is(err, ErrModelUnavailable) {
+		t.Errorf("server failure gave %v, want no ErrModelUnavailable", err)
+	}
+}
+
+func TestHTTPChatAPIStatusErrors(t *testing.T) {
+	tests := []struct {
+		code int
+		want error
+	}{
+		{http.StatusNotFound, ErrChatNotFound},
+		{http.StatusUnauthorized, ErrUnauthorized},
+		{http.StatusInternalServerError, ErrServerError},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.code)
+		}))
+		chats := NewHTTPChatAPI(srv.URL)
+
+		if _, err := chats.GetChat("chat"); !errors.Is(err, tt.want) {
+			t.Errorf("GetChat on %d: %v, want %v", tt.code, err, tt.want)
+		}
+		if _, err := chats.SendMessage("chat", "user", "hi"); !errors.Is(err, tt.want) {
+			t.Errorf("SendMessage on %d: %v, want %v", tt.code, err, tt.want)
+		}
+		if _, err := chats.UpdateChat("chat", map[string]interface{}{"title": "t"}); !errors.Is(err, tt.want) {
+			t.Errorf("UpdateChat on %d: %v, want %v", tt.code, err, tt.want)
+		}
+		if _, err := chats.GetMessages("chat"); !errors.Is(err, tt.want) {
+			t.Errorf("GetMessages on %d: %v, want %v", tt.code, err, tt.want)
+		}
+		srv.Close()
+	}
+}
+
+func TestHTTPChatAPIStartExistingChat(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.Write([]byte(`{"id":"chat"}`))
+	}))
+	defer srv.Close()
+
+	chat, err := NewHTTPChatAPI(srv.URL).StartChat("chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat.ID != "chat" {
+		t.Errorf("StartChat() = %+v, want the existing chat", chat)
+	}
+}
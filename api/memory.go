@@ -0,0 +1,83 @@
+package api
+
+import "sync"
+
+// MemoryChatAPI is a ChatAPI keeping chats in memory only. It stands in for
+// the chat backend when that is unreachable, so a call can go on; nothing
+// stored in it outlives the process.
+type MemoryChatAPI struct {
+	mu     sync.Mutex
+	nextID int
+	chats  map[string]*Chat
+}
+
+var _ ChatAPI = (*MemoryChatAPI)(nil)
+
+// NewMemoryChatAPI creates an empty MemoryChatAPI.
+func NewMemoryChatAPI() *MemoryChatAPI {
+	return &MemoryChatAPI{chats: make(map[string]*Chat)}
+}
+
+// SendMessage appends a message to the chat.
+func (m *MemoryChatAPI) SendMessage(chatID string, sender Sender, content string) (*Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	chat, ok := m.chats[chatID]
+	if !ok {
+		return nil, ErrChatNotFound
+	}
+	m.nextID++
+	msg := Message{ID: m.nextID, ChatID: chatID, Role: sender, Content: content}
+	chat.Messages = append(chat.Messages, msg)
+	return &msg, nil
+}
+
+// UpdateChat applies the title and settings in updates; other fields are
+// ignored.
+func (m *MemoryChatAPI) UpdateChat(chatID string, updates map[string]interface{}) (*Chat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	chat, ok := m.chats[chatID]
+	if !ok {
+		return nil, ErrChatNotFound
+	}
+	if title, ok := updates["title"].(string); ok {
+		chat.Title = title
+	}
+	if settings, ok := updates["settings"].(Settings); ok {
+		chat.Settings = settings
+	}
+	return copyChat(*chat), nil
+}
+
+// GetChat returns a copy of the chat.
+func (m *MemoryChatAPI) GetChat(chatID string) (*Chat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	chat, ok := m.chats[chatID]
+	if !ok {
+		return nil, ErrChatNotFound
+	}
+	return copyChat(*chat), nil
+}
+
+// GetMessages returns the messages of the chat.
+func (m *MemoryChatAPI) GetMessages(chatID string) ([]Message, error) {
+	chat, err := m.GetChat(chatID)
+	if err != nil {
+		return nil, err
+	}
+	return chat.Messages, nil
+}
+
+// StartChat creates the chat, or returns it if it already exists.
+func (m *MemoryChatAPI) StartChat(chatID string) (*Chat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	chat, ok := m.chats[chatID]
+	if !ok {
+		chat = &Chat{ID: chatID}
+		m.chats[chatID] = chat
+	}
+	return copyChat(*chat), nil
+}
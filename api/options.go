@@ -0,0 +1,35 @@
+package api
+
+import "go-ast-client/settings"
+
+// OllamaOptions returns the Ollama model options set in s, keyed by their
+// Ollama names. Unset fields are left out so the model's defaults apply.
+// s.ExtraOptions passes options not modeled in LLMSettings; the modeled
+// fields take precedence over it.
+func OllamaOptions(s settings.LLMSettings) map[string]interface{} {
+	opts := make(map[string]interface{}, len(s.ExtraOptions))
+	for k, v := range s.ExtraOptions {
+		opts[k] = v
+	}
+	setOption(opts, "seed", s.Seed)
+	setOption(opts, "mirostat", s.Mirostat)
+	setOption(opts, "mirostat_eta", s.MirostatEta)
+	setOption(opts, "mirostat_tau", s.MirostatTau)
+	setOption(opts, "num_ctx", s.NumCtx)
+	setOption(opts, "repeat_last_n", s.RepeatLastN)
+	setOption(opts, "repeat_penalty", s.RepeatPenalty)
+	setOption(opts, "temperature", s.Temperature)
+	setOption(opts, "tfs_z", s.TfsZ)
+	setOption(opts, "num_predict", s.NumPredict)
+	setOption(opts, "top_k", s.TopK)
+	setOption(opts, "top_p", s.TopP)
+	setOption(opts, "min_p", s.MinP)
+	return opts
+}
+
+// setOption sets opts[key] to *v unless v is nil.
+func setOption[T any](opts map[string]interface{}, key string, v *T) {
+	if v != nil {
+		opts[key] = *v
+	}
+}
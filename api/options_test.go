@@ -0,0 +1,110 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go-ast-client/settings"
+)
+
+func floatPtr(f float64) *float64 { return &f }
+
+func TestOllamaOptionsSamplingFields(t *testing.T) {
+	opts := OllamaOptions(settings.LLMSettings{
+		TopK: intPtr(40),
+		TopP: floatPtr(0.9),
+		MinP: floatPtr(0.05),
+	})
+	want := map[string]interface{}{"top_k": 40, "top_p": 0.9, "min_p": 0.05}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("OllamaOptions() = %v, want %v with the nil fields left out", opts, want)
+	}
+}
+
+func TestOllamaOptionsExtraOptions(t *testing.T) {
+	opts := OllamaOptions(settings.LLMSettings{
+		Temperature:  floatPtr(0.2),
+		ExtraOptions: map[string]interface{}{"typical_p": 0.7, "stop": []string{"\n"}, "temperature": 1.5},
+	})
+	if opts["typical_p"] != 0.7 || !reflect.DeepEqual(opts["stop"], []string{"\n"}) {
+		t.Errorf("OllamaOptions() = %v, want the extra options passed through", opts)
+	}
+	if opts["temperature"] != 0.2 {
+		t.Errorf("temperature = %v, want the modeled field to win", opts["temperature"])
+	}
+}
+
+func TestOllamaOptionsSent(t *testing.T) {
+	ollama := &fakeOllama{}
+	cs := newTestStore(t, ollama)
+	cs.SetSettings(Settings{LLMSettings: settings.LLMSettings{Model: strPtr("model"), TopK: intPtr(20), MinP: floatPtr(0.1)}})
+	if _, err := cs.SendMessage(context.Background(), "hello"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"top_k": 20, "min_p": 0.1}
+	if got := ollama.Requests()[0].Options; !reflect.DeepEqual(got, want) {
+		t.Errorf("request options = %v, want %v", got, want)
+	}
+}
+
+func TestOllamaOptionsAllNil(t *testing.T) {
+	if opts := OllamaOptions(settings.LLMSettings{Model: strPtr("model")}); len(opts) != 0 {
+		t.Errorf("OllamaOptions() = %v, want no overrides", opts)
+	}
+
+	// The request carries no options at all
+	ollama := &fakeOllama{}
+	cs := newTestStore(t, ollama)
+	if _, err := cs.SendMessage(context.Background(), "hello"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(ollama.Requests()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), `"options"`) {
+		t.Errorf("request %s overrides options", data)
+	}
+}
+
+func TestOllamaOptionsFullyPopulated(t *testing.T) {
+	opts := OllamaOptions(settings.LLMSettings{
+		Seed:          intPtr(42),
+		Model:         strPtr("model"),
+		SystemPrompt:  strPtr("prompt"),
+		Mirostat:      intPtr(2),
+		MirostatEta:   floatPtr(0.1),
+		MirostatTau:   floatPtr(5),
+		NumCtx:        intPtr(4096),
+		RepeatLastN:   intPtr(64),
+		RepeatPenalty: floatPtr(1.1),
+		Temperature:   floatPtr(0),
+		TfsZ:          floatPtr(1),
+		NumPredict:    intPtr(128),
+		TopK:          intPtr(40),
+		TopP:          floatPtr(0.9),
+		MinP:          floatPtr(0.05),
+	})
+	want := map[string]interface{}{
+		"seed":           42,
+		"mirostat":       2,
+		"mirostat_eta":   0.1,
+		"mirostat_tau":   5.0,
+		"num_ctx":        4096,
+		"repeat_last_n":  64,
+		"repeat_penalty": 1.1,
+		// An explicit zero is kept
+		"temperature": 0.0,
+		"tfs_z":       1.0,
+		"num_predict": 128,
+		"top_k":       40,
+		"top_p":       0.9,
+		"min_p":       0.05,
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("OllamaOptions() = %v, want %v", opts, want)
+	}
+}
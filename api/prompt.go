@@ -0,0 +1,81 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// PromptData is available to system prompt templates, e.g.
+// "You are helping {{.CallerNumber}} on {{.Date}}". CallerNumber is the
+// number configured for the chat; the call leg fields describe the live
+// call and may be empty.
+type PromptData struct {
+	CallerNumber string
+	ChatID       string
+	Date         string // 2006-01-02
+	Time         string // 15:04
+	Now          time.Time
+	CallLeg
+}
+
+// CallLeg describes the live call a chat is serving.
+type CallLeg struct {
+	// CallerID is the number of the party calling, as the dialplan
+	// reports it.
+	CallerID string `json:"caller_id,omitempty"`
+	// CalledNumber is the number that was dialed (DNIS).
+	CalledNumber string `json:"called_number,omitempty"`
+	// RemoteAddr is the address of the Asterisk server the AudioSocket
+	// connection came from.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+}
+
+// SetCallLeg sets the call leg rendered into the system prompt.
+func (cs *ChatStore) SetCallLeg(leg CallLeg) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.leg = leg
+}
+
+// parsePrompt parses a system prompt as a template. Prompts without
+// template actions yield a nil template and are used as is.
+func parsePrompt(prompt string) (*template.Template, error) {
+	if !strings.Contains(prompt, "{{") {
+		return nil, nil
+	}
+	tmpl, err := template.New("system_prompt").Option("missingkey=error").Parse(prompt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid system prompt template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// renderPrompt renders the chat's system prompt for the current turn.
+func (cs *ChatStore) renderPrompt(prompt string) string {
+	cs.settingsMu.RLock()
+	tmpl := cs.promptTemplate
+	number := cs.settings.AsteriskSettings.AsteriskNumber
+	cs.settingsMu.RUnlock()
+	if tmpl == nil {
+		return prompt
+	}
+	now := Now()
+	data := PromptData{
+		CallerNumber: number,
+		ChatID:       cs.CurrentChat,
+		Date:         now.Format("2006-01-02"),
+		Time:         now.Format("15:04"),
+		Now:          now,
+		CallLeg:      cs.leg,
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		log.Println("failed to render system prompt, using it unrendered:", err)
+		return prompt
+	}
+	return b.String()
+}
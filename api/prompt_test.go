@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go-ast-client/settings"
+)
+
+// systemPromptSent sends a message on a store whose system prompt is
+// prompt and returns the system message the LLM got.
+func systemPromptSent(t *testing.T, prompt string, configure func(cs *ChatStore)) string {
+	t.Helper()
+	ollama := &fakeOllama{}
+	cs := newTestStore(t, ollama)
+	s := cs.Settings()
+	s.LLMSettings = settings.LLMSettings{Model: strPtr("model"), SystemPrompt: strPtr(prompt)}
+	s.AsteriskSettings.AsteriskNumber = "+15551234"
+	cs.SetSettings(s)
+	if configure != nil {
+		configure(cs)
+	}
+	if _, err := cs.SendMessage(context.Background(), "hello"); err != nil {
+		t.Fatal(err)
+	}
+	requests := ollama.Requests()
+	return requests[len(requests)-1].Messages[0].Content
+}
+
+func TestPromptTemplateSubstitution(t *testing.T) {
+	got := systemPromptSent(t, "You are helping {{.CallerNumber}} on {{.Date}} in chat {{.ChatID}}, called from {{.CallerID}}.", func(cs *ChatStore) {
+		cs.SetCallLeg(CallLeg{CallerID: "+15559876"})
+	})
+	want := "You are helping +15551234 on " + time.Now().Format("2006-01-02") + " in chat chat, called from +15559876."
+	if got != want {
+		t.Errorf("system prompt = %q, want %q", got, want)
+	}
+}
+
+func TestPlainPromptUntouched(t *testing.T) {
+	// Braces that aren't template actions are left alone
+	const prompt = "Answer in JSON like {\"reply\": \"...\"}. Be brief."
+	if tmpl, err := parsePrompt(prompt); tmpl != nil || err != nil {
+		t.Errorf("parsePrompt() = %v, %v, want no template", tmpl, err)
+	}
+	if got := systemPromptSent(t, prompt, nil); got != prompt {
+		t.Errorf("system prompt = %q, want it unchanged", got)
+	}
+}
+
+func TestMalformedPromptTemplate(t *testing.T) {
+	const prompt = "You are helping {{.CallerNumber} today."
+	_, err := parsePrompt(prompt)
+	if err == nil || !strings.Contains(err.Error(), "invalid system prompt template") {
+		t.Errorf("parsePrompt() error = %v, want a clear template error", err)
+	}
+	// The chat still works, with the prompt used as plain text
+	if got := systemPromptSent(t, prompt, nil); got != prompt {
+		t.Errorf("system prompt = %q, want the malformed prompt as is", got)
+	}
+}
+
+func TestPromptTemplateUnknownField(t *testing.T) {
+	const prompt = "Hello {{.CustomerName}}."
+	if _, err := parsePrompt(prompt); err != nil {
+		t.Fatalf("parsePrompt() error = %v; unknown fields fail when rendered", err)
+	}
+	if got := systemPromptSent(t, prompt, nil); got != prompt {
+		t.Errorf("system prompt = %q, want the prompt unrendered", got)
+	}
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+)
+
+// captureLogs returns a buffer receiving the log output for the rest of
+// the test, with content logging set to logContent.
+func captureLogs(t *testing.T, logContent bool) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	savedOutput, savedContent := log.Writer(), LogContent
+	t.Cleanup(func() {
+		log.SetOutput(savedOutput)
+		LogContent = savedContent
+	})
+	log.SetOutput(&buf)
+	LogContent = logContent
+	return &buf
+}
+
+func TestRedact(t *testing.T) {
+	captureLogs(t, false)
+	got := Redact("my card is 4111")
+	if strings.Contains(got, "4111") || !strings.HasPrefix(got, "[redacted 15 chars sha256:") {
+		t.Errorf("Redact() = %q, want only the length and hash", got)
+	}
+	if Redact("my card is 4111") != got || Redact("my card is 4112") == got {
+		t.Error("redacted messages can't be told apart")
+	}
+
+	LogContent = true
+	if got := Redact("my card is 4111"); got != "my card is 4111" {
+		t.Errorf("Redact() = %q at debug level, want the content", got)
+	}
+}
+
+func TestSendMessageLogsRedacted(t *testing.T) {
+	logs := captureLogs(t, false)
+	ollama := &fakeOllama{reply: func(request OllamaChatRequest) (OllamaChatResponse, error) {
+		return OllamaChatResponse{Message: OllamaResponseMessage{Role: "assistant", Content: "your balance is 1234"}, Done: true}, nil
+	}}
+	cs := newTestStore(t, ollama)
+	if _, err := cs.SendMessage(context.Background(), "my card is 4111"); err != nil {
+		t.Fatal(err)
+	}
+	if out := logs.String(); strings.Contains(out, "4111") || strings.Contains(out, "1234") {
+		t.Errorf("message content logged at the default level:\n%s", out)
+	}
+}
+
+func TestSendMessageLogsContentAtDebug(t *testing.T) {
+	logs := captureLogs(t, true)
+	ollama := &fakeOllama{reply: func(request OllamaChatRequest) (OllamaChatResponse, error) {
+		return OllamaChatResponse{Message: OllamaResponseMessage{Role: "assistant", Content: "your balance is 1234"}, Done: true}, nil
+	}}
+	cs := newTestStore(t, ollama)
+	if _, err := cs.SendMessage(context.Background(), "my card is 4111"); err != nil {
+		t.Fatal(err)
+	}
+	if out := logs.String(); !strings.Contains(out, "4111") || !strings.Contains(out, "1234") {
+		t.Errorf("message content missing from the debug logs:\n%s", out)
+	}
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultMaxToolCalls is how many rounds of tool calls a ChatStore allows
+// per message when MaxToolCalls is zero.
+const DefaultMaxToolCalls = 3
+
+// ErrTooManyToolCalls is returned when the model keeps calling tools
+// instead of answering.
+var ErrTooManyToolCalls = errors.New("too many tool calls")
+
+// ToolFunc runs a tool with the arguments chosen by the model and returns
+// the result given back to it.
+type ToolFunc func(ctx context.Context, args map[string]interface{}) (string, error)
+
+// Tool is a function the model may call.
+type Tool struct {
+	Name        string
+	Description string
+	// Parameters is the JSON schema of the arguments.
+	Parameters map[string]interface{}
+	Handler    ToolFunc
+}
+
+// ToolSpec describes a tool to Ollama.
+type ToolSpec struct {
+	Type     string           `json:"type"`
+	Function ToolSpecFunction `json:"function"`
+}
+
+// ToolSpecFunction is the function part of a ToolSpec.
+type ToolSpecFunction struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// ToolCall is a tool call requested by the model.
+type ToolCall struct {
+	Function ToolCallFunction `json:"function"`
+}
+
+// ToolCallFunction names the tool to call and its arguments.
+type ToolCallFunction struct {
+	Name      string                 `json:"name"`
+	Arguments map[string]interface{} `json:"arguments"`
+}
+
+// ToolRegistry holds the tools offered to the model. It is safe for
+// concurrent use.
+type ToolRegistry struct {
+	mu    sync.RWMutex
+	tools map[string]Tool
+}
+
+// NewToolRegistry creates an empty ToolRegistry.
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{tools: make(map[string]Tool)}
+}
+
+// Register adds tool, replacing any tool of the same name.
+func (r *ToolRegistry) Register(tool Tool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tools[tool.Name] = tool
+}
+
+// Len returns the number of registered tools. A nil ToolRegistry has none.
+func (r *ToolRegistry) Len() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.tools)
+}
+
+// Specs describes the registered tools for a chat request, sorted by name.
+func (r *ToolRegistry) Specs() []ToolSpec {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	specs := make([]ToolSpec, 0, len(r.tools))
+	for _, tool := range r.tools {
+		specs = append(specs, ToolSpec{
+			Type: "function",
+			Function: ToolSpecFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Function.Name < specs[j].Function.Name })
+	return specs
+}
+
+// Call runs the tool requested by call. Failures are returned as the
+// result, so the model can tell the caller instead of the turn failing.
+func (r *ToolRegistry) Call(ctx context.Context, call ToolCall) string {
+	r.mu.RLock()
+	tool, ok := r.tools[call.Function.Name]
+	r.mu.RUnlock()
+	if !ok {
+		return fmt.Sprintf("error: unknown tool %q", call.Function.Name)
+	}
+	result, err := tool.Handler(ctx, call.Function.Arguments)
+	if err != nil {
+		log.Printf("tool %s failed: %v", call.Function.Name, err)
+		return "error: " + err.Error()
+	}
+	return result
+}
+
+// toolCalls returns the tool calls requested in response. Besides Ollama's
+// structured tool_calls, models without native tool support often answer
+// with the call as a JSON object in the content, which is recognized too.
+func toolCalls(response OllamaChatResponse, tools *ToolRegistry) []ToolCall {
+	if tools.Len() == 0 {
+		return nil
+	}
+	if len(response.Message.ToolCalls) > 0 {
+		return response.Message.ToolCalls
+	}
+	if call, ok := parseTextToolCall(response.Message.Content); ok && tools.has(call.Function.Name) {
+		return []ToolCall{call}
+	}
+	return nil
+}
+
+func (r *ToolRegistry) has(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.tools[name]
+	return ok
+}
+
+// parseTextToolCall recognizes a tool call written as JSON, optionally in
+// a code fence, e.g. {"name": "get_time", "arguments": {}}.
+func parseTextToolCall(content string) (ToolCall, bool) {
+	content = strings.TrimSpace(content)
+	content = strings.TrimPrefix(content, "```json")
+	content = strings.TrimPrefix(content, "```")
+	content = strings.TrimSuffix(content, "```")
+	content = strings.TrimSpace(content)
+	if !strings.HasPrefix(content, "{") {
+		return ToolCall{}, false
+	}
+	var call struct {
+		Name       string                 `json:"name"`
+		Arguments  map[string]interface{} `json:"arguments"`
+		Parameters map[string]interface{} `json:"parameters"`
+	}
+	if err := json.Unmarshal([]byte(content), &call); err != nil || call.Name == "" {
+		return ToolCall{}, false
+	}
+	if call.Arguments == nil {
+		call.Arguments = call.Parameters
+	}
+	return ToolCall{Function: ToolCallFunction{Name: call.Name, Arguments: call.Arguments}}, true
+}
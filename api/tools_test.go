@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// weatherTools registers a get_weather tool recording the cities it is
+// asked about.
+func weatherTools(cities *[]string) *ToolRegistry {
+	tools := NewToolRegistry()
+	tools.Register(Tool{
+		Name: "get_weather",
+		Handler: func(ctx context.Context, args map[string]interface{}) (string, error) {
+			city := fmt.Sprint(args["city"])
+			*cities = append(*cities, city)
+			return "sunny in " + city, nil
+		},
+	})
+	return tools
+}
+
+// lastMessage returns the last message of request.
+func lastMessage(request OllamaChatRequest) OllamaMessage {
+	return request.Messages[len(request.Messages)-1]
+}
+
+func TestToolCallFollowUp(t *testing.T) {
+	ollama := &fakeOllama{reply: func(request OllamaChatRequest) (OllamaChatResponse, error) {
+		if last := lastMessage(request); last.Role == "tool" {
+			return OllamaChatResponse{Message: OllamaResponseMessage{Role: "assistant", Content: "It is " + last.Content + "."}, Done: true}, nil
+		}
+		return OllamaChatResponse{Message: OllamaResponseMessage{Role: "assistant", ToolCalls: []ToolCall{
+			{Function: ToolCallFunction{Name: "get_weather", Arguments: map[string]interface{}{"city": "Oslo"}}},
+		}}, Done: true}, nil
+	}}
+	cs := newTestStore(t, ollama)
+	var cities []string
+	cs.Tools = weatherTools(&cities)
+
+	response, err := cs.SendMessage(context.Background(), "what's the weather in Oslo?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(cities) != "[Oslo]" {
+		t.Errorf("tool called for %v, want Oslo once", cities)
+	}
+	if response.Message.Content != "It is sunny in Oslo." {
+		t.Errorf("reply = %q, want the answer using the tool result", response.Message.Content)
+	}
+	requests := ollama.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("%d LLM requests, want the question and the follow-up", len(requests))
+	}
+	if len(requests[0].Tools) != 1 || requests[0].Tools[0].Function.Name != "get_weather" {
+		t.Errorf("tools offered = %+v, want get_weather", requests[0].Tools)
+	}
+	// Tool calls and results aren't part of the stored conversation
+	if got := cs.Snapshot(); len(got) != 2 || got[1].Content != "It is sunny in Oslo." {
+		t.Errorf("history = %+v, want the question and the final answer", got)
+	}
+}
+
+func TestTextToolCall(t *testing.T) {
+	ollama := &fakeOllama{reply: func(request OllamaChatRequest) (OllamaChatResponse, error) {
+		if lastMessage(request).Role == "tool" {
+			return OllamaChatResponse{Message: OllamaResponseMessage{Role: "assistant", Content: "Sunny."}, Done: true}, nil
+		}
+		return OllamaChatResponse{Message: OllamaResponseMessage{Role: "assistant", Content: "```json\n{\"name\": \"get_weather\", \"parameters\": {\"city\": \"Rome\"}}\n```"}, Done: true}, nil
+	}}
+	cs := newTestStore(t, ollama)
+	var cities []string
+	cs.Tools = weatherTools(&cities)
+
+	response, err := cs.SendMessage(context.Background(), "weather in Rome?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(cities) != "[Rome]" || response.Message.Content != "Sunny." {
+		t.Errorf("tool called for %v, reply %q; want the JSON call run instead of spoken", cities, response.Message.Content)
+	}
+}
+
+func TestToolCallLimit(t *testing.T) {
+	ollama := &fakeOllama{reply: func(request OllamaChatRequest) (OllamaChatResponse, error) {
+		return OllamaChatResponse{Message: OllamaResponseMessage{Role: "assistant", ToolCalls: []ToolCall{
+			{Function: ToolCallFunction{Name: "get_weather", Arguments: map[string]interface{}{"city": "Oslo"}}},
+		}}, Done: true}, nil
+	}}
+	cs := newTestStore(t, ollama)
+	var cities []string
+	cs.Tools = weatherTools(&cities)
+	cs.MaxToolCalls = 2
+
+	if _, err := cs.SendMessage(context.Background(), "weather?"); !errors.Is(err, ErrTooManyToolCalls) {
+		t.Errorf("SendMessage() error = %v, want ErrTooManyToolCalls", err)
+	}
+	if len(cities) != 2 {
+		t.Errorf("tool called %d times, want 2", len(cities))
+	}
+}
+
+func TestToolRegistryCallFailures(t *testing.T) {
+	tools := NewToolRegistry()
+	tools.Register(Tool{Name: "broken", Handler: func(context.Context, map[string]interface{}) (string, error) {
+		return "", errors.New("database down")
+	}})
+	if got := tools.Call(context.Background(), ToolCall{Function: ToolCallFunction{Name: "broken"}}); got != "error: database down" {
+		t.Errorf("failed tool gave %q", got)
+	}
+	if got := tools.Call(context.Background(), ToolCall{Function: ToolCallFunction{Name: "missing"}}); got != `error: unknown tool "missing"` {
+		t.Errorf("unknown tool gave %q", got)
+	}
+}
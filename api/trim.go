@@ -0,0 +1,172 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	// defaultNumCtx is Ollama's context size when num_ctx isn't set.
+	defaultNumCtx = 2048
+	// messageOverheadTokens approximates the tokens the chat template adds
+	// around each message.
+	messageOverheadTokens = 4
+)
+
+// ApproxTokens estimates the number of tokens in text. It assumes about
+// three characters per token, which errs on the safe side for Cyrillic.
+func ApproxTokens(text string) int {
+	return (utf8.RuneCountInString(text)+2)/3 + messageOverheadTokens
+}
+
+// messagesTokens estimates the tokens used by messages.
+func messagesTokens(messages []OllamaMessage) int {
+	total := 0
+	for _, msg := range messages {
+		total += ApproxTokens(msg.Content)
+	}
+	return total
+}
+
+// ContextBudget returns the number of prompt tokens available: num_ctx
+// minus a reserve for the response, which is num_predict when set and a
+// quarter of the context otherwise.
+func ContextBudget(numCtx, numPredict *int) int {
+	ctx := defaultNumCtx
+	if numCtx != nil && *numCtx > 0 {
+		ctx = *numCtx
+	}
+	reserve := ctx / 4
+	if numPredict != nil && *numPredict > 0 && *numPredict < ctx {
+		reserve = *numPredict
+	}
+	return ctx - reserve
+}
+
+// TrimStrategy fits the messages sent to the LLM into a token budget.
+// Leading system messages hold the system prompt and must be kept.
+type TrimStrategy interface {
+	Trim(ctx context.Context, messages []OllamaMessage, budget int) []OllamaMessage
+}
+
+// DropOldest drops the oldest non-system messages until the rest fit. The
+// latest message is always kept.
+type DropOldest struct{}
+
+// Trim implements TrimStrategy.
+func (DropOldest) Trim(ctx context.Context, messages []OllamaMessage, budget int) []OllamaMessage {
+	head, history := splitSystem(messages)
+	used := messagesTokens(head)
+	keep := len(history)
+	for keep > 0 && used+ApproxTokens(history[keep-1].Content) <= budget {
+		used += ApproxTokens(history[keep-1].Content)
+		keep--
+	}
+	if keep == len(history) && keep > 0 {
+		keep-- // Never drop the message being answered
+	}
+	if keep > 0 {
+		log.Printf("trimmed %d of %d messages to fit %d tokens", keep, len(history), budget)
+	}
+	return append(head, history[keep:]...)
+}
+
+// SummarizeThenDrop replaces the messages DropOldest would drop with a
+// summary of them. Summaries are built incrementally, so each dropped
+// message is summarized once. If summarizing fails or the summary doesn't
+// fit, it behaves like DropOldest. A SummarizeThenDrop must not be shared
+// between chats.
+type SummarizeThenDrop struct {
+	Summarize func(ctx context.Context, messages []OllamaMessage) (string, error)
+
+	mu         sync.Mutex
+	summary    string
+	summarized int
+}
+
+// Trim implements TrimStrategy.
+func (s *SummarizeThenDrop) Trim(ctx context.Context, messages []OllamaMessage, budget int) []OllamaMessage {
+	trimmed := DropOldest{}.Trim(ctx, messages, budget)
+	head, history := splitSystem(messages)
+	dropped := len(messages) - len(trimmed)
+	if dropped == 0 {
+		return trimmed
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if dropped < s.summarized {
+		// The history shrank, e.g. a new chat; start over
+		s.summary, s.summarized = "", 0
+	}
+	if dropped > s.summarized {
+		var input []OllamaMessage
+		if s.summary != "" {
+			input = append(input, OllamaMessage{Role: "system", Content: s.summary})
+		}
+		input = append(input, history[s.summarized:dropped]...)
+		summary, err := s.Summarize(ctx, input)
+		if err != nil {
+			log.Println("failed to summarize conversation:", err)
+			return trimmed
+		}
+		s.summary, s.summarized = summary, dropped
+	}
+
+	// The summary is kept like the system prompt, which may push out a few
+	// more messages; they are summarized once DropOldest drops them too.
+	summary := OllamaMessage{Role: "system", Content: "Summary of the earlier conversation: " + s.summary}
+	withSummary := DropOldest{}.Trim(ctx, append(append(head, summary), history[dropped:]...), budget)
+	if messagesTokens(withSummary) > budget {
+		return trimmed
+	}
+	return withSummary
+}
+
+// DefaultSummaryPrompt is the system prompt OllamaSummarizer uses.
+const DefaultSummaryPrompt = "Summarize the following conversation in a few sentences, keeping names, numbers and anything the user asked for."
+
+// OllamaSummarizer returns a summarize function for SummarizeThenDrop that
+// asks model to summarize the messages.
+func OllamaSummarizer(client OllamaAPIClient, model string) func(context.Context, []OllamaMessage) (string, error) {
+	return func(ctx context.Context, messages []OllamaMessage) (string, error) {
+		return summarize(ctx, client, model, DefaultSummaryPrompt, messages)
+	}
+}
+
+// summarize asks model to summarize messages following prompt.
+func summarize(ctx context.Context, client OllamaAPIClient, model, prompt string, messages []OllamaMessage) (string, error) {
+	var transcript strings.Builder
+	for _, msg := range messages {
+		fmt.Fprintf(&transcript, "%s: %s\n", msg.Role, msg.Content)
+	}
+	res, err := client.Chat(ctx, OllamaChatRequest{
+		Model: model,
+		Messages: []OllamaMessage{
+			{Role: "system", Content: prompt},
+			{Role: "user", Content: transcript.String()},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	summary := strings.TrimSpace(res.Message.Content)
+	if summary == "" {
+		return "", fmt.Errorf("empty summary")
+	}
+	return summary, nil
+}
+
+// splitSystem splits messages into the leading system messages and the
+// rest. The head is copied so callers can append to it.
+func splitSystem(messages []OllamaMessage) (head, history []OllamaMessage) {
+	n := 0
+	for n < len(messages) && messages[n].Role == "system" {
+		n++
+	}
+	return append([]OllamaMessage(nil), messages[:n]...), messages[n:]
+}
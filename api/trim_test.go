@@ -0,0 +1,123 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// conversation returns a system prompt followed by n alternating user and
+// assistant messages of about 30 tokens each.
+func conversation(n int) []OllamaMessage {
+	messages := []OllamaMessage{{Role: "system", Content: "You are a helpful phone assistant."}}
+	for i := 0; i < n; i++ {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		messages = append(messages, OllamaMessage{Role: role, Content: fmt.Sprintf("message %03d %s", i, strings.Repeat("word ", 15))})
+	}
+	return messages
+}
+
+func TestContextBudget(t *testing.T) {
+	tests := []struct {
+		name               string
+		numCtx, numPredict *int
+		want               int
+	}{
+		{"defaults", nil, nil, 1536},
+		{"num_ctx", intPtr(4096), nil, 3072},
+		{"num_predict reserve", intPtr(4096), intPtr(256), 3840},
+		{"num_predict too large", intPtr(1024), intPtr(2048), 768},
+	}
+	for _, tt := range tests {
+		if got := ContextBudget(tt.numCtx, tt.numPredict); got != tt.want {
+			t.Errorf("%s: ContextBudget() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDropOldestKeepsSystemPrompt(t *testing.T) {
+	messages := conversation(100)
+	for _, budget := range []int{50, 200, 1000} {
+		trimmed := DropOldest{}.Trim(context.Background(), messages, budget)
+		if trimmed[0].Content != messages[0].Content {
+			t.Errorf("budget %d: system prompt dropped", budget)
+		}
+		if last := trimmed[len(trimmed)-1]; last.Content != messages[len(messages)-1].Content {
+			t.Errorf("budget %d: latest message dropped", budget)
+		}
+		if used := messagesTokens(trimmed); used > budget && len(trimmed) > 2 {
+			t.Errorf("budget %d: %d tokens used", budget, used)
+		}
+		// What is kept is the most recent history, in order
+		kept := trimmed[1:]
+		if want := messages[len(messages)-len(kept):]; fmt.Sprint(kept) != fmt.Sprint(want) {
+			t.Errorf("budget %d: kept messages are not the most recent", budget)
+		}
+	}
+}
+
+func TestDropOldestKeepsFittingConversation(t *testing.T) {
+	messages := conversation(4)
+	if trimmed := (DropOldest{}).Trim(context.Background(), messages, 10000); len(trimmed) != len(messages) {
+		t.Errorf("%d of %d messages kept although all fit", len(trimmed), len(messages))
+	}
+}
+
+func TestDropOldestKeepsLatestOverBudget(t *testing.T) {
+	// A single message larger than the budget is still answered
+	messages := []OllamaMessage{
+		{Role: "system", Content: "prompt"},
+		{Role: "user", Content: strings.Repeat("long ", 500)},
+	}
+	trimmed := DropOldest{}.Trim(context.Background(), messages, 100)
+	if len(trimmed) != 2 {
+		t.Errorf("trimmed to %d messages, want the system prompt and the latest message", len(trimmed))
+	}
+}
+
+func TestSummarizeThenDrop(t *testing.T) {
+	var summarized []int
+	strategy := &SummarizeThenDrop{Summarize: func(ctx context.Context, messages []OllamaMessage) (string, error) {
+		summarized = append(summarized, len(messages))
+		return "the caller asked about opening hours", nil
+	}}
+
+	messages := conversation(60)
+	const budget = 600
+	trimmed := strategy.Trim(context.Background(), messages, budget)
+	if trimmed[0].Content != messages[0].Content {
+		t.Error("system prompt dropped")
+	}
+	if !strings.Contains(trimmed[1].Content, "opening hours") {
+		t.Errorf("second message = %q, want the summary", trimmed[1].Content)
+	}
+	if used := messagesTokens(trimmed); used > budget {
+		t.Errorf("%d tokens used, budget %d", used, budget)
+	}
+
+	// A longer conversation only summarizes the newly dropped messages,
+	// on top of the earlier summary
+	messages = append(messages, conversation(10)[1:]...)
+	strategy.Trim(context.Background(), messages, budget)
+	if len(summarized) != 2 || summarized[1] >= summarized[0] {
+		t.Errorf("summarized batches of %v messages, want a smaller second batch", summarized)
+	}
+}
+
+func TestSummarizeThenDropFallsBack(t *testing.T) {
+	strategy := &SummarizeThenDrop{Summarize: func(ctx context.Context, messages []OllamaMessage) (string, error) {
+		return "", fmt.Errorf("model unavailable")
+	}}
+	messages := conversation(60)
+	got := strategy.Trim(context.Background(), messages, 600)
+	want := DropOldest{}.Trim(context.Background(), messages, 600)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Error("failed summary did not fall back to dropping the oldest messages")
+	}
+}
+
+func intPtr(i int) *int { return &i }
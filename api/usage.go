@@ -0,0 +1,21 @@
+package api
+
+// TokenUsage counts LLM tokens, for a single turn or accumulated over a
+// chat.
+type TokenUsage struct {
+	PromptTokens   int `json:"prompt_tokens"`
+	ResponseTokens int `json:"response_tokens"`
+	Turns          int `json:"turns"`
+}
+
+// Add accumulates other into u.
+func (u *TokenUsage) Add(other TokenUsage) {
+	u.PromptTokens += other.PromptTokens
+	u.ResponseTokens += other.ResponseTokens
+	u.Turns += other.Turns
+}
+
+// Total returns the number of prompt and response tokens combined.
+func (u TokenUsage) Total() int {
+	return u.PromptTokens + u.ResponseTokens
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// cannedOllamaResponse is a non-streaming chat response as Ollama sends it.
+const cannedOllamaResponse = `{
+	"model": "llama3",
+	"created_at": "2024-05-01T10:00:00Z",
+	"message": {"role": "assistant", "content": "Hello!"},
+	"done": true,
+	"done_reason": "stop",
+	"total_duration": 5191566416,
+	"load_duration": 2154458,
+	"prompt_eval_count": 26,
+	"prompt_eval_duration": 383809000,
+	"eval_count": 298,
+	"eval_duration": 4799921000
+}`
+
+func TestUsageFromOllamaResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want TokenUsage
+	}{
+		{"with counts", cannedOllamaResponse, TokenUsage{PromptTokens: 26, ResponseTokens: 298, Turns: 1}},
+		{"without counts", `{"model":"llama3","message":{"role":"assistant","content":"Hi"},"done":true}`, TokenUsage{Turns: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			client := &HTTPollamaAPIClient{BaseURL: srv.URL, HTTPClient: srv.Client()}
+			response, err := client.Chat(context.Background(), OllamaChatRequest{Model: "llama3"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := response.Usage(); got != tt.want {
+				t.Errorf("Usage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenUsageAdd(t *testing.T) {
+	var total TokenUsage
+	total.Add(TokenUsage{PromptTokens: 26, ResponseTokens: 298, Turns: 1})
+	total.Add(TokenUsage{PromptTokens: 340, ResponseTokens: 12, Turns: 1})
+	if want := (TokenUsage{PromptTokens: 366, ResponseTokens: 310, Turns: 2}); total != want {
+		t.Errorf("total = %+v, want %+v", total, want)
+	}
+	if total.Total() != 676 {
+		t.Errorf("Total() = %d, want 676", total.Total())
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-ast-client/api"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// defaultARIPort is the port of Asterisk's HTTP server, which serves ARI.
+const defaultARIPort = 8088
+
+// ARIConfig configures outbound calls through the Asterisk REST Interface.
+type ARIConfig struct {
+	// URL is the ARI base URL, e.g. "http://asterisk:8088/ari". If empty it
+	// is derived from the chat's AsteriskHost.
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Endpoint is the channel to dial; "{number}" is replaced by the number
+	// being called, e.g. "PJSIP/{number}@trunk".
+	Endpoint string `json:"endpoint"`
+	// Context and Extension locate the dialplan that connects an answered
+	// call to our AudioSocket listener. It receives the call ID in the
+	// AUDIOSOCKET_UUID channel variable.
+	Context   string `json:"context"`
+	Extension string `json:"extension"`
+	// CallerID is used when the chat settings carry no AsteriskNumber.
+	CallerID string `json:"caller_id"`
+	// TimeoutSeconds is how long the callee may take to answer.
+	TimeoutSeconds int `json:"timeout_seconds"`
+}
+
+// ARIClient is a minimal client for the ARI endpoints the bridge uses.
+type ARIClient struct {
+	BaseURL    string
+	Username   string
+	Password   string
+	HTTPClient *http.Client
+}
+
+// OriginateRequest is the body of POST /channels.
+type OriginateRequest struct {
+	Endpoint  string            `json:"endpoint"`
+	Context   string            `json:"context,omitempty"`
+	Extension string            `json:"extension,omitempty"`
+	Priority  int               `json:"priority,omitempty"`
+	CallerID  string            `json:"callerId,omitempty"`
+	Timeout   int               `json:"timeout,omitempty"`
+	ChannelID string            `json:"channelId,omitempty"`
+	Variables map[string]string `json:"variables,omitempty"`
+}
+
+// ARIChannel is the part of an ARI channel object the bridge reads.
+type ARIChannel struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	State string `json:"state"`
+}
+
+// Originate asks Asterisk to place a call.
+func (c *ARIClient) Originate(ctx context.Context, request OriginateRequest) (*ARIChannel, error) {
+	var channel ARIChannel
+	if err := c.post(ctx, "/channels", request, &channel); err != nil {
+		return nil, fmt.Errorf("failed to originate call: %w", err)
+	}
+	return &channel, nil
+}
+
+// post sends body as JSON to path and decodes the response into result.
+func (c *ARIClient) post(ctx context.Context, path string, body, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(c.BaseURL, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(c.Username, c.Password)
+
+	client := c.HTTPClient
+	if client == nil {
+		client = httpClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("received status code %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	if result == nil || len(respBody) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, result)
+}
+
+// ariClientFor returns the ARI client for a chat, using the configured URL
+// or else the chat's Asterisk host.
+func ariClientFor(settings api.AsteriskSettings) (*ARIClient, error) {
+	baseURL := config.ARI.URL
+	if baseURL == "" {
+		if settings.AsteriskHost == "" {
+			return nil, fmt.Errorf("no ARI url configured and no asterisk_host in chat settings")
+		}
+		baseURL = fmt.Sprintf("http://%s:%d/ari", settings.AsteriskHost, defaultARIPort)
+	}
+	return &ARIClient{
+		BaseURL:  baseURL,
+		Username: config.ARI.Username,
+		Password: config.ARI.Password,
+	}, nil
+}
+
+// Originate places an outbound call to number. Once answered, the dialplan
+// connects the call to our AudioSocket listener with the returned ID and
+// it runs through Handle like an inbound call, using settings.
+func Originate(ctx context.Context, number string, settings api.Settings) (uuid.UUID, error) {
+	client, err := ariClientFor(settings.AsteriskSettings)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	callerID := settings.AsteriskSettings.AsteriskNumber
+	if callerID == "" {
+		callerID = config.ARI.CallerID
+	}
+	request := OriginateRequest{
+		Endpoint:  strings.ReplaceAll(config.ARI.Endpoint, "{number}", number),
+		Context:   config.ARI.Context,
+		Extension: config.ARI.Extension,
+		Priority:  1,
+		CallerID:  callerID,
+		Timeout:   config.ARI.TimeoutSeconds,
+		ChannelID: id.String(),
+		Variables: map[string]string{"AUDIOSOCKET_UUID": id.String()},
+	}
+
+	// Keep the settings until the answered call connects, or the callee
+	// could no longer answer
+	originated.Put(id.String(), settings, time.Duration(config.ARI.TimeoutSeconds)*time.Second+time.Minute)
+	if _, err := client.Originate(ctx, request); err != nil {
+		originated.Take(id.String())
+		return uuid.Nil, err
+	}
+	log.Printf("originated call %s to %s", id, number)
+	return id, nil
+}
+
+// originated holds the settings of originated calls that haven't
+// connected yet.
+var originated = newTTLMap[api.Settings]()
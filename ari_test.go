@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go-ast-client/api"
+)
+
+// ariRequest is a request received by fakeARI.
+type ariRequest struct {
+	Method, Path       string
+	Username, Password string
+	Body               map[string]interface{}
+}
+
+// fakeARI is an ARI server recording the requests it receives and
+// answering them with status.
+type fakeARI struct {
+	*httptest.Server
+	status int
+
+	mu       sync.Mutex
+	requests []ariRequest
+}
+
+func newFakeARI(t *testing.T) *fakeARI {
+	t.Helper()
+	ari := &fakeARI{status: http.StatusOK}
+	ari.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := ariRequest{Method: r.Method, Path: r.URL.Path}
+		request.Username, request.Password, _ = r.BasicAuth()
+		data, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &request.Body); err != nil {
+			t.Errorf("invalid ARI request body %q: %v", data, err)
+		}
+		ari.mu.Lock()
+		ari.requests = append(ari.requests, request)
+		ari.mu.Unlock()
+		w.WriteHeader(ari.status)
+		if ari.status == http.StatusOK {
+			w.Write([]byte(`{"id":"channel","name":"PJSIP/trunk-00000001","state":"Down"}`))
+		} else {
+			w.Write([]byte(`{"message":"Allocation failed"}`))
+		}
+	}))
+	t.Cleanup(ari.Close)
+	withConfig(t, func(c *Config) {
+		c.ARI.URL = ari.URL + "/ari"
+		c.ARI.Username = "bridge"
+		c.ARI.Password = "secret"
+	})
+	return ari
+}
+
+// Requests returns the requests received so far.
+func (ari *fakeARI) Requests() []ariRequest {
+	ari.mu.Lock()
+	defer ari.mu.Unlock()
+	return append([]ariRequest(nil), ari.requests...)
+}
+
+func TestOriginatePayload(t *testing.T) {
+	ari := newFakeARI(t)
+	withConfig(t, func(c *Config) {
+		c.ARI.Endpoint = "PJSIP/{number}@trunk"
+		c.ARI.Context = "audiosocket-outbound"
+		c.ARI.Extension = "s"
+		c.ARI.TimeoutSeconds = 30
+	})
+	s := testSettings(0.7)
+	s.AsteriskSettings.AsteriskNumber = "+15550100"
+
+	id, err := Originate(context.Background(), "+15550199", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := ari.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("%d ARI requests, want 1", len(requests))
+	}
+	request := requests[0]
+	if request.Method != http.MethodPost || request.Path != "/ari/channels" {
+		t.Errorf("request = %s %s, want POST /ari/channels", request.Method, request.Path)
+	}
+	if request.Username != "bridge" || request.Password != "secret" {
+		t.Errorf("credentials = %q:%q", request.Username, request.Password)
+	}
+	want := map[string]interface{}{
+		"endpoint":  "PJSIP/+15550199@trunk",
+		"context":   "audiosocket-outbound",
+		"extension": "s",
+		"priority":  1.0,
+		"callerId":  "+15550100",
+		"timeout":   30.0,
+		"channelId": id.String(),
+		"variables": map[string]interface{}{"AUDIOSOCKET_UUID": id.String()},
+	}
+	if got, _ := json.Marshal(request.Body); string(got) != mustJSON(t, want) {
+		t.Errorf("originate payload = %s, want %s", got, mustJSON(t, want))
+	}
+
+	// The call picks up its settings once it connects
+	if got, ok := originated.Take(id.String()); !ok || got.AsteriskSettings.AsteriskNumber != "+15550100" {
+		t.Errorf("settings of the originated call = %+v, %v", got, ok)
+	}
+}
+
+func TestOriginateDefaultCallerID(t *testing.T) {
+	ari := newFakeARI(t)
+	withConfig(t, func(c *Config) { c.ARI.CallerID = "+15550000" })
+	id, err := Originate(context.Background(), "100", testSettings(0.7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	originated.Take(id.String())
+	if got := ari.Requests()[0].Body["callerId"]; got != "+15550000" {
+		t.Errorf("callerId = %v, want the configured one", got)
+	}
+}
+
+func TestOriginateFailure(t *testing.T) {
+	ari := newFakeARI(t)
+	ari.status = http.StatusInternalServerError
+	if _, err := Originate(context.Background(), "100", testSettings(0.7)); err == nil {
+		t.Fatal("Originate() succeeded on a server error")
+	}
+	requests := ari.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("%d ARI requests, want 1", len(requests))
+	}
+	if _, ok := originated.Get(requests[0].Body["channelId"].(string)); ok {
+		t.Error("settings of the failed call kept")
+	}
+}
+
+func TestARIClientFor(t *testing.T) {
+	withConfig(t, func(c *Config) { c.ARI.URL = "" })
+	client, err := ariClientFor(api.AsteriskSettings{AsteriskHost: "pbx.local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.BaseURL != "http://pbx.local:8088/ari" {
+		t.Errorf("BaseURL = %q, want one derived from the Asterisk host", client.BaseURL)
+	}
+	if _, err := ariClientFor(api.AsteriskSettings{}); err == nil {
+		t.Error("client without any ARI address")
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
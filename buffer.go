@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sync"
+)
+
+// AudioBufferConfig bounds the memory used to collect a single utterance.
+type AudioBufferConfig struct {
+	// MaxBytes caps the in-memory size of an utterance. Zero disables the cap.
+	MaxBytes int `json:"max_bytes"`
+	// SpillToDisk moves audio to a temporary file when the cap is reached.
+	// Otherwise the utterance is flushed for processing early.
+	SpillToDisk bool `json:"spill_to_disk"`
+	// SpillDir is where spill files are created; empty uses os.TempDir.
+	SpillDir string `json:"spill_dir"`
+	// MaxUtteranceMs caps the length of an utterance, in memory or spilled,
+	// so continuous speech or a VAD stuck on noise can't grow it forever.
+	// Zero disables the cap.
+	MaxUtteranceMs int `json:"max_utterance_ms"`
+	// DropOverlong discards an utterance reaching MaxUtteranceMs instead
+	// of processing it.
+	DropOverlong bool `json:"drop_overlong"`
+}
+
+// UtteranceBuffer collects the float32 frames of an utterance while keeping
+// track of how much memory they use. It is safe for concurrent use.
+type UtteranceBuffer struct {
+	mu         sync.Mutex
+	config     AudioBufferConfig
+	maxSamples int
+	frames     [][]float32
+	bytes      int
+	spill      *os.File
+	spilled    int
+}
+
+// NewUtteranceBuffer creates an empty buffer for audio at sampleRate,
+// bounded by config.
+func NewUtteranceBuffer(config AudioBufferConfig, sampleRate int) *UtteranceBuffer {
+	return &UtteranceBuffer{
+		config:     config,
+		maxSamples: sampleRate * config.MaxUtteranceMs / 1000,
+	}
+}
+
+// Append adds frame to the buffer. It returns true when the memory cap or
+// the length cap has been reached and the caller should flush the buffer;
+// Overlong tells the two apart.
+func (b *UtteranceBuffer) Append(frame []float32) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.frames = append(b.frames, frame)
+	b.bytes += len(frame) * 4
+	if b.overlong() {
+		return true
+	}
+	if b.config.MaxBytes <= 0 || b.bytes < b.config.MaxBytes {
+		return false
+	}
+	if !b.config.SpillToDisk {
+		return true
+	}
+	if err := b.spillFrames(); err != nil {
+		log.Println("failed to spill audio buffer, flushing instead:", err)
+		return true
+	}
+	return false
+}
+
+// spillFrames moves the in-memory frames to the spill file.
+func (b *UtteranceBuffer) spillFrames() error {
+	if b.spill == nil {
+		f, err := ioutil.TempFile(b.config.SpillDir, "utterance-*.f32")
+		if err != nil {
+			return err
+		}
+		b.spill = f
+	}
+
+	w := bufio.NewWriter(b.spill)
+	var sample [4]byte
+	for _, frame := range b.frames {
+		for _, f := range frame {
+			binary.LittleEndian.PutUint32(sample[:], math.Float32bits(f))
+			if _, err := w.Write(sample[:]); err != nil {
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	b.spilled += b.bytes
+	b.frames = nil
+	b.bytes = 0
+	return nil
+}
+
+// Frames returns the buffered frames, including any spilled to disk.
+func (b *UtteranceBuffer) Frames() ([][]float32, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.spill == nil {
+		return append([][]float32(nil), b.frames...), nil
+	}
+
+	data, err := ioutil.ReadFile(b.spill.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spilled audio: %v", err)
+	}
+	spilled := make([]float32, len(data)/4)
+	for i := range spilled {
+		spilled[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[i*4:]))
+	}
+	return append([][]float32{spilled}, b.frames...), nil
+}
+
+// Overlong reports whether the buffer has reached MaxUtteranceMs.
+func (b *UtteranceBuffer) Overlong() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.overlong()
+}
+
+func (b *UtteranceBuffer) overlong() bool {
+	return b.maxSamples > 0 && (b.bytes+b.spilled)/4 >= b.maxSamples
+}
+
+// Len returns the number of buffered samples.
+func (b *UtteranceBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return (b.bytes + b.spilled) / 4
+}
+
+// Bytes returns the memory held by in-memory frames.
+func (b *UtteranceBuffer) Bytes() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.bytes
+}
+
+// Reset empties the buffer and removes any spill file.
+func (b *UtteranceBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.frames = nil
+	b.bytes = 0
+	b.spilled = 0
+	if b.spill != nil {
+		b.spill.Close()
+		os.Remove(b.spill.Name())
+		b.spill = nil
+	}
+}
+
+// frameRing keeps the most recent frames, up to a fixed count.
+type frameRing struct {
+	size   int
+	frames [][]float32
+}
+
+func newFrameRing(size int) *frameRing {
+	return &frameRing{size: size}
+}
+
+// Push adds frame, dropping the oldest frame when the ring is full.
+func (r *frameRing) Push(frame []float32) {
+	if r.size <= 0 {
+		return
+	}
+	r.frames = append(r.frames, frame)
+	if len(r.frames) > r.size {
+		r.frames = append(r.frames[:0], r.frames[1:]...)
+	}
+}
+
+// Drain returns the buffered frames, oldest first, and empties the ring.
+func (r *frameRing) Drain() [][]float32 {
+	frames := r.frames
+	r.frames = nil
+	return frames
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// noiseFrames returns a source of 20 ms frames of white noise at 16 kHz.
+func noiseFrames(seed int64) func() []float32 {
+	rng := rand.New(rand.NewSource(seed))
+	return func() []float32 {
+		frame := make([]float32, 320)
+		for i := range frame {
+			frame[i] = rng.Float32()*2 - 1
+		}
+		return frame
+	}
+}
+
+func TestUtteranceBufferFlushesAtCap(t *testing.T) {
+	const maxBytes = 64 * 1024
+	b := NewUtteranceBuffer(AudioBufferConfig{MaxBytes: maxBytes}, 16000)
+	next := noiseFrames(1)
+
+	// Ten minutes of noise a VAD might never end
+	flushes := 0
+	for i := 0; i < 30000; i++ {
+		if b.Append(next()) {
+			flushes++
+			b.Reset()
+		}
+		if got := b.Bytes(); got >= maxBytes {
+			t.Fatalf("buffer holds %d bytes after frame %d, cap is %d", got, i, maxBytes)
+		}
+	}
+	if flushes == 0 {
+		t.Error("buffer never asked for a flush")
+	}
+}
+
+func TestUtteranceBufferSpillsToDisk(t *testing.T) {
+	const maxBytes = 16 * 1024
+	dir := t.TempDir()
+	b := NewUtteranceBuffer(AudioBufferConfig{MaxBytes: maxBytes, SpillToDisk: true, SpillDir: dir}, 16000)
+	next := noiseFrames(2)
+
+	var want []float32
+	for i := 0; i < 500; i++ {
+		frame := next()
+		want = append(want, frame...)
+		if b.Append(frame) {
+			t.Fatalf("flush requested at frame %d although spilling is on", i)
+		}
+		if got := b.Bytes(); got >= maxBytes {
+			t.Fatalf("buffer holds %d bytes in memory after frame %d, cap is %d", got, i, maxBytes)
+		}
+	}
+	if got := b.Len(); got != len(want) {
+		t.Fatalf("Len() = %d, want %d", got, len(want))
+	}
+
+	frames, err := b.Frames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []float32
+	for _, frame := range frames {
+		got = append(got, frame...)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("read back %d samples, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("sample %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	b.Reset()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d spill files left after Reset", len(files))
+	}
+}
+
+func TestUtteranceBufferOverlong(t *testing.T) {
+	dir := t.TempDir()
+	b := NewUtteranceBuffer(AudioBufferConfig{MaxBytes: 4096, SpillToDisk: true, SpillDir: dir, MaxUtteranceMs: 1000}, 16000)
+	next := noiseFrames(3)
+
+	// 50 frames of 20 ms make the second
+	for i := 1; i <= 50; i++ {
+		full := b.Append(next())
+		if full != (i == 50) {
+			t.Fatalf("Append of frame %d returned %v", i, full)
+		}
+	}
+	if !b.Overlong() {
+		t.Error("buffer of a second not overlong")
+	}
+	b.Reset()
+	if b.Overlong() || b.Len() != 0 {
+		t.Error("Reset kept audio")
+	}
+}
+
+func TestFrameRing(t *testing.T) {
+	r := newFrameRing(3)
+	for i := 1; i <= 5; i++ {
+		r.Push([]float32{float32(i)})
+	}
+	frames := r.Drain()
+	if len(frames) != 3 || frames[0][0] != 3 || frames[2][0] != 5 {
+		t.Errorf("Drain() = %v, want the last three frames oldest first", frames)
+	}
+	if frames := r.Drain(); len(frames) != 0 {
+		t.Errorf("second Drain() = %v, want nothing", frames)
+	}
+
+	off := newFrameRing(0)
+	off.Push([]float32{1})
+	if frames := off.Drain(); len(frames) != 0 {
+		t.Errorf("ring of size 0 kept %v", frames)
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"go-ast-client/api"
+	"go-ast-client/settings"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// retainedChats keeps the ChatStores of ended calls for reuse when the
+// call reconnects, see Config.KeepHistory.
+var retainedChats = newTTLMap[*api.ChatStore]()
+
+// Call holds the state of a single AudioSocket call.
+type Call struct {
+	ID          string
+	Stream      MessageStream
+	RemoteAddr  string
+	Started     time.Time
+	ChatStore   *api.ChatStore
+	Interrupter *Interrupter
+	Echo        *EchoGate
+	// AEC is nil unless echo cancellation is enabled.
+	AEC         *EchoCanceller
+	Transcriber Transcriber
+	// Streamer is set when transcription streams while the caller speaks.
+	Streamer StreamTranscriber
+	Filter   ContentFilter
+
+	turns *utteranceProcessor
+
+	cancel        context.CancelFunc
+	done          chan struct{}
+	doneOnce      sync.Once
+	mu            sync.Mutex
+	writeFailures int
+	inRecording   *WAVRecorder
+	outRecording  *WAVRecorder
+	language      string
+	paused        bool
+	heardCount    int
+	lastActivity  time.Time
+	lastHeard     string
+	usage         api.TokenUsage
+	filler        *Filler
+	playedUntil   time.Time
+	state         string
+	rate          int
+	channelID     string
+	failures      int
+	transferTo    string
+	leg           api.CallLeg
+	finalizeOnce  sync.Once
+
+	// Settings refreshing, see refreshSettings. metadata holds the
+	// overrides applied so far, to apply again to refreshed settings.
+	refreshable     bool
+	settingsFetched time.Time
+	metadata        []CallMetadata
+}
+
+// NewCall creates the state for a call identified by id on stream. cancel
+// tears down the call's context.
+func NewCall(id string, stream MessageStream, cancel context.CancelFunc) *Call {
+	remoteAddr := streamRemoteAddr(stream)
+	return &Call{
+		ID:          id,
+		Stream:      stream,
+		RemoteAddr:  remoteAddr,
+		Started:     clock.Now(),
+		Interrupter: NewInterrupter(config.BargeIn, config.PlaybackPolicy),
+		Echo:        NewEchoGate(config.Echo, config.InputSampleRate),
+		AEC:         newEchoCanceller(config.AEC, config.InputSampleRate),
+		Filter:      newContentFilter(config.ContentFilter),
+		language:    config.Language,
+		leg:         api.CallLeg{RemoteAddr: remoteAddr},
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+}
+
+// SetChatStore attaches the loaded chat to the call and sets up everything
+// that depends on its settings.
+func (c *Call) SetChatStore(chatStore *api.ChatStore) {
+	c.ChatStore = chatStore
+	chatStore.SetCallLeg(c.Leg())
+	if tools.Len() > 0 {
+		chatStore.Tools = tools
+		chatStore.MaxToolCalls = config.Tools.MaxCalls
+	}
+	chatStore.FallbackModels = config.LLMFallbackModels
+	c.Transcriber = transcriberFor(chatStore.Settings().AsteriskSettings)
+	if t, ok := c.Transcriber.(*HTTPTranscriber); ok {
+		t.CallID = c.ID
+	}
+	if model := chatStore.Settings().LLMSettings.Model; config.ContextTrim == contextTrimSummarize && model != nil && chatStore.Trim == nil {
+		chatStore.Trim = &api.SummarizeThenDrop{Summarize: api.OllamaSummarizer(ollamaAPI, *model)}
+	}
+	if config.STTStreaming {
+		c.Streamer = streamerFor(c.Transcriber)
+	}
+}
+
+// sttSettings returns the STT settings used for the call's utterances.
+// With language detection on, the STT service picks the language itself.
+func (c *Call) sttSettings() settings.STTSettings {
+	current := c.ChatStore.Settings()
+	sttSettings := current.STTSettings
+	if current.AsteriskSettings.AsteriskDetectLanguage {
+		sttSettings.Language = nil
+	} else {
+		sttSettings.Language = ptr(c.Language())
+	}
+	return sttSettings
+}
+
+// Language returns the language the assistant speaks on the call.
+func (c *Call) Language() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.language
+}
+
+// DetectLanguage switches the call to the language text is written in.
+// Detections below the configured confidence fall back to the default
+// language.
+func (c *Call) DetectLanguage(text string) {
+	language, confidence := languageDetector.Detect(text)
+	if confidence < config.LanguageMinConfidence {
+		language = config.Language
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if language != c.language {
+		log.Printf("call %s: switching language to %s (confidence %.2f)", c.ID, language, confidence)
+		c.language = language
+	}
+}
+
+// Hangup asks Asterisk to hang up the call and cancels it. The hangup is
+// sent first, as Handle closes the stream once the call is canceled. It
+// doesn't wait for Handle to return; use Done for that.
+func (c *Call) Hangup() {
+	if err := c.Stream.WriteHangup(); err != nil {
+		log.Printf("call %s: failed to send hangup: %v", c.ID, err)
+	}
+	c.cancel()
+}
+
+// heard records a transcription of what the caller said.
+func (c *Call) heard(transcription string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.heardCount++
+	c.lastHeard = transcription
+	c.lastActivity = clock.Now()
+}
+
+// Activity returns how many utterances were transcribed on the call, the
+// time of the latest and its text.
+func (c *Call) Activity() (turns int, last time.Time, transcription string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.heardCount, c.lastActivity, c.lastHeard
+}
+
+// Pause stops the assistant from responding, cutting off any reply being
+// played. The caller is still listened to and transcribed.
+func (c *Call) Pause() {
+	c.mu.Lock()
+	c.paused = true
+	c.mu.Unlock()
+	c.Interrupter.Stop()
+	c.stopFiller()
+}
+
+// Resume lets a paused assistant respond again.
+func (c *Call) Resume() {
+	c.mu.Lock()
+	c.paused = false
+	c.mu.Unlock()
+}
+
+// Paused reports whether the assistant is paused.
+func (c *Call) Paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
+
+// setState records what the assistant is doing, emitting a state_changed
+// event if it changed and state events are enabled.
+func (c *Call) setState(state string) {
+	c.mu.Lock()
+	changed := c.state != state
+	c.state = state
+	c.mu.Unlock()
+	if changed && config.Webhook.StateEvents {
+		webhooks.Emit(eventStateChanged, c.ID, map[string]interface{}{"state": state})
+	}
+}
+
+// startSpeaking is called as a reply starts playing.
+func (c *Call) startSpeaking() {
+	c.stopFiller()
+	c.setState(stateSpeaking)
+}
+
+// Done is closed once Handle has finished with the call.
+func (c *Call) Done() <-chan struct{} {
+	return c.done
+}
+
+// finish closes Done.
+func (c *Call) finish() {
+	c.doneOnce.Do(func() { close(c.done) })
+}
+
+// played records SLIN audio written to the caller.
+func (c *Call) played(pcm []byte) {
+	c.Echo.Played(pcm)
+	c.AEC.Reference(pcm)
+	c.outRecording.Write(pcm)
+
+	// Frames may be written faster than they play, so track when the
+	// caller will have heard them all
+	duration := time.Duration(len(pcm)/2) * time.Second / time.Duration(c.sampleRate())
+	c.mu.Lock()
+	if now := clock.Now(); c.playedUntil.Before(now) {
+		c.playedUntil = now
+	}
+	c.playedUntil = c.playedUntil.Add(duration)
+	c.mu.Unlock()
+}
+
+// halfDuplexMuted reports whether inbound audio is ignored because the
+// assistant is speaking or just stopped, in half-duplex mode.
+func (c *Call) halfDuplexMuted() bool {
+	if !config.HalfDuplex.Enabled {
+		return false
+	}
+	if c.Interrupter.Playing() {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	guard := time.Duration(config.HalfDuplex.GuardMs) * time.Millisecond
+	return clock.Now().Before(c.playedUntil.Add(guard))
+}
+
+// stopRecording finalizes the call's recordings.
+func (c *Call) stopRecording() {
+	for _, r := range []*WAVRecorder{c.inRecording, c.outRecording} {
+		if err := r.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// setSampleRate adapts the parts of the call that depend on the rate of its
+// audio once it has been negotiated.
+func (c *Call) setSampleRate(rate int) {
+	c.mu.Lock()
+	c.rate = rate
+	c.mu.Unlock()
+	c.Echo.SetSampleRate(rate)
+	c.AEC.SetSampleRate(rate)
+	c.inRecording.SetSampleRate(rate)
+	c.outRecording.SetSampleRate(rate)
+}
+
+// sampleRate returns the rate of the call's audio, or the configured
+// input rate until it has been negotiated.
+func (c *Call) sampleRate() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rate == 0 {
+		return config.InputSampleRate
+	}
+	return c.rate
+}
+
+// ChannelID returns the ID of the call's Asterisk channel, or "" while it
+// is unknown. The AudioSocket UUID is no channel ID: originated calls are
+// given one equal to it, inbound calls report theirs in metadata.
+func (c *Call) ChannelID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.channelID
+}
+
+// setChannelID records the ID of the call's Asterisk channel.
+func (c *Call) setChannelID(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.channelID = id
+}
+
+// requestTransfer has the call transferred to endpoint after the reply of
+// the current turn.
+func (c *Call) requestTransfer(endpoint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.transferTo = endpoint
+}
+
+// takeTransfer returns and clears the endpoint of a requested transfer.
+func (c *Call) takeTransfer() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	endpoint := c.transferTo
+	c.transferTo = ""
+	return endpoint
+}
+
+// recordFailure counts a failed turn and returns how many failed in a row.
+func (c *Call) recordFailure() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures++
+	return c.failures
+}
+
+// recordSuccess resets the count of failed turns once a reply was played.
+func (c *Call) recordSuccess() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures = 0
+}
+
+// frameBytes returns the size of the SLIN frames written to the call.
+func (c *Call) frameBytes() int {
+	return frameBytes(c.sampleRate(), config.AudioFrameMs)
+}
+
+// summarize asks the LLM for a summary of the call, bounded by its own
+// timeout. Failures are logged and yield no summary.
+func (c *Call) summarize() string {
+	timeout := time.Duration(config.CallSummary.TimeoutSeconds) * time.Second
+	ctx, cancel := withTimeout(context.Background(), timeout)
+	defer cancel()
+	summary, err := c.ChatStore.Summarize(ctx, config.CallSummary.Prompt)
+	if err != nil {
+		log.Printf("call %s: failed to summarize: %v", c.ID, err)
+		return ""
+	}
+	log.Printf("call %s: summary: %s", c.ID, api.Redact(summary))
+	return summary
+}
+
+// startFiller starts the thinking filler, replacing any filler still
+// playing. Like the reply it precedes, it outlives the turn and plays until
+// stopFiller is called.
+func (c *Call) startFiller() {
+	filler := startFiller(context.Background(), c)
+	c.mu.Lock()
+	previous := c.filler
+	c.filler = filler
+	c.mu.Unlock()
+	previous.Stop()
+}
+
+// stopFiller stops the thinking filler, if one is playing, and returns
+// once it is silent.
+func (c *Call) stopFiller() {
+	c.mu.Lock()
+	filler := c.filler
+	c.filler = nil
+	c.mu.Unlock()
+	filler.Stop()
+}
+
+// writeFailed records a failed write of outbound audio. Unless disabled in
+// the config, the call is treated as hung up and its context is canceled.
+func (c *Call) writeFailed(err error) {
+	c.mu.Lock()
+	c.writeFailures++
+	failures := c.writeFailures
+	c.mu.Unlock()
+
+	log.Printf("call %s: audio write failed (%d so far): %v", c.ID, failures, err)
+	if config.HangupOnWriteError {
+		c.cancel()
+	}
+}
+
+// WriteFailures returns how many outbound audio writes failed on the call.
+func (c *Call) WriteFailures() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeFailures
+}
+
+// RecordUsage adds the token usage reported in res to the call's totals.
+func (c *Call) RecordUsage(res *api.OllamaChatResponse) {
+	usage := res.Usage()
+	c.mu.Lock()
+	c.usage.Add(usage)
+	c.mu.Unlock()
+
+	log.Printf("call %s: llm usage prompt_tokens=%d response_tokens=%d prompt_eval_ms=%d eval_ms=%d total_ms=%d",
+		c.ID, usage.PromptTokens, usage.ResponseTokens,
+		time.Duration(res.PromptEvalDuration).Milliseconds(),
+		time.Duration(res.EvalDuration).Milliseconds(),
+		time.Duration(res.TotalDuration).Milliseconds())
+}
+
+// Usage returns the token usage accumulated over the call.
+func (c *Call) Usage() api.TokenUsage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.usage
+}
+
+// Finalize flushes messages that haven't reached the chat backend and marks
+// the chat as ended. It runs at most once per call.
+func (c *Call) Finalize() {
+	c.finalizeOnce.Do(func() {
+		if c.ChatStore == nil {
+			return
+		}
+		usage := c.Usage()
+		log.Printf("call %s: total llm usage prompt_tokens=%d response_tokens=%d turns=%d",
+			c.ID, usage.PromptTokens, usage.ResponseTokens, usage.Turns)
+		if err := c.ChatStore.Flush(); err != nil {
+			log.Println("failed to flush messages:", err)
+		}
+		updates := map[string]interface{}{"endTime": clock.Now()}
+		if config.CallSummary.Enabled {
+			if summary := c.summarize(); summary != "" {
+				updates[config.CallSummary.Field] = summary
+			}
+		}
+		if _, err := c.ChatStore.ChatAPI.UpdateChat(c.ID, updates); err != nil {
+			log.Println("failed to finalize chat:", err)
+		}
+		if config.KeepHistory {
+			retainedChats.Put(c.ID, c.ChatStore, time.Duration(config.KeepHistorySeconds)*time.Second)
+		}
+	})
+}
+
+// refreshSettings re-fetches the chat's settings if they are older than
+// Config.SettingsRefreshSeconds and applies them, with the call's
+// metadata overrides, to the following turns. It runs before a turn, so a
+// turn never sees settings change halfway. A failed fetch keeps the
+// current settings, as does a kind of settings that fails to load.
+func (c *Call) refreshSettings() {
+	if !c.refreshable || config.SettingsRefreshSeconds <= 0 {
+		return
+	}
+	if since(c.settingsFetched) < time.Duration(config.SettingsRefreshSeconds)*time.Second {
+		return
+	}
+	c.settingsFetched = clock.Now()
+
+	chat, err := chatBackend.GetChat(c.ID)
+	if err != nil {
+		log.Printf("call %s: failed to refresh settings, keeping the current ones: %v", c.ID, err)
+		return
+	}
+	fetched := chat.Settings
+	completeSettings(API, c.ID, &fetched)
+	c.ChatStore.UpdateSettings(func(current api.Settings) api.Settings {
+		s := fetched
+		keepMissingSettings(&s, current)
+		applyDefaultSettings(&s)
+		c.mu.Lock()
+		for _, md := range c.metadata {
+			s = mergeMetadata(s, md)
+		}
+		c.mu.Unlock()
+		clampSettings(c.ID, &s)
+		if !reflect.DeepEqual(s, current) {
+			log.Printf("call %s: settings changed in the backend, applying them", c.ID)
+		}
+		return s
+	})
+}
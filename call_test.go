@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CyCoreSystems/audiosocket"
+
+	"go-ast-client/api"
+	"go-ast-client/settings"
+)
+
+// fakeOllama answers chat requests with reply, or "ok" if reply is nil.
+type fakeOllama struct {
+	mu       sync.Mutex
+	requests []api.OllamaChatRequest
+	reply    func(ctx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error)
+}
+
+func (f *fakeOllama) Chat(ctx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error) {
+	f.mu.Lock()
+	f.requests = append(f.requests, request)
+	f.mu.Unlock()
+	if f.reply != nil {
+		return f.reply(ctx, request)
+	}
+	return api.OllamaChatResponse{Message: api.OllamaResponseMessage{Role: "assistant", Content: "ok"}, Done: true}, nil
+}
+
+// Requests returns the requests received so far.
+func (f *fakeOllama) Requests() []api.OllamaChatRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]api.OllamaChatRequest(nil), f.requests...)
+}
+
+// withConfig changes the global config for the test, restoring it after.
+func withConfig(t *testing.T, change func(c *Config)) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+	change(&config)
+}
+
+// withClock replaces the global clock for the test, restoring it after.
+func withClock(t *testing.T, c Clock) {
+	t.Helper()
+	saved := clock
+	t.Cleanup(func() { clock = saved })
+	clock = c
+}
+
+// withChatBackend replaces the chat backend for the test, restoring it
+// after.
+func withChatBackend(t *testing.T, chats api.ChatAPI) {
+	t.Helper()
+	saved := chatBackend
+	t.Cleanup(func() { chatBackend = saved })
+	chatBackend = chats
+}
+
+func float64Ptr(f float64) *float64 { return &f }
+
+// testSettings returns settings with every kind filled in, so nothing is
+// fetched from the settings endpoints.
+func testSettings(temperature float64) api.Settings {
+	return api.Settings{
+		STTSettings: settings.STTSettings{Model: ptr("stt")},
+		LLMSettings: settings.LLMSettings{Model: ptr("model"), Temperature: float64Ptr(temperature)},
+		TTSSettings: api.TTSSettings{Voice: "voice"},
+	}
+}
+
+// newTestChat starts an in-memory chat with s and loads it into a store
+// answering through ollama.
+func newTestChat(t *testing.T, chatID string, s api.Settings, ollama api.OllamaAPIClient) (*api.MemoryChatAPI, *api.ChatStore) {
+	t.Helper()
+	chats := api.NewMemoryChatAPI()
+	if _, err := chats.StartChat(chatID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chats.UpdateChat(chatID, map[string]interface{}{"settings": s}); err != nil {
+		t.Fatal(err)
+	}
+	store, err := api.LoadChatStore(chatID, chats, ollama)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chats, store
+}
+
+func TestRefreshSettingsAppliesBackendChanges(t *testing.T) {
+	withConfig(t, func(c *Config) { c.SettingsRefreshSeconds = 30 })
+	fake := NewFakeClock(time.Unix(0, 0))
+	withClock(t, fake)
+	ollama := &fakeOllama{}
+	chats, store := newTestChat(t, "call", testSettings(0.7), ollama)
+	withChatBackend(t, chats)
+
+	call := NewCall("call", NewScriptedStream(), func() {})
+	call.ChatStore = store
+	call.refreshable = true
+	call.settingsFetched = clock.Now()
+
+	turn := func() interface{} {
+		t.Helper()
+		call.refreshSettings()
+		if _, err := store.SendMessage(context.Background(), "hello"); err != nil {
+			t.Fatal(err)
+		}
+		requests := ollama.Requests()
+		return requests[len(requests)-1].Options["temperature"]
+	}
+
+	if got := turn(); got != 0.7 {
+		t.Fatalf("first turn temperature = %v, want 0.7", got)
+	}
+	if _, err := chats.UpdateChat("call", map[string]interface{}{"settings": testSettings(0.2)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := turn(); got != 0.7 {
+		t.Errorf("temperature before the refresh interval = %v, want 0.7", got)
+	}
+	fake.Advance(31 * time.Second)
+	if got := turn(); got != 0.2 {
+		t.Errorf("temperature after the refresh = %v, want 0.2", got)
+	}
+}
+
+func TestRefreshSettingsKeepsMetadataOverrides(t *testing.T) {
+	withConfig(t, func(c *Config) { c.SettingsRefreshSeconds = 1 })
+	fake := NewFakeClock(time.Unix(0, 0))
+	withClock(t, fake)
+	chats, store := newTestChat(t, "call", testSettings(0.7), &fakeOllama{})
+	withChatBackend(t, chats)
+
+	call := NewCall("call", NewScriptedStream(), func() {})
+	call.ChatStore = store
+	call.refreshable = true
+	call.settingsFetched = clock.Now()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		call.applyMetadata([]byte(`{"model": "override"}`))
+	}()
+	go func() {
+		defer wg.Done()
+		fake.Advance(2 * time.Second)
+		call.refreshSettings()
+	}()
+	wg.Wait()
+
+	if got := store.Settings().LLMSettings.Model; got == nil || *got != "override" {
+		t.Errorf("model = %v, want the metadata override", got)
+	}
+}
+
+func TestCallRecordsUsage(t *testing.T) {
+	call := NewCall("call", NewScriptedStream(), func() {})
+	call.RecordUsage(&api.OllamaChatResponse{PromptEvalCount: 26, EvalCount: 298})
+	// A backend that doesn't report counts still counts the turn
+	call.RecordUsage(&api.OllamaChatResponse{})
+	call.RecordUsage(&api.OllamaChatResponse{PromptEvalCount: 340, EvalCount: 12})
+
+	if want := (api.TokenUsage{PromptTokens: 366, ResponseTokens: 310, Turns: 3}); call.Usage() != want {
+		t.Errorf("Usage() = %+v, want %+v", call.Usage(), want)
+	}
+}
+
+func TestHalfDuplexMutedDuringPlayback(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.HalfDuplex = HalfDuplexConfig{Enabled: true, GuardMs: 200}
+		c.InputSampleRate = 8000
+	})
+	fake := NewFakeClock(time.Unix(0, 0))
+	withClock(t, fake)
+	call := NewCall("call", NewScriptedStream(), func() {})
+	if call.halfDuplexMuted() {
+		t.Fatal("muted before anything played")
+	}
+
+	_, _, finish := call.Interrupter.StartPlayback(context.Background())
+	if !call.halfDuplexMuted() {
+		t.Error("not muted during playback")
+	}
+	// 20 ms of audio written at once is heard until then
+	call.played(make([]byte, 320))
+	finish()
+	fake.Advance(219 * time.Millisecond)
+	if !call.halfDuplexMuted() {
+		t.Error("not muted during the guard interval")
+	}
+	fake.Advance(2 * time.Millisecond)
+	if call.halfDuplexMuted() {
+		t.Error("still muted after the guard interval")
+	}
+}
+
+func TestHalfDuplexDisabled(t *testing.T) {
+	withConfig(t, func(c *Config) { c.HalfDuplex.Enabled = false })
+	call := NewCall("call", NewScriptedStream(), func() {})
+	_, _, finish := call.Interrupter.StartPlayback(context.Background())
+	defer finish()
+	if call.halfDuplexMuted() {
+		t.Error("muted during playback with half-duplex disabled")
+	}
+}
+
+func TestHalfDuplexDropsFramesDuringPlayback(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.VAD.Backend = vadEnergy
+		c.BargeIn.VAD = false
+		c.HalfDuplex = HalfDuplexConfig{Enabled: true}
+		c.Unavailable.Message = ""
+		c.Unavailable.MaxFailures = 0
+	})
+	stt := newSTTServer(t, "hello")
+	s := testSettings(0.7)
+	s.AsteriskSettings.AsteriskSegment = "test"
+	id, _ := newTestCallChat(t, s)
+	withOllama(t, &fakeOllama{reply: func(ctx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error) {
+		return api.OllamaChatResponse{}, errors.New("model offline")
+	}})
+
+	stream := newTestStream(audiosocket.IDMessage(id))
+	stream.hold = true
+	stream.more = make(chan audiosocket.Message)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(context.Background(), stream)
+	}()
+	defer func() {
+		stream.Close()
+		<-done
+	}()
+	call := waitForCall(t, id.String(), stream)
+	say := func() {
+		for _, m := range utteranceFrames() {
+			stream.more <- m
+		}
+	}
+
+	// The assistant's own voice leaking back in isn't transcribed
+	_, _, finish := call.Interrupter.StartPlayback(context.Background())
+	say()
+	select {
+	case <-stt.uploads:
+		t.Error("audio heard during playback transcribed")
+	case <-time.After(200 * time.Millisecond):
+	}
+	finish()
+
+	say()
+	stt.Upload(t)
+}
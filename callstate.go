@@ -0,0 +1,125 @@
+package main
+
+import (
+	"go-ast-client/api"
+	"log"
+	"time"
+)
+
+// CallState is what a call checkpoints after each turn, so a call that
+// reconnects with the same ID, e.g. after the bridge crashed, resumes
+// where it left off.
+type CallState struct {
+	Messages []api.Message  `json:"messages"`
+	Settings api.Settings   `json:"settings"`
+	Language string         `json:"language"`
+	Usage    api.TokenUsage `json:"usage"`
+	Saved    time.Time      `json:"saved"`
+}
+
+// CallStateStore persists CallStates by call ID. Implementations must be
+// safe for concurrent use. A store shared between bridge instances, e.g.
+// backed by Redis, lets calls resume on another instance.
+type CallStateStore interface {
+	Save(callID string, state CallState) error
+	// Load returns the state saved for callID, or nil if there is none.
+	Load(callID string) (*CallState, error)
+}
+
+// CallStateConfig configures call state checkpoints.
+type CallStateConfig struct {
+	Enabled bool `json:"enabled"`
+	// TTLSeconds is how long the in-memory store keeps a call's state
+	// after its last checkpoint.
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+// callStates is where calls checkpoint their state; nil disables
+// checkpoints. main sets up a MemoryCallStateStore when enabled, and
+// embedding code may plug in its own store instead.
+var callStates CallStateStore
+
+// MemoryCallStateStore keeps call states in memory. They survive a
+// reconnect, but not a restart of the bridge.
+type MemoryCallStateStore struct {
+	states *ttlMap[CallState]
+	ttl    time.Duration
+}
+
+// NewMemoryCallStateStore creates a store keeping states for ttl after
+// they were last saved.
+func NewMemoryCallStateStore(ttl time.Duration) *MemoryCallStateStore {
+	return &MemoryCallStateStore{states: newTTLMap[CallState](), ttl: ttl}
+}
+
+// Save implements CallStateStore.
+func (s *MemoryCallStateStore) Save(callID string, state CallState) error {
+	s.states.Put(callID, state, s.ttl)
+	return nil
+}
+
+// Load implements CallStateStore.
+func (s *MemoryCallStateStore) Load(callID string) (*CallState, error) {
+	state, ok := s.states.Get(callID)
+	if !ok {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+// loadCallState returns the checkpoint of a reconnecting call, or nil.
+func loadCallState(callID string) *CallState {
+	if callStates == nil {
+		return nil
+	}
+	state, err := callStates.Load(callID)
+	if err != nil {
+		log.Printf("call %s: failed to load call state: %v", callID, err)
+		return nil
+	}
+	return state
+}
+
+// restoreChat rebuilds a ChatStore from a checkpoint instead of the
+// backend's history. The backend is still asked for messages the
+// checkpoint lacks, but the call goes on without it if it is unreachable.
+func restoreChat(chatID string, state *CallState) *api.ChatStore {
+	chatStore := api.NewChatStore(chatBackend, ollamaAPI)
+	chatStore.CurrentChat = chatID
+	chatStore.Chat = api.Chat{ID: chatID, Settings: state.Settings}
+	chatStore.Messages = append([]api.Message(nil), state.Messages...)
+	chatStore.SetSettings(state.Settings)
+	if chat, err := chatBackend.GetChat(chatID); err != nil {
+		log.Printf("chat %s: restored from checkpoint, backend unavailable: %v", chatID, err)
+	} else {
+		chatStore.Sync(chat)
+	}
+	return chatStore
+}
+
+// checkpoint saves the call's state to callStates.
+func (c *Call) checkpoint() {
+	if callStates == nil || c.ChatStore == nil {
+		return
+	}
+	state := CallState{
+		Messages: c.ChatStore.Snapshot(),
+		Settings: c.ChatStore.Settings(),
+		Language: c.Language(),
+		Usage:    c.Usage(),
+		Saved:    clock.Now(),
+	}
+	if err := callStates.Save(c.ID, state); err != nil {
+		log.Printf("call %s: failed to save call state: %v", c.ID, err)
+	}
+}
+
+// restore picks up the language and usage of a checkpoint.
+func (c *Call) restore(state *CallState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if state.Language != "" {
+		c.language = state.Language
+	}
+	c.usage = state.Usage
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/CyCoreSystems/audiosocket"
+
+	"go-ast-client/api"
+)
+
+// withCallStates checkpoints calls to store for the test, restoring the
+// previous store after.
+func withCallStates(t *testing.T, store CallStateStore) {
+	t.Helper()
+	saved := callStates
+	t.Cleanup(func() { callStates = saved })
+	callStates = store
+}
+
+func TestMemoryCallStateStoreRoundTrip(t *testing.T) {
+	fake := NewFakeClock(time.Unix(0, 0))
+	withClock(t, fake)
+	store := NewMemoryCallStateStore(time.Minute)
+
+	state := CallState{
+		Messages: []api.Message{{ChatID: "call", Role: api.SenderUser, Content: "hello"}},
+		Settings: testSettings(0.7),
+		Language: "ru",
+		Usage:    api.TokenUsage{PromptTokens: 10, ResponseTokens: 5, Turns: 1},
+		Saved:    fake.Now(),
+	}
+	if err := store.Save("call", state); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Load("call")
+	if err != nil || got == nil || !reflect.DeepEqual(*got, state) {
+		t.Errorf("Load() = %+v, %v; want %+v", got, err, state)
+	}
+	if got, err := store.Load("other"); got != nil || err != nil {
+		t.Errorf("Load() of an unknown call = %+v, %v; want nil", got, err)
+	}
+
+	fake.Advance(2 * time.Minute)
+	if got, _ := store.Load("call"); got != nil {
+		t.Error("state loaded after its TTL")
+	}
+}
+
+func TestTurnCheckpointsCall(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Webhook.StateEvents = true })
+	events := withWebhookQueue(t)
+	store := NewMemoryCallStateStore(time.Minute)
+	withCallStates(t, store)
+	withTTS(t, newTTSServer(t, make([]byte, 640), 320))
+	stt := newSTTServer(t, "hello")
+	s := testSettings(0.7)
+	s.AsteriskSettings.AsteriskSegment = "test"
+	_, chatStore := newTestChat(t, "call", s, &fakeOllama{})
+	call := NewCall("call", NewScriptedStream(), func() {})
+	call.SetChatStore(chatStore)
+
+	frames := make([][]float32, 30)
+	for i := range frames {
+		frames[i] = sine(200, 16000, 0.02)
+	}
+	processUtterance(context.Background(), call, frames, nil)
+	stt.Upload(t)
+	waitForState(t, events, stateListening)
+
+	state, _ := store.Load("call")
+	if state == nil {
+		t.Fatal("no checkpoint after the turn")
+	}
+	if len(state.Messages) != 2 || state.Messages[0].Content != "hello" || state.Messages[1].Content != "ok" {
+		t.Errorf("checkpointed messages = %+v, want the turn", state.Messages)
+	}
+	if state.Usage.Turns != 1 {
+		t.Errorf("checkpointed usage = %+v, want the turn counted", state.Usage)
+	}
+}
+
+func TestCallResumesFromCheckpoint(t *testing.T) {
+	events := withWebhookQueue(t)
+	store := NewMemoryCallStateStore(time.Minute)
+	withCallStates(t, store)
+	// The backend never got the messages of the call before the crash
+	id, _ := newTestCallChat(t, testSettings(0.7))
+	store.Save(id.String(), CallState{
+		Messages: []api.Message{
+			{ChatID: id.String(), Role: api.SenderUser, Content: "book a table"},
+			{ChatID: id.String(), Role: api.SenderAssistant, Content: "for how many?"},
+		},
+		Settings: testSettings(0.7),
+		Language: "ru",
+		Usage:    api.TokenUsage{PromptTokens: 10, ResponseTokens: 5, Turns: 1},
+	})
+
+	stream := newTestStream(audiosocket.IDMessage(id))
+	stream.hold = true
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(context.Background(), stream)
+	}()
+	defer func() {
+		stream.Close()
+		<-done
+	}()
+
+	call := waitForCall(t, id.String(), stream)
+	for event := range events {
+		if event.Type == eventCallStarted {
+			break
+		}
+	}
+	messages := call.ChatStore.Snapshot()
+	if len(messages) != 2 || messages[1].Content != "for how many?" {
+		t.Errorf("history = %+v, want the checkpointed conversation", messages)
+	}
+	if call.Language() != "ru" || call.Usage().Turns != 1 {
+		t.Errorf("language %q, usage %+v; want the checkpointed ones", call.Language(), call.Usage())
+	}
+}
@@ -4,11 +4,27 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"go-ast-client/api"
+	"go-ast-client/settings"
 	"io"
+	"log"
 	"net/http"
+	"reflect"
 	"time"
 )
 
+// Errors returned by ChatAPI implementations; see the api package.
+var (
+	ErrChatNotFound = api.ErrChatNotFound
+	ErrChatExists   = api.ErrChatExists
+	ErrUnauthorized = api.ErrUnauthorized
+	ErrServerError  = api.ErrServerError
+)
+
+// statusError is api.StatusError, reachable from methods whose receiver
+// shadows the package name.
+var statusError = api.StatusError
+
 type Optional[T any] struct {
 	Defined bool
 	Value   *T
@@ -24,43 +40,14 @@ type User struct {
 	Chats     []Chat    `json:"chats,omitempty"`
 }
 type Chat struct {
-	ID          string                 `json:"id"`
-	UserID      uint                   `json:"userId"`
-	StartTime   time.Time              `json:"startTime"`
-	EndTime     *time.Time             `json:"endTime,omitempty"`
-	Messages    []Message              `json:"messages,omitempty"`
-	Settings    map[string]interface{} `json:"settings,omitempty"`
-	STTSettings map[string]interface{} `json:"sttSettings,omitempty"`
-	LLMSettings map[string]interface{} `json:"llmSettings,omitempty"`
-	TTSSettings map[string]interface{} `json:"ttsSettings,omitempty"`
-}
-
-type STTSettings struct {
-	Language                      string   `json:"language,omitempty"`
-	BeamSize                      *int     `json:"beam_size,omitempty"`
-	BestOf                        *int     `json:"best_of,omitempty"`
-	Patience                      *float64 `json:"patience,omitempty"`
-	NoSpeechThreshold             *float64 `json:"no_speech_threshold,omitempty"`
-	Temperature                   *float64 `json:"temperature,omitempty"`
-	HallucinationSilenceThreshold *int     `json:"hallucination_silence_threshold,omitempty"`
-}
-
-type LLMSettings struct {
-	Model         string   `json:"model"`
-	Seed          *int     `json:"seed,omitempty"`
-	SystemPrompt  *string  `json:"system_prompt"`
-	Mirostat      *int     `json:"mirostat,omitempty"`
-	MirostatEta   *float64 `json:"mirostat_eta,omitempty"`
-	MirostatTau   *float64 `json:"mirostat_tau,omitempty"`
-	NumCtx        *int     `json:"num_ctx,omitempty"`
-	RepeatLastN   *int     `json:"repeat_last_n,omitempty"`
-	RepeatPenalty *float64 `json:"repeat_penalty,omitempty"`
-	Temperature   *float64 `json:"temperature,omitempty"`
-	TfsZ          *float64 `json:"tfs_z,omitempty"`
-	NumPredict    *int     `json:"num_predict,omitempty"`
-	TopK          *int     `json:"top_k,omitempty"`
-	TopP          *float64 `json:"top_p,omitempty"`
-	MinP          *float64 `json:"min_p,omitempty"`
+	ID        string     `json:"id"`
+	UserID    uint       `json:"userId"`
+	StartTime time.Time  `json:"startTime"`
+	EndTime   *time.Time `json:"endTime,omitempty"`
+	Messages  []Message  `json:"messages,omitempty"`
+	// Settings has the same shape as api.Chat's, so a chat fetched once
+	// carries everything a call needs.
+	Settings api.Settings `json:"settings"`
 }
 
 type Message struct {
@@ -76,43 +63,101 @@ var (
 	LLMSender  string = "assistant"
 )
 
-type ChatAPI struct {
+// ChatAPI is the chat backend used by the bridge.
+type ChatAPI interface {
+	CreateUser(username, email string) (map[string]interface{}, error)
+	ListUsers() (map[string]interface{}, error)
+	// StartUserChat creates a chat for a user, with an ID chosen by the
+	// backend. Calls use api.ChatAPI.StartChat instead, which creates a
+	// chat with the call's ID.
+	StartUserChat(userID string) (map[string]interface{}, error)
+	GetChat(chatID string) (*Chat, error)
+	ListChats() (map[string]interface{}, error)
+	DeleteChat(chatID string) (map[string]interface{}, error)
+	UpdateChat(chatID string, data map[string]interface{}) (map[string]interface{}, error)
+	SendMessage(chatID, sender, content string) (map[string]interface{}, error)
+	GetMessages(chatID string) (map[string]interface{}, error)
+	GetSttSettings(chatID string) (*settings.STTSettings, error)
+	GetLlmSettings(chatID string) (*settings.LLMSettings, error)
+	GetTtsSettings(chatID string) (map[string]interface{}, error)
+}
+
+// HTTPChatAPI is the production ChatAPI talking to the backend over HTTP.
+type HTTPChatAPI struct {
 	BaseURL    string
 	HTTPClient *http.Client
+	// RequestIDHeader, if set, names the header carrying the chat ID on
+	// requests about a chat, so they can be correlated with the call.
+	RequestIDHeader string
+}
+
+// ChatAPIOption configures an HTTPChatAPI.
+type ChatAPIOption func(*HTTPChatAPI)
+
+// WithBearerToken authenticates every request with a static bearer token.
+func WithBearerToken(token string) ChatAPIOption {
+	return WithTokenFunc(api.StaticToken(token))
+}
+
+// WithTokenFunc authenticates every request with the token returned by fn,
+// which is asked for a fresh token when the backend answers 401.
+func WithTokenFunc(fn api.TokenFunc) ChatAPIOption {
+	return func(c *HTTPChatAPI) {
+		c.HTTPClient = api.NewAuthClient(fn)
+	}
+}
+
+// WithHTTPClient sends requests with client, e.g. to share its connection
+// pool and transport settings with the other backend integrations.
+func WithHTTPClient(client *http.Client) ChatAPIOption {
+	return func(c *HTTPChatAPI) {
+		c.HTTPClient = client
+	}
 }
 
-func NewChatAPI(baseURL string) *ChatAPI {
-	return &ChatAPI{
+// WithRequestIDHeader sends the chat ID in the named header.
+func WithRequestIDHeader(name string) ChatAPIOption {
+	return func(c *HTTPChatAPI) {
+		c.RequestIDHeader = name
+	}
+}
+
+func NewChatAPI(baseURL string, opts ...ChatAPIOption) *HTTPChatAPI {
+	c := &HTTPChatAPI{
 		BaseURL:    baseURL,
 		HTTPClient: &http.Client{},
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 // Users
-func (api *ChatAPI) CreateUser(username, email string) (map[string]interface{}, error) {
+func (api *HTTPChatAPI) CreateUser(username, email string) (map[string]interface{}, error) {
 	data := map[string]string{"username": username, "email": email}
-	return api.post("/users", data)
+	return api.post("/users", "", data)
 }
 
-func (api *ChatAPI) ListUsers() (map[string]interface{}, error) {
-	return api.get("/users")
+func (api *HTTPChatAPI) ListUsers() (map[string]interface{}, error) {
+	return api.get("/users", "")
 }
 
 // Chats
-func (api *ChatAPI) StartChat(userID string) (map[string]interface{}, error) {
+func (api *HTTPChatAPI) StartUserChat(userID string) (map[string]interface{}, error) {
 	data := map[string]string{"userId": userID}
-	return api.post("/chats", data)
+	return api.post("/chats", "", data)
 }
 
-func (api *ChatAPI) GetChat(chatID string) (*Chat, error) {
-	resp, err := api.HTTPClient.Get(api.BaseURL + "/chats/" + chatID)
+func (api *HTTPChatAPI) GetChat(chatID string) (*Chat, error) {
+	resp, err := api.getResponse("/chats/"+chatID, chatID)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching chat: %v", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get chat: received status code %d", resp.StatusCode)
+	if err := statusError(resp.StatusCode); err != nil {
+		return nil, fmt.Errorf("failed to get chat: %w", err)
 	}
 
 	var chat Chat
@@ -123,68 +168,68 @@ func (api *ChatAPI) GetChat(chatID string) (*Chat, error) {
 	return &chat, nil
 }
 
-func (api *ChatAPI) ListChats() (map[string]interface{}, error) {
-	return api.get("/chats")
+func (api *HTTPChatAPI) ListChats() (map[string]interface{}, error) {
+	return api.get("/chats", "")
 }
 
-func (api *ChatAPI) DeleteChat(chatID string) (map[string]interface{}, error) {
-	return api.delete(fmt.Sprintf("/chats/%s", chatID))
+func (api *HTTPChatAPI) DeleteChat(chatID string) (map[string]interface{}, error) {
+	return api.delete(fmt.Sprintf("/chats/%s", chatID), chatID)
 }
 
-func (api *ChatAPI) UpdateChat(chatID string, data map[string]interface{}) (map[string]interface{}, error) {
-	return api.put(fmt.Sprintf("/chats/%s", chatID), data)
+func (api *HTTPChatAPI) UpdateChat(chatID string, data map[string]interface{}) (map[string]interface{}, error) {
+	return api.put(fmt.Sprintf("/chats/%s", chatID), chatID, data)
 }
 
 // Messages
-func (api *ChatAPI) SendMessage(chatID, sender, content string) (map[string]interface{}, error) {
+func (api *HTTPChatAPI) SendMessage(chatID, sender, content string) (map[string]interface{}, error) {
 	data := map[string]string{"chatId": chatID, "role": sender, "content": content}
-	return api.post("/messages", data)
+	return api.post("/messages", chatID, data)
 }
 
-func (api *ChatAPI) GetMessages(chatID string) (map[string]interface{}, error) {
-	return api.get(fmt.Sprintf("/messages/%s", chatID))
+func (api *HTTPChatAPI) GetMessages(chatID string) (map[string]interface{}, error) {
+	return api.get(fmt.Sprintf("/messages/%s", chatID), chatID)
 }
 
 // Helper methods
-func (api *ChatAPI) get(path string) (map[string]interface{}, error) {
-	resp, err := api.HTTPClient.Get(api.BaseURL + path)
+func (api *HTTPChatAPI) get(path, chatID string) (map[string]interface{}, error) {
+	resp, err := api.getResponse(path, chatID)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	return parseResponse(resp.Body)
+	return parseResponse(resp)
 }
-func (api *ChatAPI) GetSttSettings(chatID string) (*STTSettings, error) {
-	resp, err := api.HTTPClient.Get(api.BaseURL + fmt.Sprintf("/settings/%s/stt", chatID))
+func (api *HTTPChatAPI) GetSttSettings(chatID string) (*settings.STTSettings, error) {
+	resp, err := api.getResponse(fmt.Sprintf("/settings/%s/stt", chatID), chatID)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get STT settings: received status code %d", resp.StatusCode)
+	if err := statusError(resp.StatusCode); err != nil {
+		return nil, fmt.Errorf("failed to get STT settings: %w", err)
 	}
 
-	var sttSettings STTSettings
+	var sttSettings settings.STTSettings
 	if err := parseJSONResponse(resp.Body, &sttSettings); err != nil {
 		return nil, fmt.Errorf("error unmarshalling STT settings: %v", err)
 	}
 
 	return &sttSettings, nil
 }
-func (api *ChatAPI) GetLlmSettings(chatID string) (*LLMSettings, error) {
+func (api *HTTPChatAPI) GetLlmSettings(chatID string) (*settings.LLMSettings, error) {
 
-	resp, err := api.HTTPClient.Get(api.BaseURL + fmt.Sprintf("/settings/%s/llm", chatID))
+	resp, err := api.getResponse(fmt.Sprintf("/settings/%s/llm", chatID), chatID)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get LLM settings: received status code %d", resp.StatusCode)
+	if err := statusError(resp.StatusCode); err != nil {
+		return nil, fmt.Errorf("failed to get LLM settings: %w", err)
 	}
 
-	var llmSettings LLMSettings
+	var llmSettings settings.LLMSettings
 	if err := parseJSONResponse(resp.Body, &llmSettings); err != nil {
 		return nil, fmt.Errorf("error unmarshalling LLM settings: %v", err)
 	}
@@ -192,15 +237,15 @@ func (api *ChatAPI) GetLlmSettings(chatID string) (*LLMSettings, error) {
 	return &llmSettings, nil
 }
 
-func (api *ChatAPI) GetTtsSettings(chatID string) (map[string]interface{}, error) {
-	resp, err := api.HTTPClient.Get(api.BaseURL + fmt.Sprintf("/settings/%s/tts", chatID))
+func (api *HTTPChatAPI) GetTtsSettings(chatID string) (map[string]interface{}, error) {
+	resp, err := api.getResponse(fmt.Sprintf("/settings/%s/tts", chatID), chatID)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get TTS settings: received status code %d", resp.StatusCode)
+	if err := statusError(resp.StatusCode); err != nil {
+		return nil, fmt.Errorf("failed to get TTS settings: %w", err)
 	}
 
 	var ttsSettings map[string]interface{}
@@ -211,20 +256,26 @@ func (api *ChatAPI) GetTtsSettings(chatID string) (map[string]interface{}, error
 	return ttsSettings, nil
 }
 
-func (api *ChatAPI) post(path string, data interface{}) (map[string]interface{}, error) {
+func (api *HTTPChatAPI) post(path, chatID string, data interface{}) (map[string]interface{}, error) {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := api.HTTPClient.Post(api.BaseURL+path, "application/json", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequest(http.MethodPost, api.BaseURL+path, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := api.do(req, chatID)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	return parseResponse(resp.Body)
+	return parseResponse(resp)
 }
 
-func (api *ChatAPI) put(path string, data interface{}) (map[string]interface{}, error) {
+func (api *HTTPChatAPI) put(path, chatID string, data interface{}) (map[string]interface{}, error) {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return nil, err
@@ -235,31 +286,124 @@ func (api *ChatAPI) put(path string, data interface{}) (map[string]interface{},
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := api.HTTPClient.Do(req)
+	resp, err := api.do(req, chatID)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	return parseResponse(resp.Body)
+	return parseResponse(resp)
 }
 
-func (api *ChatAPI) delete(path string) (map[string]interface{}, error) {
+func (api *HTTPChatAPI) delete(path, chatID string) (map[string]interface{}, error) {
 	req, err := http.NewRequest(http.MethodDelete, api.BaseURL+path, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := api.HTTPClient.Do(req)
+	resp, err := api.do(req, chatID)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	return parseResponse(resp.Body)
+	return parseResponse(resp)
+}
+
+// getResponse sends a GET request for path, leaving the response to the
+// caller.
+func (api *HTTPChatAPI) getResponse(path, chatID string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, api.BaseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return api.do(req, chatID)
+}
+
+// do sends req, tagged with chatID if the request concerns a chat.
+func (api *HTTPChatAPI) do(req *http.Request, chatID string) (*http.Response, error) {
+	if api.RequestIDHeader != "" && chatID != "" {
+		req.Header.Set(api.RequestIDHeader, chatID)
+	}
+	return api.HTTPClient.Do(req)
+}
+
+// completeSettings fills in the kinds of settings missing from s, as left
+// by a backend that doesn't embed them all in the chat, from their own
+// endpoints. It reports whether s was changed; failures are logged and
+// leave that kind empty.
+func completeSettings(chats ChatAPI, chatID string, s *api.Settings) bool {
+	changed := false
+	if s.STTSettings == (settings.STTSettings{}) {
+		if stt, err := chats.GetSttSettings(chatID); err != nil {
+			log.Printf("chat %s: %v", chatID, err)
+		} else {
+			s.STTSettings, changed = *stt, true
+		}
+	}
+	if reflect.DeepEqual(s.LLMSettings, settings.LLMSettings{}) {
+		if llm, err := chats.GetLlmSettings(chatID); err != nil {
+			log.Printf("chat %s: %v", chatID, err)
+		} else {
+			s.LLMSettings, changed = *llm, true
+		}
+	}
+	if s.TTSSettings == (api.TTSSettings{}) {
+		tts, err := chats.GetTtsSettings(chatID)
+		if err == nil {
+			err = convertJSON(tts, &s.TTSSettings)
+		}
+		if err != nil {
+			log.Printf("chat %s: %v", chatID, err)
+		} else {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// keepMissingSettings fills in the kinds of settings still empty in s from
+// current, so a refresh that couldn't load a kind doesn't wipe it.
+func keepMissingSettings(s *api.Settings, current api.Settings) {
+	if s.STTSettings == (settings.STTSettings{}) {
+		s.STTSettings = current.STTSettings
+	}
+	if reflect.DeepEqual(s.LLMSettings, settings.LLMSettings{}) {
+		s.LLMSettings = current.LLMSettings
+	}
+	if s.TTSSettings == (api.TTSSettings{}) {
+		s.TTSSettings = current.TTSSettings
+	}
+}
+
+// clampSettings bounds the STT and LLM settings in s to sane ranges and
+// drops an invalid TTS await time, logging every value it changes. It
+// reports whether s was changed.
+func clampSettings(chatID string, s *api.Settings) bool {
+	clamped := append(s.STTSettings.Clamp(), s.LLMSettings.Clamp()...)
+	if t := s.TTSSettings.AwaitTime; t != nil && *t < 0 {
+		clamped = append(clamped, fmt.Sprintf("negative await_time %v replaced by the default", *t))
+		s.TTSSettings.AwaitTime = nil
+	}
+	for _, c := range clamped {
+		log.Printf("chat %s: %s", chatID, c)
+	}
+	return len(clamped) > 0
 }
 
-func parseResponse(body io.Reader) (map[string]interface{}, error) {
+// convertJSON copies from into the differently typed to by way of JSON.
+func convertJSON(from, to interface{}) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, to)
+}
+
+func parseResponse(resp *http.Response) (map[string]interface{}, error) {
+	if err := statusError(resp.StatusCode); err != nil {
+		return nil, err
+	}
 	var result map[string]interface{}
-	if err := parseJSONResponse(body, &result); err != nil {
+	if err := parseJSONResponse(resp.Body, &result); err != nil {
 		return nil, err
 	}
 	return result, nil
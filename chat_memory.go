@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"go-ast-client/settings"
+	"sync"
+)
+
+// InMemoryChatAPI is a ChatAPI backed by maps. It records every message sent
+// through it, which makes it useful as a test double for code that would
+// otherwise need a running chat backend.
+type InMemoryChatAPI struct {
+	mu      sync.Mutex
+	nextID  uint
+	users   []map[string]interface{}
+	chats   map[string]*Chat
+	stt     map[string]*settings.STTSettings
+	llm     map[string]*settings.LLMSettings
+	tts     map[string]map[string]interface{}
+	sent    []Message
+	updates map[string][]map[string]interface{}
+}
+
+var _ ChatAPI = (*InMemoryChatAPI)(nil)
+
+// NewInMemoryChatAPI creates an empty InMemoryChatAPI.
+func NewInMemoryChatAPI() *InMemoryChatAPI {
+	return &InMemoryChatAPI{
+		chats:   make(map[string]*Chat),
+		stt:     make(map[string]*settings.STTSettings),
+		llm:     make(map[string]*settings.LLMSettings),
+		tts:     make(map[string]map[string]interface{}),
+		updates: make(map[string][]map[string]interface{}),
+	}
+}
+
+// Users
+func (api *InMemoryChatAPI) CreateUser(username, email string) (map[string]interface{}, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	api.nextID++
+	user := map[string]interface{}{"id": api.nextID, "username": username, "email": email}
+	api.users = append(api.users, user)
+	return user, nil
+}
+
+func (api *InMemoryChatAPI) ListUsers() (map[string]interface{}, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return map[string]interface{}{"users": api.users}, nil
+}
+
+// Chats
+func (api *InMemoryChatAPI) StartUserChat(userID string) (map[string]interface{}, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	api.nextID++
+	id := fmt.Sprintf("chat-%d", api.nextID)
+	api.chats[id] = &Chat{ID: id, StartTime: clock.Now()}
+	return map[string]interface{}{"id": id, "userId": userID}, nil
+}
+
+// AddChat stores chat so it can be fetched with GetChat.
+func (api *InMemoryChatAPI) AddChat(chat Chat) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.chats[chat.ID] = &chat
+}
+
+func (api *InMemoryChatAPI) GetChat(chatID string) (*Chat, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	chat, ok := api.chats[chatID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get chat: %w", ErrChatNotFound)
+	}
+	c := *chat
+	c.Messages = append([]Message(nil), chat.Messages...)
+	return &c, nil
+}
+
+func (api *InMemoryChatAPI) ListChats() (map[string]interface{}, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	ids := make([]string, 0, len(api.chats))
+	for id := range api.chats {
+		ids = append(ids, id)
+	}
+	return map[string]interface{}{"chats": ids}, nil
+}
+
+func (api *InMemoryChatAPI) DeleteChat(chatID string) (map[string]interface{}, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	delete(api.chats, chatID)
+	return map[string]interface{}{"id": chatID}, nil
+}
+
+func (api *InMemoryChatAPI) UpdateChat(chatID string, data map[string]interface{}) (map[string]interface{}, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	api.updates[chatID] = append(api.updates[chatID], data)
+	return data, nil
+}
+
+// Updates returns every update applied to chatID, in order.
+func (api *InMemoryChatAPI) Updates(chatID string) []map[string]interface{} {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return append([]map[string]interface{}(nil), api.updates[chatID]...)
+}
+
+// Messages
+func (api *InMemoryChatAPI) SendMessage(chatID, sender, content string) (map[string]interface{}, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	api.nextID++
+	msg := Message{ID: api.nextID, ChatID: chatID, Role: sender, Content: content, SentAt: clock.Now()}
+	api.sent = append(api.sent, msg)
+	if chat, ok := api.chats[chatID]; ok {
+		chat.Messages = append(chat.Messages, msg)
+	}
+	return map[string]interface{}{"id": msg.ID, "chatId": chatID, "role": sender, "content": content}, nil
+}
+
+// Sent returns every message sent through the API, in order.
+func (api *InMemoryChatAPI) Sent() []Message {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return append([]Message(nil), api.sent...)
+}
+
+func (api *InMemoryChatAPI) GetMessages(chatID string) (map[string]interface{}, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	var messages []Message
+	for _, msg := range api.sent {
+		if msg.ChatID == chatID {
+			messages = append(messages, msg)
+		}
+	}
+	return map[string]interface{}{"messages": messages}, nil
+}
+
+// Settings
+func (api *InMemoryChatAPI) SetSttSettings(chatID string, sttSettings settings.STTSettings) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.stt[chatID] = &sttSettings
+}
+
+func (api *InMemoryChatAPI) SetLlmSettings(chatID string, llmSettings settings.LLMSettings) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.llm[chatID] = &llmSettings
+}
+
+func (api *InMemoryChatAPI) SetTtsSettings(chatID string, ttsSettings map[string]interface{}) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.tts[chatID] = ttsSettings
+}
+
+func (api *InMemoryChatAPI) GetSttSettings(chatID string) (*settings.STTSettings, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	settings, ok := api.stt[chatID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get STT settings: %w", ErrChatNotFound)
+	}
+	s := *settings
+	return &s, nil
+}
+
+func (api *InMemoryChatAPI) GetLlmSettings(chatID string) (*settings.LLMSettings, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	settings, ok := api.llm[chatID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get LLM settings: %w", ErrChatNotFound)
+	}
+	s := *settings
+	return &s, nil
+}
+
+func (api *InMemoryChatAPI) GetTtsSettings(chatID string) (map[string]interface{}, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	settings, ok := api.tts[chatID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get TTS settings: %w", ErrChatNotFound)
+	}
+	return settings, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"go-ast-client/api"
+	"go-ast-client/settings"
+)
+
+func ExampleInMemoryChatAPI() {
+	chats := NewInMemoryChatAPI()
+	chats.AddChat(Chat{ID: "call"})
+	chats.SendMessage("call", "user", "hello")
+	chats.SendMessage("call", "assistant", "hi, how can I help?")
+
+	for _, msg := range chats.Sent() {
+		fmt.Printf("%s: %s\n", msg.Role, msg.Content)
+	}
+	// Output:
+	// user: hello
+	// assistant: hi, how can I help?
+}
+
+func TestInMemoryChatAPIRecordsMessages(t *testing.T) {
+	chats := NewInMemoryChatAPI()
+	chats.AddChat(Chat{ID: "a"})
+	chats.AddChat(Chat{ID: "b"})
+	chats.SendMessage("a", "user", "one")
+	chats.SendMessage("b", "user", "other chat")
+	chats.SendMessage("a", "assistant", "two")
+
+	chat, err := chats.GetChat("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chat.Messages) != 2 || chat.Messages[0].Content != "one" || chat.Messages[1].Content != "two" {
+		t.Errorf("chat a has %+v, want one then two", chat.Messages)
+	}
+	if got := len(chats.Sent()); got != 3 {
+		t.Errorf("%d messages sent, want 3", got)
+	}
+
+	chats.UpdateChat("a", map[string]interface{}{"title": "first"})
+	if updates := chats.Updates("a"); len(updates) != 1 || updates[0]["title"] != "first" {
+		t.Errorf("updates = %v", updates)
+	}
+}
+
+func TestInMemoryChatAPINotFound(t *testing.T) {
+	chats := NewInMemoryChatAPI()
+	if _, err := chats.GetChat("missing"); !errors.Is(err, ErrChatNotFound) {
+		t.Errorf("GetChat error = %v, want ErrChatNotFound", err)
+	}
+	if _, err := chats.GetLlmSettings("missing"); !errors.Is(err, ErrChatNotFound) {
+		t.Errorf("GetLlmSettings error = %v, want ErrChatNotFound", err)
+	}
+}
+
+func TestCompleteSettingsFromInMemoryChatAPI(t *testing.T) {
+	chats := NewInMemoryChatAPI()
+	chats.SetSttSettings("call", settings.STTSettings{Model: ptr("stt")})
+	chats.SetLlmSettings("call", settings.LLMSettings{Model: ptr("llm")})
+	chats.SetTtsSettings("call", map[string]interface{}{"voice": "anna"})
+
+	var s api.Settings
+	if !completeSettings(chats, "call", &s) {
+		t.Fatal("completeSettings reported no change")
+	}
+	if *s.STTSettings.Model != "stt" || *s.LLMSettings.Model != "llm" || s.TTSSettings.Voice != "anna" {
+		t.Errorf("settings = %+v", s)
+	}
+
+	// Kinds already set are kept
+	s.LLMSettings.Model = ptr("chat")
+	completeSettings(chats, "call", &s)
+	if *s.LLMSettings.Model != "chat" {
+		t.Errorf("LLM model = %q, want the chat's", *s.LLMSettings.Model)
+	}
+}
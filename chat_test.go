@@ -0,0 +1,388 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-ast-client/api"
+	"go-ast-client/settings"
+)
+
+// withAPI replaces the ChatAPI settings are fetched from for the test,
+// restoring it after.
+func withAPI(t *testing.T, chats ChatAPI) {
+	t.Helper()
+	saved := API
+	t.Cleanup(func() { API = saved })
+	API = chats
+}
+
+func TestChatAPIStatusErrors(t *testing.T) {
+	tests := []struct {
+		code int
+		want error
+	}{
+		{http.StatusNotFound, ErrChatNotFound},
+		{http.StatusConflict, ErrChatExists},
+		{http.StatusUnauthorized, ErrUnauthorized},
+		{http.StatusForbidden, ErrUnauthorized},
+		{http.StatusInternalServerError, ErrServerError},
+		{http.StatusServiceUnavailable, ErrServerError},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.code)
+		}))
+		chats := NewChatAPI(srv.URL)
+
+		calls := map[string]func() error{
+			"GetChat":        func() error { _, err := chats.GetChat("chat"); return err },
+			"GetSttSettings": func() error { _, err := chats.GetSttSettings("chat"); return err },
+			"GetLlmSettings": func() error { _, err := chats.GetLlmSettings("chat"); return err },
+			"GetTtsSettings": func() error { _, err := chats.GetTtsSettings("chat"); return err },
+			"CreateUser":     func() error { _, err := chats.CreateUser("user", "user@example.com"); return err },
+			"UpdateChat":     func() error { _, err := chats.UpdateChat("chat", map[string]interface{}{"title": "t"}); return err },
+			"DeleteChat":     func() error { _, err := chats.DeleteChat("chat"); return err },
+		}
+		for name, call := range calls {
+			if err := call(); !errors.Is(err, tt.want) {
+				t.Errorf("%s on %d: %v, want %v", name, tt.code, err, tt.want)
+			}
+		}
+		srv.Close()
+	}
+}
+
+func TestLoadChatStartsMissingChat(t *testing.T) {
+	chats := api.NewMemoryChatAPI()
+	withChatBackend(t, chats)
+	withOllama(t, &fakeOllama{})
+	settingsAPI := NewInMemoryChatAPI()
+	settingsAPI.SetLlmSettings("new", settings.LLMSettings{Model: ptr("llm")})
+	withAPI(t, settingsAPI)
+
+	store, err := loadChat("new", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chats.GetChat("new"); err != nil {
+		t.Errorf("chat not started: %v", err)
+	}
+	if model := store.Settings().LLMSettings.Model; model == nil || *model != "llm" {
+		t.Errorf("LLM model = %v, want the one fetched for the new chat", model)
+	}
+}
+
+func TestLoadChatDoesNotStartOnServerError(t *testing.T) {
+	var mu sync.Mutex
+	var posts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			mu.Lock()
+			posts++
+			mu.Unlock()
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	withChatBackend(t, api.NewHTTPChatAPI(srv.URL))
+
+	if _, err := loadChat("chat", nil); !errors.Is(err, ErrServerError) {
+		t.Errorf("loadChat() error = %v, want ErrServerError", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if posts != 0 {
+		t.Errorf("%d chats started although the backend failed", posts)
+	}
+}
+
+func TestChatAPIBearerToken(t *testing.T) {
+	var mu sync.Mutex
+	var headers []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers = append(headers, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Write([]byte(`{"id":"chat"}`))
+	}))
+	defer srv.Close()
+
+	chats := NewChatAPI(srv.URL, WithBearerToken("secret"))
+	if _, err := chats.GetChat("chat"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chats.UpdateChat("chat", map[string]interface{}{"title": "t"}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for i, header := range headers {
+		if header != "Bearer secret" {
+			t.Errorf("request %d has Authorization %q", i, header)
+		}
+	}
+}
+
+// reconnect ends a call on chat with a turn the backend hasn't stored
+// yet, stores another turn in the backend meanwhile, and loads the chat
+// again as a reconnecting call does.
+func reconnect(t *testing.T, chats *api.MemoryChatAPI) (first, second *api.ChatStore) {
+	t.Helper()
+	withChatBackend(t, chats)
+	withOllama(t, &fakeOllama{})
+	withAPI(t, NewInMemoryChatAPI())
+	first, err := loadChat("chat", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Messages = append(first.Messages, api.Message{ChatID: "chat", Role: api.SenderUser, Content: "unsaved"})
+	if config.KeepHistory {
+		retainedChats.Put("chat", first, time.Minute)
+		t.Cleanup(func() { retainedChats.Take("chat") })
+	}
+	if _, err := chats.SendMessage("chat", api.SenderAssistant, "saved elsewhere"); err != nil {
+		t.Fatal(err)
+	}
+	if second, err = loadChat("chat", nil); err != nil {
+		t.Fatal(err)
+	}
+	return first, second
+}
+
+func contents(messages []api.Message) []string {
+	var out []string
+	for _, msg := range messages {
+		out = append(out, msg.Content)
+	}
+	return out
+}
+
+func TestReconnectReusesHistory(t *testing.T) {
+	withConfig(t, func(c *Config) { c.KeepHistory = true })
+	chats := api.NewMemoryChatAPI()
+	chats.StartChat("chat")
+	chats.SendMessage("chat", api.SenderUser, "hello")
+
+	first, second := reconnect(t, chats)
+	if second != first {
+		t.Error("reconnect did not reuse the in-memory history")
+	}
+	// Known messages aren't duplicated, the new one is synced
+	want := []string{"hello", "unsaved", "saved elsewhere"}
+	if got := contents(second.Snapshot()); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("history = %q, want %q", got, want)
+	}
+}
+
+func TestReconnectReloadsHistory(t *testing.T) {
+	withConfig(t, func(c *Config) { c.KeepHistory = false })
+	chats := api.NewMemoryChatAPI()
+	chats.StartChat("chat")
+	chats.SendMessage("chat", api.SenderUser, "hello")
+
+	first, second := reconnect(t, chats)
+	if second == first {
+		t.Error("reconnect reused the history with KeepHistory off")
+	}
+	want := []string{"hello", "saved elsewhere"}
+	if got := contents(second.Snapshot()); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("history = %q, want the backend's %q", got, want)
+	}
+}
+
+// settingsBackend serves chat, and the settings endpoints, recording the
+// paths requested.
+func settingsBackend(t *testing.T, chat string) func() []string {
+	t.Helper()
+	var mu sync.Mutex
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		if strings.Contains(r.URL.Path, "stt") {
+			w.Write([]byte(`{"language":"ru"}`))
+			return
+		}
+		w.Write([]byte(chat))
+	}))
+	t.Cleanup(srv.Close)
+	withChatBackend(t, api.NewHTTPChatAPI(srv.URL))
+	withAPI(t, NewChatAPI(srv.URL))
+	withOllama(t, &fakeOllama{})
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), paths...)
+	}
+}
+
+func TestLoadChatSingleRequest(t *testing.T) {
+	paths := settingsBackend(t, `{"id":"chat","settings":{
+		"sttSettings":{"language":"en"},
+		"llmSettings":{"model":"llama3"},
+		"ttsSettings":{"voice":"anna"}}}`)
+
+	store, err := loadChat("chat", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := paths(); len(got) != 1 {
+		t.Errorf("requests %q, want only the chat fetched", got)
+	}
+	s := store.Settings()
+	if *s.STTSettings.Language != "en" || *s.LLMSettings.Model != "llama3" || s.TTSSettings.Voice != "anna" {
+		t.Errorf("settings = %+v, want those of the chat", s)
+	}
+}
+
+func TestLoadChatFetchesMissingKind(t *testing.T) {
+	paths := settingsBackend(t, `{"id":"chat","settings":{
+		"llmSettings":{"model":"llama3"},
+		"ttsSettings":{"voice":"anna"}}}`)
+
+	store, err := loadChat("chat", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := paths(); len(got) != 2 || !strings.Contains(got[1], "stt") {
+		t.Errorf("requests %q, want the chat and its STT settings", got)
+	}
+	if language := store.Settings().STTSettings.Language; language == nil || *language != "ru" {
+		t.Errorf("STT language = %v, want the one from the STT endpoint", language)
+	}
+}
+
+func TestClampSettings(t *testing.T) {
+	s := testSettings(50)
+	s.STTSettings.BeamSize = intPtr(0)
+	if !clampSettings("chat", &s) {
+		t.Fatal("out-of-range settings reported unchanged")
+	}
+	if *s.LLMSettings.Temperature != settings.MaxLLMTemperature || *s.STTSettings.BeamSize != 1 {
+		t.Errorf("temperature %v, beam size %v, want both clamped", *s.LLMSettings.Temperature, *s.STTSettings.BeamSize)
+	}
+
+	s = testSettings(0.7)
+	if clampSettings("chat", &s) || *s.LLMSettings.Temperature != 0.7 {
+		t.Error("in-range settings changed")
+	}
+}
+
+func TestConcurrentFirstContact(t *testing.T) {
+	const callers = 5
+	var mu sync.Mutex
+	var misses, posts int
+	created := false
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/chats":
+			mu.Lock()
+			posts++
+			mu.Unlock()
+			<-release
+			mu.Lock()
+			created = true
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":"chat"}`))
+		case r.URL.Path == "/chats/chat":
+			mu.Lock()
+			defer mu.Unlock()
+			if !created {
+				misses++
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{"id":"chat"}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer srv.Close()
+	withChatBackend(t, api.NewHTTPChatAPI(srv.URL))
+	withAPI(t, NewChatAPI(srv.URL))
+	withOllama(t, &fakeOllama{})
+
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			_, err := loadChat("chat", nil)
+			errs <- err
+		}()
+	}
+	// Let every caller find the chat missing before it is created
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := misses
+		mu.Unlock()
+		if n == callers {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d callers looked up the chat", n, callers)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < callers; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("loadChat() error = %v", err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if posts != 1 {
+		t.Errorf("chat created %d times, want once", posts)
+	}
+}
+
+// recordingTransport is an http.RoundTripper counting the requests sent
+// through it.
+type recordingTransport struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.paths = append(rt.paths, req.URL.Path)
+	rt.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (rt *recordingTransport) Paths() []string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return append([]string(nil), rt.paths...)
+}
+
+func TestChatAPIUsesInjectedClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"chat"}`))
+	}))
+	defer srv.Close()
+	transport := &recordingTransport{}
+	chats := NewChatAPI(srv.URL, WithHTTPClient(&http.Client{Transport: transport}))
+
+	if _, err := chats.GetChat("chat"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chats.SendMessage("chat", "user", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(transport.Paths()); n != 2 {
+		t.Errorf("%d requests through the injected client, want 2", n)
+	}
+}
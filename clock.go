@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for timeouts, pacing and rate limits, so
+// they can be driven by a FakeClock instead of waiting in real time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the part of time.Ticker a Clock provides.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// clock is used wherever the bridge reads or waits for the time.
+var clock Clock = realClock{}
+
+// since returns the time elapsed on clock since t.
+func since(t time.Time) time.Duration {
+	return clock.Now().Sub(t)
+}
+
+// withTimeout is context.WithTimeout on clock: the returned context is
+// done once d has passed on clock, and its Err then reports
+// context.DeadlineExceeded. Its Deadline is the parent's.
+func withTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	t := &timeoutContext{Context: parent, done: make(chan struct{})}
+	expired := clock.After(d)
+	go func() {
+		select {
+		case <-expired:
+			t.stop(context.DeadlineExceeded)
+		case <-parent.Done():
+			t.stop(parent.Err())
+		case <-t.done:
+		}
+	}()
+	return t, func() { t.stop(context.Canceled) }
+}
+
+// timeoutContext is the context of withTimeout. The embedded parent
+// provides Deadline and Value.
+type timeoutContext struct {
+	context.Context
+	done chan struct{}
+	once sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+func (t *timeoutContext) Done() <-chan struct{} { return t.done }
+
+func (t *timeoutContext) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+func (t *timeoutContext) stop(err error) {
+	t.once.Do(func() {
+		t.mu.Lock()
+		t.err = err
+		t.mu.Unlock()
+		close(t.done)
+	})
+}
+
+// realClock is the wall clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+// FakeClock is a Clock that only moves when Advance is called. Timers and
+// tickers fire as Advance passes their deadlines.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []fakeTimer
+	tickers []*fakeTicker
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// NewFakeClock creates a FakeClock reading now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now implements Clock.
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After implements Clock.
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- f.now
+		return c
+	}
+	f.timers = append(f.timers, fakeTimer{at: f.now.Add(d), c: c})
+	return c
+}
+
+// NewTicker implements Clock. Like time.NewTicker it panics if d isn't
+// positive.
+func (f *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTicker{clock: f, period: d, next: f.now.Add(d), c: make(chan time.Time, 1)}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers and tickers due
+// by then. Like time.Ticker, a ticker nobody reads drops ticks.
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+
+	pending := f.timers[:0]
+	for _, t := range f.timers {
+		if t.at.After(f.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- f.now
+	}
+	f.timers = pending
+
+	for _, t := range f.tickers {
+		for !t.next.After(f.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+// WaitForTimers blocks until n timers and tickers are pending, so a test
+// can advance the clock once the code under test is waiting on it.
+func (f *FakeClock) WaitForTimers(n int) {
+	for {
+		f.mu.Lock()
+		pending := len(f.timers) + len(f.tickers)
+		f.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type fakeTicker struct {
+	clock  *FakeClock
+	period time.Duration
+	next   time.Time
+	c      chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, other := range t.clock.tickers {
+		if other == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			return
+		}
+	}
+}
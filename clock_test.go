@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWithTimeoutOnFakeClock(t *testing.T) {
+	fake := NewFakeClock(time.Unix(0, 0))
+	withClock(t, fake)
+
+	ctx, cancel := withTimeout(context.Background(), time.Minute)
+	defer cancel()
+	child, cancelChild := context.WithCancel(ctx)
+	defer cancelChild()
+
+	fake.Advance(59 * time.Second)
+	if ctx.Err() != nil {
+		t.Fatalf("context done %s early", time.Second)
+	}
+	fake.Advance(time.Second)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not done once the timeout passed")
+	}
+	if err := ctx.Err(); err != context.DeadlineExceeded {
+		t.Errorf("Err() = %v, want context.DeadlineExceeded", err)
+	}
+	<-child.Done()
+	if err := child.Err(); err != context.DeadlineExceeded {
+		t.Errorf("child Err() = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestWithTimeoutCanceledFirst(t *testing.T) {
+	fake := NewFakeClock(time.Unix(0, 0))
+	withClock(t, fake)
+
+	ctx, cancel := withTimeout(context.Background(), time.Minute)
+	cancel()
+	fake.Advance(time.Hour)
+	if err := ctx.Err(); err != context.Canceled {
+		t.Errorf("Err() = %v, want context.Canceled", err)
+	}
+}
+
+func TestFakeClockTicker(t *testing.T) {
+	fake := NewFakeClock(time.Unix(0, 0))
+	ticker := fake.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	fake.Advance(10 * time.Millisecond)
+	select {
+	case <-ticker.C():
+		t.Fatal("ticked before its period")
+	default:
+	}
+	fake.Advance(10 * time.Millisecond)
+	select {
+	case tick := <-ticker.C():
+		if want := time.Unix(0, 0).Add(20 * time.Millisecond); !tick.Equal(want) {
+			t.Errorf("tick at %v, want %v", tick, want)
+		}
+	default:
+		t.Fatal("no tick after its period")
+	}
+}
+
+func TestFakeClockTickerRejectsZeroPeriod(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewTicker(0) did not panic")
+		}
+	}()
+	NewFakeClock(time.Unix(0, 0)).NewTicker(0)
+}
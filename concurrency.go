@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errBackendBusy is returned when no backend slot freed up in time.
+var errBackendBusy = errors.New("backend is busy")
+
+// BackendConcurrencyConfig bounds how many requests all calls together
+// may have in flight to the STT service and the LLM. Unlike
+// UtteranceRateLimit it protects the backends rather than being fair
+// between chats.
+type BackendConcurrencyConfig struct {
+	// STT is the most concurrent transcription requests. Zero means
+	// unlimited.
+	STT int `json:"stt"`
+	// LLM is the most concurrent LLM requests. Zero means unlimited.
+	LLM int `json:"llm"`
+	// QueueTimeoutMs is how long a request may wait for a free slot
+	// before it is given up.
+	QueueTimeoutMs int `json:"queue_timeout_ms"`
+}
+
+// ConcurrencyLimiter is a semaphore shared by all calls. A nil
+// ConcurrencyLimiter never blocks.
+type ConcurrencyLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+// NewConcurrencyLimiter creates a limiter allowing n concurrent holders,
+// each waiting at most timeout for a slot, or nil if n is zero.
+func NewConcurrencyLimiter(n int, timeout time.Duration) *ConcurrencyLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &ConcurrencyLimiter{slots: make(chan struct{}, n), timeout: timeout}
+}
+
+var (
+	// sttLimiter and llmLimiter bound the requests to the backends, set
+	// up in main.
+	sttLimiter *ConcurrencyLimiter
+	llmLimiter *ConcurrencyLimiter
+)
+
+// Acquire waits for a free slot and returns the function releasing it. It
+// fails with errBackendBusy if the queue timeout passes first, or with
+// ctx's error if ctx ends.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	release = func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-clock.After(l.timeout):
+		return nil, errBackendBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
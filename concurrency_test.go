@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go-ast-client/api"
+	"go-ast-client/settings"
+)
+
+// inFlight tracks how many requests run at once.
+type inFlight struct {
+	mu       sync.Mutex
+	now, max int
+}
+
+// enter records a request starting, and returns the function recording
+// it ending.
+func (f *inFlight) enter() func() {
+	f.mu.Lock()
+	f.now++
+	if f.now > f.max {
+		f.max = f.now
+	}
+	f.mu.Unlock()
+	return func() {
+		f.mu.Lock()
+		f.now--
+		f.mu.Unlock()
+	}
+}
+
+func (f *inFlight) Max() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.max
+}
+
+// withLimiters bounds the STT and LLM requests for the test, restoring the
+// previous limiters after.
+func withLimiters(t *testing.T, stt, llm *ConcurrencyLimiter) {
+	t.Helper()
+	savedSTT, savedLLM := sttLimiter, llmLimiter
+	t.Cleanup(func() { sttLimiter, llmLimiter = savedSTT, savedLLM })
+	sttLimiter, llmLimiter = stt, llm
+}
+
+func TestConcurrencyLimiterSerializes(t *testing.T) {
+	l := NewConcurrencyLimiter(2, 5*time.Second)
+	var running inFlight
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := l.Acquire(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			done := running.enter()
+			time.Sleep(10 * time.Millisecond)
+			done()
+			release()
+		}()
+	}
+	wg.Wait()
+	if got := running.Max(); got != 2 {
+		t.Errorf("%d holders at once, want the limit of 2", got)
+	}
+}
+
+func TestConcurrencyLimiterDeadline(t *testing.T) {
+	fake := NewFakeClock(time.Unix(0, 0))
+	withClock(t, fake)
+	l := NewConcurrencyLimiter(1, time.Second)
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := l.Acquire(context.Background())
+		errs <- err
+	}()
+	fake.WaitForTimers(1)
+	fake.Advance(999 * time.Millisecond)
+	select {
+	case err := <-errs:
+		t.Fatalf("Acquire() = %v before the queue timeout", err)
+	default:
+	}
+	fake.Advance(time.Millisecond)
+	select {
+	case err := <-errs:
+		if !errors.Is(err, errBackendBusy) {
+			t.Errorf("Acquire() = %v, want errBackendBusy", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Acquire() kept waiting past the queue timeout")
+	}
+}
+
+func TestConcurrencyLimiterCanceled(t *testing.T) {
+	l := NewConcurrencyLimiter(1, time.Minute)
+	release, _ := l.Acquire(context.Background())
+	defer release()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Acquire(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Acquire() = %v, want context.Canceled", err)
+	}
+}
+
+func TestNilConcurrencyLimiter(t *testing.T) {
+	l := NewConcurrencyLimiter(0, time.Second)
+	if l != nil {
+		t.Fatal("limiter created for unlimited concurrency")
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := l.Acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConcurrentBackendRequestsSerialize(t *testing.T) {
+	withLimiters(t, NewConcurrencyLimiter(1, 5*time.Second), NewConcurrencyLimiter(1, 5*time.Second))
+	var stt, llm inFlight
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer stt.enter()()
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(`{"transcription":"ok"}`))
+	}))
+	defer srv.Close()
+	ollama := &fakeOllama{reply: func(ctx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error) {
+		defer llm.enter()()
+		time.Sleep(10 * time.Millisecond)
+		return api.OllamaChatResponse{Message: api.OllamaResponseMessage{Role: "assistant", Content: "ok"}, Done: true}, nil
+	}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		_, store := newTestChat(t, "call", testSettings(0.7), ollama)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			transcriber := &HTTPTranscriber{URL: srv.URL, Form: config.STTForm, ResponseKey: config.STTResponseKey}
+			if _, err := transcriber.Transcribe(context.Background(), make([]float32, 160), settings.STTSettings{}); err != nil {
+				t.Error(err)
+			}
+			if _, err := sendMessage(context.Background(), store, "hello"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if stt.Max() != 1 || llm.Max() != 1 {
+		t.Errorf("%d STT and %d LLM requests at once, want one each", stt.Max(), llm.Max())
+	}
+}
+
+func TestBackendBusyAfterQueueTimeout(t *testing.T) {
+	withLimiters(t, nil, NewConcurrencyLimiter(1, 50*time.Millisecond))
+	release := make(chan struct{})
+	ollama := &fakeOllama{reply: func(ctx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error) {
+		<-release
+		return api.OllamaChatResponse{Message: api.OllamaResponseMessage{Role: "assistant", Content: "ok"}, Done: true}, nil
+	}}
+	_, first := newTestChat(t, "first", testSettings(0.7), ollama)
+	_, second := newTestChat(t, "second", testSettings(0.7), ollama)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sendMessage(context.Background(), first, "hello")
+	}()
+	defer func() {
+		close(release)
+		<-done
+	}()
+	for len(ollama.Requests()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	if _, err := sendMessage(context.Background(), second, "hello"); !errors.Is(err, errBackendBusy) {
+		t.Errorf("sendMessage() = %v with the LLM saturated, want errBackendBusy", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("gave up after %v, want the 50ms queue timeout", elapsed)
+	}
+}
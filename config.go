@@ -0,0 +1,631 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-ast-client/api"
+	"net/url"
+	"os"
+)
+
+// STT request encodings supported by the transcription client.
+const (
+	sttFormatMultipart = "multipart"
+	sttFormatProtobuf  = "protobuf"
+	sttFormatWAV       = "wav"
+)
+
+// Context trimming strategies, see Config.ContextTrim.
+const (
+	contextTrimDropOldest = "drop_oldest"
+	contextTrimSummarize  = "summarize"
+)
+
+// Log levels, see Config.LogLevel.
+const (
+	logLevelInfo  = "info"
+	logLevelDebug = "debug"
+)
+
+// Config holds server-wide options for the bridge.
+type Config struct {
+	// ListenNetwork is the network AudioSocket connections are accepted on:
+	// "tcp", "tcp4", "tcp6" or "unix".
+	ListenNetwork string `json:"listen_network"`
+	// ListenAddr is a host:port for TCP networks or a socket path for unix.
+	ListenAddr string `json:"listen_addr"`
+
+	// InputSampleRate is the rate of SLIN audio expected from Asterisk:
+	// 8000 for slin, 16000 for slin16. The actual rate of each call is
+	// detected from its frames; a mismatch is logged.
+	InputSampleRate int `json:"input_sample_rate"`
+	// InputChannels is 1 for mono SLIN, the default, or 2 for gateways
+	// sending interleaved stereo, which is downmixed to mono on arrival.
+	InputChannels int `json:"input_channels"`
+	// AudioFrameMs is the duration of the SLIN frames exchanged with
+	// Asterisk: the packetization Asterisk reads with, which the rate of
+	// a call is detected from, and the size of the frames written back.
+	// It is independent of vad.frame_ms; inbound frames are re-framed for
+	// the VAD, so any multiple of 10 works with any VAD frame length. If
+	// it isn't a multiple of vad.frame_ms a frame can end mid VAD frame,
+	// whose decision then waits for the next one.
+	AudioFrameMs int `json:"audio_frame_ms"`
+	// STTSampleRate is the rate the STT service expects; inbound audio is
+	// resampled to it.
+	STTSampleRate int `json:"stt_sample_rate"`
+	// TTSSampleRate is the rate of the audio the TTS service returns; it
+	// is converted to the call's rate before playback. Zero means it
+	// already matches.
+	TTSSampleRate int `json:"tts_sample_rate"`
+
+	// LogLevel is "info" (default), which logs transcriptions and message
+	// content only by length and hash, or "debug", which logs them in full.
+	LogLevel string `json:"log_level"`
+
+	// Language is the default language for STT and TTS.
+	Language string `json:"language"`
+	// LanguageMinConfidence is the detection confidence (0-1) needed to
+	// switch a call away from Language.
+	LanguageMinConfidence float64 `json:"language_min_confidence"`
+
+	// STTFormat selects how requests are encoded for the STT service:
+	// "multipart" (default) with raw float32 audio, "wav", the same form
+	// with the audio as a 16-bit PCM WAV file, or "protobuf".
+	STTFormat string `json:"stt_format"`
+	// STTForm lays out the multipart form of the multipart and wav formats.
+	STTForm STTFormConfig `json:"stt_form"`
+	// STTResponseKey selects the transcription in the JSON responses of
+	// the multipart and wav formats: a key, or a dot-separated path into
+	// nested objects and arrays such as "results.0.text".
+	STTResponseKey string `json:"stt_response_key"`
+
+	// STTSegments maps caller segment names to dedicated STT endpoints.
+	STTSegments map[string]STTSegmentConfig `json:"stt_segments"`
+
+	// STTStreaming sends audio to the STT service while the caller is still
+	// speaking instead of after the utterance ends.
+	STTStreaming bool `json:"stt_streaming"`
+	// STTStreamURL is the websocket endpoint used in streaming mode.
+	STTStreamURL string `json:"stt_stream_url"`
+
+	// BargeIn selects which sources may interrupt assistant playback.
+	BargeIn BargeInConfig `json:"barge_in"`
+	// HalfDuplex ignores the caller while the assistant is speaking, for
+	// lines whose echo leaks back. It rules out barge-in by voice.
+	HalfDuplex HalfDuplexConfig `json:"half_duplex"`
+	// PlaybackPolicy decides what happens to a reply still playing when the
+	// next one is ready: "cancel" (default) cuts it off, "queue" plays the
+	// next one after it. Barge-in cancels playback either way.
+	PlaybackPolicy string `json:"playback_policy"`
+
+	// Recording captures call audio to WAV files.
+	Recording RecordingConfig `json:"recording"`
+
+	// ARI configures outbound calls placed with Originate, and transfers.
+	ARI ARIConfig `json:"ari"`
+	// AMI is used to transfer calls.
+	AMI AMIConfig `json:"ami"`
+	// Transfer configures handing calls over to a human through AMI.
+	Transfer TransferConfig `json:"transfer"`
+
+	// Webhook notifies an external system of call lifecycle events.
+	Webhook WebhookConfig `json:"webhook"`
+
+	// HealthAddr is where /healthz and /readyz are served. Empty disables
+	// the health server.
+	HealthAddr string `json:"health_addr"`
+	// HealthProbeTimeoutMs bounds each dependency check done by /readyz.
+	HealthProbeTimeoutMs int `json:"health_probe_timeout_ms"`
+	// AdminAddr is where the admin API controlling active calls is served.
+	// It is unauthenticated, so bind it to a private interface. Empty
+	// disables it.
+	AdminAddr string `json:"admin_addr"`
+
+	// HTTP tunes connection reuse towards the backends.
+	HTTP HTTPConfig `json:"http"`
+
+	// ChatAPIToken, if set, is sent as a bearer token to the chat backend.
+	ChatAPIToken string `json:"chat_api_token"`
+
+	// DegradedMode keeps calls going with default settings while the chat
+	// backend is unreachable.
+	DegradedMode DegradedModeConfig `json:"degraded_mode"`
+
+	// RequestIDHeader names the header carrying the call ID on requests to
+	// the STT, chat and TTS backends, for correlating their logs. Empty
+	// disables it.
+	RequestIDHeader string `json:"request_id_header"`
+
+	// ResponseCache reuses LLM responses for identical conversation states.
+	ResponseCache ResponseCacheConfig `json:"response_cache"`
+
+	// SettingsCache caches chats, and with them their settings, to save
+	// backend round-trips at call setup.
+	SettingsCache SettingsCacheConfig `json:"settings_cache"`
+	// SettingsRefreshSeconds re-fetches a call's settings before a turn
+	// once they are this old, so changes made in the backend during a
+	// long call apply to its next turns. It goes through the settings
+	// cache when enabled. Zero disables refreshing.
+	SettingsRefreshSeconds int `json:"settings_refresh_seconds"`
+
+	// CallState checkpoints each call after every turn so it can resume
+	// if it reconnects with the same ID.
+	CallState CallStateConfig `json:"call_state"`
+
+	// UtteranceMergeGapMs merges speech resuming within this many
+	// milliseconds of the end of an utterance into the same turn, as long
+	// as that turn hasn't reached the LLM yet. Zero disables merging.
+	UtteranceMergeGapMs int `json:"utterance_merge_gap_ms"`
+
+	// LLMTimeoutSeconds bounds how long we wait for an LLM response. Zero
+	// disables the timeout.
+	LLMTimeoutSeconds int `json:"llm_timeout_seconds"`
+	// LLMFallbackModels are tried in order when the chat's model isn't
+	// pulled or fails to load.
+	LLMFallbackModels []string `json:"llm_fallback_models"`
+	// Tools are offered to the LLM for function calling.
+	Tools ToolsConfig `json:"tools"`
+
+	// CallSummary stores an LLM summary of each call with its chat.
+	CallSummary CallSummaryConfig `json:"call_summary"`
+
+	// Filler is played while waiting for the LLM.
+	Filler FillerConfig `json:"filler"`
+
+	// Unavailable is played when a turn fails for good, so the caller
+	// doesn't face silence.
+	Unavailable UnavailableConfig `json:"unavailable"`
+
+	// Reprompt speaks to a caller who has gone quiet before hanging up
+	// on them. The idle timeout still applies if it is shorter.
+	Reprompt RepromptConfig `json:"reprompt"`
+
+	// LLMFallbackMessage is spoken when the LLM times out.
+	LLMFallbackMessage string `json:"llm_fallback_message"`
+
+	// KeepHistory keeps a call's in-memory conversation for
+	// KeepHistorySeconds after it ends. If the call reconnects with the same
+	// ID, it is reused and only synced with the chat backend.
+	KeepHistory        bool `json:"keep_history"`
+	KeepHistorySeconds int  `json:"keep_history_seconds"`
+
+	// ReplayHistory sends the chat's earlier messages to the LLM when a
+	// call connects. Without it every call starts from the system prompt
+	// alone, e.g. for stateless Q&A; a call resuming from its checkpoint
+	// keeps its own turns either way.
+	ReplayHistory bool `json:"replay_history"`
+
+	// TranscriptRules rewrite transcriptions, in order, before they are
+	// sent to the LLM.
+	TranscriptRules []TranscriptRule `json:"transcript_rules"`
+
+	// ContentFilter redacts or blocks words in transcriptions and responses.
+	ContentFilter ContentFilterConfig `json:"content_filter"`
+
+	// ContextTrim selects how long conversations are fit into the model's
+	// context: "drop_oldest" (default) or "summarize", which replaces the
+	// dropped messages with an LLM-written summary.
+	ContextTrim string `json:"context_trim"`
+
+	// Tracing exports spans of each call's STT, LLM and TTS requests.
+	Tracing TracingConfig `json:"tracing"`
+
+	// StripMarkdown removes markdown from text before it is spoken, so
+	// emphasis, lists, links and code aren't read out literally.
+	StripMarkdown bool `json:"strip_markdown"`
+
+	// MaxReplyChars cuts replies longer than this many characters back to
+	// their last complete sentence before they are spoken. Zero disables
+	// the cap.
+	MaxReplyChars int `json:"max_reply_chars"`
+
+	// ExpandNumbers spells out numbers, amounts of money and ordinals in
+	// the TTS language before synthesis.
+	ExpandNumbers bool `json:"expand_numbers"`
+	// ExpandAbbreviations replaces common abbreviations, like "Dr." or
+	// "т.е.", with the words they stand for.
+	ExpandAbbreviations bool `json:"expand_abbreviations"`
+	// Abbreviations adds to or overrides the built-in abbreviations, keyed
+	// by language and then abbreviation.
+	Abbreviations map[string]map[string]string `json:"abbreviations"`
+
+	// EchoMode skips the LLM and speaks every transcription back to the
+	// caller, for debugging VAD, STT and TTS on a line.
+	EchoMode bool `json:"echo_mode"`
+
+	// PacedPlayback writes TTS audio at real-time rate, one audio_frame_ms
+	// frame at a time, instead of as fast as the TTS service delivers it.
+	PacedPlayback bool `json:"paced_playback"`
+
+	// HangupOnWriteError tears down a call when writing audio to it fails,
+	// which usually means the caller hung up during playback.
+	HangupOnWriteError bool `json:"hangup_on_write_error"`
+
+	// UtteranceRateLimit bounds how many utterances per chat reach STT and
+	// the LLM; excess ones are skipped.
+	UtteranceRateLimit RateLimitConfig `json:"utterance_rate_limit"`
+
+	// BackendConcurrency bounds the STT and LLM requests in flight across
+	// all calls; excess ones queue for a while, then are skipped.
+	BackendConcurrency BackendConcurrencyConfig `json:"backend_concurrency"`
+
+	// AudioBuffer bounds the memory used per call for utterance audio.
+	AudioBuffer AudioBufferConfig `json:"audio_buffer"`
+
+	// Echo suppresses VAD triggers caused by our own playback.
+	Echo EchoConfig `json:"echo"`
+	// AEC subtracts the echo of our own playback from inbound audio before
+	// VAD and STT.
+	AEC AECConfig `json:"aec"`
+
+	// AGC normalizes utterance loudness before transcription.
+	AGC AGCConfig `json:"agc"`
+	// MinSpeechRMS is the RMS level (0-1) an utterance needs to be
+	// transcribed; quieter ones are taken for line noise and skipped. Zero
+	// disables the check.
+	MinSpeechRMS float64 `json:"min_speech_rms"`
+
+	// DuplicateCallPolicy decides what happens when a call arrives with the
+	// ID of an active call: "reject" hangs up the new call, "supersede" hangs
+	// up the old one.
+	DuplicateCallPolicy string `json:"duplicate_call_policy"`
+
+	// VAD selects the voice activity detector.
+	VAD VADConfig `json:"vad"`
+}
+
+// AGCConfig configures automatic gain control.
+type AGCConfig struct {
+	Enabled bool `json:"enabled"`
+	// TargetRMS is the RMS level (0-1) utterances are normalized toward.
+	TargetRMS float64 `json:"target_rms"`
+}
+
+// ResponseCacheConfig configures the LLM response cache.
+type ResponseCacheConfig struct {
+	Enabled bool `json:"enabled"`
+	// Window is the number of trailing messages hashed into the cache key.
+	Window int `json:"window"`
+	// TTLSeconds is how long a cached response stays valid.
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+// SettingsCacheConfig configures caching of chats fetched from the chat
+// backend.
+type SettingsCacheConfig struct {
+	Enabled bool `json:"enabled"`
+	// TTLSeconds is how long a fetched chat is reused before it is fetched
+	// again. Settings changed in the backend take up to this long to apply.
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+// HalfDuplexConfig configures ignoring inbound audio during playback.
+type HalfDuplexConfig struct {
+	Enabled bool `json:"enabled"`
+	// GuardMs keeps ignoring inbound audio this long after the played
+	// audio has ended, for the echo tail.
+	GuardMs int `json:"guard_ms"`
+}
+
+// CallSummaryConfig configures the summary generated when a call ends.
+type CallSummaryConfig struct {
+	Enabled bool `json:"enabled"`
+	// Prompt is the system prompt asking for the summary; empty uses a
+	// generic one.
+	Prompt string `json:"prompt"`
+	// Field is the chat field the summary is stored in, e.g. "title".
+	Field string `json:"field"`
+	// TimeoutSeconds bounds the LLM request, so it can't hold up shutdown.
+	TimeoutSeconds int `json:"timeout_seconds"`
+}
+
+// DefaultConfig returns the configuration used when no config file is given.
+func DefaultConfig() Config {
+	return Config{
+		ListenNetwork:         "tcp",
+		ListenAddr:            ":9092",
+		InputSampleRate:       8000,
+		AudioFrameMs:          20,
+		InputChannels:         1,
+		STTSampleRate:         16000,
+		Language:              "ru",
+		LanguageMinConfidence: 0.6,
+		STTFormat:             sttFormatMultipart,
+		STTForm: STTFormConfig{
+			AudioField:    "audio",
+			SettingsField: "settings",
+		},
+		STTResponseKey: "transcription",
+		BargeIn: BargeInConfig{
+			DTMF: true,
+			API:  true,
+		},
+		HalfDuplex: HalfDuplexConfig{
+			GuardMs: 300,
+		},
+		ResponseCache: ResponseCacheConfig{
+			Window:     4,
+			TTLSeconds: 600,
+		},
+		LLMTimeoutSeconds:  20,
+		LLMFallbackMessage: "Одну минуту, пожалуйста.",
+		Tools: ToolsConfig{
+			MaxCalls: api.DefaultMaxToolCalls,
+		},
+		CallSummary: CallSummaryConfig{
+			Field:          "summary",
+			TimeoutSeconds: 30,
+		},
+		Filler: FillerConfig{
+			DelayMs: 700,
+		},
+		Recording: RecordingConfig{
+			Dir: os.TempDir(),
+		},
+		Transfer: TransferConfig{
+			Context:   "audiosocket-transfer",
+			Extension: "s",
+		},
+		ARI: ARIConfig{
+			Endpoint:       "PJSIP/{number}",
+			Context:        "audiosocket-outbound",
+			Extension:      "s",
+			TimeoutSeconds: 30,
+		},
+		Webhook: WebhookConfig{
+			QueueSize:  256,
+			MaxRetries: 3,
+			TimeoutMs:  5000,
+		},
+		Tracing: TracingConfig{
+			ServiceName: "go-ast-bridge",
+		},
+		RequestIDHeader:      "X-Request-ID",
+		HealthAddr:           "",
+		HealthProbeTimeoutMs: 2000,
+		HTTP: HTTPConfig{
+			MaxIdleConnsPerHost:    64,
+			IdleConnTimeoutSeconds: 90,
+			KeepAliveSeconds:       30,
+		},
+		ContextTrim:        contextTrimDropOldest,
+		LogLevel:           logLevelInfo,
+		KeepHistorySeconds: 300,
+		ReplayHistory:      true,
+		ContentFilter: ContentFilterConfig{
+			BlockedResponse: "Извините, я не могу это обсуждать.",
+		},
+		SettingsCache: SettingsCacheConfig{
+			TTLSeconds: 30,
+		},
+		BackendConcurrency: BackendConcurrencyConfig{
+			QueueTimeoutMs: 5000,
+		},
+		CallState: CallStateConfig{
+			TTLSeconds: 600,
+		},
+		HangupOnWriteError: true,
+		AudioBuffer: AudioBufferConfig{
+			MaxBytes:       8 << 20,
+			MaxUtteranceMs: 60000,
+		},
+		Echo: EchoConfig{
+			TailMs:               300,
+			CorrelationThreshold: 0.6,
+			PlaybackRMSFloor:     0.02,
+		},
+		AEC: AECConfig{
+			TailMs:   100,
+			StepSize: 0.5,
+		},
+		AGC: AGCConfig{
+			TargetRMS: 0.1,
+		},
+		DuplicateCallPolicy: duplicateReject,
+		PlaybackPolicy:      playbackCancel,
+		VAD: VADConfig{
+			Backend:             vadWebRTC,
+			Mode:                3,
+			EnergyThreshold:     0.02,
+			MaxZeroCrossingRate: 0.35,
+			PreRollFrames:       10,
+			HangoverFrames:      5,
+			FrameMs:             20,
+		},
+	}
+}
+
+// LoadConfig reads a JSON config file on top of the defaults.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config: %v", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// Validate checks the config for unsupported values.
+func (c Config) Validate() error {
+	switch c.ListenNetwork {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return fmt.Errorf("unsupported listen_network %q", c.ListenNetwork)
+	}
+	if c.ListenAddr == "" {
+		return fmt.Errorf("listen_addr must be set")
+	}
+	if c.TTSSampleRate < 0 {
+		return fmt.Errorf("tts_sample_rate must not be negative")
+	}
+	if c.InputSampleRate <= 0 || c.STTSampleRate <= 0 {
+		return fmt.Errorf("sample rates must be positive")
+	}
+	if c.InputChannels != 1 && c.InputChannels != 2 {
+		return fmt.Errorf("input_channels must be 1 or 2, got %d", c.InputChannels)
+	}
+	if c.Language == "" {
+		return fmt.Errorf("language must be set")
+	}
+	switch c.STTFormat {
+	case sttFormatMultipart, sttFormatWAV, sttFormatProtobuf:
+	default:
+		return fmt.Errorf("unsupported stt_format %q", c.STTFormat)
+	}
+	if err := c.STTForm.validate(); err != nil {
+		return fmt.Errorf("stt_form: %v", err)
+	}
+	if err := validateJSONPath(c.STTResponseKey); err != nil {
+		return fmt.Errorf("stt_response_key: %v", err)
+	}
+	switch c.DuplicateCallPolicy {
+	case duplicateReject, duplicateSupersede:
+	default:
+		return fmt.Errorf("unsupported duplicate_call_policy %q", c.DuplicateCallPolicy)
+	}
+	if c.DegradedMode.Enabled && c.DegradedMode.Settings.LLMSettings.Model == nil {
+		return fmt.Errorf("degraded_mode.settings.llmSettings.model is required when degraded_mode is enabled")
+	}
+	if c.AEC.Enabled && (c.AEC.TailMs <= 0 || c.AEC.StepSize <= 0 || c.AEC.StepSize >= 2) {
+		return fmt.Errorf("aec needs a positive tail_ms and a step_size between 0 and 2")
+	}
+	if c.HalfDuplex.Enabled && c.BargeIn.VAD {
+		return fmt.Errorf("half_duplex and barge_in.vad can't both be enabled")
+	}
+	if c.HalfDuplex.GuardMs < 0 {
+		return fmt.Errorf("half_duplex.guard_ms must not be negative")
+	}
+	if _, err := compileTranscriptRules(c.TranscriptRules); err != nil {
+		return err
+	}
+	if err := validateTools(c.Tools); err != nil {
+		return err
+	}
+	if err := c.Transfer.validate(); err != nil {
+		return err
+	}
+	for _, name := range c.Tools.Enabled {
+		if name == transferTool.Name && len(c.Transfer.Targets) == 0 {
+			return fmt.Errorf("tool %q needs transfer targets", name)
+		}
+	}
+	if c.CallSummary.Enabled && (c.CallSummary.Field == "" || c.CallSummary.TimeoutSeconds <= 0) {
+		return fmt.Errorf("call_summary needs a field and a positive timeout_seconds")
+	}
+	if c.MaxReplyChars < 0 {
+		return fmt.Errorf("max_reply_chars must not be negative")
+	}
+	if c.Filler.DelayMs < 0 {
+		return fmt.Errorf("filler.delay_ms must not be negative")
+	}
+	if c.Unavailable.MaxFailures < 0 {
+		return fmt.Errorf("unavailable.max_failures must not be negative")
+	}
+	if c.Reprompt.AfterSeconds < 0 || c.Reprompt.MaxReprompts < 0 {
+		return fmt.Errorf("reprompt values must not be negative")
+	}
+	if c.UtteranceRateLimit.PerMinute < 0 || c.UtteranceRateLimit.Burst < 0 {
+		return fmt.Errorf("utterance_rate_limit values must not be negative")
+	}
+	if c.BackendConcurrency.STT < 0 || c.BackendConcurrency.LLM < 0 {
+		return fmt.Errorf("backend_concurrency limits must not be negative")
+	}
+	if c.BackendConcurrency.QueueTimeoutMs <= 0 {
+		return fmt.Errorf("backend_concurrency.queue_timeout_ms must be positive")
+	}
+	if c.MinSpeechRMS < 0 || c.MinSpeechRMS > 1 {
+		return fmt.Errorf("min_speech_rms must be between 0 and 1")
+	}
+	if c.AudioBuffer.MaxUtteranceMs < 0 {
+		return fmt.Errorf("audio_buffer.max_utterance_ms must not be negative")
+	}
+	switch c.PlaybackPolicy {
+	case playbackCancel, playbackQueue:
+	default:
+		return fmt.Errorf("unsupported playback_policy %q", c.PlaybackPolicy)
+	}
+	if c.ARI.TimeoutSeconds < 0 {
+		return fmt.Errorf("ari.timeout_seconds must not be negative")
+	}
+	if c.Webhook.URL != "" {
+		if _, err := url.ParseRequestURI(c.Webhook.URL); err != nil {
+			return fmt.Errorf("invalid webhook.url: %v", err)
+		}
+		if c.Webhook.QueueSize <= 0 || c.Webhook.TimeoutMs <= 0 || c.Webhook.MaxRetries < 0 {
+			return fmt.Errorf("webhook queue_size and timeout_ms must be positive and max_retries not negative")
+		}
+		if c.Webhook.TranscriptWindow < 0 {
+			return fmt.Errorf("webhook.transcript_window must not be negative")
+		}
+	}
+	if c.HealthAddr != "" && c.HealthProbeTimeoutMs <= 0 {
+		return fmt.Errorf("health_probe_timeout_ms must be positive")
+	}
+	if c.HTTP.MaxIdleConnsPerHost < 0 || c.HTTP.IdleConnTimeoutSeconds < 0 {
+		return fmt.Errorf("http pool settings must not be negative")
+	}
+	if c.KeepHistory && c.KeepHistorySeconds <= 0 {
+		return fmt.Errorf("keep_history_seconds must be positive")
+	}
+	if c.UtteranceMergeGapMs < 0 {
+		return fmt.Errorf("utterance_merge_gap_ms must not be negative")
+	}
+	if c.LLMTimeoutSeconds < 0 {
+		return fmt.Errorf("llm_timeout_seconds must not be negative")
+	}
+	for _, model := range c.LLMFallbackModels {
+		if model == "" {
+			return fmt.Errorf("llm_fallback_models must not contain empty names")
+		}
+	}
+	switch c.LogLevel {
+	case logLevelInfo, logLevelDebug:
+	default:
+		return fmt.Errorf("unsupported log_level %q", c.LogLevel)
+	}
+	switch c.ContextTrim {
+	case contextTrimDropOldest, contextTrimSummarize:
+	default:
+		return fmt.Errorf("unsupported context_trim %q", c.ContextTrim)
+	}
+	switch c.VAD.Backend {
+	case vadWebRTC, vadEnergy:
+	default:
+		return fmt.Errorf("unsupported vad.backend %q", c.VAD.Backend)
+	}
+	if c.AudioFrameMs <= 0 || c.AudioFrameMs%10 != 0 || c.AudioFrameMs > 100 {
+		return fmt.Errorf("audio_frame_ms must be a multiple of 10 up to 100, got %d", c.AudioFrameMs)
+	}
+	switch c.VAD.FrameMs {
+	case 10, 20, 30:
+	default:
+		return fmt.Errorf("vad.frame_ms must be 10, 20 or 30, got %d", c.VAD.FrameMs)
+	}
+	if err := validateSTTSegments(c.STTSegments); err != nil {
+		return err
+	}
+	if c.Tracing.OTLPEndpoint != "" {
+		if _, err := url.ParseRequestURI(c.Tracing.OTLPEndpoint); err != nil {
+			return fmt.Errorf("invalid tracing.otlp_endpoint: %v", err)
+		}
+	}
+	if c.ResponseCache.Enabled && c.ResponseCache.TTLSeconds <= 0 {
+		return fmt.Errorf("response_cache.ttl_seconds must be positive")
+	}
+	if c.CallState.Enabled && c.CallState.TTLSeconds <= 0 {
+		return fmt.Errorf("call_state.ttl_seconds must be positive")
+	}
+	if c.SettingsRefreshSeconds < 0 {
+		return fmt.Errorf("settings_refresh_seconds must not be negative")
+	}
+	if c.SettingsCache.Enabled && c.SettingsCache.TTLSeconds <= 0 {
+		return fmt.Errorf("settings_cache.ttl_seconds must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestValidateListenNetwork(t *testing.T) {
+	for _, network := range []string{"tcp", "tcp4", "tcp6", "unix"} {
+		c := DefaultConfig()
+		c.ListenNetwork = network
+		if err := c.Validate(); err != nil {
+			t.Errorf("%s rejected: %v", network, err)
+		}
+	}
+	for _, network := range []string{"", "udp", "unixgram"} {
+		c := DefaultConfig()
+		c.ListenNetwork = network
+		if err := c.Validate(); err == nil {
+			t.Errorf("listen_network %q accepted", network)
+		}
+	}
+
+	c := DefaultConfig()
+	c.ListenAddr = ""
+	if err := c.Validate(); err == nil {
+		t.Error("empty listen_addr accepted")
+	}
+}
+
+func TestValidateHalfDuplexExcludesVADBargeIn(t *testing.T) {
+	c := DefaultConfig()
+	c.HalfDuplex.Enabled = true
+	c.BargeIn.VAD = true
+	if err := c.Validate(); err == nil {
+		t.Error("half_duplex accepted along with barge_in.vad")
+	}
+	c.BargeIn.VAD = false
+	if err := c.Validate(); err != nil {
+		t.Errorf("half_duplex without barge_in.vad rejected: %v", err)
+	}
+}
+
+func TestValidateAudioFrameMs(t *testing.T) {
+	for _, frameMs := range []int{10, 20, 30, 40, 100} {
+		c := DefaultConfig()
+		c.AudioFrameMs = frameMs
+		if err := c.Validate(); err != nil {
+			t.Errorf("audio_frame_ms %d rejected: %v", frameMs, err)
+		}
+	}
+	for _, frameMs := range []int{0, -20, 15, 110} {
+		c := DefaultConfig()
+		c.AudioFrameMs = frameMs
+		if err := c.Validate(); err == nil {
+			t.Errorf("audio_frame_ms %d accepted", frameMs)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"go-ast-client/api"
+	"go-ast-client/settings"
+	"reflect"
+)
+
+// DegradedModeConfig keeps calls going while the chat backend is down.
+type DegradedModeConfig struct {
+	// Enabled runs calls whose chat can't be loaded with Settings and a
+	// history kept in memory only, instead of dropping them.
+	Enabled bool `json:"enabled"`
+	// Settings are used for such calls, and fill in any kind of settings
+	// the backend failed to provide for the others.
+	Settings api.Settings `json:"settings"`
+	// Notice, if set, is spoken to callers at the start of a degraded
+	// call.
+	Notice string `json:"notice"`
+}
+
+// degradedChat returns a ChatStore for chatID that keeps its history in
+// memory and uses the degraded mode settings.
+func degradedChat(chatID string) (*api.ChatStore, error) {
+	memory := api.NewMemoryChatAPI()
+	if _, err := memory.StartChat(chatID); err != nil {
+		return nil, err
+	}
+	chatStore, err := api.LoadChatStore(chatID, memory, ollamaAPI)
+	if err != nil {
+		return nil, err
+	}
+	chatStore.SetSettings(config.DegradedMode.Settings)
+	return chatStore, nil
+}
+
+// applyDefaultSettings fills the kinds of settings missing from s with the
+// degraded mode settings. It reports whether s was changed.
+func applyDefaultSettings(s *api.Settings) bool {
+	if !config.DegradedMode.Enabled {
+		return false
+	}
+	defaults := config.DegradedMode.Settings
+	changed := false
+	if s.STTSettings == (settings.STTSettings{}) && defaults.STTSettings != (settings.STTSettings{}) {
+		s.STTSettings, changed = defaults.STTSettings, true
+	}
+	if reflect.DeepEqual(s.LLMSettings, settings.LLMSettings{}) && !reflect.DeepEqual(defaults.LLMSettings, settings.LLMSettings{}) {
+		s.LLMSettings, changed = defaults.LLMSettings, true
+	}
+	if s.TTSSettings == (api.TTSSettings{}) && defaults.TTSSettings != (api.TTSSettings{}) {
+		s.TTSSettings, changed = defaults.TTSSettings, true
+	}
+	return changed
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/CyCoreSystems/audiosocket"
+	"github.com/gofrs/uuid"
+
+	"go-ast-client/api"
+	"go-ast-client/settings"
+)
+
+// downBackend makes the chat backend of the test fail every request.
+func downBackend(t *testing.T) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(srv.Close)
+	withChatBackend(t, api.NewHTTPChatAPI(srv.URL))
+	withAPI(t, NewChatAPI(srv.URL))
+}
+
+func TestDegradedCallProceeds(t *testing.T) {
+	defaults := testSettings(0.7)
+	defaults.LLMSettings.Model = ptr("fallback")
+	defaults.AsteriskSettings.AsteriskSegment = "test"
+	withConfig(t, func(c *Config) {
+		c.VAD.Backend = vadEnergy
+		c.Webhook.StateEvents = true
+		c.Unavailable.Message = ""
+		c.Unavailable.MaxFailures = 0
+		c.DegradedMode = DegradedModeConfig{Enabled: true, Settings: defaults, Notice: "Some features are unavailable."}
+	})
+	events := withWebhookQueue(t)
+	downBackend(t)
+	stt := newSTTServer(t, "hello")
+	tts := newTTSServer(t, make([]byte, 640), 320)
+	withTTS(t, tts)
+	models := make(chan string, 4)
+	withOllama(t, &fakeOllama{reply: func(ctx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error) {
+		models <- request.Model
+		return api.OllamaChatResponse{}, errors.New("model offline")
+	}})
+
+	id := uuid.Must(uuid.NewV4())
+	stream := newTestStream(append([]audiosocket.Message{audiosocket.IDMessage(id)}, utteranceFrames()...)...)
+	stream.hold = true
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(context.Background(), stream)
+	}()
+	defer func() {
+		stream.Close()
+		<-done
+	}()
+
+	started := <-events
+	if started.Type != eventCallStarted || started.Data["degraded"] != true {
+		t.Errorf("first event = %+v, want a degraded call_started", started)
+	}
+	stt.Upload(t)
+	select {
+	case model := <-models:
+		if model != "fallback" {
+			t.Errorf("LLM model = %q, want the degraded mode default", model)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("degraded call never reached the LLM")
+	}
+	waitForState(t, events, stateSpeaking)
+	waitForState(t, events, stateListening)
+	if requests := tts.Requests(); len(requests) != 1 || requests[0]["message"] != "Some features are unavailable." {
+		t.Errorf("synthesis requests = %v, want the degraded mode notice", requests)
+	}
+	if stream.HungUp() {
+		t.Error("degraded call hung up")
+	}
+}
+
+func TestBackendDownWithoutDegradedMode(t *testing.T) {
+	withConfig(t, func(c *Config) { c.DegradedMode.Enabled = false })
+	downBackend(t)
+	tts := newTTSServer(t, make([]byte, 640), 320)
+	withTTS(t, tts)
+	withOllama(t, &fakeOllama{})
+
+	stream := newTestStream(append([]audiosocket.Message{audiosocket.IDMessage(uuid.Must(uuid.NewV4()))}, utteranceFrames()...)...)
+	stream.hold = true
+	runHandle(t, context.Background(), stream)
+	if n := len(tts.Requests()); n != 0 {
+		t.Errorf("%d synthesis requests on a call that couldn't load its chat", n)
+	}
+}
+
+func TestApplyDefaultSettings(t *testing.T) {
+	defaults := testSettings(0.7)
+	withConfig(t, func(c *Config) { c.DegradedMode = DegradedModeConfig{Enabled: true, Settings: defaults} })
+
+	s := api.Settings{LLMSettings: settings.LLMSettings{Model: ptr("llama3")}}
+	if !applyDefaultSettings(&s) {
+		t.Fatal("missing settings not filled in")
+	}
+	if *s.LLMSettings.Model != "llama3" {
+		t.Errorf("LLM model = %q, want the backend's kept", *s.LLMSettings.Model)
+	}
+	if s.STTSettings != defaults.STTSettings || s.TTSSettings != defaults.TTSSettings {
+		t.Errorf("settings = %+v, want the missing kinds from the defaults", s)
+	}
+	if applyDefaultSettings(&s) {
+		t.Error("complete settings changed")
+	}
+
+	config.DegradedMode.Enabled = false
+	if empty := (api.Settings{}); applyDefaultSettings(&empty) {
+		t.Error("settings filled in with degraded mode disabled")
+	}
+}
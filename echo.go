@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// EchoConfig tunes suppression of our own TTS leaking back into the
+// inbound audio.
+type EchoConfig struct {
+	Enabled bool `json:"enabled"`
+	// TailMs is how much recently played audio inbound frames are compared
+	// against, and how long after playback suppression stays active.
+	TailMs int `json:"tail_ms"`
+	// CorrelationThreshold is the normalized cross-correlation (0-1) above
+	// which an inbound frame is treated as echo.
+	CorrelationThreshold float64 `json:"correlation_threshold"`
+	// PlaybackRMSFloor raises the bar for speech while playing: quieter
+	// frames are never treated as the caller talking.
+	PlaybackRMSFloor float64 `json:"playback_rms_floor"`
+}
+
+// EchoGate decides whether inbound frames are echoes of recently played
+// audio. It is safe for concurrent use.
+type EchoGate struct {
+	mu         sync.Mutex
+	config     EchoConfig
+	tail       time.Duration
+	maxSamples int
+	reference  []float32
+	lastPlayed time.Time
+}
+
+// NewEchoGate creates an EchoGate for audio at sampleRate.
+func NewEchoGate(config EchoConfig, sampleRate int) *EchoGate {
+	return &EchoGate{
+		config:     config,
+		tail:       time.Duration(config.TailMs) * time.Millisecond,
+		maxSamples: sampleRate * config.TailMs / 1000,
+	}
+}
+
+// SetSampleRate adapts the gate to audio at sampleRate, once the rate of a
+// call's audio is known.
+func (g *EchoGate) SetSampleRate(sampleRate int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.maxSamples = sampleRate * g.config.TailMs / 1000
+}
+
+// Played records SLIN audio written to the caller as echo reference.
+func (g *EchoGate) Played(pcm []byte) {
+	if !g.config.Enabled {
+		return
+	}
+	samples, err := pcmToFloat32Array(pcm)
+	if err != nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.reference = append(g.reference, samples...)
+	if over := len(g.reference) - g.maxSamples; over > 0 {
+		g.reference = append(g.reference[:0], g.reference[over:]...)
+	}
+	g.lastPlayed = clock.Now()
+}
+
+// Suppress reports whether frame should be ignored by the VAD because it
+// most likely is our own playback leaking back.
+func (g *EchoGate) Suppress(frame []float32) bool {
+	if !g.config.Enabled {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.lastPlayed.IsZero() || since(g.lastPlayed) > g.tail {
+		return false
+	}
+	if rms(frame) < g.config.PlaybackRMSFloor {
+		return true
+	}
+	return maxCorrelation(frame, g.reference) >= g.config.CorrelationThreshold
+}
+
+// maxCorrelation returns the highest normalized cross-correlation between
+// frame and any equally long window of reference. The reference is taken
+// as preceded by silence, so an echo delayed into the middle of a frame
+// still lines up with the start of playback.
+func maxCorrelation(frame, reference []float32) float64 {
+	n := len(frame)
+	if n == 0 || len(reference) == 0 {
+		return 0
+	}
+
+	var frameEnergy float64
+	for _, s := range frame {
+		frameEnergy += float64(s) * float64(s)
+	}
+	if frameEnergy == 0 {
+		return 0
+	}
+
+	// Energy of the sliding reference window, updated incrementally. The
+	// first window holds only the first reference sample.
+	first := 1 - n
+	windowEnergy := float64(reference[0]) * float64(reference[0])
+
+	best := 0.0
+	for lag := first; lag+n <= len(reference); lag++ {
+		if lag > first {
+			in := float64(reference[lag+n-1])
+			windowEnergy += in * in
+			if lag > 0 {
+				out := float64(reference[lag-1])
+				windowEnergy -= out * out
+			}
+		}
+		if windowEnergy <= 0 {
+			continue
+		}
+		start := 0
+		if lag < 0 {
+			start = -lag
+		}
+		var dot float64
+		for i := start; i < n; i++ {
+			dot += float64(frame[i]) * float64(reference[lag+i])
+		}
+		if c := math.Abs(dot) / math.Sqrt(frameEnergy*windowEnergy); c > best {
+			best = c
+		}
+	}
+	return best
+}
+
+// rms returns the root mean square level of samples.
+func rms(samples []float32) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// echoTestConfig is the default echo tuning, enabled.
+func echoTestConfig() EchoConfig {
+	c := DefaultConfig().Echo
+	c.Enabled = true
+	return c
+}
+
+// leak returns what the caller's side sends back while we play frames: our
+// playback attenuated and delayed by delay samples.
+func leak(played []float32, delay, frame int) []float32 {
+	out := make([]float32, 320)
+	for i := range out {
+		if j := frame*320 + i - delay; j >= 0 {
+			out[i] = 0.3 * played[j]
+		}
+	}
+	return out
+}
+
+// countTurns plays 50 frames of noise through gate while feeding inbound
+// frames to an energy VAD, skipping those the gate suppresses, and returns
+// how many frames the VAD took for speech.
+func countTurns(t *testing.T, gate *EchoGate, fake *FakeClock, inbound func(played []float32, frame int) []float32) int {
+	t.Helper()
+	vad := &EnergyVAD{Threshold: 0.01}
+	next := noiseFrames(4)
+	var played []float32
+	turns := 0
+	for i := 0; i < 50; i++ {
+		frame := next()
+		played = append(played, frame...)
+		gate.Played(float32ArrayToPCM(frame))
+		fake.Advance(20 * time.Millisecond)
+
+		in := inbound(played, i)
+		if gate.Suppress(in) {
+			continue
+		}
+		active, err := vad.Process(16000, float32ArrayToPCM(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if active {
+			turns++
+		}
+	}
+	return turns
+}
+
+func TestEchoGateSuppressesLeakedPlayback(t *testing.T) {
+	fake := NewFakeClock(time.Unix(0, 0))
+	withClock(t, fake)
+	echo := func(played []float32, frame int) []float32 { return leak(played, 40, frame) }
+
+	// Without the gate the leak alone looks like the caller talking
+	off := echoTestConfig()
+	off.Enabled = false
+	if turns := countTurns(t, NewEchoGate(off, 16000), fake, echo); turns == 0 {
+		t.Fatal("leaked playback never triggered the VAD, the test proves nothing")
+	}
+
+	if turns := countTurns(t, NewEchoGate(echoTestConfig(), 16000), fake, echo); turns != 0 {
+		t.Errorf("leaked playback triggered the VAD on %d frames", turns)
+	}
+}
+
+func TestEchoGatePassesCallerSpeech(t *testing.T) {
+	fake := NewFakeClock(time.Unix(0, 0))
+	withClock(t, fake)
+	caller := noiseFrames(5)
+
+	// The caller talks over our playback
+	turns := countTurns(t, NewEchoGate(echoTestConfig(), 16000), fake, func([]float32, int) []float32 {
+		return caller()
+	})
+	if turns < 45 {
+		t.Errorf("caller speech passed on %d of 50 frames", turns)
+	}
+}
+
+func TestEchoGateTail(t *testing.T) {
+	fake := NewFakeClock(time.Unix(0, 0))
+	withClock(t, fake)
+	gate := NewEchoGate(echoTestConfig(), 16000)
+	frame := noiseFrames(6)()
+	gate.Played(float32ArrayToPCM(frame))
+
+	fake.Advance(200 * time.Millisecond)
+	if !gate.Suppress(frame) {
+		t.Error("echo within the tail not suppressed")
+	}
+	fake.Advance(200 * time.Millisecond)
+	if gate.Suppress(frame) {
+		t.Error("audio suppressed after the tail")
+	}
+}
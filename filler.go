@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+// FillerConfig configures the sound played while the assistant is thinking.
+type FillerConfig struct {
+	// File is a WAV or raw file of 16-bit mono SLIN at the call's sample
+	// rate, looped from when the LLM is asked until the reply starts
+	// playing. Empty disables the filler.
+	File string `json:"file"`
+	// DelayMs is how long to wait before starting the filler, so quick
+	// replies aren't preceded by a snippet of it.
+	DelayMs int `json:"delay_ms"`
+}
+
+// fillerAudio is the SLIN audio of the configured filler, loaded in main.
+var fillerAudio []byte
+
+// loadAudioFile reads SLIN audio, such as the filler, from path. For WAV
+// files only the samples of the data chunk are kept.
+func loadAudioFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audio file: %v", err)
+	}
+	if bytes.HasPrefix(data, []byte("RIFF")) {
+		if data, err = wavData(data); err != nil {
+			return nil, fmt.Errorf("invalid audio file %s: %v", path, err)
+		}
+	}
+	if len(data) < frameBytes(config.InputSampleRate, config.AudioFrameMs) {
+		return nil, fmt.Errorf("audio file %s is shorter than one frame", path)
+	}
+	return data, nil
+}
+
+// wavData returns the contents of the data chunk of a WAV file.
+func wavData(wav []byte) ([]byte, error) {
+	if len(wav) < 12 || string(wav[8:12]) != "WAVE" {
+		return nil, fmt.Errorf("not a WAVE file")
+	}
+	for chunk := wav[12:]; len(chunk) >= 8; {
+		size := int(binary.LittleEndian.Uint32(chunk[4:8]))
+		body := chunk[8:]
+		if size > len(body) {
+			size = len(body)
+		}
+		if string(chunk[:4]) == "data" {
+			return body[:size], nil
+		}
+		// Chunks are padded to an even size
+		size += size % 2
+		if size > len(body) {
+			break
+		}
+		chunk = body[size:]
+	}
+	return nil, fmt.Errorf("no data chunk")
+}
+
+// Filler loops the filler audio on a call until stopped.
+type Filler struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startFiller starts looping the filler audio to call after the
+// configured delay, or returns nil if no filler is configured. The filler
+// stops when ctx is canceled or Stop is called.
+func startFiller(ctx context.Context, call *Call) *Filler {
+	if len(fillerAudio) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	f := &Filler{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(f.done)
+		select {
+		case <-clock.After(time.Duration(config.Filler.DelayMs) * time.Millisecond):
+		case <-ctx.Done():
+			return
+		}
+
+		// The filler is always paced, or looping it would flood the call
+		size := call.frameBytes()
+		w := NewPacedWriter(ctx, &AudioWriter{stream: call.Stream, frameSize: size, onWrite: call.played}, size)
+		for {
+			if _, err := w.Write(fillerAudio); err != nil {
+				if ctx.Err() == nil {
+					log.Printf("call %s: failed to play filler: %v", call.ID, err)
+				}
+				break
+			}
+		}
+		<-w.done
+	}()
+	return f
+}
+
+// Stop stops the filler and waits until it has written its last frame, so
+// audio played afterwards never overlaps it.
+func (f *Filler) Stop() {
+	if f == nil {
+		return
+	}
+	f.cancel()
+	<-f.done
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"go-ast-client/api"
+)
+
+func TestFillerPlaysUntilReply(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.Filler.DelayMs = 0
+		c.Webhook.StateEvents = true
+	})
+	events := withWebhookQueue(t)
+	saved := fillerAudio
+	t.Cleanup(func() { fillerAudio = saved })
+	fillerAudio = bytes.Repeat([]byte{0x11}, 640)
+	withTTS(t, newTTSServer(t, bytes.Repeat([]byte{0x22}, 3200), 640))
+
+	release := make(chan struct{})
+	ollama := &fakeOllama{reply: func(ctx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error) {
+		<-release
+		return api.OllamaChatResponse{Message: api.OllamaResponseMessage{Role: "assistant", Content: "ok"}, Done: true}, nil
+	}}
+	_, store := newTestChat(t, "call", testSettings(0.7), ollama)
+	stream := NewScriptedStream()
+	call := NewCall("call", stream, func() {})
+	call.ChatStore = store
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleTranscription(context.Background(), call, "hello")
+	}()
+
+	// The filler loops while the LLM is thinking
+	deadline := time.Now().Add(5 * time.Second)
+	for len(stream.Written()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("no filler played during a slow LLM")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(release)
+	<-done
+	waitForState(t, events, stateListening)
+	// A filler left running would keep writing frames
+	time.Sleep(100 * time.Millisecond)
+
+	written := stream.Written()
+	first := -1
+	for i, frame := range written {
+		if frame[0] == 0x22 {
+			first = i
+			break
+		}
+	}
+	if first < 3 {
+		t.Fatalf("reply starts at frame %d, want it after the filler", first)
+	}
+	for i, frame := range written {
+		if frame[0] == 0x11 && i > first {
+			t.Fatalf("filler frame %d played after the reply started", i)
+		}
+	}
+}
+
+func TestFillerDisabled(t *testing.T) {
+	saved := fillerAudio
+	t.Cleanup(func() { fillerAudio = saved })
+	fillerAudio = nil
+	call := NewCall("call", NewScriptedStream(), func() {})
+	if f := startFiller(context.Background(), call); f != nil {
+		f.Stop()
+		t.Error("filler started without audio configured")
+	}
+}
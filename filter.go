@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// ContentFilter screens text going to the LLM and coming back from it.
+// filtered is the text with unwanted words redacted; blocked reports that
+// the text must not be used at all.
+type ContentFilter interface {
+	Filter(text string) (filtered string, blocked bool)
+}
+
+// ContentFilterConfig configures the wordlist content filter. Words are
+// matched case-insensitively as whole words.
+type ContentFilterConfig struct {
+	// Redact lists words replaced by a mask.
+	Redact []string `json:"redact"`
+	// Block lists words that reject the whole text.
+	Block []string `json:"block"`
+	// BlockedResponse is spoken instead when either side is blocked.
+	BlockedResponse string `json:"blocked_response"`
+}
+
+// NopFilter lets all text through unchanged.
+type NopFilter struct{}
+
+// Filter implements ContentFilter.
+func (NopFilter) Filter(text string) (string, bool) {
+	return text, false
+}
+
+// WordlistFilter is a ContentFilter based on fixed lists of words.
+type WordlistFilter struct {
+	redact map[string]bool
+	block  map[string]bool
+}
+
+// NewWordlistFilter creates a WordlistFilter redacting and blocking the
+// given words.
+func NewWordlistFilter(redact, block []string) *WordlistFilter {
+	f := &WordlistFilter{
+		redact: make(map[string]bool),
+		block:  make(map[string]bool),
+	}
+	for _, w := range redact {
+		f.redact[strings.ToLower(w)] = true
+	}
+	for _, w := range block {
+		f.block[strings.ToLower(w)] = true
+	}
+	return f
+}
+
+// Filter implements ContentFilter.
+func (f *WordlistFilter) Filter(text string) (string, bool) {
+	var out strings.Builder
+	var word []rune
+	blocked := false
+	flush := func() {
+		if len(word) == 0 {
+			return
+		}
+		w := strings.ToLower(string(word))
+		switch {
+		case f.block[w]:
+			blocked = true
+			out.WriteString(string(word))
+		case f.redact[w]:
+			out.WriteString(strings.Repeat("*", len(word)))
+		default:
+			out.WriteString(string(word))
+		}
+		word = word[:0]
+	}
+
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			word = append(word, r)
+			continue
+		}
+		flush()
+		out.WriteRune(r)
+	}
+	flush()
+	return out.String(), blocked
+}
+
+// newContentFilter returns the filter described by cfg, or a NopFilter if
+// it has no words.
+func newContentFilter(cfg ContentFilterConfig) ContentFilter {
+	if len(cfg.Redact) == 0 && len(cfg.Block) == 0 {
+		return NopFilter{}
+	}
+	return NewWordlistFilter(cfg.Redact, cfg.Block)
+}
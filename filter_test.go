@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"go-ast-client/api"
+)
+
+func TestWordlistFilterRedacts(t *testing.T) {
+	f := NewWordlistFilter([]string{"damn", "Чёрт"}, nil)
+	tests := []struct {
+		text, want string
+	}{
+		{"well damn it", "well **** it"},
+		{"DAMN, again!", "****, again!"},
+		{"чёрт побери", "**** побери"},
+		// Only whole words are matched
+		{"damnation", "damnation"},
+		{"nothing to see", "nothing to see"},
+	}
+	for _, tt := range tests {
+		got, blocked := f.Filter(tt.text)
+		if got != tt.want || blocked {
+			t.Errorf("Filter(%q) = %q, %v, want %q, false", tt.text, got, blocked, tt.want)
+		}
+	}
+}
+
+func TestWordlistFilterBlocks(t *testing.T) {
+	f := NewWordlistFilter([]string{"damn"}, []string{"password"})
+	if _, blocked := f.Filter("my Password is hunter2, damn"); !blocked {
+		t.Error("text with a blocked word not blocked")
+	}
+	if _, blocked := f.Filter("passwords are hard"); blocked {
+		t.Error("text blocked on part of a word")
+	}
+}
+
+func TestNewContentFilter(t *testing.T) {
+	if _, ok := newContentFilter(ContentFilterConfig{BlockedResponse: "no"}).(NopFilter); !ok {
+		t.Error("filter without words is not a NopFilter")
+	}
+	if text, blocked := (NopFilter{}).Filter("anything at all"); text != "anything at all" || blocked {
+		t.Errorf("NopFilter changed the text to %q, %v", text, blocked)
+	}
+	if _, ok := newContentFilter(ContentFilterConfig{Block: []string{"x"}}).(*WordlistFilter); !ok {
+		t.Error("filter with words is not a WordlistFilter")
+	}
+}
+
+// filteredCall returns a call answering through ollama whose content is
+// filtered by the config's content filter.
+func filteredCall(t *testing.T, ollama *fakeOllama) *Call {
+	t.Helper()
+	_, store := newTestChat(t, "call", testSettings(0.7), ollama)
+	call := NewCall("call", NewScriptedStream(), func() {})
+	call.ChatStore = store
+	return call
+}
+
+func TestBlockedTranscriptionNotSent(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ContentFilter = ContentFilterConfig{Block: []string{"password"}, BlockedResponse: "I can't discuss that."}
+		c.Webhook.StateEvents = true
+	})
+	events := withWebhookQueue(t)
+	tts := newTTSServer(t, make([]byte, 640), 320)
+	withTTS(t, tts)
+	ollama := &fakeOllama{}
+	call := filteredCall(t, ollama)
+
+	handleTranscription(context.Background(), call, "my password is hunter2")
+	waitForState(t, events, stateListening)
+	if n := len(ollama.Requests()); n != 0 {
+		t.Errorf("%d LLM requests for a blocked transcription", n)
+	}
+	if requests := tts.Requests(); len(requests) != 1 || fmt.Sprint(requests[0]["message"]) != "I can't discuss that." {
+		t.Errorf("synthesis requests = %v, want the blocked response", requests)
+	}
+}
+
+func TestRedactedTranscriptionSent(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ContentFilter = ContentFilterConfig{Redact: []string{"hunter2"}}
+		c.Webhook.StateEvents = true
+	})
+	events := withWebhookQueue(t)
+	tts := newTTSServer(t, make([]byte, 640), 320)
+	withTTS(t, tts)
+	ollama := &fakeOllama{}
+	call := filteredCall(t, ollama)
+
+	handleTranscription(context.Background(), call, "my code is hunter2")
+	waitForState(t, events, stateListening)
+	requests := ollama.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("%d LLM requests, want 1", len(requests))
+	}
+	messages := requests[0].Messages
+	if got := messages[len(messages)-1].Content; got != "my code is *******" {
+		t.Errorf("LLM got %q, want the redacted transcription", got)
+	}
+}
+
+func TestBlockedResponseNotSpoken(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ContentFilter = ContentFilterConfig{Block: []string{"secret"}, BlockedResponse: "I can't discuss that."}
+		c.Webhook.StateEvents = true
+	})
+	events := withWebhookQueue(t)
+	tts := newTTSServer(t, make([]byte, 640), 320)
+	withTTS(t, tts)
+	call := filteredCall(t, &fakeOllama{reply: func(ctx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error) {
+		return api.OllamaChatResponse{Message: api.OllamaResponseMessage{Role: "assistant", Content: "The secret is 42."}, Done: true}, nil
+	}})
+
+	handleTranscription(context.Background(), call, "tell me")
+	waitForState(t, events, stateListening)
+	if requests := tts.Requests(); len(requests) != 1 || fmt.Sprint(requests[0]["message"]) != "I can't discuss that." {
+		t.Errorf("synthesis requests = %v, want the blocked response instead of the reply", requests)
+	}
+}
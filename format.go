@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"go-ast-client/api"
+	"log"
+	"time"
+)
+
+// supportedSampleRates are the SLIN rates the VAD can handle: slin, slin16,
+// slin32 and slin48.
+var supportedSampleRates = []int{8000, 16000, 32000, 48000}
+
+// negotiateSampleRate determines the rate of a call's inbound audio from
+// the size of its first SLIN frame. A rate declared in the chat settings
+// wins over detection; frames that don't fit it are only logged, as
+// Asterisk may use a different packetization.
+func negotiateSampleRate(settings api.AsteriskSettings, frameSize int) (int, error) {
+	if settings.AsteriskSampleRate != nil {
+		rate := *settings.AsteriskSampleRate
+		if !isSupportedSampleRate(rate) {
+			return 0, fmt.Errorf("unsupported sample rate %d in chat settings", rate)
+		}
+		if detected, err := detectSampleRate(frameSize); err != nil || detected != rate {
+			log.Printf("%d byte frames don't match the %d Hz sample rate in the chat settings", frameSize, rate)
+		}
+		return rate, nil
+	}
+
+	rate, err := detectSampleRate(frameSize)
+	if err != nil {
+		return 0, err
+	}
+	if !isSupportedSampleRate(rate) {
+		return 0, fmt.Errorf("unsupported audio format: %d byte frames (%d Hz)", frameSize, rate)
+	}
+	if rate != config.InputSampleRate {
+		log.Printf("detected %d Hz audio instead of the configured %d Hz", rate, config.InputSampleRate)
+	}
+	return rate, nil
+}
+
+// detectSampleRate infers the sample rate of 16-bit mono SLIN from the size
+// of a frame lasting audio_frame_ms.
+func detectSampleRate(frameSize int) (int, error) {
+	if frameSize%2 != 0 {
+		return 0, fmt.Errorf("unsupported audio format: odd frame size %d is not 16-bit audio", frameSize)
+	}
+	return frameSize / 2 * 1000 / config.AudioFrameMs, nil
+}
+
+// audioFrameDuration is the playing time of one AudioSocket frame.
+func audioFrameDuration() time.Duration {
+	return time.Duration(config.AudioFrameMs) * time.Millisecond
+}
+
+func isSupportedSampleRate(rate int) bool {
+	for _, r := range supportedSampleRates {
+		if r == rate {
+			return true
+		}
+	}
+	return false
+}
+
+// downmixStereo converts interleaved 16-bit stereo SLIN to mono by
+// averaging the channels. A trailing partial sample pair is dropped.
+func downmixStereo(pcm []byte) []byte {
+	mono := make([]byte, len(pcm)/4*2)
+	for i := 0; i < len(mono)/2; i++ {
+		left := int16(binary.LittleEndian.Uint16(pcm[4*i:]))
+		right := int16(binary.LittleEndian.Uint16(pcm[4*i+2:]))
+		binary.LittleEndian.PutUint16(mono[2*i:], uint16(int16((int32(left)+int32(right))/2)))
+	}
+	return mono
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/CyCoreSystems/audiosocket"
+
+	"go-ast-client/api"
+)
+
+func TestNegotiateSampleRate(t *testing.T) {
+	withConfig(t, func(c *Config) { c.AudioFrameMs = 20 })
+	tests := []struct {
+		name      string
+		declared  *int
+		frameSize int
+		want      int
+		wantErr   bool
+	}{
+		{"slin", nil, 320, 8000, false},
+		{"slin16", nil, 640, 16000, false},
+		{"slin48", nil, 1920, 48000, false},
+		{"odd frame", nil, 321, 0, true},
+		{"unsupported rate", nil, 440, 0, true},
+		{"declared rate wins", intPtr(16000), 320, 16000, false},
+		{"unsupported declared rate", intPtr(11025), 320, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := negotiateSampleRate(api.AsteriskSettings{AsteriskSampleRate: tt.declared}, tt.frameSize)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: negotiateSampleRate() = %d, %v; want %d, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// negotiatedRate runs a call sending one frame of frameSize bytes with the
+// bridge configured for configured Hz, and returns the rate it settles on.
+func negotiatedRate(t *testing.T, configured, frameSize int) int {
+	t.Helper()
+	withConfig(t, func(c *Config) {
+		c.InputSampleRate = configured
+		c.AudioFrameMs = 20
+	})
+	id, _ := newTestCallChat(t, testSettings(0.7))
+	stream := newTestStream(audiosocket.IDMessage(id), audiosocket.SlinMessage(make([]byte, frameSize)))
+	stream.hold = true
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(context.Background(), stream)
+	}()
+	defer func() {
+		stream.Close()
+		<-done
+	}()
+
+	call := waitForCall(t, id.String(), stream)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		call.mu.Lock()
+		rate := call.rate
+		call.mu.Unlock()
+		if rate != 0 {
+			return rate
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("sample rate never negotiated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCallDetectsSlin8(t *testing.T) {
+	if rate := negotiatedRate(t, 16000, 320); rate != 8000 {
+		t.Errorf("negotiated %d Hz for 320 byte frames, want 8000", rate)
+	}
+}
+
+func TestCallDetectsSlin16(t *testing.T) {
+	if rate := negotiatedRate(t, 8000, 640); rate != 16000 {
+		t.Errorf("negotiated %d Hz for 640 byte frames, want 16000", rate)
+	}
+}
+
+func TestCallRejectsUnsupportedFormat(t *testing.T) {
+	id, _ := newTestCallChat(t, testSettings(0.7))
+	stream := newTestStream(audiosocket.IDMessage(id), audiosocket.SlinMessage(make([]byte, 321)))
+	stream.hold = true
+	runHandle(t, context.Background(), stream)
+	if !stream.HungUp() {
+		t.Error("call with an unsupported format not hung up")
+	}
+	if calls.Get(id.String()) != nil {
+		t.Error("rejected call still registered")
+	}
+}
+
+func TestDetectSampleRateAudioFrameMs(t *testing.T) {
+	tests := []struct {
+		frameMs, frameSize, want int
+	}{
+		{10, 160, 8000},
+		{20, 320, 8000},
+		{30, 480, 8000},
+		{30, 960, 16000},
+		{40, 3840, 48000},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(c *Config) { c.AudioFrameMs = tt.frameMs })
+		if got, err := detectSampleRate(tt.frameSize); err != nil || got != tt.want {
+			t.Errorf("detectSampleRate(%d) with %d ms frames = %d, %v; want %d", tt.frameSize, tt.frameMs, got, err, tt.want)
+		}
+	}
+}
+
+func TestPlaybackUsesAudioFrameMs(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.AudioFrameMs = 30
+		c.PacedPlayback = false
+	})
+	stream := NewScriptedStream()
+	call := NewCall("call", stream, func() {})
+	call.setSampleRate(8000)
+
+	playAudio(context.Background(), call, make([]byte, 3*480))
+	written := stream.Written()
+	if len(written) != 3 {
+		t.Fatalf("%d frames written, want 3", len(written))
+	}
+	for i, frame := range written {
+		if len(frame) != 480 {
+			t.Errorf("frame %d has %d bytes, want 30 ms of slin", i, len(frame))
+		}
+	}
+}
+
+func TestDownmixStereo(t *testing.T) {
+	// Interleaved left/right pairs
+	stereo := pcm16(100, 300, -100, -300, math.MaxInt16, math.MaxInt16, math.MinInt16, math.MinInt16, 1000, -1000, 7, 8)
+	want := []int16{200, -200, math.MaxInt16, math.MinInt16, 0, 7}
+	got := pcm16FromBytes(downmixStereo(stereo))
+	if !equalInt16s(got, want) {
+		t.Errorf("downmixStereo() = %v, want %v", got, want)
+	}
+	if n := len(downmixStereo(make([]byte, 640))); n != 320 {
+		t.Errorf("640 bytes of stereo gave %d bytes of mono, want 320", n)
+	}
+}
+
+func TestCallDownmixesStereo(t *testing.T) {
+	withConfig(t, func(c *Config) { c.InputChannels = 2 })
+	// 20 ms of 8 kHz stereo is as long as 20 ms of 16 kHz mono
+	if rate := negotiatedRate(t, 8000, 640); rate != 8000 {
+		t.Errorf("negotiated %d Hz for 640 byte stereo frames, want 8000", rate)
+	}
+}
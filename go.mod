@@ -10,8 +10,3 @@ require (
 )
 
 require github.com/gofrs/uuid v3.2.0+incompatible
-
-require (
-	github.com/JexSrs/go-ollama v0.0.0-20240524130700-9c34c46d4b9c // indirect
-	github.com/lib/pq v1.10.9 // indirect
-)
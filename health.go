@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// healthProbe checks that one dependency of the bridge is reachable.
+type healthProbe struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// httpProbe considers a dependency up if it answers a GET on rawURL with
+// anything but a server error.
+func httpProbe(name, rawURL string) healthProbe {
+	return healthProbe{name: name, check: func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("received status code %d", resp.StatusCode)
+		}
+		return nil
+	}}
+}
+
+// dialProbe considers a dependency up if a TCP connection to the host of
+// rawURL can be opened.
+func dialProbe(name, rawURL string) healthProbe {
+	return healthProbe{name: name, check: func(ctx context.Context) error {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return err
+		}
+		host := u.Host
+		if u.Port() == "" {
+			switch u.Scheme {
+			case "https", "wss":
+				host = net.JoinHostPort(u.Hostname(), "443")
+			default:
+				host = net.JoinHostPort(u.Hostname(), "80")
+			}
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}}
+}
+
+// healthProbes returns the probes for the configured dependencies.
+func healthProbes() []healthProbe {
+	probes := []healthProbe{
+		httpProbe("chat_api", chatAPIBaseURL),
+		httpProbe("ollama", ollamaAPIURL),
+		dialProbe("stt", transcribeURL),
+		dialProbe("tts", websocketURI),
+	}
+	if config.STTStreamURL != "" {
+		probes = append(probes, dialProbe("stt_stream", config.STTStreamURL))
+	}
+	for name, segment := range config.STTSegments {
+		probes = append(probes, dialProbe("stt:"+name, segment.URL))
+	}
+	return probes
+}
+
+// healthReport is the body of a readiness response.
+type healthReport struct {
+	Status string            `json:"status"`
+	Down   []string          `json:"down,omitempty"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// checkHealth runs probes concurrently, each bounded by timeout.
+func checkHealth(ctx context.Context, probes []healthProbe, timeout time.Duration) healthReport {
+	report := healthReport{Status: "ok"}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, probe := range probes {
+		wg.Add(1)
+		go func(probe healthProbe) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			if err := probe.check(ctx); err != nil {
+				mu.Lock()
+				if report.Errors == nil {
+					report.Errors = make(map[string]string)
+				}
+				report.Down = append(report.Down, probe.name)
+				report.Errors[probe.name] = err.Error()
+				mu.Unlock()
+			}
+		}(probe)
+	}
+	wg.Wait()
+	if len(report.Down) > 0 {
+		report.Status = "unavailable"
+		sort.Strings(report.Down)
+	}
+	return report
+}
+
+// healthHandler serves /healthz, which reports that the process is alive,
+// and /readyz, which probes the dependencies and answers 503 if any of
+// them is down.
+func healthHandler(probes []healthProbe, timeout time.Duration) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, healthReport{Status: "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		report := checkHealth(r.Context(), probes, timeout)
+		status := http.StatusOK
+		if len(report.Down) > 0 {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("failed to write response:", err)
+	}
+}
+
+// serveHealth runs the health server on addr until ctx is canceled.
+func serveHealth(ctx context.Context, addr string) {
+	timeout := time.Duration(config.HealthProbeTimeoutMs) * time.Millisecond
+	srv := &http.Server{Addr: addr, Handler: healthHandler(healthProbes(), timeout)}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	log.Printf("serving health checks on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Println("health server failed:", err)
+	}
+}
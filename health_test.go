@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closedAddress returns a URL nothing listens on.
+func closedAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return "http://" + addr
+}
+
+func readyz(t *testing.T, probes []healthProbe, timeout time.Duration) (int, healthReport) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	healthHandler(probes, timeout).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var report healthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("invalid report %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, report
+}
+
+func TestReadyzReportsDownBackend(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	probes := []healthProbe{
+		httpProbe("chat_api", up.URL),
+		dialProbe("tts", "ws"+strings.TrimPrefix(up.URL, "http")),
+		dialProbe("stt", closedAddress(t)),
+	}
+
+	code, report := readyz(t, probes, time.Second)
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("status %d with STT down, want 503", code)
+	}
+	if len(report.Down) != 1 || report.Down[0] != "stt" || report.Errors["stt"] == "" {
+		t.Errorf("report = %+v, want only stt down", report)
+	}
+}
+
+func TestReadyzAllUp(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only server errors count as down
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer up.Close()
+
+	code, report := readyz(t, []healthProbe{httpProbe("ollama", up.URL), dialProbe("stt", up.URL)}, time.Second)
+	if code != http.StatusOK || report.Status != "ok" || len(report.Down) != 0 {
+		t.Errorf("status %d, report %+v, want everything up", code, report)
+	}
+}
+
+func TestReadyzServerError(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+
+	if code, report := readyz(t, []healthProbe{httpProbe("chat_api", failing.URL)}, time.Second); code != http.StatusServiceUnavailable || len(report.Down) != 1 {
+		t.Errorf("status %d, report %+v, want chat_api down", code, report)
+	}
+}
+
+func TestReadyzProbeTimeout(t *testing.T) {
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hanging.Close()
+
+	start := time.Now()
+	code, report := readyz(t, []healthProbe{httpProbe("ollama", hanging.URL)}, 100*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("readiness took %v with a 100ms probe timeout", elapsed)
+	}
+	if code != http.StatusServiceUnavailable || len(report.Down) != 1 || report.Down[0] != "ollama" {
+		t.Errorf("status %d, report %+v, want the hanging backend down", code, report)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	rec := httptest.NewRecorder()
+	healthHandler([]healthProbe{dialProbe("stt", closedAddress(t))}, time.Second).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("liveness status %d with a backend down, want 200", rec.Code)
+	}
+}
+
+func TestHealthServerOffByDefault(t *testing.T) {
+	if addr := DefaultConfig().HealthAddr; addr != "" {
+		t.Errorf("default health_addr = %q, want the health server disabled", addr)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTPConfig tunes the connection pool shared by the chat backend, LLM and
+// STT clients.
+type HTTPConfig struct {
+	// MaxIdleConnsPerHost is how many idle connections are kept open to
+	// each backend host.
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host"`
+	// IdleConnTimeoutSeconds closes idle connections after this long.
+	IdleConnTimeoutSeconds int `json:"idle_conn_timeout_seconds"`
+	// KeepAliveSeconds is the TCP keep-alive interval. Negative disables
+	// keep-alive probes.
+	KeepAliveSeconds int `json:"keep_alive_seconds"`
+}
+
+// httpClient is the client shared by the backend integrations. main
+// replaces it with one using the configured transport.
+var httpClient = &http.Client{}
+
+// setRequestID tags a backend request with the call it is made for, using
+// the configured header.
+func setRequestID(h http.Header, callID string) {
+	if config.RequestIDHeader != "" && callID != "" {
+		h.Set(config.RequestIDHeader, callID)
+	}
+}
+
+// newHTTPTransport returns a transport tuned according to cfg.
+func newHTTPTransport(cfg HTTPConfig) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: time.Duration(cfg.KeepAliveSeconds) * time.Second,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	if transport.MaxIdleConns < cfg.MaxIdleConnsPerHost {
+		transport.MaxIdleConns = cfg.MaxIdleConnsPerHost
+	}
+	transport.IdleConnTimeout = time.Duration(cfg.IdleConnTimeoutSeconds) * time.Second
+	return transport
+}
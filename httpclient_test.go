@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"go-ast-client/api"
+)
+
+// countingServer counts the connections opened to it.
+type countingServer struct {
+	*httptest.Server
+	mu    sync.Mutex
+	conns int
+}
+
+func newCountingServer(t *testing.T, handler http.HandlerFunc) *countingServer {
+	t.Helper()
+	s := &countingServer{Server: httptest.NewUnstartedServer(handler)}
+	s.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+		}
+	}
+	s.Start()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Conns returns the number of connections opened so far.
+func (s *countingServer) Conns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+func TestNewHTTPTransport(t *testing.T) {
+	transport := newHTTPTransport(HTTPConfig{MaxIdleConnsPerHost: 500, IdleConnTimeoutSeconds: 90, KeepAliveSeconds: 30})
+	if transport.MaxIdleConnsPerHost != 500 {
+		t.Errorf("MaxIdleConnsPerHost = %d, want 500", transport.MaxIdleConnsPerHost)
+	}
+	if transport.MaxIdleConns < 500 {
+		t.Errorf("MaxIdleConns = %d caps the per host limit", transport.MaxIdleConns)
+	}
+	if transport.IdleConnTimeout != 90*time.Second {
+		t.Errorf("IdleConnTimeout = %v, want 90s", transport.IdleConnTimeout)
+	}
+}
+
+func TestChatAPIReusesConnections(t *testing.T) {
+	srv := newCountingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"chat"}`))
+	})
+	client := &http.Client{Transport: newHTTPTransport(DefaultConfig().HTTP)}
+	chats := NewChatAPI(srv.URL, WithHTTPClient(client))
+	for i := 0; i < 10; i++ {
+		if _, err := chats.GetChat("chat"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := srv.Conns(); n != 1 {
+		t.Errorf("10 sequential requests opened %d connections, want 1", n)
+	}
+}
+
+func TestTranscriberReusesConnections(t *testing.T) {
+	srv := newCountingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"transcription":"hello"}`))
+	})
+	transcriber := &HTTPTranscriber{
+		URL:         srv.URL,
+		HTTPClient:  &http.Client{Transport: newHTTPTransport(DefaultConfig().HTTP)},
+		Form:        DefaultConfig().STTForm,
+		ResponseKey: "transcription",
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := transcriber.Transcribe(context.Background(), make([]float32, 320), testSettings(0.7).STTSettings); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := srv.Conns(); n != 1 {
+		t.Errorf("10 sequential transcriptions opened %d connections, want 1", n)
+	}
+}
+
+// headerServer records the named header of every request, answering
+// transcription and chat requests and ending synthesis requests right away.
+type headerServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	values []string
+}
+
+func newHeaderServer(t *testing.T, name string) *headerServer {
+	t.Helper()
+	s := &headerServer{}
+	upgrader := websocket.Upgrader{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.values = append(s.values, r.Header.Get(name))
+		s.mu.Unlock()
+		if websocket.IsWebSocketUpgrade(r) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			var request map[string]interface{}
+			conn.ReadJSON(&request)
+			conn.WriteJSON(map[string]string{"type": "end_of_audio"})
+			return
+		}
+		w.Write([]byte(`{"id":"call-1","transcription":"hello"}`))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Values returns the header of every request received so far.
+func (s *headerServer) Values() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.values...)
+}
+
+// backendRequests sends one request to each kind of backend at srv for
+// the call with ID call-1.
+func backendRequests(t *testing.T, srv *headerServer) {
+	t.Helper()
+	transcriber := &HTTPTranscriber{URL: srv.URL, CallID: "call-1", Form: DefaultConfig().STTForm, ResponseKey: "transcription"}
+	if _, err := transcriber.Transcribe(context.Background(), make([]float32, 320), testSettings(0.7).STTSettings); err != nil {
+		t.Fatal(err)
+	}
+	uri := "ws" + strings.TrimPrefix(srv.URL, "http")
+	if err := playTTS(context.Background(), uri, "call-1", map[string]interface{}{"message": "hi"}, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewChatAPI(srv.URL, WithRequestIDHeader(config.RequestIDHeader)).GetChat("call-1"); err != nil {
+		t.Fatal(err)
+	}
+	chats := api.NewHTTPChatAPI(srv.URL)
+	chats.RequestIDHeader = config.RequestIDHeader
+	if _, err := chats.GetChat("call-1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequestIDOnEveryBackend(t *testing.T) {
+	for _, name := range []string{"X-Request-ID", "X-Correlation-ID"} {
+		withConfig(t, func(c *Config) { c.RequestIDHeader = name })
+		srv := newHeaderServer(t, name)
+		backendRequests(t, srv)
+
+		values := srv.Values()
+		if len(values) != 4 {
+			t.Fatalf("%d requests, want one to each backend", len(values))
+		}
+		for i, value := range values {
+			if value != "call-1" {
+				t.Errorf("%s: request %d has %q, want the call ID", name, i, value)
+			}
+		}
+	}
+}
+
+func TestRequestIDDisabled(t *testing.T) {
+	withConfig(t, func(c *Config) { c.RequestIDHeader = "" })
+	srv := newHeaderServer(t, "X-Request-ID")
+	backendRequests(t, srv)
+	for i, value := range srv.Values() {
+		if value != "" {
+			t.Errorf("request %d has X-Request-ID %q with the header disabled", i, value)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// InterruptSource identifies what asked for the current playback to stop.
+type InterruptSource string
+
+const (
+	InterruptVAD  InterruptSource = "vad"
+	InterruptDTMF InterruptSource = "dtmf"
+	InterruptAPI  InterruptSource = "api"
+)
+
+// BargeInConfig enables or disables each interruption source.
+type BargeInConfig struct {
+	VAD  bool `json:"vad"`
+	DTMF bool `json:"dtmf"`
+	API  bool `json:"api"`
+}
+
+func (c BargeInConfig) enabled(source InterruptSource) bool {
+	switch source {
+	case InterruptVAD:
+		return c.VAD
+	case InterruptDTMF:
+		return c.DTMF
+	case InterruptAPI:
+		return c.API
+	}
+	return false
+}
+
+// Policies for a playback started while another is in progress.
+const (
+	playbackCancel = "cancel"
+	playbackQueue  = "queue"
+)
+
+// closedChan is a channel that is always ready.
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// Interrupter owns the TTS playback of a single call. Barge-in signals from
+// any source are coalesced so the current playback is canceled exactly once.
+//
+// With the cancel policy a new playback replaces the one in progress. With
+// the queue policy it waits for the earlier ones to finish; barge-in still
+// cancels all of them.
+type Interrupter struct {
+	mu         sync.Mutex
+	config     BargeInConfig
+	queue      bool
+	active     map[int]context.CancelFunc
+	tail       chan struct{}
+	generation int
+	counts     map[InterruptSource]int
+	last       InterruptSource
+}
+
+// NewInterrupter creates an Interrupter honoring the enabled sources in
+// config and the playback policy.
+func NewInterrupter(config BargeInConfig, policy string) *Interrupter {
+	return &Interrupter{
+		config: config,
+		queue:  policy == playbackQueue,
+		active: make(map[int]context.CancelFunc),
+		tail:   closedChan,
+		counts: make(map[InterruptSource]int),
+	}
+}
+
+// StartPlayback returns a context for a new playback. It must wait to
+// start until the returned channel is ready, which with the cancel policy
+// is immediately, after canceling any playback in progress. The returned
+// function must be called once playback finishes.
+func (i *Interrupter) StartPlayback(parent context.Context) (context.Context, <-chan struct{}, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	finished := make(chan struct{})
+
+	i.mu.Lock()
+	if !i.queue {
+		i.cancelAll() // A new turn replaces the previous one
+	}
+	ready := i.tail
+	if !i.queue {
+		ready = closedChan
+	}
+	i.tail = finished
+	i.generation++
+	generation := i.generation
+	i.active[generation] = cancel
+	i.mu.Unlock()
+
+	return ctx, ready, func() {
+		i.mu.Lock()
+		delete(i.active, generation)
+		i.mu.Unlock()
+		cancel()
+		close(finished)
+	}
+}
+
+// cancelAll cancels every playback in progress or queued. i.mu must be
+// held.
+func (i *Interrupter) cancelAll() {
+	for generation, cancel := range i.active {
+		cancel()
+		delete(i.active, generation)
+	}
+}
+
+// Playing reports whether a playback is in progress or queued.
+func (i *Interrupter) Playing() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return len(i.active) > 0
+}
+
+// Interrupt cancels the current playback on behalf of source. It returns
+// false if the source is disabled or nothing is playing, including when
+// another source already interrupted the same playback.
+func (i *Interrupter) Interrupt(source InterruptSource) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if !i.config.enabled(source) || len(i.active) == 0 {
+		return false
+	}
+	i.cancelAll()
+	i.counts[source]++
+	i.last = source
+	log.Printf("playback interrupted by %s", source)
+	return true
+}
+
+// Stop cancels all playback regardless of the barge-in config. It
+// isn't counted as an interruption.
+func (i *Interrupter) Stop() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.cancelAll()
+}
+
+// Interruptions returns how many times each source interrupted playback,
+// and the most recent source.
+func (i *Interrupter) Interruptions() (map[InterruptSource]int, InterruptSource) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	counts := make(map[InterruptSource]int, len(i.counts))
+	for source, n := range i.counts {
+		counts[source] = n
+	}
+	return counts, i.last
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInterruptConcurrentSourcesCancelOnce(t *testing.T) {
+	i := NewInterrupter(BargeInConfig{VAD: true, DTMF: true, API: true}, playbackCancel)
+	ctx, ready, done := i.StartPlayback(context.Background())
+	defer done()
+	<-ready
+
+	sources := []InterruptSource{InterruptVAD, InterruptDTMF, InterruptAPI}
+	results := make([]bool, len(sources))
+	var wg sync.WaitGroup
+	for n, source := range sources {
+		wg.Add(1)
+		go func(n int, source InterruptSource) {
+			defer wg.Done()
+			results[n] = i.Interrupt(source)
+		}(n, source)
+	}
+	wg.Wait()
+
+	won := 0
+	for _, ok := range results {
+		if ok {
+			won++
+		}
+	}
+	if won != 1 {
+		t.Errorf("%d interrupts succeeded, want 1", won)
+	}
+	if ctx.Err() == nil {
+		t.Error("playback was not canceled")
+	}
+	counts, last := i.Interruptions()
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	if total != 1 || counts[last] != 1 {
+		t.Errorf("Interruptions() = %v, %q; want a single interruption", counts, last)
+	}
+	if i.Playing() {
+		t.Error("Playing() after the interruption")
+	}
+}
+
+func TestInterruptDisabledSource(t *testing.T) {
+	i := NewInterrupter(BargeInConfig{VAD: true}, playbackCancel)
+	ctx, _, done := i.StartPlayback(context.Background())
+	defer done()
+
+	if i.Interrupt(InterruptDTMF) {
+		t.Error("a disabled source interrupted playback")
+	}
+	if ctx.Err() != nil {
+		t.Error("playback canceled by a disabled source")
+	}
+	if !i.Interrupt(InterruptVAD) {
+		t.Error("an enabled source failed to interrupt playback")
+	}
+}
+
+func TestInterruptNothingPlaying(t *testing.T) {
+	i := NewInterrupter(BargeInConfig{VAD: true}, playbackCancel)
+	if i.Interrupt(InterruptVAD) {
+		t.Error("interrupted with nothing playing")
+	}
+	if counts, _ := i.Interruptions(); len(counts) != 0 {
+		t.Errorf("Interruptions() = %v, want none", counts)
+	}
+}
+
+// isReady reports whether ch is ready without waiting.
+func isReady(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestCancelPolicyReplacesPlayback(t *testing.T) {
+	i := NewInterrupter(BargeInConfig{}, playbackCancel)
+	first, _, firstDone := i.StartPlayback(context.Background())
+	second, ready, secondDone := i.StartPlayback(context.Background())
+	defer secondDone()
+
+	if first.Err() == nil {
+		t.Error("earlier playback not canceled by a new one")
+	}
+	if !isReady(ready) || second.Err() != nil {
+		t.Error("new playback not started right away")
+	}
+	firstDone()
+	if !i.Playing() {
+		t.Error("finishing the replaced playback stopped the new one")
+	}
+}
+
+func TestQueuePolicyWaitsForPlayback(t *testing.T) {
+	i := NewInterrupter(BargeInConfig{}, playbackQueue)
+	first, ready, firstDone := i.StartPlayback(context.Background())
+	if !isReady(ready) {
+		t.Fatal("first playback not started right away")
+	}
+	second, ready, secondDone := i.StartPlayback(context.Background())
+	defer secondDone()
+
+	if first.Err() != nil {
+		t.Error("earlier playback canceled by a queued one")
+	}
+	if isReady(ready) {
+		t.Fatal("queued playback started before the earlier one finished")
+	}
+	firstDone()
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("queued playback never started")
+	}
+	if second.Err() != nil {
+		t.Error("queued playback canceled")
+	}
+}
+
+func TestBargeInCancelsQueue(t *testing.T) {
+	i := NewInterrupter(BargeInConfig{VAD: true}, playbackQueue)
+	first, _, firstDone := i.StartPlayback(context.Background())
+	defer firstDone()
+	second, _, secondDone := i.StartPlayback(context.Background())
+	defer secondDone()
+
+	if !i.Interrupt(InterruptVAD) {
+		t.Fatal("barge-in failed to interrupt")
+	}
+	if first.Err() == nil || second.Err() == nil {
+		t.Error("barge-in left queued playback running")
+	}
+	if i.Playing() {
+		t.Error("Playing() after barge-in")
+	}
+}
+
+// playTwoReplies plays two replies back to back on a call with policy and
+// returns the frames written once playback ends, and how many frames one
+// reply takes.
+func playTwoReplies(t *testing.T, policy string) (written, reply int) {
+	t.Helper()
+	withConfig(t, func(c *Config) {
+		c.PlaybackPolicy = policy
+		c.Webhook.StateEvents = true
+	})
+	events := withWebhookQueue(t)
+	tts := newTTSServer(t, make([]byte, 640*10), 640)
+	tts.delay = 10 * time.Millisecond
+	stream := NewScriptedStream()
+	call := NewCall("call", stream, func() {})
+
+	websocketSendReceive(context.Background(), tts.URI(), map[string]interface{}{"message": "first"}, call)
+	websocketSendReceive(context.Background(), tts.URI(), map[string]interface{}{"message": "second"}, call)
+	waitForState(t, events, stateListening)
+	return len(stream.Written()), len(tts.audio) / call.frameBytes()
+}
+
+func TestPlaybackPolicies(t *testing.T) {
+	if frames, reply := playTwoReplies(t, playbackQueue); frames != 2*reply {
+		t.Errorf("queue policy wrote %d frames, want both replies of %d in full", frames, reply)
+	}
+	if frames, reply := playTwoReplies(t, playbackCancel); frames >= 2*reply {
+		t.Errorf("cancel policy wrote %d frames, want the first reply of %d cut off", frames, reply)
+	}
+}
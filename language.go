@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// minDetectLetters is the fewest letters a text needs for the script
+// heuristic to be confident at all.
+const minDetectLetters = 3
+
+// LanguageDetector guesses the language of a text. confidence is between 0
+// and 1.
+type LanguageDetector interface {
+	Detect(text string) (language string, confidence float64)
+}
+
+// languageDetector is used for calls with language detection enabled.
+var languageDetector LanguageDetector = ScriptDetector{}
+
+// scriptLanguages maps writing systems to the language assumed for them.
+var scriptLanguages = []struct {
+	script   *unicode.RangeTable
+	language string
+}{
+	{unicode.Cyrillic, "ru"},
+	{unicode.Latin, "en"},
+	{unicode.Greek, "el"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Armenian, "hy"},
+	{unicode.Georgian, "ka"},
+	{unicode.Hangul, "ko"},
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Han, "zh"},
+}
+
+// ScriptDetector detects the language from the dominant writing system. It
+// can't tell apart languages sharing a script, e.g. all Latin text is
+// reported as English.
+type ScriptDetector struct{}
+
+// Detect implements LanguageDetector. The confidence is the share of
+// letters written in the dominant script.
+func (ScriptDetector) Detect(text string) (string, float64) {
+	counts := make(map[string]int)
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		for _, sl := range scriptLanguages {
+			if unicode.Is(sl.script, r) {
+				counts[sl.language]++
+				break
+			}
+		}
+	}
+	if letters < minDetectLetters {
+		return "", 0
+	}
+
+	best, bestCount := "", 0
+	for _, sl := range scriptLanguages {
+		if n := counts[sl.language]; n > bestCount {
+			best, bestCount = sl.language, n
+		}
+	}
+	return best, float64(bestCount) / float64(letters)
+}
+
+// stripAnnotations removes the emotion annotation the STT service prepends
+// to transcriptions, leaving only what the caller said.
+func stripAnnotations(text string) string {
+	if strings.HasPrefix(text, "[") {
+		if i := strings.Index(text, "]\n"); i >= 0 {
+			return text[i+2:]
+		}
+	}
+	return text
+}
@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestScriptDetector(t *testing.T) {
+	tests := []struct {
+		text     string
+		language string
+		minConf  float64
+	}{
+		{"Здравствуйте, я хотел бы записаться на приём", "ru", 1},
+		{"Hello, I would like to book an appointment", "en", 1},
+		// Mixed text goes with the dominant script
+		{"Мой email это ivan, спасибо большое", "ru", 0.6},
+		{"Please call Иван back tomorrow morning", "en", 0.6},
+	}
+	for _, tt := range tests {
+		language, confidence := ScriptDetector{}.Detect(tt.text)
+		if language != tt.language || confidence < tt.minConf {
+			t.Errorf("Detect(%q) = %q, %.2f, want %q with at least %.2f", tt.text, language, confidence, tt.language, tt.minConf)
+		}
+	}
+
+	for _, text := range []string{"", "12 345", "да", "?!"} {
+		if language, confidence := (ScriptDetector{}).Detect(text); confidence != 0 {
+			t.Errorf("Detect(%q) = %q, %.2f, want no confidence", text, language, confidence)
+		}
+	}
+}
+
+func TestCallDetectLanguage(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.Language = "ru"
+		c.LanguageMinConfidence = 0.8
+	})
+	call := NewCall("call", NewScriptedStream(), func() {})
+
+	call.DetectLanguage("Hello, is anybody there?")
+	if got := call.Language(); got != "en" {
+		t.Errorf("language = %q after English, want en", got)
+	}
+	call.DetectLanguage("Да, я здесь")
+	if got := call.Language(); got != "ru" {
+		t.Errorf("language = %q after Russian, want ru", got)
+	}
+	// Too evenly mixed to tell, so the configured language is used
+	call.DetectLanguage("Hello привет")
+	if got := call.Language(); got != "ru" {
+		t.Errorf("language = %q on low confidence, want the configured ru", got)
+	}
+	call.DetectLanguage("ok")
+	if got := call.Language(); got != "ru" {
+		t.Errorf("language = %q on too short a text, want the configured ru", got)
+	}
+}
+
+func TestStripAnnotations(t *testing.T) {
+	if got := stripAnnotations("[neutral]\nHello there"); got != "Hello there" {
+		t.Errorf("stripAnnotations() = %q", got)
+	}
+	if got := stripAnnotations("[not an annotation"); got != "[not an annotation" {
+		t.Errorf("stripAnnotations() = %q, want the text unchanged", got)
+	}
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"go-ast-client/api"
+	"go-ast-client/settings"
 	"io"
 	"io/ioutil"
 	"log"
@@ -14,63 +15,226 @@ import (
 	"mime/multipart"
 	"net"
 	"net/http"
+	"net/textproto"
 	"net/url"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/CyCoreSystems/audiosocket"
-	"github.com/JexSrs/go-ollama"
 	"github.com/gofrs/uuid"
 	"github.com/gorilla/websocket"
-	"github.com/maxhawkins/go-webrtcvad"
 	"github.com/pkg/errors"
 )
 
+// websocketURI is the TTS service.
+var websocketURI = "ws://localhost:8011/ws"
+
 const (
-	slinChunkSize   = 320 // 8000Hz * 20ms * 2 bytes
-	websocketURI    = "ws://localhost:8011/ws"
-	listenAddr      = ":9092"
 	ollamaAPIURL    = "http://localhost:11434"
 	chatAPIBaseURL  = "http://127.0.0.1:8009/api"
 	transcribeURL   = "http://localhost:8002/complete_transcribe_r"
 	systemPromptKey = "system_prompt" // Assuming you have a key for system prompt in settings
+
+	closingMessageTimeout = 15 * time.Second
+	maxAcceptDelay        = 1 * time.Second
+
+	// Limits for AutomaticGain
+	agcMaxGain     = 10.0
+	agcPeakCeiling = 0.99
+	agcNoiseFloor  = 0.001
+
+	// defaultTTSAwaitTime is the TTS chunk pacing used unless the chat
+	// settings have one.
+	defaultTTSAwaitTime = 0.015
+
+	// kindDTMF carries a DTMF digit; newer Asterisk versions send it but the
+	// audiosocket package doesn't define it yet.
+	kindDTMF = 0x03
 )
 
 var chatAPI = api.NewHTTPChatAPI("http://127.0.0.1:8009/api")
-var ollamaAPI = api.NewHTTPollamaAPIClient("http://127.0.0.1:8009/api")
+var ollamaAPI api.OllamaAPIClient = api.NewHTTPollamaAPIClient("http://127.0.0.1:8009/api")
+
+// chatBackend is the chat API used by calls: chatAPI, possibly behind a
+// settings cache.
+var chatBackend api.ChatAPI = chatAPI
 
-var API = NewChatAPI("http://127.0.0.1:8009/api")
-var LLM = ollama.New(url.URL{Scheme: "http", Host: "localhost:11434"})
+var API ChatAPI = NewChatAPI("http://127.0.0.1:8009/api")
 var ErrHangup = errors.New("Hangup")
 
+var config = DefaultConfig()
+
+// activeCalls tracks running Handle goroutines so shutdown can wait for
+// them to finalize.
+var activeCalls sync.WaitGroup
+
 func main() {
 	var err error
-	ctx := context.Background()
-	log.Println("listening for AudioSocket connections on", listenAddr)
+	configPath := flag.String("config", "", "path to a JSON config file")
+	flag.Parse()
+	if *configPath != "" {
+		if config, err = LoadConfig(*configPath); err != nil {
+			log.Fatalln("config failure:", err)
+		}
+	}
+	var transport http.RoundTripper = newHTTPTransport(config.HTTP)
+	var exporter *OTLPExporter
+	if config.Tracing.OTLPEndpoint != "" {
+		exporter = NewOTLPExporter(config.Tracing, &http.Client{Transport: transport})
+		spanExporter = exporter
+		transport = traceTransport{Base: transport}
+	}
+	httpClient = &http.Client{Transport: transport}
+	backendClient := httpClient
+	if config.ChatAPIToken != "" {
+		auth := &api.AuthTransport{Base: transport, Token: api.StaticToken(config.ChatAPIToken)}
+		backendClient = &http.Client{Transport: auth}
+	}
+	chatAPI.HTTPClient = backendClient
+	chatAPI.RequestIDHeader = config.RequestIDHeader
+	ollamaAPI = &api.HTTPollamaAPIClient{BaseURL: chatAPIBaseURL, HTTPClient: backendClient}
+	API = NewChatAPI(chatAPIBaseURL, WithHTTPClient(backendClient), WithRequestIDHeader(config.RequestIDHeader))
+	api.LogContent = config.LogLevel == logLevelDebug
+	api.Now = clock.Now
+	textNormalizers = newTextNormalizers(config)
+	registerTools(config.Tools)
+	if transcriptRewrites, err = compileTranscriptRules(config.TranscriptRules); err != nil {
+		log.Fatalln("config failure:", err)
+	}
+	if config.Filler.File != "" {
+		if fillerAudio, err = loadAudioFile(config.Filler.File); err != nil {
+			log.Fatalln("config failure:", err)
+		}
+	}
+	if config.Unavailable.File != "" {
+		if unavailableFile, err = loadAudioFile(config.Unavailable.File); err != nil {
+			log.Fatalln("config failure:", err)
+		}
+	} else if config.Unavailable.Message != "" {
+		go unavailableAudioFor(config.InputSampleRate)
+	}
+	utteranceLimiter = NewRateLimiter(config.UtteranceRateLimit)
+	queueTimeout := time.Duration(config.BackendConcurrency.QueueTimeoutMs) * time.Millisecond
+	sttLimiter = NewConcurrencyLimiter(config.BackendConcurrency.STT, queueTimeout)
+	llmLimiter = NewConcurrencyLimiter(config.BackendConcurrency.LLM, queueTimeout)
+	if config.CallState.Enabled {
+		callStates = NewMemoryCallStateStore(time.Duration(config.CallState.TTLSeconds) * time.Second)
+	}
+	if config.SettingsCache.Enabled {
+		ttl := time.Duration(config.SettingsCache.TTLSeconds) * time.Second
+		chatBackend = api.NewCachingChatAPI(chatAPI, ttl)
+	}
+	if config.Webhook.URL != "" {
+		webhooks = NewWebhookEmitter(config.Webhook, httpClient)
+	}
+	if config.ResponseCache.Enabled {
+		ttl := time.Duration(config.ResponseCache.TTLSeconds) * time.Second
+		ollamaAPI = api.NewCachingOllamaClient(ollamaAPI, config.ResponseCache.Window, ttl)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if config.HealthAddr != "" {
+		go serveHealth(ctx, config.HealthAddr)
+	}
+	if config.AdminAddr != "" {
+		go serveAdmin(ctx, config.AdminAddr)
+	}
+	log.Printf("listening for AudioSocket connections on %s %s", config.ListenNetwork, config.ListenAddr)
 	if err = Listen(ctx); err != nil {
 		log.Fatalln("listen failure:", err)
 	}
 
+	log.Println("waiting for active calls to finish")
+	activeCalls.Wait()
+	webhooks.Close()
+	if exporter != nil {
+		exporter.Close()
+	}
 	log.Println("exiting")
 }
 func Listen(ctx context.Context) error {
-	l, err := net.Listen("tcp", listenAddr)
+	if config.ListenNetwork == "unix" {
+		if err := removeStaleSocket(config.ListenAddr); err != nil {
+			return err
+		}
+	}
+	// Unix listeners remove their socket file when closed on shutdown
+	l, err := net.Listen(config.ListenNetwork, config.ListenAddr)
 	if err != nil {
-		return errors.Wrapf(err, "failed to bind listener to socket %s", listenAddr)
+		return errors.Wrapf(err, "failed to bind listener to socket %s", config.ListenAddr)
 	}
+	return Serve(ctx, l)
+}
 
+// removeStaleSocket deletes a unix socket file left behind by a previous
+// run. Anything other than a socket at path is left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat socket %s", path)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("%s exists and is not a socket", path)
+	}
+	return errors.Wrapf(os.Remove(path), "failed to remove stale socket %s", path)
+}
+
+// Serve accepts AudioSocket connections on l until ctx is canceled or l
+// fails permanently. Temporary accept errors, such as running out of file
+// descriptors, are retried with an increasing delay.
+func Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	var tempDelay time.Duration
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			log.Println("failed to accept new connection:", err)
-			continue
+			if ctx.Err() != nil {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > maxAcceptDelay {
+					tempDelay = maxAcceptDelay
+				}
+				log.Printf("failed to accept new connection: %v; retrying in %v", err, tempDelay)
+				select {
+				case <-clock.After(tempDelay):
+				case <-ctx.Done():
+					return nil
+				}
+				continue
+			}
+			return errors.Wrap(err, "failed to accept new connection")
 		}
+		tempDelay = 0
 
-		go Handle(ctx, conn)
+		activeCalls.Add(1)
+		go func() {
+			defer activeCalls.Done()
+			Handle(ctx, NewAudioSocketStream(conn))
+		}()
 	}
 }
-func getCallID(c net.Conn) (uuid.UUID, error) {
-	m, err := audiosocket.NextMessage(c)
+
+func getCallID(s MessageStream) (uuid.UUID, error) {
+	m, err := s.NextMessage()
 	if err != nil {
 		return uuid.Nil, err
 	}
@@ -80,42 +244,193 @@ func getCallID(c net.Conn) (uuid.UUID, error) {
 	return uuid.FromBytes(m.Payload())
 }
 
-func Handle(pCtx context.Context, c net.Conn) {
+// Handle runs a call on s until the caller hangs up or the call ends.
+func Handle(pCtx context.Context, s MessageStream) {
 	ctx, cancel := context.WithCancel(pCtx)
 	defer cancel()
-	defer c.Close()
-	vad, err := webrtcvad.New()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := vad.SetMode(3); err != nil {
-		log.Fatal(err)
-	}
-	id, err := getCallID(c)
+	defer s.Close()
+	vad := newVoiceDetector(config.VAD)
+	id, err := getCallID(s)
 	if err != nil {
 		log.Println("failed to get call ID:", err)
 		return
 	}
+	// The maximum duration counts from here, loading the chat included
+	accepted := clock.Now()
 	log.Printf("processing call %s", id.String())
 
 	ChatID := id.String()
 	log.Println("ChatID:", ChatID)
-	chatStore, err := api.LoadChatStore(ChatID, chatAPI, ollamaAPI)
+	ctx, span := startSpan(ctx, "call")
+	span.SetAttribute("call.id", ChatID)
+	defer span.End()
+	call := NewCall(ChatID, s, cancel)
+	if !admitCall(call) {
+		return
+	}
+	defer calls.Unregister(call)
+	startRecording(call)
+	defer call.stopRecording()
+
+	state := loadCallState(ChatID)
+	chatStore, err := loadChat(ChatID, state)
+	degraded := false
+	if err != nil && config.DegradedMode.Enabled {
+		log.Printf("call %s: failed to get chat, continuing in degraded mode: %v", ChatID, err)
+		chatStore, err = degradedChat(ChatID)
+		degraded = true
+	}
 	if err != nil {
 		log.Println("failed to get chat:", err)
 		return
 	}
+	// Settings given for an originated call or made up in degraded mode
+	// aren't the backend's, so they aren't refreshed from it
+	call.refreshable = !degraded
+	if settings, ok := originated.Take(ChatID); ok {
+		log.Println("using the settings of originated call", ChatID)
+		chatStore.SetSettings(settings)
+		call.refreshable = false
+		// Originate names the channel after the call
+		call.setChannelID(ChatID)
+	}
+	if s := chatStore.Settings(); clampSettings(ChatID, &s) {
+		chatStore.SetSettings(s)
+	}
+	if !config.ReplayHistory && state == nil {
+		chatStore.DropHistory()
+	}
+	call.SetChatStore(chatStore)
+	call.settingsFetched = clock.Now()
+	if state != nil {
+		log.Printf("call %s: resuming from the checkpoint of %s", ChatID, state.Saved.Format(time.RFC3339))
+		call.restore(state)
+	}
+	defer call.Finalize()
+
+	started := clock.Now()
+	webhooks.Emit(eventCallStarted, ChatID, map[string]interface{}{
+		"remote_addr": call.RemoteAddr,
+		"number":      chatStore.Settings().AsteriskSettings.AsteriskNumber,
+		"degraded":    degraded,
+	})
+	call.setState(stateListening)
+	defer func() {
+		interruptions, _ := call.Interrupter.Interruptions()
+		webhooks.Emit(eventCallEnded, ChatID, map[string]interface{}{
+			"duration_seconds": since(started).Seconds(),
+			"usage":            call.Usage(),
+			"leg":              call.Leg(),
+			"interruptions":    interruptions,
+		})
+	}()
+
+	if limit := maxCallDuration(chatStore.Settings().AsteriskSettings); limit > 0 {
+		var cancelLimit context.CancelFunc
+		ctx, cancelLimit = withTimeout(ctx, limit-since(accepted))
+		defer cancelLimit()
+	}
+
+	if degraded && config.DegradedMode.Notice != "" {
+		websocketSendReceive(ctx, websocketURI, call.ttsPayload(config.DegradedMode.Notice), call)
+	}
 
-	rate := 16000
+	// Unblock the read loop when the call is canceled, e.g. on shutdown
+	go func() {
+		<-ctx.Done()
+		interruptStream(s)
+	}()
+
+	// The audio format is negotiated on the first frame
+	var rate int
+	var resampler *Resampler
+	var vadFrames *FrameAligner
+	var active bool
 	silenceThreshold := 5
-	var inputAudioBuffer [][]float32
+	// The hangover tail must be collected before the utterance is finalized
+	endOfSpeech := silenceThreshold
+	if config.VAD.HangoverFrames > endOfSpeech {
+		endOfSpeech = config.VAD.HangoverFrames
+	}
+	preRoll := newFrameRing(config.VAD.PreRollFrames)
+
+	inputAudioBuffer := NewUtteranceBuffer(config.AudioBuffer, config.STTSampleRate)
+	defer inputAudioBuffer.Reset()
+
+	// Utterances are processed off the read loop; on return, in-flight
+	// processing is canceled before the call is finalized
+	processor := startUtteranceProcessor(ctx, call, time.Duration(config.UtteranceMergeGapMs)*time.Millisecond)
+	call.turns = processor
+	defer func() {
+		cancel()
+		processor.Stop()
+		call.stopFiller()
+	}()
+
+	// With a streaming transcriber, frames are sent as they're captured. If
+	// the stream can't be opened the utterance is transcribed in batch.
+	var stream *utteranceStream
+	var streamFailed bool
+	defer func() {
+		if stream != nil {
+			stream.Abort()
+		}
+	}()
+	appendFrame := func(frame []float32) bool {
+		if call.Streamer != nil && stream == nil && !streamFailed {
+			var err error
+			if stream, err = startUtteranceStream(ctx, call.Streamer, call.sttSettings()); err != nil {
+				log.Println("failed to start streaming transcription:", err)
+				streamFailed = true
+			}
+		}
+		if stream != nil {
+			stream.Push(frame)
+		}
+		return inputAudioBuffer.Append(frame)
+	}
+	finishUtterance := func() {
+		frames, err := inputAudioBuffer.Frames()
+		inputAudioBuffer.Reset()
+		if err != nil {
+			log.Println("failed to read utterance:", err)
+			if stream != nil {
+				stream.Abort()
+			}
+		} else {
+			processor.Submit(utterance{frames: frames, stream: stream})
+		}
+		stream = nil
+		streamFailed = false
+	}
 	var silenceCount int
+	// endSilence finishes the utterance once the silence has lasted long
+	// enough
+	endSilence := func() {
+		if silenceCount > endOfSpeech && inputAudioBuffer.Len() > 0 {
+			log.Println("Processing complete sentence")
+			finishUtterance()
+		}
+	}
+
+	idleLimit := idleTimeout(chatStore.Settings().AsteriskSettings)
+	lastSpeech := clock.Now()
+	reprompts := newReprompter(config.Reprompt)
 
+	messages := readMessages(ctx, s, ChatID)
 	for ctx.Err() == nil {
-		m, err := audiosocket.NextMessage(c)
-		if errors.Cause(err) == io.EOF {
-			log.Println("audiosocket closed")
-			return
+		var m audiosocket.Message
+		select {
+		case <-ctx.Done():
+			continue
+		case next, ok := <-messages:
+			if !ok {
+				if ctx.Err() == nil {
+					return
+				}
+				continue
+			}
+			m = next
 		}
 
 		switch m.Kind() {
@@ -123,79 +438,411 @@ func Handle(pCtx context.Context, c net.Conn) {
 			log.Println("audiosocket received hangup command")
 			return
 		case audiosocket.KindError:
-			log.Println("error from audiosocket")
+			code := m.ErrorCode()
+			description, fatal := audiosocketError(code)
+			if !fatal {
+				log.Printf("call %s: audiosocket error 0x%02x (%s), continuing", ChatID, byte(code), description)
+				continue
+			}
+			log.Printf("call %s: audiosocket error 0x%02x (%s), ending call", ChatID, byte(code), description)
+			if code != audiosocket.ErrAstHangup {
+				endCall(call, "")
+			}
+			return
+		case kindMetadata:
+			call.applyMetadata(m.Payload())
+		case kindDTMF:
+			log.Printf("received DTMF %q", m.Payload())
+			call.Interrupter.Interrupt(InterruptDTMF)
 		case audiosocket.KindSlin:
 			if m.ContentLength() < 1 {
 				log.Println("no audio data")
 				continue
 			}
 			audioData := m.Payload()
-			//	threshold := int16(0x02)
-			//	audioDataReduced := NoiseGate(audioData, threshold)
-			floatArray, err := pcmToFloat32Array(audioData)
+			if config.InputChannels == 2 {
+				audioData = downmixStereo(audioData)
+			}
+			if rate == 0 {
+				if rate, err = negotiateSampleRate(chatStore.Settings().AsteriskSettings, len(audioData)); err != nil {
+					log.Printf("call %s: %v, hanging up", ChatID, err)
+					endCall(call, "")
+					return
+				}
+				log.Printf("call %s: receiving %d Hz audio", ChatID, rate)
+				resampler = NewResampler(rate, config.STTSampleRate)
+				vadFrames = NewFrameAligner(frameBytes(rate, config.VAD.FrameMs))
+				call.setSampleRate(rate)
+			}
+			call.inRecording.Write(audioData)
+			audioData = call.AEC.Cancel(audioData)
+			if threshold := chatStore.Settings().AsteriskSettings.AsteriskNoiseGateThreshold; threshold != nil {
+				audioData = NoiseGate(audioData, *threshold)
+			}
+			// A resampled frame is copied, so the decoded one can be pooled;
+			// otherwise it is kept in the utterance and pre-roll, which
+			// never give it back, so decodePCM allocates it
+			var decoded []float32
+			if resampler.Converts() {
+				decoded = getFloat32s(len(audioData) / 2)
+			}
+			floatArray, err := decodePCM(decoded, audioData)
 			if err != nil {
 				log.Println("error converting pcm to float32:", err)
 				continue
 			}
 
-			if active, err := vad.Process(rate, audioData); err != nil {
+			samples := resampler.Process(floatArray)
+
+			// Frames that echo our own playback, or arrive while it plays in
+			// half-duplex mode, are treated as silence. The VAD sees
+			// frames of its own size; a chunk completing none of them
+			// keeps the previous decision.
+			frames := vadFrames.Push(audioData)
+			if call.halfDuplexMuted() || call.Echo.Suppress(floatArray) {
+				active = false
+			} else if len(frames) > 0 {
+				active, err = vadActive(vad, rate, frames)
+			}
+			if resampler.Converts() {
+				putFloat32s(floatArray)
+			}
+			if err != nil {
 				log.Println("Error processing VAD:", err)
 			} else if active {
-				inputAudioBuffer = append(inputAudioBuffer, floatArray)
-				calculateAudioLength(inputAudioBuffer, rate)
+				call.Interrupter.Interrupt(InterruptVAD)
 				silenceCount = 0
+				lastSpeech = clock.Now()
+				reprompts.Reset()
+				if inputAudioBuffer.Len() == 0 {
+					if frames := processor.Reclaim(); frames != nil {
+						log.Println("speech resumed within the merge gap, merging with the previous utterance")
+						for _, frame := range frames {
+							inputAudioBuffer.Append(frame)
+						}
+						// The merged audio is transcribed in batch
+						streamFailed = true
+					}
+					// Keep the onset that preceded the VAD decision
+					for _, frame := range preRoll.Drain() {
+						appendFrame(frame)
+					}
+				}
+				if appendFrame(samples) {
+					switch {
+					case !inputAudioBuffer.Overlong():
+						log.Println("Audio buffer reached its memory cap, processing early")
+						finishUtterance()
+					case config.AudioBuffer.DropOverlong:
+						log.Printf("call %s: utterance reached %dms, dropping it", ChatID, config.AudioBuffer.MaxUtteranceMs)
+						inputAudioBuffer.Reset()
+						if stream != nil {
+							stream.Abort()
+							stream = nil
+						}
+						streamFailed = false
+					default:
+						log.Printf("call %s: utterance reached %dms, processing it", ChatID, config.AudioBuffer.MaxUtteranceMs)
+						finishUtterance()
+					}
+				}
 			} else {
 				silenceCount++
-				if silenceCount > silenceThreshold {
-					if len(inputAudioBuffer) > 0 {
-						log.Println("Processing complete sentence")
-						handleInputAudio(c, inputAudioBuffer, chatStore)
-						inputAudioBuffer = nil // Reset buffer
-					}
+				if inputAudioBuffer.Len() == 0 {
+					preRoll.Push(samples)
+				} else if silenceCount <= config.VAD.HangoverFrames {
+					// Keep trailing sounds after the VAD stops reporting speech
+					appendFrame(samples)
 				}
+				endSilence()
 			}
 
+			// Don't count our own processing and playback as caller silence
+			if processor.Busy() || call.Interrupter.Playing() {
+				lastSpeech = clock.Now()
+			}
+			if idleLimit > 0 && since(lastSpeech) > idleLimit {
+				log.Printf("no speech for %s, hanging up call %s", idleLimit, id.String())
+				endCall(call, "")
+				return
+			}
+			if reprompt, hangup := reprompts.Check(since(lastSpeech)); hangup {
+				log.Printf("call %s: no answer to %d reprompts, hanging up", ChatID, config.Reprompt.MaxReprompts)
+				endCall(call, "")
+				return
+			} else if reprompt {
+				log.Printf("call %s: caller is silent, reprompting", ChatID)
+				websocketSendReceive(ctx, websocketURI, call.ttsPayload(config.Reprompt.Message), call)
+				lastSpeech = clock.Now()
+			}
+		case audiosocket.KindSilence:
+			// Silence carries no audio, but may end an utterance
+			if config.VAD.SilenceHints {
+				silenceCount++
+				endSilence()
+			}
+		case audiosocket.KindID:
+			// The ID is only expected first
+		default:
+			log.Printf("call %s: skipping message of unknown kind 0x%02x", ChatID, byte(m.Kind()))
 		}
 	}
+
+	if ctx.Err() == context.DeadlineExceeded && pCtx.Err() == nil {
+		log.Printf("call %s reached its maximum duration", id.String())
+		endCall(call, chatStore.Settings().AsteriskSettings.AsteriskClosingMessage)
+	}
 }
-func ptr(s string) *string {
-	return &s
+
+// loadChat loads the chat for a call, starting it if the backend doesn't
+// know it yet. With KeepHistory, the ChatStore of an earlier connection
+// with the same ID is reused and synced with the backend instead.
+//
+// The settings come with the chat; only kinds the chat lacks are fetched
+// from their own endpoints. With degraded mode enabled, kinds still missing
+// are taken from its settings.
+func loadChat(chatID string, state *CallState) (*api.ChatStore, error) {
+	chatStore, err := fetchChat(chatID, state)
+	if err != nil {
+		return nil, err
+	}
+	s := chatStore.Settings()
+	completed := completeSettings(API, chatID, &s)
+	if applyDefaultSettings(&s) || completed {
+		chatStore.SetSettings(s)
+	}
+	return chatStore, nil
 }
-func handleInputAudio(conn net.Conn, buffer [][]float32, chatStore *api.ChatStore) {
-	// Merge and process buffer, then send to server
-	var mergedBuffer []float32
-	for _, data := range buffer {
-		mergedBuffer = append(mergedBuffer, data...)
+
+// fetchChat loads or reuses the ChatStore for loadChat, or restores it
+// from state if the call is resuming.
+func fetchChat(chatID string, state *CallState) (*api.ChatStore, error) {
+	if state != nil {
+		return restoreChat(chatID, state), nil
+	}
+	if config.KeepHistory {
+		if chatStore, ok := retainedChats.Take(chatID); ok {
+			chat, err := chatBackend.GetChat(chatID)
+			if err == nil {
+				chatStore.Sync(chat)
+				return chatStore, nil
+			}
+			log.Println("failed to sync retained chat, reloading it:", err)
+		}
+	}
+
+	chatStore, err := api.LoadChatStore(chatID, chatBackend, ollamaAPI)
+	if errors.Is(err, api.ErrChatNotFound) {
+		log.Println("chat not found, starting it:", chatID)
+		if err = startChat(chatID); err == nil {
+			chatStore, err = api.LoadChatStore(chatID, chatBackend, ollamaAPI)
+		}
+	}
+	return chatStore, err
+}
+
+// chatStart is a chat creation in flight.
+type chatStart struct {
+	done chan struct{}
+	err  error
+}
+
+var (
+	chatStartsMu sync.Mutex
+	chatStarts   = make(map[string]*chatStart)
+)
+
+// startChat creates chatID in the backend. Concurrent first contacts for
+// the same ID, e.g. a caller reconnecting right away, share one request
+// instead of racing to create the chat.
+func startChat(chatID string) error {
+	chatStartsMu.Lock()
+	if start, ok := chatStarts[chatID]; ok {
+		chatStartsMu.Unlock()
+		<-start.done
+		return start.err
+	}
+	start := &chatStart{done: make(chan struct{})}
+	chatStarts[chatID] = start
+	chatStartsMu.Unlock()
+
+	_, start.err = chatBackend.StartChat(chatID)
+
+	chatStartsMu.Lock()
+	delete(chatStarts, chatID)
+	chatStartsMu.Unlock()
+	close(start.done)
+	return start.err
+}
+
+// maxCallDuration returns the hard limit on a call's length, or zero when
+// calls may run indefinitely.
+func maxCallDuration(settings api.AsteriskSettings) time.Duration {
+	if settings.AsteriskMaxCallDuration == nil || *settings.AsteriskMaxCallDuration <= 0 {
+		return 0
+	}
+	return time.Duration(*settings.AsteriskMaxCallDuration) * time.Second
+}
+
+// endCall optionally speaks a closing message and then asks Asterisk to hang
+// up the call. The closing message is played like a reply, so it doesn't
+// overlap one still playing.
+func endCall(call *Call, closingMessage string) {
+	s := call.Stream
+	if closingMessage != "" {
+		ctx, ready, done := call.Interrupter.StartPlayback(context.Background())
+		ctx, cancel := context.WithTimeout(ctx, closingMessageTimeout)
+		select {
+		case <-ready:
+			w := playbackWriter(ctx, &AudioWriter{stream: s, frameSize: call.frameBytes(), onWrite: call.played})
+			if err := playTTS(ctx, websocketURI, call.ID, call.ttsPayload(closingMessage), w); err != nil {
+				log.Println("failed to play closing message:", err)
+			}
+		case <-ctx.Done():
+			log.Println("failed to play closing message:", ctx.Err())
+		}
+		cancel()
+		done()
+	}
+	if err := s.WriteHangup(); err != nil {
+		log.Println("failed to send hangup:", err)
+	}
+}
+
+// idleTimeout returns the no-speech timeout for a call, or zero when disabled.
+func idleTimeout(settings api.AsteriskSettings) time.Duration {
+	if settings.AsteriskIdleTimeout == nil || *settings.AsteriskIdleTimeout <= 0 {
+		return 0
+	}
+	return time.Duration(*settings.AsteriskIdleTimeout) * time.Second
+}
+
+// processUtterance transcribes and answers an utterance. If stream is set
+// its transcript is used, otherwise the audio is handed to handleInputAudio
+// for batch transcription.
+func processUtterance(ctx context.Context, call *Call, frames [][]float32, stream *utteranceStream) {
+	ctx, span := startSpan(withCall(ctx, call), "utterance")
+	defer span.End()
+	if !utteranceLimiter.Allow(call.ID) {
+		log.Printf("call %s: utterance rate limit exceeded, skipping the turn", call.ID)
+		if stream != nil {
+			stream.Abort()
+		}
+		return
+	}
+	call.refreshSettings()
+	call.setState(stateThinking)
+	// A reply being played reports listening once it ends
+	defer func() {
+		call.checkpoint()
+		if !call.Interrupter.Playing() {
+			call.setState(stateListening)
+		}
+	}()
+	if stream == nil {
+		handleInputAudio(ctx, call, frames)
+		return
+	}
+
+	if !longEnough(frames) || !loudEnough(frames) {
+		stream.Abort()
+		return
 	}
-	length := calculateAudioLength(buffer, 16000)
+	_, sttSpan := startSpan(ctx, "transcription")
+	transcription, err := stream.Finish()
+	sttSpan.End()
+	if err != nil {
+		log.Println("Error streaming data to server:", err)
+		turnFailed(ctx, call)
+		return
+	}
+	handleTranscription(ctx, call, transcription)
+}
+
+// longEnough reports whether an utterance is long enough to be worth
+// transcribing.
+func longEnough(buffer [][]float32) bool {
+	length := calculateAudioLength(buffer, config.STTSampleRate)
 	log.Println("Audio length:", length)
 	if length < 0.40 {
 		log.Println("Audio length is less than 0.45 seconds, skipping processing.")
+		return false
+	}
+	return true
+}
+
+// loudEnough reports whether an utterance's level reaches
+// config.MinSpeechRMS, so steady line noise the VAD let through isn't
+// transcribed.
+func loudEnough(buffer [][]float32) bool {
+	if config.MinSpeechRMS <= 0 {
+		return true
+	}
+	var sum float64
+	n := 0
+	for _, frame := range buffer {
+		for _, s := range frame {
+			sum += float64(s) * float64(s)
+		}
+		n += len(frame)
+	}
+	if n == 0 {
+		return false
+	}
+	level := math.Sqrt(sum / float64(n))
+	if level < config.MinSpeechRMS {
+		log.Printf("Audio level %.4f is below %.4f, skipping processing.", level, config.MinSpeechRMS)
+		return false
+	}
+	return true
+}
+
+func ptr(s string) *string {
+	return &s
+}
+func handleInputAudio(ctx context.Context, call *Call, buffer [][]float32) {
+	if !longEnough(buffer) || !loudEnough(buffer) {
 		return
 	}
-	sttSettings := chatStore.Settings.STTSettings
-	sttSettings.Language = ptr("ru")
+	// Merge and process buffer, then send to server. Transcribers don't
+	// keep the samples, so the merged buffer goes back to the pool once
+	// the transcription is in.
+	n := 0
+	for _, data := range buffer {
+		n += len(data)
+	}
+	pooled := getFloat32s(n)[:0]
+	for _, data := range buffer {
+		pooled = append(pooled, data...)
+	}
+	mergedBuffer := pooled
+	if config.AGC.Enabled {
+		mergedBuffer = AutomaticGain(mergedBuffer, config.AGC.TargetRMS)
+	}
 
-	transcription, err := sendFloat32ArrayToServer("http://localhost:8002/complete_transcribe_r", mergedBuffer, sttSettings)
+	sttCtx, sttSpan := startSpan(ctx, "transcription")
+	transcription, err := call.Transcriber.Transcribe(sttCtx, mergedBuffer, call.sttSettings())
+	sttSpan.End()
+	putFloat32s(pooled)
 	if err != nil {
 		log.Println("Error sending data to server:", err)
+		turnFailed(ctx, call)
+		return
+	}
+	handleTranscription(ctx, call, transcription)
+}
+
+// handleTranscription sends the caller's words to the LLM and speaks the
+// response.
+func handleTranscription(ctx context.Context, call *Call, transcription string) {
+	if !call.turns.Commit(ctx) {
+		log.Println("utterance was merged into the next one")
 		return
 	}
-	llmSettings := chatStore.Settings.LLMSettings
-	llmOptions := ollama.Options{
-		Seed:          llmSettings.Seed,
-		Mirostat:      llmSettings.Mirostat,
-		MirostatEta:   llmSettings.MirostatEta,
-		MirostatTau:   llmSettings.MirostatTau,
-		NumCtx:        llmSettings.NumCtx,
-		RepeatLastN:   llmSettings.RepeatLastN,
-		RepeatPenalty: llmSettings.RepeatPenalty,
-		TfsZ:          llmSettings.TfsZ,
-		Temperature:   llmSettings.Temperature,
-		NumPredict:    llmSettings.NumPredict,
-	}
-
-	log.Println("LLM Options:", llmOptions)
+	chatStore := call.ChatStore
+	// Only options set in the chat are sent, so unset ones keep the
+	// model's defaults instead of being overridden with null or zero
+	log.Println("LLM Options:", api.OllamaOptions(chatStore.Settings().LLMSettings))
 	excludedWords := []string{"Продолжение следует...", "Субтитры сделал DimaTorzok", "Субтитры создавал DimaTorzok"}
 	for _, word := range excludedWords {
 		if strings.Contains(transcription, word) {
@@ -203,24 +850,146 @@ func handleInputAudio(conn net.Conn, buffer [][]float32, chatStore *api.ChatStor
 			return
 		}
 	}
-	log.Println("Transcription:", transcription)
-	response, err := chatStore.SendMessage(transcription)
-	log.Println("Response:", response)
+	transcription = rewriteTranscript(transcription)
+	log.Println("Transcription:", api.Redact(transcription))
+	if chatStore.Settings().AsteriskSettings.AsteriskDetectLanguage {
+		call.DetectLanguage(stripAnnotations(transcription))
+	}
+	transcription, blocked := call.Filter.Filter(transcription)
+	call.heard(transcription)
+	event := map[string]interface{}{
+		"text":    api.Redact(transcription),
+		"blocked": blocked,
+		"leg":     call.Leg(),
+	}
+	if n := config.Webhook.TranscriptWindow; n > 0 {
+		event["transcript"] = transcriptWindow(chatStore.Snapshot(), transcription, n)
+	}
+	webhooks.Emit(eventUtteranceTranscribed, call.ID, event)
+	if blocked {
+		log.Println("Transcription blocked by content filter")
+		playBlockedResponse(ctx, call)
+		return
+	}
+	if call.Paused() {
+		log.Println("Assistant is paused, not responding")
+		return
+	}
+	if config.EchoMode {
+		log.Println("Echo mode, speaking back:", api.Redact(transcription))
+		websocketSendReceive(ctx, websocketURI, call.ttsPayload(stripAnnotations(transcription)), call)
+		return
+	}
+	llmCtx, cancel := context.WithCancel(ctx)
+	if config.LLMTimeoutSeconds > 0 {
+		llmCtx, cancel = context.WithTimeout(ctx, time.Duration(config.LLMTimeoutSeconds)*time.Second)
+	}
+	llmCtx, llmSpan := startSpan(llmCtx, "llm")
+	// The filler plays until the reply starts, or the turn ends without one
+	call.startFiller()
+	response, err := sendMessage(llmCtx, chatStore, transcription)
+	llmSpan.End()
+	cancel()
+	// A transfer the LLM asked for only happens along with its reply
+	endpoint := call.takeTransfer()
 	if err != nil {
 		log.Println("Error sending user message:", err)
+		// Rather than dead air, tell the caller we're still there, unless
+		// the call itself is over
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil && config.LLMFallbackMessage != "" {
+			log.Println("LLM timed out, playing fallback message")
+			websocketSendReceive(ctx, websocketURI, call.ttsPayload(config.LLMFallbackMessage), call)
+			return
+		}
+		call.stopFiller()
+		turnFailed(ctx, call)
 		return
 	}
+	log.Println("Response:", api.Redact(response.Message.Content))
+	call.RecordUsage(response)
 
-	data := map[string]interface{}{
-		"message":    response.Message.Content,
-		"language":   "ru",
-		"speed":      1.0,
-		"await_time": 0.015,
+	content, target, transfer := extractTransfer(response.Message.Content)
+	if transfer {
+		if endpoint, err = transferEndpoint(target); err != nil {
+			log.Printf("call %s: ignoring transfer request: %v", call.ID, err)
+		}
+	}
+	reply, blocked := call.Filter.Filter(content)
+	webhooks.Emit(eventAssistantResponded, call.ID, map[string]interface{}{
+		"text":    api.Redact(reply),
+		"blocked": blocked,
+		"usage":   response.Usage(),
+	})
+	if blocked {
+		log.Println("Response blocked by content filter")
+		if config.ContentFilter.BlockedResponse == "" {
+			call.stopFiller()
+		}
+		playBlockedResponse(ctx, call)
+		return
+	}
+	if call.Paused() {
+		log.Println("Assistant was paused while answering, not speaking the reply")
+		call.stopFiller()
+		return
+	}
+	if cut, truncated := truncateReply(reply, config.MaxReplyChars); truncated {
+		log.Printf("call %s: reply of %d characters truncated to %d", call.ID, utf8.RuneCountInString(reply), utf8.RuneCountInString(cut))
+		reply = cut
 	}
-	log.Println("Using transcription:", transcription)
+	if endpoint != "" {
+		transferCall(call, reply, endpoint)
+		return
+	}
+	data := call.ttsPayload(reply)
+	log.Println("Using transcription:", api.Redact(transcription))
+
+	websocketSendReceive(ctx, websocketURI, data, call)
 
-	websocketSendReceive(websocketURI, data, conn)
+}
+
+// sendMessage sends the caller's words to the LLM once llmLimiter has a
+// slot for it.
+func sendMessage(ctx context.Context, chatStore *api.ChatStore, content string) (*api.OllamaChatResponse, error) {
+	release, err := llmLimiter.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get an LLM slot: %w", err)
+	}
+	defer release()
+	return chatStore.SendMessage(ctx, content)
+}
+
+// playBlockedResponse speaks the configured response for content rejected
+// by the content filter.
+func playBlockedResponse(ctx context.Context, call *Call) {
+	if config.ContentFilter.BlockedResponse == "" {
+		return
+	}
+	websocketSendReceive(ctx, websocketURI, call.ttsPayload(config.ContentFilter.BlockedResponse), call)
+}
+
+// ttsPayload builds the request sent to the TTS websocket for message,
+// spoken in language.
+func ttsPayload(message, language string) map[string]interface{} {
+	return map[string]interface{}{
+		"message":    speakable(message, language),
+		"language":   language,
+		"speed":      1.0,
+		"await_time": defaultTTSAwaitTime,
+	}
+}
 
+// ttsPayload builds the TTS request for message in the call's language and
+// with the voice and await time from the chat settings, if any.
+func (c *Call) ttsPayload(message string) map[string]interface{} {
+	data := ttsPayload(message, c.Language())
+	if voice := c.ChatStore.Settings().TTSSettings.Voice; voice != "" {
+		data["voice"] = voice
+	}
+	if awaitTime := c.ChatStore.Settings().TTSSettings.AwaitTime; awaitTime != nil {
+		data["await_time"] = *awaitTime
+	}
+	return data
 }
 
 func calculateAudioLength(inputAudioBuffer [][]float32, sampleRate int) float64 {
@@ -255,73 +1024,221 @@ func NoiseGate(input []byte, threshold int16) []byte {
 	return output
 }
 
+// AutomaticGain scales input so its RMS level approaches targetRMS. The gain
+// is limited so no sample exceeds agcPeakCeiling, and input quieter than
+// agcNoiseFloor is returned untouched so silence isn't amplified into noise.
+func AutomaticGain(input []float32, targetRMS float64) []float32 {
+	level := rms(input)
+	if level < agcNoiseFloor || targetRMS <= 0 {
+		return input
+	}
+
+	gain := targetRMS / level
+	if gain > agcMaxGain {
+		gain = agcMaxGain
+	}
+
+	var peak float64
+	for _, sample := range input {
+		if abs := math.Abs(float64(sample)); abs > peak {
+			peak = abs
+		}
+	}
+	if peak*gain > agcPeakCeiling {
+		gain = agcPeakCeiling / peak
+	}
+
+	output := make([]float32, len(input))
+	for i, sample := range input {
+		output[i] = float32(float64(sample) * gain)
+	}
+	return output
+}
+
+// pcmToFloat32Array converts little-endian int16 PCM to float32 samples.
+// Samples are divided by 32768, the usual convention, so -32768 maps to
+// exactly -1.0 and 32767 to just under 1.0. Scaling by a power of two is
+// exact, which lets float32ArrayToPCM restore every int16 value unchanged.
 func pcmToFloat32Array(pcmData []byte) ([]float32, error) {
+	return decodePCM(nil, pcmData)
+}
+
+// decodePCM is pcmToFloat32Array decoding into dst, which is reused if it
+// has room for the samples.
+func decodePCM(dst []float32, pcmData []byte) ([]float32, error) {
 	if len(pcmData)%2 != 0 {
 		return nil, fmt.Errorf("pcm data length must be even")
 	}
 
-	float32Array := make([]float32, len(pcmData)/2)
-	buf := bytes.NewReader(pcmData)
-
-	for i := 0; i < len(float32Array); i++ {
-		var sample int16
-		if err := binary.Read(buf, binary.LittleEndian, &sample); err != nil {
-			return nil, fmt.Errorf("failed to read sample: %v", err)
-		}
+	// This runs on every inbound frame, so the samples are decoded in place
+	// rather than through binary.Read
+	float32Array := dst[:0]
+	if cap(float32Array) < len(pcmData)/2 {
+		float32Array = make([]float32, len(pcmData)/2)
+	}
+	float32Array = float32Array[:len(pcmData)/2]
+	for i := range float32Array {
+		sample := int16(binary.LittleEndian.Uint16(pcmData[2*i:]))
 		float32Array[i] = float32(sample) / 32768.0
 	}
 
 	return float32Array, nil
 }
-func sendFloat32ArrayToServer(serverAddress string, float32Array []float32, settings api.STTSettings) (string, error) {
-	// Buffer to store the audio data
-	var audioBuffer bytes.Buffer
-	for _, f := range float32Array {
-		if err := binary.Write(&audioBuffer, binary.LittleEndian, f); err != nil {
-			return "", fmt.Errorf("failed to write float32: %v", err)
+
+// float32ArrayToPCM converts float32 samples back to little-endian int16
+// PCM, the inverse of pcmToFloat32Array. Values are rounded to the nearest
+// integer, symmetrically around zero, and clamped to [-32768, 32767] so
+// out-of-range input saturates instead of wrapping.
+func float32ArrayToPCM(samples []float32) []byte {
+	pcm := make([]byte, len(samples)*2)
+	for i, f := range samples {
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(pcm16Sample(f)))
+	}
+	return pcm
+}
+
+// pcm16Sample converts a float32 sample to int16 as float32ArrayToPCM does.
+func pcm16Sample(f float32) int16 {
+	v := math.Round(float64(f) * 32768.0)
+	if v > math.MaxInt16 {
+		v = math.MaxInt16
+	} else if v < math.MinInt16 {
+		v = math.MinInt16
+	}
+	return int16(v)
+}
+
+// settingsQuery adds the STT settings, given as a JSON object, to the query
+// of serverAddress, one parameter per setting.
+func settingsQuery(serverAddress string, settingsJSON []byte) (string, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(settingsJSON, &fields); err != nil {
+		return "", fmt.Errorf("error decoding settings JSON: %v", err)
+	}
+	u, err := url.Parse(serverAddress)
+	if err != nil {
+		return "", fmt.Errorf("invalid STT url: %v", err)
+	}
+	query := u.Query()
+	for key, value := range fields {
+		if value == nil {
+			continue
 		}
+		query.Set(key, fmt.Sprint(value))
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// writeSamples writes samples to w as little-endian float32 or, with pcm16,
+// as 16-bit PCM, a chunk at a time.
+func writeSamples(w io.Writer, samples []float32, pcm16 bool) error {
+	var chunk [4096]byte
+	size := 4
+	if pcm16 {
+		size = 2
+	}
+	for len(samples) > 0 {
+		n := len(samples)
+		if n > len(chunk)/size {
+			n = len(chunk) / size
+		}
+		for i, f := range samples[:n] {
+			if pcm16 {
+				binary.LittleEndian.PutUint16(chunk[2*i:], uint16(pcm16Sample(f)))
+			} else {
+				binary.LittleEndian.PutUint32(chunk[4*i:], math.Float32bits(f))
+			}
+		}
+		if _, err := w.Write(chunk[:n*size]); err != nil {
+			return err
+		}
+		samples = samples[n:]
+	}
+	return nil
+}
+
+// sendFloat32ArrayToServer uploads the utterance as a multipart form laid
+// out by form, with the audio as raw little-endian float32 or, if asWAV is
+// set, as a 16-bit PCM WAV file the STT service can identify by its header.
+// The transcription is taken from the JSON response at responseKey, see
+// selectJSON, and prefixed with the emotion if the service reports one.
+func sendFloat32ArrayToServer(ctx context.Context, client *http.Client, serverAddress, callID string, float32Array []float32, sttSettings settings.STTSettings, asWAV bool, form STTFormConfig, responseKey string) (string, error) {
+	fileName, contentType := "audio.raw", "application/octet-stream"
+	if asWAV {
+		fileName, contentType = "audio.wav", "audio/wav"
+	}
+	if form.FileName != "" {
+		fileName = form.FileName
+	}
+	if form.ContentType != "" {
+		contentType = form.ContentType
 	}
 
-	// Create a new multipart writer
-	var requestBody bytes.Buffer
-	writer := multipart.NewWriter(&requestBody)
+	// Create a new multipart writer. The body is pooled; the transport
+	// puts it back when it closes the request body, and until the request
+	// is made every return must do so.
+	requestBody := getBuffer()
+	writer := multipart.NewWriter(requestBody)
 
 	// Add audio data to the multipart form
-	audioWriter, err := writer.CreateFormFile("audio", "audio.raw")
+	partHeader := make(textproto.MIMEHeader)
+	partHeader.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, form.AudioField, fileName))
+	partHeader.Set("Content-Type", contentType)
+	audioWriter, err := writer.CreatePart(partHeader)
 	if err != nil {
+		putBuffer(requestBody)
 		return "", fmt.Errorf("failed to create form file: %v", err)
 	}
-	if _, err = io.Copy(audioWriter, &audioBuffer); err != nil {
+	if asWAV {
+		_, err = audioWriter.Write(wavHeader(config.STTSampleRate, uint32(len(float32Array)*2)))
+	}
+	if err == nil {
+		err = writeSamples(audioWriter, float32Array, asWAV)
+	}
+	if err != nil {
+		putBuffer(requestBody)
 		return "", fmt.Errorf("failed to copy audio data: %v", err)
 	}
 
-	// Add settings as a JSON string to the multipart form
-	settingsJSON, err := json.Marshal(settings)
+	// Add settings as a JSON string to the multipart form, or to the URL
+	settingsJSON, err := json.Marshal(sttSettings)
 	if err != nil {
+		putBuffer(requestBody)
 		return "", fmt.Errorf("error marshalling settings JSON: %v", err)
 	}
 
-	if err = writer.WriteField("settings", string(settingsJSON)); err != nil {
+	if form.SettingsInQuery {
+		if serverAddress, err = settingsQuery(serverAddress, settingsJSON); err != nil {
+			putBuffer(requestBody)
+			return "", err
+		}
+	} else if err = writer.WriteField(form.SettingsField, string(settingsJSON)); err != nil {
+		putBuffer(requestBody)
 		return "", fmt.Errorf("failed to write settings field: %v", err)
 	}
 
 	// Close the writer
 	if err = writer.Close(); err != nil {
+		putBuffer(requestBody)
 		return "", fmt.Errorf("failed to close writer: %v", err)
 	}
 
 	// Create a new HTTP request
-	req, err := http.NewRequest("POST", serverAddress, &requestBody)
+	reqBody := newPooledBody(requestBody)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, serverAddress, reqBody)
 	if err != nil {
+		reqBody.Close()
 		return "", fmt.Errorf("error creating request: %v", err)
 	}
+	req.ContentLength = int64(requestBody.Len())
 	req.Header.Set("Content-Type", writer.FormDataContentType())
+	setRequestID(req.Header, callID)
 
 	// Send the HTTP request
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("error sending request: %v", err)
+		return "", fmt.Errorf("error sending request: %w", err)
 	}
 	defer resp.Body.Close()
 
@@ -331,113 +1248,221 @@ func sendFloat32ArrayToServer(serverAddress string, float32Array []float32, sett
 		return "", fmt.Errorf("error reading response body: %v", err)
 	}
 
-	var result map[string]interface{}
+	var result interface{}
 	if err := json.Unmarshal(body, &result); err != nil {
 		return "", fmt.Errorf("error unmarshalling response body: %v", err)
 	}
 
 	// Extract the transcription from the result
-	emotion, ok := result["emotion"].(string)
+	value, err := selectJSON(result, responseKey)
+	if err != nil {
+		return "", fmt.Errorf("transcription not found: %v", err)
+	}
+	transcription, ok := value.(string)
 	if !ok {
-		return "", fmt.Errorf("emotion not found in response")
+		return "", fmt.Errorf("transcription at %q is no string", responseKey)
 	}
-	log.Println("Emotion:", emotion)
-	if transcription, ok := result["transcription"].(string); ok {
-		log.Println("Transcription:", transcription)
-		return fmt.Sprintf("[**Emotion:** %s]\n%s", emotion, transcription), nil
-	} else {
-		return "", fmt.Errorf("transcription not found in response")
+	log.Println("Transcription:", api.Redact(transcription))
+	// Only some services detect the emotion
+	if fields, ok := result.(map[string]interface{}); ok {
+		emotion, _ := fields["emotion"].(string)
+		return withEmotion(transcription, emotion), nil
 	}
+	return transcription, nil
 }
 
-var wsMutex sync.Mutex
-var wsCancel context.CancelFunc
-
-func websocketSendReceive(uri string, data map[string]interface{}, conn net.Conn) {
-	wsMutex.Lock()
-	if wsCancel != nil {
-		wsCancel() // Cancel the previous instance
-	}
-	ctx, cancel := context.WithCancel(context.Background())
-	wsCancel = cancel
-	wsMutex.Unlock()
+// websocketSendReceive plays data through the TTS service in the background,
+// replacing any playback already in progress on the call. The playback
+// outlives ctx, of which it only joins the trace.
+func websocketSendReceive(ctx context.Context, uri string, data map[string]interface{}, call *Call) {
+	ctx, ready, done := call.Interrupter.StartPlayback(withSpanOf(context.Background(), ctx))
 
 	go func() {
 		defer func() {
-			wsMutex.Lock()
-			wsCancel = nil
-			wsMutex.Unlock()
+			done()
+			if !call.Interrupter.Playing() && !call.turns.Busy() {
+				call.setState(stateListening)
+			}
 		}()
-
-		wsConn, _, err := websocket.DefaultDialer.Dial(uri, nil)
-		audioWriter := &AudioWriter{conn: conn}
-		if err != nil {
-			log.Println("Failed to connect to WebSocket:", err)
+		select {
+		case <-ready:
+		case <-ctx.Done():
 			return
 		}
-		defer wsConn.Close()
+		ctx, span := startSpan(ctx, "synthesis")
+		defer span.End()
 
-		err = wsConn.WriteJSON(data)
-		if err != nil {
-			log.Println("Failed to send JSON:", err)
-			return
+		// The thinking filler gives way right before the reply is heard
+		audioWriter := &AudioWriter{stream: call.Stream, frameSize: call.frameBytes(), onFirst: call.startSpeaking, onWrite: call.played, onError: call.writeFailed}
+		w := newTTSWriter(playbackWriter(ctx, audioWriter), call.sampleRate())
+		if err := playTTS(ctx, uri, call.ID, data, w); err != nil {
+			log.Println(err)
+			call.stopFiller()
+			turnFailed(ctx, call)
+		} else if ctx.Err() == nil {
+			call.recordSuccess()
 		}
+	}()
+}
 
-		for {
-			select {
-			case <-ctx.Done():
-				log.Println("WebSocket connection closed by new instance")
-				return
-			default:
-				messageType, message, err := wsConn.ReadMessage()
-				if err != nil {
-					if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-						log.Printf("Unexpected WebSocket closure: %v", err)
-					}
-					return
+// playTTS sends a synthesis request to the TTS websocket and streams the
+// returned audio to w until the server signals the end of audio or ctx is
+// canceled. Once all audio has arrived w is flushed if it buffers; audio
+// cut off by ctx is dropped instead. w is closed on return if it needs
+// closing.
+func playTTS(ctx context.Context, uri, callID string, data map[string]interface{}, w io.Writer) error {
+	defer closeAudio(w)
+	header := traceHeader(ctx)
+	if header == nil {
+		header = http.Header{}
+	}
+	setRequestID(header, callID)
+	wsConn, _, err := websocket.DefaultDialer.DialContext(ctx, uri, header)
+	if err != nil {
+		return fmt.Errorf("failed to connect to WebSocket: %v", err)
+	}
+	defer wsConn.Close()
+
+	// Closing the connection unblocks a pending read when ctx is canceled
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			wsConn.Close()
+		case <-stop:
+		}
+	}()
+
+	err = wsConn.WriteJSON(data)
+	if err != nil {
+		return fmt.Errorf("failed to send JSON: %v", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("WebSocket connection closed by interruption")
+			return nil
+		default:
+			messageType, message, err := wsConn.ReadMessage()
+			if err != nil {
+				if ctx.Err() != nil {
+					log.Println("WebSocket connection closed by interruption")
+					return nil
+				}
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+					log.Printf("Unexpected WebSocket closure: %v", err)
 				}
+				return flushAudio(w)
+			}
 
-				switch messageType {
-				case websocket.TextMessage:
-					var jsonMessage map[string]interface{}
-					if err := json.Unmarshal(message, &jsonMessage); err == nil {
-						if typeField, ok := jsonMessage["type"].(string); ok && typeField == "end_of_audio" {
-							log.Println("End of conversation")
-							return
-						}
-						log.Println("Received message:", jsonMessage)
-					} else {
-						log.Println("Failed to unmarshal JSON message:", err)
+			switch messageType {
+			case websocket.TextMessage:
+				var jsonMessage map[string]interface{}
+				if err := json.Unmarshal(message, &jsonMessage); err == nil {
+					if typeField, ok := jsonMessage["type"].(string); ok && typeField == "end_of_audio" {
+						log.Println("End of conversation")
+						return flushAudio(w)
 					}
-				case websocket.BinaryMessage:
-					//	log.Println("Received binary message:")
-					if _, err := audioWriter.Write(message); err != nil {
-						log.Println("Error writing to connection:", err)
-						return
-					}
-				default:
-					log.Printf("Received unsupported message type: %v", messageType)
+					log.Println("Received message:", jsonMessage)
+				} else {
+					log.Println("Failed to unmarshal JSON message:", err)
+				}
+			case websocket.BinaryMessage:
+				//	log.Println("Received binary message:")
+				if _, err := w.Write(message); err != nil {
+					return fmt.Errorf("error writing to connection: %v", err)
 				}
+			default:
+				log.Printf("Received unsupported message type: %v", messageType)
 			}
 		}
-	}()
+	}
 }
 
+// flushAudio flushes w if it holds back partial frames.
+func flushAudio(w io.Writer) error {
+	if f, ok := w.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return fmt.Errorf("error writing to connection: %v", err)
+		}
+	}
+	return nil
+}
+
+// closeAudio closes w if it runs until closed, like a PacedWriter.
+func closeAudio(w io.Writer) error {
+	if c, ok := w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// AudioWriter sends SLIN audio to the caller. TTS chunks of any size are
+// re-chunked into frames of exactly frameSize bytes, the audio_frame_ms
+// Asterisk expects per message; a partial frame is held until the next
+// Write or Flush.
 type AudioWriter struct {
-	mutex sync.Mutex
-	conn  net.Conn
+	mutex     sync.Mutex
+	stream    MessageStream
+	frameSize int
+	// pending holds audio not yet making up a whole frame.
+	pending []byte
+	// onFirst, if set, is called once before the first frame is written.
+	onFirst func()
+	// onWrite, if set, receives every frame written successfully.
+	onWrite func([]byte)
+	// onError, if set, is notified of every failed write.
+	onError func(error)
 }
 
 func (aw *AudioWriter) Write(p []byte) (n int, err error) {
 	aw.mutex.Lock()
 	defer aw.mutex.Unlock()
 
-	n, err = aw.conn.Write(audiosocket.SlinMessage(p))
-	if err != nil {
-		return n, err
+	aw.pending = append(aw.pending, p...)
+	for len(aw.pending) >= aw.frameSize {
+		if err := aw.writeFrame(aw.pending[:aw.frameSize]); err != nil {
+			return 0, err
+		}
+		aw.pending = aw.pending[aw.frameSize:]
+	}
+	// Move the remainder to the front so pending doesn't keep growing
+	aw.pending = append(aw.pending[:0:0], aw.pending...)
+	return len(p), nil
+}
+
+// Flush pads held audio with silence to a whole frame and sends it.
+func (aw *AudioWriter) Flush() error {
+	aw.mutex.Lock()
+	defer aw.mutex.Unlock()
+
+	if len(aw.pending) == 0 {
+		return nil
 	}
+	frame := make([]byte, aw.frameSize)
+	copy(frame, aw.pending)
+	aw.pending = nil
+	return aw.writeFrame(frame)
+}
 
-	return n, nil
+// writeFrame sends one frame. aw.mutex must be held.
+func (aw *AudioWriter) writeFrame(frame []byte) error {
+	if aw.onFirst != nil {
+		aw.onFirst()
+		aw.onFirst = nil
+	}
+	if err := aw.stream.WriteSlin(frame); err != nil {
+		if aw.onError != nil {
+			aw.onError(err)
+		}
+		return err
+	}
+	if aw.onWrite != nil {
+		aw.onWrite(frame)
+	}
+	return nil
 }
 
 // func noiseGate(samples []float64, threshold float64) []float64 {
@@ -0,0 +1,1641 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CyCoreSystems/audiosocket"
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/websocket"
+
+	"go-ast-client/api"
+)
+
+// testStream is a ScriptedStream that can advance a FakeClock by step
+// before each message and, with hold set, blocks once the script is
+// exhausted until it is closed instead of ending the call. Messages sent
+// on more while it blocks are read as they come.
+type testStream struct {
+	*ScriptedStream
+	clock *FakeClock
+	step  time.Duration
+	hold  bool
+	more  chan audiosocket.Message
+
+	mu     sync.Mutex
+	read   int
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newTestStream(messages ...audiosocket.Message) *testStream {
+	return &testStream{ScriptedStream: NewScriptedStream(messages...), closed: make(chan struct{})}
+}
+
+func (s *testStream) NextMessage() (audiosocket.Message, error) {
+	m, err := s.ScriptedStream.NextMessage()
+	if err == io.EOF && s.hold {
+		select {
+		case m := <-s.more:
+			return m, nil
+		case <-s.closed:
+			return nil, io.EOF
+		}
+	}
+	if err == nil {
+		s.mu.Lock()
+		s.read++
+		s.mu.Unlock()
+		if s.clock != nil {
+			s.clock.Advance(s.step)
+		}
+	}
+	return m, err
+}
+
+func (s *testStream) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return s.ScriptedStream.Close()
+}
+
+// Read returns how many messages were read.
+func (s *testStream) Read() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read
+}
+
+// withOllama replaces the LLM client for the test, restoring it after.
+func withOllama(t *testing.T, ollama api.OllamaAPIClient) {
+	t.Helper()
+	saved := ollamaAPI
+	t.Cleanup(func() { ollamaAPI = saved })
+	ollamaAPI = ollama
+}
+
+// newTestCallChat starts a chat with s on an in-memory backend used for
+// the test's calls and returns its ID.
+func newTestCallChat(t *testing.T, s api.Settings) (uuid.UUID, *api.MemoryChatAPI) {
+	t.Helper()
+	id := uuid.Must(uuid.NewV4())
+	chats := api.NewMemoryChatAPI()
+	if _, err := chats.StartChat(id.String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chats.UpdateChat(id.String(), map[string]interface{}{"settings": s}); err != nil {
+		t.Fatal(err)
+	}
+	withChatBackend(t, chats)
+	withOllama(t, &fakeOllama{})
+	return id, chats
+}
+
+// runHandle runs Handle on s, failing the test if it doesn't return in
+// time.
+func runHandle(t *testing.T, ctx context.Context, s MessageStream) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(ctx, s)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handle did not return")
+	}
+}
+
+// silenceFrames returns n frames of 20ms of silence at 8kHz.
+func silenceFrames(n int) []audiosocket.Message {
+	frames := make([]audiosocket.Message, n)
+	for i := range frames {
+		frames[i] = audiosocket.SlinMessage(make([]byte, 320))
+	}
+	return frames
+}
+
+func TestIdleTimeoutHangsUp(t *testing.T) {
+	s := testSettings(0.7)
+	s.AsteriskSettings.AsteriskIdleTimeout = intPtr(1)
+	id, _ := newTestCallChat(t, s)
+	withClock(t, NewFakeClock(time.Unix(0, 0)))
+
+	stream := newTestStream(append([]audiosocket.Message{audiosocket.IDMessage(id)}, silenceFrames(100)...)...)
+	stream.clock = clock.(*FakeClock)
+	stream.step = 20 * time.Millisecond
+	runHandle(t, context.Background(), stream)
+
+	if !stream.HungUp() {
+		t.Fatal("no hangup after a second of silence")
+	}
+	// 1s of 20ms frames, plus the ID and the frame that trips the timeout
+	if read := stream.Read(); read > 53 {
+		t.Errorf("%d messages read, want the call to end after about 52", read)
+	}
+}
+
+func TestIdleTimeoutDisabled(t *testing.T) {
+	id, _ := newTestCallChat(t, testSettings(0.7))
+	withClock(t, NewFakeClock(time.Unix(0, 0)))
+
+	stream := newTestStream(append([]audiosocket.Message{audiosocket.IDMessage(id)}, silenceFrames(100)...)...)
+	stream.clock = clock.(*FakeClock)
+	stream.step = time.Second
+	runHandle(t, context.Background(), stream)
+
+	if stream.HungUp() {
+		t.Error("hung up without an idle timeout")
+	}
+}
+
+func TestMaxCallDurationHangsUp(t *testing.T) {
+	s := testSettings(0.7)
+	s.AsteriskSettings.AsteriskMaxCallDuration = intPtr(60)
+	id, _ := newTestCallChat(t, s)
+	fake := NewFakeClock(time.Unix(0, 0))
+	withClock(t, fake)
+
+	stream := newTestStream(append([]audiosocket.Message{audiosocket.IDMessage(id)}, silenceFrames(5)...)...)
+	stream.hold = true
+	go func() {
+		fake.WaitForTimers(1)
+		fake.Advance(time.Minute)
+	}()
+	runHandle(t, context.Background(), stream)
+
+	if !stream.HungUp() {
+		t.Error("no hangup once the maximum duration passed")
+	}
+}
+
+// slowChatAPI is a MemoryChatAPI whose chats take delay on clock to load.
+type slowChatAPI struct {
+	*api.MemoryChatAPI
+	clock *FakeClock
+	delay time.Duration
+}
+
+func (s *slowChatAPI) GetChat(chatID string) (*api.Chat, error) {
+	s.clock.Advance(s.delay)
+	return s.MemoryChatAPI.GetChat(chatID)
+}
+
+func TestMaxCallDurationCountsChatLoad(t *testing.T) {
+	s := testSettings(0.7)
+	s.AsteriskSettings.AsteriskMaxCallDuration = intPtr(60)
+	id, chats := newTestCallChat(t, s)
+	fake := NewFakeClock(time.Unix(0, 0))
+	withClock(t, fake)
+	withChatBackend(t, &slowChatAPI{MemoryChatAPI: chats, clock: fake, delay: 40 * time.Second})
+
+	stream := newTestStream(audiosocket.IDMessage(id))
+	stream.hold = true
+	go func() {
+		fake.WaitForTimers(1)
+		// What is left of the minute after loading the chat
+		fake.Advance(20 * time.Second)
+	}()
+	runHandle(t, context.Background(), stream)
+
+	if !stream.HungUp() {
+		t.Error("no hangup a minute after the call was accepted")
+	}
+}
+
+func TestClosingMessageWaitsForReply(t *testing.T) {
+	withConfig(t, func(c *Config) { c.PlaybackPolicy = playbackQueue })
+	withTTS(t, newTTSServer(t, bytes.Repeat([]byte{0x55}, 640), 320))
+	_, store := newTestChat(t, "call", testSettings(0.7), &fakeOllama{})
+	stream := NewScriptedStream()
+	call := NewCall("call", stream, func() {})
+	call.ChatStore = store
+
+	// A reply still playing
+	_, ready, done := call.Interrupter.StartPlayback(context.Background())
+	<-ready
+	ended := make(chan struct{})
+	go func() {
+		defer close(ended)
+		endCall(call, "Goodbye.")
+	}()
+	select {
+	case <-ended:
+		t.Fatal("closing message played over the reply")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if len(stream.Written()) != 0 || stream.HungUp() {
+		t.Error("closing message started before the reply finished")
+	}
+
+	done()
+	<-ended
+	if len(stream.Written()) != 2 || !stream.HungUp() {
+		t.Errorf("%d frames written, hung up %v; want the closing message and then the hangup", len(stream.Written()), stream.HungUp())
+	}
+}
+
+func TestClosingMessageCancelsReply(t *testing.T) {
+	withConfig(t, func(c *Config) { c.PlaybackPolicy = playbackCancel })
+	withTTS(t, newTTSServer(t, bytes.Repeat([]byte{0x55}, 640), 320))
+	_, store := newTestChat(t, "call", testSettings(0.7), &fakeOllama{})
+	stream := NewScriptedStream()
+	call := NewCall("call", stream, func() {})
+	call.ChatStore = store
+
+	reply, _, done := call.Interrupter.StartPlayback(context.Background())
+	defer done()
+	endCall(call, "Goodbye.")
+	if reply.Err() == nil {
+		t.Error("reply kept playing under the closing message")
+	}
+	if len(stream.Written()) != 2 || !stream.HungUp() {
+		t.Errorf("%d frames written, hung up %v; want the closing message and then the hangup", len(stream.Written()), stream.HungUp())
+	}
+}
+
+func TestCallEndsOnShutdownWithoutHangup(t *testing.T) {
+	id, _ := newTestCallChat(t, testSettings(0.7))
+	stream := newTestStream(audiosocket.IDMessage(id))
+	stream.hold = true
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for calls.Get(id.String()) == nil {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	runHandle(t, ctx, stream)
+
+	if stream.HungUp() {
+		t.Error("hung up a call canceled by the server rather than its limit")
+	}
+}
+
+// recordingChatAPI is a MemoryChatAPI recording the updates made to chats.
+type recordingChatAPI struct {
+	*api.MemoryChatAPI
+	mu      sync.Mutex
+	updates []map[string]interface{}
+}
+
+func (r *recordingChatAPI) UpdateChat(chatID string, updates map[string]interface{}) (*api.Chat, error) {
+	r.mu.Lock()
+	r.updates = append(r.updates, updates)
+	r.mu.Unlock()
+	return r.MemoryChatAPI.UpdateChat(chatID, updates)
+}
+
+// Updates returns the updates made so far.
+func (r *recordingChatAPI) Updates() []map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]map[string]interface{}(nil), r.updates...)
+}
+
+// errorMessage returns a KindError message carrying code.
+func errorMessage(code audiosocket.ErrorCode) audiosocket.Message {
+	return audiosocket.MessageFromData([]byte{byte(audiosocket.KindError), 0, 1, byte(code)})
+}
+
+func TestHandleFinalizesOnEveryExit(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []audiosocket.Message
+		shutdown bool
+	}{
+		{name: "hangup", messages: []audiosocket.Message{audiosocket.HangupMessage()}},
+		{name: "end of stream"},
+		{name: "fatal error", messages: []audiosocket.Message{errorMessage(audiosocket.ErrAstMemory)}},
+		{name: "shutdown", shutdown: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, chats := newTestCallChat(t, testSettings(0.7))
+			recorder := &recordingChatAPI{MemoryChatAPI: chats}
+			withChatBackend(t, recorder)
+
+			stream := newTestStream(append([]audiosocket.Message{audiosocket.IDMessage(id)}, tt.messages...)...)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.shutdown {
+				stream.hold = true
+				go func() {
+					for calls.Get(id.String()) == nil {
+						time.Sleep(time.Millisecond)
+					}
+					cancel()
+				}()
+			}
+			runHandle(t, ctx, stream)
+
+			ended := 0
+			for _, updates := range recorder.Updates() {
+				if _, ok := updates["endTime"]; ok {
+					ended++
+				}
+			}
+			if ended != 1 {
+				t.Errorf("chat ended %d times, want once", ended)
+			}
+		})
+	}
+}
+
+func TestFinalizeFlushesOnce(t *testing.T) {
+	chats, store := newTestChat(t, "call", testSettings(0.7), &fakeOllama{})
+	recorder := &recordingChatAPI{MemoryChatAPI: chats}
+	store.ChatAPI = recorder
+	store.Pending = []api.Message{{ChatID: "call", Role: api.SenderUser, Content: "unsent"}}
+	call := NewCall("call", NewScriptedStream(), func() {})
+	call.ChatStore = store
+
+	call.Finalize()
+	call.Finalize()
+	if got := len(recorder.Updates()); got != 1 {
+		t.Errorf("%d updates, want 1", got)
+	}
+	messages, _ := chats.GetMessages("call")
+	if len(messages) != 1 || messages[0].Content != "unsent" {
+		t.Errorf("backend has %+v, want the unsent message", messages)
+	}
+}
+
+// summarizedCall runs a call on a chat where the caller already spoke,
+// hanging up right away with the LLM answering through ollama, and
+// returns the updates made to the chat.
+func summarizedCall(t *testing.T, ollama *fakeOllama) []map[string]interface{} {
+	t.Helper()
+	id, chats := newTestCallChat(t, testSettings(0.7))
+	if _, err := chats.SendMessage(id.String(), api.SenderUser, "I'd like to book a table"); err != nil {
+		t.Fatal(err)
+	}
+	recorder := &recordingChatAPI{MemoryChatAPI: chats}
+	withChatBackend(t, recorder)
+	withOllama(t, ollama)
+	runHandle(t, context.Background(), newTestStream(audiosocket.IDMessage(id), audiosocket.HangupMessage()))
+	return recorder.Updates()
+}
+
+func TestCallSummaryOnHangup(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ReplayHistory = true
+		c.CallSummary = CallSummaryConfig{Enabled: true, Prompt: "Summarize the call.", Field: "title", TimeoutSeconds: 5}
+	})
+	ollama := &fakeOllama{reply: func(ctx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error) {
+		return api.OllamaChatResponse{Message: api.OllamaResponseMessage{Role: "assistant", Content: "The caller booked a table."}, Done: true}, nil
+	}}
+	updates := summarizedCall(t, ollama)
+
+	requests := ollama.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("%d LLM requests at hangup, want the summary", len(requests))
+	}
+	if got := fmt.Sprint(requests[0].Messages); !strings.Contains(got, "Summarize the call.") || !strings.Contains(got, "book a table") {
+		t.Errorf("summary request = %s, want the prompt and the transcript", got)
+	}
+	if len(updates) != 1 || updates[0]["title"] != "The caller booked a table." {
+		t.Errorf("chat updates = %v, want the summary stored in the title", updates)
+	}
+}
+
+func TestCallSummaryDisabled(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ReplayHistory = true
+		c.CallSummary.Enabled = false
+	})
+	ollama := &fakeOllama{}
+	updates := summarizedCall(t, ollama)
+	if n := len(ollama.Requests()); n != 0 {
+		t.Errorf("%d LLM requests with summaries disabled", n)
+	}
+	if len(updates) != 1 || updates[0]["summary"] != nil {
+		t.Errorf("chat updates = %v, want the end time only", updates)
+	}
+}
+
+func TestCallSummaryTimeout(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ReplayHistory = true
+		c.CallSummary = CallSummaryConfig{Enabled: true, Field: "summary", TimeoutSeconds: 1}
+	})
+	canceled := make(chan error, 1)
+	updates := summarizedCall(t, hangingOllama(canceled))
+	if err := <-canceled; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("summary request ended with %v, want its timeout", err)
+	}
+	if len(updates) != 1 || updates[0]["summary"] != nil || updates[0]["endTime"] == nil {
+		t.Errorf("chat updates = %v, want the chat ended without a summary", updates)
+	}
+}
+
+// replayCall runs a call on a chat with an earlier exchange, and returns
+// the messages loaded when the call started and the LLM request of the
+// call's first turn.
+func replayCall(t *testing.T, replay bool) ([]api.Message, api.OllamaChatRequest) {
+	t.Helper()
+	withConfig(t, func(c *Config) {
+		c.ReplayHistory = replay
+		c.VAD.Backend = vadEnergy
+		c.Unavailable.Message = ""
+		c.Unavailable.MaxFailures = 0
+	})
+	events := withWebhookQueue(t)
+	newSTTServer(t, "hello")
+	s := testSettings(0.7)
+	s.AsteriskSettings.AsteriskSegment = "test"
+	s.LLMSettings.SystemPrompt = ptr("Be brief.")
+	id, chats := newTestCallChat(t, s)
+	if _, err := chats.SendMessage(id.String(), api.SenderUser, "I'd like to book a table"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chats.SendMessage(id.String(), api.SenderAssistant, "For how many people?"); err != nil {
+		t.Fatal(err)
+	}
+	requests := make(chan api.OllamaChatRequest, 1)
+	withOllama(t, &fakeOllama{reply: func(ctx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error) {
+		requests <- request
+		return api.OllamaChatResponse{}, errors.New("model offline")
+	}})
+
+	stream := newTestStream(audiosocket.IDMessage(id))
+	stream.hold = true
+	stream.more = make(chan audiosocket.Message)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(context.Background(), stream)
+	}()
+	defer func() {
+		stream.Close()
+		<-done
+	}()
+
+	call := waitForCall(t, id.String(), stream)
+	for event := range events {
+		if event.Type == eventCallStarted {
+			break
+		}
+	}
+	loaded := call.ChatStore.Snapshot()
+	for _, m := range utteranceFrames() {
+		stream.more <- m
+	}
+	select {
+	case request := <-requests:
+		return loaded, request
+	case <-time.After(5 * time.Second):
+		t.Fatal("LLM never asked")
+		return nil, api.OllamaChatRequest{}
+	}
+}
+
+func TestReplayHistoryDisabled(t *testing.T) {
+	loaded, request := replayCall(t, false)
+	if len(loaded) != 0 {
+		t.Errorf("call started with %d earlier messages, want none", len(loaded))
+	}
+	messages := request.Messages
+	if len(messages) != 2 || messages[0].Role != "system" || messages[0].Content != "Be brief." || messages[1].Content != "hello" {
+		t.Errorf("LLM request = %+v, want the system prompt and the new turn only", messages)
+	}
+}
+
+func TestReplayHistoryEnabled(t *testing.T) {
+	loaded, request := replayCall(t, true)
+	if len(loaded) != 2 {
+		t.Errorf("call started with %d earlier messages, want 2", len(loaded))
+	}
+	if got := fmt.Sprint(request.Messages); len(request.Messages) != 4 || !strings.Contains(got, "book a table") || !strings.Contains(got, "how many people") {
+		t.Errorf("LLM request = %s, want the earlier exchange replayed", got)
+	}
+}
+
+// ttsServer is a fake TTS websocket service answering every request with
+// audio, sent in chunks, and then the end of audio.
+type ttsServer struct {
+	*httptest.Server
+	audio []byte
+	chunk int
+	// delay is waited before each chunk.
+	delay time.Duration
+
+	mu       sync.Mutex
+	requests []map[string]interface{}
+}
+
+func newTTSServer(t *testing.T, audio []byte, chunk int) *ttsServer {
+	t.Helper()
+	tts := &ttsServer{audio: audio, chunk: chunk}
+	upgrader := websocket.Upgrader{}
+	tts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var request map[string]interface{}
+		if err := conn.ReadJSON(&request); err != nil {
+			return
+		}
+		tts.mu.Lock()
+		tts.requests = append(tts.requests, request)
+		tts.mu.Unlock()
+		for i := 0; i < len(tts.audio); i += tts.chunk {
+			time.Sleep(tts.delay)
+			end := i + tts.chunk
+			if end > len(tts.audio) {
+				end = len(tts.audio)
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, tts.audio[i:end]); err != nil {
+				return
+			}
+		}
+		conn.WriteJSON(map[string]string{"type": "end_of_audio"})
+	}))
+	t.Cleanup(tts.Close)
+	return tts
+}
+
+// URI returns the websocket URI of the service.
+func (tts *ttsServer) URI() string {
+	return "ws" + strings.TrimPrefix(tts.URL, "http")
+}
+
+// Requests returns the synthesis requests received so far.
+func (tts *ttsServer) Requests() []map[string]interface{} {
+	tts.mu.Lock()
+	defer tts.mu.Unlock()
+	return append([]map[string]interface{}(nil), tts.requests...)
+}
+
+// withTTS sends the test's synthesis requests to tts.
+func withTTS(t *testing.T, tts *ttsServer) {
+	t.Helper()
+	saved := websocketURI
+	t.Cleanup(func() { websocketURI = saved })
+	websocketURI = tts.URI()
+}
+
+// brokenStream is a ScriptedStream whose audio writes fail after the
+// first n.
+type brokenStream struct {
+	*ScriptedStream
+	mu sync.Mutex
+	n  int
+}
+
+func (s *brokenStream) WriteSlin(pcm []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.n == 0 {
+		return errors.New("connection reset by peer")
+	}
+	s.n--
+	return s.ScriptedStream.WriteSlin(pcm)
+}
+
+// withWebhookQueue replaces the webhook emitter with one whose events are
+// queued for the test instead of being delivered.
+func withWebhookQueue(t *testing.T) <-chan WebhookEvent {
+	t.Helper()
+	saved := webhooks
+	webhooks = &WebhookEmitter{queue: make(chan WebhookEvent, 64)}
+	t.Cleanup(func() { webhooks = saved })
+	return webhooks.queue
+}
+
+// waitForState waits for the state_changed event to state, which playback
+// emits last as it finishes.
+func waitForState(t *testing.T, events <-chan WebhookEvent, state string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type == eventStateChanged && event.Data["state"] == state {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("call never reached state %q", state)
+		}
+	}
+}
+
+func TestWriteErrorTearsDownCall(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.Unavailable.Message = ""
+		c.Webhook.StateEvents = true
+	})
+	events := withWebhookQueue(t)
+	tts := newTTSServer(t, make([]byte, 3200), 320)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	call := NewCall("call", &brokenStream{ScriptedStream: NewScriptedStream(), n: 3}, cancel)
+
+	websocketSendReceive(ctx, tts.URI(), map[string]interface{}{"text": "hello"}, call)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("call not torn down after a failed write")
+	}
+	waitForState(t, events, stateListening)
+	if call.WriteFailures() == 0 {
+		t.Error("write failure not recorded")
+	}
+}
+
+func TestWriteErrorKeepsCallWhenDisabled(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.HangupOnWriteError = false
+		c.Unavailable.Message = ""
+		c.Webhook.StateEvents = true
+	})
+	events := withWebhookQueue(t)
+	tts := newTTSServer(t, make([]byte, 3200), 320)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	call := NewCall("call", &brokenStream{ScriptedStream: NewScriptedStream(), n: 3}, cancel)
+
+	websocketSendReceive(ctx, tts.URI(), map[string]interface{}{"text": "hello"}, call)
+	waitForState(t, events, stateListening)
+	if ctx.Err() != nil {
+		t.Error("call torn down with hangup_on_write_error off")
+	}
+	if call.WriteFailures() == 0 {
+		t.Error("write failure not recorded")
+	}
+}
+
+// temporaryError is an accept error worth retrying.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails its first failures accepts with err before handing
+// out connections of the wrapped listener.
+type flakyListener struct {
+	net.Listener
+	err      error
+	mu       sync.Mutex
+	failures int
+	accepts  int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	l.accepts++
+	if l.failures > 0 {
+		l.failures--
+		l.mu.Unlock()
+		return nil, l.err
+	}
+	l.mu.Unlock()
+	return l.Listener.Accept()
+}
+
+func (l *flakyListener) Accepts() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.accepts
+}
+
+func newFlakyListener(t *testing.T, err error, failures int) *flakyListener {
+	t.Helper()
+	l, lerr := net.Listen("tcp", "127.0.0.1:0")
+	if lerr != nil {
+		t.Fatal(lerr)
+	}
+	return &flakyListener{Listener: l, err: err, failures: failures}
+}
+
+func TestServeRetriesTemporaryAcceptErrors(t *testing.T) {
+	l := newFlakyListener(t, temporaryError{}, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- Serve(ctx, l) }()
+
+	// The connection closes at once, so its call fails to get an ID
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	for l.Accepts() < 5 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve returned %v after shutdown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return on shutdown")
+	}
+	activeCalls.Wait()
+}
+
+func TestServeStopsOnPermanentAcceptError(t *testing.T) {
+	l := newFlakyListener(t, errors.New("listener broken"), 1)
+	defer l.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- Serve(ctx, l) }()
+
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Error("Serve returned no error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve kept accepting after a permanent error")
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audiosocket.sock")
+	withConfig(t, func(c *Config) {
+		c.ListenNetwork = "unix"
+		c.ListenAddr = path
+	})
+
+	// A previous run that crashed left its socket behind
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- Listen(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("never accepted on the unix socket:", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	activeCalls.Wait()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left after shutdown: %v", err)
+	}
+}
+
+func TestListenKeepsNonSocketFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audiosocket.sock")
+	if err := ioutil.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, func(c *Config) {
+		c.ListenNetwork = "unix"
+		c.ListenAddr = path
+	})
+
+	if err := Listen(context.Background()); err == nil {
+		t.Fatal("Listen replaced a regular file")
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "data" {
+		t.Error("regular file was modified")
+	}
+}
+
+func TestAutomaticGainConvergesToTarget(t *testing.T) {
+	const target = 0.1
+	for _, amplitude := range []float64{0.05, 0.1, 0.3} {
+		in := sine(300, 16000, 0.5)
+		for i := range in {
+			in[i] *= float32(amplitude / 0.5)
+		}
+		if got := rms(AutomaticGain(in, target)); math.Abs(got-target) > 0.001 {
+			t.Errorf("amplitude %v: RMS %.4f after AGC, want %v", amplitude, got, target)
+		}
+	}
+
+	// Very quiet speech is raised as far as the maximum gain allows
+	quiet := sine(300, 16000, 0.5)
+	for i := range quiet {
+		quiet[i] *= 0.01
+	}
+	got := rms(AutomaticGain(quiet, target))
+	if want := rms(quiet) * agcMaxGain; math.Abs(got-want) > 1e-4 {
+		t.Errorf("quiet input reached RMS %.4f, want %.4f at the maximum gain", got, want)
+	}
+}
+
+func TestAutomaticGainLeavesSilence(t *testing.T) {
+	silence := make([]float32, 1600)
+	if got := AutomaticGain(silence, 0.1); rms(got) != 0 {
+		t.Errorf("silence amplified to RMS %v", rms(got))
+	}
+
+	// Line noise below the floor stays as quiet as it was
+	hiss := noiseFrames(7)()
+	for i := range hiss {
+		hiss[i] *= 0.0005
+	}
+	if got := rms(AutomaticGain(hiss, 0.1)); got != rms(hiss) {
+		t.Errorf("noise below the floor raised from RMS %v to %v", rms(hiss), got)
+	}
+}
+
+func TestAutomaticGainDoesNotClip(t *testing.T) {
+	// A quiet utterance with one loud click
+	in := make([]float32, 1600)
+	for i := range in {
+		in[i] = 0.01
+	}
+	in[800] = 0.5
+	for i, sample := range AutomaticGain(in, 0.1) {
+		if math.Abs(float64(sample)) > agcPeakCeiling+1e-6 {
+			t.Fatalf("sample %d = %v exceeds the ceiling", i, sample)
+		}
+	}
+}
+
+// pcm16 encodes samples as little-endian SLIN.
+func pcm16(samples ...int16) []byte {
+	pcm := make([]byte, len(samples)*2)
+	for i, sample := range samples {
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(sample))
+	}
+	return pcm
+}
+
+func TestNoiseGate(t *testing.T) {
+	in := pcm16(0, 50, -50, 99, -99, 100, -100, 2000, -2000, math.MaxInt16, math.MinInt16)
+	want := pcm16(0, 0, 0, 0, 0, 100, -100, 2000, -2000, math.MaxInt16, math.MinInt16)
+	got := NoiseGate(in, 100)
+	if string(got) != string(want) {
+		t.Errorf("NoiseGate() = %v, want %v", got, want)
+	}
+	if string(in) != string(pcm16(0, 50, -50, 99, -99, 100, -100, 2000, -2000, math.MaxInt16, math.MinInt16)) {
+		t.Error("input modified in place")
+	}
+}
+
+func TestPCMRoundTrip(t *testing.T) {
+	boundary := []int16{math.MinInt16, math.MinInt16 + 1, -1, 0, 1, math.MaxInt16 - 1, math.MaxInt16}
+	samples, err := pcmToFloat32Array(pcm16(boundary...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if samples[0] != -1 {
+		t.Errorf("%d decoded to %v, want -1", math.MinInt16, samples[0])
+	}
+	if samples[3] != 0 {
+		t.Errorf("0 decoded to %v", samples[3])
+	}
+	if got := pcm16FromBytes(float32ArrayToPCM(samples)); !equalInt16s(got, boundary) {
+		t.Errorf("round trip gave %v, want %v", got, boundary)
+	}
+
+	// Every int16 value survives
+	all := make([]int16, 0, 1<<16)
+	for v := math.MinInt16; v <= math.MaxInt16; v++ {
+		all = append(all, int16(v))
+	}
+	samples, _ = pcmToFloat32Array(pcm16(all...))
+	if got := pcm16FromBytes(float32ArrayToPCM(samples)); !equalInt16s(got, all) {
+		t.Error("round trip of all int16 values changed some")
+	}
+}
+
+func TestFloat32ArrayToPCMClamps(t *testing.T) {
+	got := pcm16FromBytes(float32ArrayToPCM([]float32{1, 1.5, -1, -1.5, 0.5, -0.5, 0.4999 / 32768, -0.5001 / 32768}))
+	want := []int16{math.MaxInt16, math.MaxInt16, math.MinInt16, math.MinInt16, 16384, -16384, 0, -1}
+	if !equalInt16s(got, want) {
+		t.Errorf("float32ArrayToPCM() = %v, want %v", got, want)
+	}
+}
+
+func TestPCMToFloat32ArrayRejectsOddLength(t *testing.T) {
+	if _, err := pcmToFloat32Array([]byte{1, 2, 3}); err == nil {
+		t.Error("odd-length PCM decoded without an error")
+	}
+}
+
+// pcm16FromBytes decodes little-endian SLIN.
+func pcm16FromBytes(pcm []byte) []int16 {
+	samples := make([]int16, len(pcm)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(pcm[i*2:]))
+	}
+	return samples
+}
+
+func equalInt16s(a, b []int16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sttServer is a fake STT service recording the audio of each upload and
+// answering with a fixed transcription.
+type sttServer struct {
+	*httptest.Server
+	uploads chan []float32
+	// hold keeps requests waiting until the client gives up, so no turn
+	// gets past the transcription.
+	hold bool
+}
+
+// newSTTServer starts an STT service answering transcription and routes
+// the calls of the test to it through the "test" segment.
+func newSTTServer(t *testing.T, transcription string) *sttServer {
+	t.Helper()
+	stt := &sttServer{uploads: make(chan []float32, 16)}
+	stt.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile("audio")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		audio, _ := ioutil.ReadAll(file)
+		samples := make([]float32, len(audio)/4)
+		for i := range samples {
+			samples[i] = math.Float32frombits(binary.LittleEndian.Uint32(audio[i*4:]))
+		}
+		stt.uploads <- samples
+		if stt.hold {
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte(`{"transcription":` + strconv.Quote(transcription) + `}`))
+	}))
+	t.Cleanup(stt.Close)
+	withConfig(t, func(c *Config) {
+		c.STTSegments = map[string]STTSegmentConfig{"test": {URL: stt.URL}}
+	})
+	return stt
+}
+
+// Upload waits for the next upload.
+func (stt *sttServer) Upload(t *testing.T) []float32 {
+	t.Helper()
+	select {
+	case samples := <-stt.uploads:
+		return samples
+	case <-time.After(5 * time.Second):
+		t.Fatal("no audio uploaded")
+		return nil
+	}
+}
+
+// levelFrames returns n 20 ms frames of slin16 at a constant level.
+func levelFrames(n int, level float32) []audiosocket.Message {
+	frames := make([]audiosocket.Message, n)
+	for i := range frames {
+		frames[i] = audiosocket.SlinMessage(float32ArrayToPCM(constantSamples(320, level)))
+	}
+	return frames
+}
+
+// voicedFrames returns n 20 ms frames of a slin16 tone.
+func voicedFrames(n int) []audiosocket.Message {
+	frames := make([]audiosocket.Message, n)
+	for i := range frames {
+		frames[i] = audiosocket.SlinMessage(float32ArrayToPCM(sine(200, 16000, 0.02)))
+	}
+	return frames
+}
+
+func TestUtteranceKeepsPreRollAndHangover(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.VAD.Backend = vadEnergy
+		c.VAD.PreRollFrames = 3
+		c.VAD.HangoverFrames = 4
+	})
+	stt := newSTTServer(t, "hello")
+	stt.hold = true
+	s := testSettings(0.7)
+	s.AsteriskSettings.AsteriskSegment = "test"
+	id, _ := newTestCallChat(t, s)
+
+	// Quiet levels below the VAD threshold tell the leading silence from
+	// the trailing one
+	const before, after = 0.004, 0.008
+	script := []audiosocket.Message{audiosocket.IDMessage(id)}
+	script = append(script, levelFrames(10, before)...)
+	// Long enough to be transcribed
+	script = append(script, voicedFrames(20)...)
+	script = append(script, levelFrames(10, after)...)
+	stream := newTestStream(script...)
+	stream.hold = true
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(context.Background(), stream)
+	}()
+	defer func() {
+		stream.Close()
+		<-done
+	}()
+
+	samples := stt.Upload(t)
+	if want := (3 + 20 + 4) * 320; len(samples) != want {
+		t.Fatalf("utterance has %d samples, want %d", len(samples), want)
+	}
+	isLevel := func(samples []float32, level float64) bool {
+		for _, s := range samples {
+			if math.Abs(float64(s)-level) > 1.0/32768 {
+				return false
+			}
+		}
+		return true
+	}
+	if !isLevel(samples[:3*320], before) {
+		t.Error("utterance does not start with the pre-roll")
+	}
+	if isLevel(samples[3*320:4*320], before) {
+		t.Error("utterance has more pre-roll than configured")
+	}
+	if !isLevel(samples[23*320:], after) {
+		t.Error("utterance does not end with the hangover")
+	}
+}
+
+// overlongCall runs a call whose caller speaks continuously for the given
+// number of frames with utterances capped at 600 ms, and returns the STT
+// service.
+func overlongCall(t *testing.T, frames int, drop bool) *sttServer {
+	t.Helper()
+	withConfig(t, func(c *Config) {
+		c.VAD.PreRollFrames = 0
+		c.VAD.HangoverFrames = 0
+		c.AudioBuffer.MaxUtteranceMs = 600
+		c.AudioBuffer.DropOverlong = drop
+	})
+	stt, _, _ := turnsCall(t, 0, append(voicedFrames(frames), levelFrames(10, 0)...)...)
+	return stt
+}
+
+func TestOverlongUtteranceFinalizedAtCap(t *testing.T) {
+	stt := overlongCall(t, 60, false)
+	if samples := stt.Upload(t); len(samples) != 30*320 {
+		t.Errorf("first utterance has %d samples, want the 600 ms cap", len(samples))
+	}
+	if samples := stt.Upload(t); len(samples) != 30*320 {
+		t.Errorf("second utterance has %d samples, want the rest of the speech", len(samples))
+	}
+}
+
+func TestOverlongUtteranceDropped(t *testing.T) {
+	stt := overlongCall(t, 55, true)
+	// Only what was said after the cap is transcribed
+	if samples := stt.Upload(t); len(samples) != 25*320 {
+		t.Errorf("utterance has %d samples, want the speech after the dropped one", len(samples))
+	}
+	select {
+	case samples := <-stt.uploads:
+		t.Errorf("another utterance of %d samples uploaded", len(samples))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// hangingOllama never answers; each request's context is sent on
+// canceled once it is canceled.
+func hangingOllama(canceled chan<- error) *fakeOllama {
+	return &fakeOllama{reply: func(ctx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error) {
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return api.OllamaChatResponse{}, ctx.Err()
+	}}
+}
+
+func TestLLMTimeoutPlaysFallback(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.LLMTimeoutSeconds = 1
+		c.LLMFallbackMessage = "One moment, please."
+		c.Unavailable.Message = ""
+		c.Webhook.StateEvents = true
+	})
+	events := withWebhookQueue(t)
+	tts := newTTSServer(t, make([]byte, 640), 320)
+	withTTS(t, tts)
+	canceled := make(chan error, 1)
+	_, store := newTestChat(t, "call", testSettings(0.7), hangingOllama(canceled))
+	call := NewCall("call", NewScriptedStream(), func() {})
+	call.ChatStore = store
+
+	start := time.Now()
+	handleTranscription(context.Background(), call, "hello")
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("turn took %v with a 1s LLM timeout", elapsed)
+	}
+	select {
+	case err := <-canceled:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("LLM request ended with %v, want its deadline exceeded", err)
+		}
+	default:
+		t.Error("LLM request not canceled")
+	}
+	waitForState(t, events, stateListening)
+	requests := tts.Requests()
+	if len(requests) != 1 || !strings.Contains(fmt.Sprint(requests[0]["message"]), "One moment") {
+		t.Errorf("synthesis requests = %v, want the fallback message", requests)
+	}
+}
+
+func TestLLMHangupSkipsFallback(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.LLMTimeoutSeconds = 30
+		c.LLMFallbackMessage = "One moment, please."
+		c.Unavailable.Message = ""
+	})
+	tts := newTTSServer(t, make([]byte, 640), 320)
+	withTTS(t, tts)
+	ctx, hangup := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	// The caller hangs up while the LLM is thinking
+	ollama := &fakeOllama{reply: func(llmCtx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error) {
+		hangup()
+		<-llmCtx.Done()
+		canceled <- llmCtx.Err()
+		return api.OllamaChatResponse{}, llmCtx.Err()
+	}}
+	_, store := newTestChat(t, "call", testSettings(0.7), ollama)
+	call := NewCall("call", NewScriptedStream(), hangup)
+	call.ChatStore = store
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleTranscription(ctx, call, "hello")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("turn not abandoned on hangup")
+	}
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Errorf("LLM request ended with %v, want it canceled", err)
+	}
+	if requests := tts.Requests(); len(requests) != 0 {
+		t.Errorf("synthesis requests = %v after hangup, want none", requests)
+	}
+}
+
+func TestHangupDuringProcessing(t *testing.T) {
+	withConfig(t, func(c *Config) { c.VAD.Backend = vadEnergy })
+	stt := newSTTServer(t, "hello")
+	stt.hold = true
+	s := testSettings(0.7)
+	s.AsteriskSettings.AsteriskSegment = "test"
+	id, _ := newTestCallChat(t, s)
+
+	script := []audiosocket.Message{audiosocket.IDMessage(id)}
+	script = append(script, voicedFrames(30)...)
+	script = append(script, levelFrames(30, 0)...)
+	stream := newTestStream(script...)
+	stream.hold = true
+	stream.more = make(chan audiosocket.Message)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(context.Background(), stream)
+	}()
+	defer func() {
+		stream.Close()
+		<-done
+	}()
+
+	// The transcription never comes back, yet the hangup is still read
+	stt.Upload(t)
+	select {
+	case stream.more <- audiosocket.HangupMessage():
+	case <-time.After(time.Second):
+		t.Fatal("frames not read while the utterance is processed")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("hangup not honored while the utterance is processed")
+	}
+}
+
+func TestAudioWriterRechunksToFrames(t *testing.T) {
+	stream := NewScriptedStream()
+	w := &AudioWriter{stream: stream, frameSize: 320}
+
+	var sent []byte
+	for i, size := range []int{1, 100, 333, 319, 640, 7, 1000} {
+		chunk := bytes.Repeat([]byte{byte(i + 1)}, size)
+		if n, err := w.Write(chunk); n != size || err != nil {
+			t.Fatalf("Write(%d bytes) = %d, %v", size, n, err)
+		}
+		sent = append(sent, chunk...)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []byte
+	for i, frame := range stream.Written() {
+		if len(frame) != 320 {
+			t.Errorf("frame %d has %d bytes, want 320", i, len(frame))
+		}
+		got = append(got, frame...)
+	}
+	// The last frame is padded with silence
+	padded := append(sent, make([]byte, len(got)-len(sent))...)
+	if len(got)%320 != 0 || len(got)-len(sent) >= 320 || !bytes.Equal(got, padded) {
+		t.Errorf("sent %d bytes, got %d bytes of frames not matching them", len(sent), len(got))
+	}
+}
+
+func TestAudioWriterFlushWithoutRemainder(t *testing.T) {
+	stream := NewScriptedStream()
+	w := &AudioWriter{stream: stream, frameSize: 320}
+	w.Write(make([]byte, 640))
+	w.Flush()
+	if n := len(stream.Written()); n != 2 {
+		t.Errorf("%d frames written, want no padding frame", n)
+	}
+}
+
+func TestAudioWriterConcurrentWrites(t *testing.T) {
+	stream := NewScriptedStream()
+	w := &AudioWriter{stream: stream, frameSize: 320}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				w.Write(make([]byte, 111))
+			}
+		}()
+	}
+	wg.Wait()
+	w.Flush()
+	for i, frame := range stream.Written() {
+		if len(frame) != 320 {
+			t.Errorf("frame %d has %d bytes, want 320", i, len(frame))
+		}
+	}
+	if n := len(stream.Written()); n != (8*10*111+319)/320 {
+		t.Errorf("%d frames written for %d bytes", n, 8*10*111)
+	}
+}
+
+func TestMiniCall(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.VAD.Backend = vadEnergy
+		c.Webhook.StateEvents = true
+	})
+	events := withWebhookQueue(t)
+	stt := newSTTServer(t, "hello")
+	tts := newTTSServer(t, make([]byte, 3200), 640)
+	withTTS(t, tts)
+	s := testSettings(0.7)
+	s.AsteriskSettings.AsteriskSegment = "test"
+	id, chats := newTestCallChat(t, s)
+
+	script := []audiosocket.Message{audiosocket.IDMessage(id)}
+	script = append(script, voicedFrames(25)...)
+	script = append(script, levelFrames(10, 0)...)
+	stream := newTestStream(script...)
+	stream.hold = true
+	stream.more = make(chan audiosocket.Message)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(context.Background(), stream)
+	}()
+	defer func() {
+		stream.Close()
+		<-done
+	}()
+
+	if samples := stt.Upload(t); len(samples) < 25*320 {
+		t.Errorf("uploaded %d samples, want the speech", len(samples))
+	}
+	// The reply is played, then the caller hangs up
+	waitForState(t, events, stateSpeaking)
+	waitForState(t, events, stateListening)
+	stream.more <- audiosocket.HangupMessage()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("call did not end on hangup")
+	}
+
+	if requests := tts.Requests(); len(requests) != 1 || fmt.Sprint(requests[0]["message"]) != "ok" {
+		t.Errorf("synthesis requests = %v, want the reply", requests)
+	}
+	if len(stream.Written()) == 0 {
+		t.Error("no reply audio played to the caller")
+	}
+	messages, err := chats.GetMessages(id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(contents(messages)); got != "[hello ok]" {
+		t.Errorf("chat history = %s, want the turn stored", got)
+	}
+}
+
+func TestEchoModeSkipsLLM(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.EchoMode = true
+		c.Webhook.StateEvents = true
+	})
+	events := withWebhookQueue(t)
+	tts := newTTSServer(t, make([]byte, 640), 320)
+	withTTS(t, tts)
+	ollama := &fakeOllama{}
+	_, store := newTestChat(t, "call", testSettings(0.7), ollama)
+	call := NewCall("call", NewScriptedStream(), func() {})
+	call.ChatStore = store
+
+	handleTranscription(context.Background(), call, "[neutral]\nthe line is clear")
+	waitForState(t, events, stateListening)
+	if n := len(ollama.Requests()); n != 0 {
+		t.Errorf("%d LLM requests in echo mode", n)
+	}
+	if requests := tts.Requests(); len(requests) != 1 || requests[0]["message"] != "the line is clear" {
+		t.Errorf("synthesis requests = %v, want the transcription spoken back", requests)
+	}
+	if history := store.Snapshot(); len(history) != 0 {
+		t.Errorf("echo turn stored in the chat: %v", history)
+	}
+}
+
+func TestTTSAwaitTime(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Webhook.StateEvents = true })
+	for _, tt := range []struct {
+		name      string
+		awaitTime *float64
+		want      float64
+	}{
+		{"configured", float64Ptr(0.05), 0.05},
+		{"unset", nil, defaultTTSAwaitTime},
+	} {
+		events := withWebhookQueue(t)
+		tts := newTTSServer(t, make([]byte, 640), 320)
+		withTTS(t, tts)
+		s := testSettings(0.7)
+		s.TTSSettings.AwaitTime = tt.awaitTime
+		_, store := newTestChat(t, "call", s, &fakeOllama{})
+		call := NewCall("call", NewScriptedStream(), func() {})
+		call.ChatStore = store
+
+		handleTranscription(context.Background(), call, "hello")
+		waitForState(t, events, stateListening)
+		if requests := tts.Requests(); len(requests) != 1 || requests[0]["await_time"] != tt.want {
+			t.Errorf("%s: synthesis requests = %v, want await_time %v", tt.name, requests, tt.want)
+		}
+	}
+}
+
+func TestNegativeAwaitTimeDropped(t *testing.T) {
+	s := testSettings(0.7)
+	s.TTSSettings.AwaitTime = float64Ptr(-1)
+	if !clampSettings("chat", &s) || s.TTSSettings.AwaitTime != nil {
+		t.Errorf("await_time = %v, want a negative one replaced by the default", s.TTSSettings.AwaitTime)
+	}
+}
+
+// transcriptionLogs returns what handling text as a transcription logs
+// with content logging set to logContent.
+func transcriptionLogs(t *testing.T, text string, logContent bool) string {
+	t.Helper()
+	withConfig(t, func(c *Config) {
+		c.Unavailable.Message = ""
+		c.Unavailable.MaxFailures = 0
+	})
+	var buf bytes.Buffer
+	savedOutput, savedContent := log.Writer(), api.LogContent
+	t.Cleanup(func() {
+		log.SetOutput(savedOutput)
+		api.LogContent = savedContent
+	})
+	log.SetOutput(&buf)
+	api.LogContent = logContent
+
+	ollama := &fakeOllama{reply: func(ctx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error) {
+		return api.OllamaChatResponse{}, errors.New("LLM down")
+	}}
+	_, store := newTestChat(t, "call", testSettings(0.7), ollama)
+	call := NewCall("call", NewScriptedStream(), func() {})
+	call.ChatStore = store
+	handleTranscription(context.Background(), call, text)
+	log.SetOutput(savedOutput)
+	return buf.String()
+}
+
+func TestTranscriptionRedactedInLogs(t *testing.T) {
+	if out := transcriptionLogs(t, "my card is 4111", false); strings.Contains(out, "4111") {
+		t.Errorf("transcription logged at the default level:\n%s", out)
+	}
+}
+
+func TestTranscriptionLoggedAtDebug(t *testing.T) {
+	if out := transcriptionLogs(t, "my card is 4111", true); !strings.Contains(out, "Transcription: my card is 4111") {
+		t.Errorf("transcription missing from the debug logs:\n%s", out)
+	}
+}
+
+// levelUtterance returns 30 frames of 20 ms at 16 kHz with an RMS level of
+// about level.
+func levelUtterance(level float32) [][]float32 {
+	frames := make([][]float32, 30)
+	for i := range frames {
+		// A full scale sine has an RMS level of 0.354
+		frames[i] = scaled(sine(200, 16000, 0.02), level/0.354)
+	}
+	return frames
+}
+
+func TestLoudEnough(t *testing.T) {
+	withConfig(t, func(c *Config) { c.MinSpeechRMS = 0.01 })
+	if loudEnough(levelUtterance(0.001)) {
+		t.Error("near-silent utterance taken for speech")
+	}
+	if !loudEnough(levelUtterance(0.05)) {
+		t.Error("speech-level utterance rejected")
+	}
+	if loudEnough(nil) {
+		t.Error("empty utterance taken for speech")
+	}
+
+	config.MinSpeechRMS = 0
+	if !loudEnough(levelUtterance(0.001)) {
+		t.Error("near-silent utterance rejected with the check disabled")
+	}
+}
+
+func TestQuietUtteranceSkipsSTT(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.MinSpeechRMS = 0.01
+		c.Unavailable.Message = ""
+		c.Unavailable.MaxFailures = 0
+	})
+	stt := newSTTServer(t, "hello")
+	ollama := &fakeOllama{reply: func(ctx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error) {
+		return api.OllamaChatResponse{}, errors.New("LLM down")
+	}}
+	s := testSettings(0.7)
+	s.AsteriskSettings.AsteriskSegment = "test"
+	_, store := newTestChat(t, "call", s, ollama)
+	call := NewCall("call", NewScriptedStream(), func() {})
+	call.SetChatStore(store)
+
+	handleInputAudio(context.Background(), call, levelUtterance(0.001))
+	select {
+	case <-stt.uploads:
+		t.Error("near-silent utterance sent to STT")
+	default:
+	}
+
+	handleInputAudio(context.Background(), call, levelUtterance(0.05))
+	select {
+	case <-stt.uploads:
+	default:
+		t.Error("speech-level utterance not sent to STT")
+	}
+}
+
+func TestPlayTTSCanceledMidFlight(t *testing.T) {
+	requested, closed := make(chan struct{}), make(chan struct{})
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var request map[string]interface{}
+		if err := conn.ReadJSON(&request); err != nil {
+			return
+		}
+		// Synthesis never finishes; only the client closing ends the read
+		close(requested)
+		conn.ReadMessage()
+		close(closed)
+	}))
+	defer srv.Close()
+
+	ctx, hangup := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- playTTS(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), "call", map[string]interface{}{"message": "hello"}, io.Discard)
+	}()
+	<-requested
+	hangup()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("playTTS() = %v, want nil for an interruption", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("TTS read kept running after the call was canceled")
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("TTS connection not closed")
+	}
+}
+
+// pcmToFloat32ArrayReader is the binary.Read decoder pcmToFloat32Array
+// replaced, kept to check the outputs match and to compare speed.
+func pcmToFloat32ArrayReader(pcmData []byte) ([]float32, error) {
+	if len(pcmData)%2 != 0 {
+		return nil, fmt.Errorf("pcm data length must be even")
+	}
+	float32Array := make([]float32, len(pcmData)/2)
+	buf := bytes.NewReader(pcmData)
+	for i := 0; i < len(float32Array); i++ {
+		var sample int16
+		if err := binary.Read(buf, binary.LittleEndian, &sample); err != nil {
+			return nil, fmt.Errorf("failed to read sample: %v", err)
+		}
+		float32Array[i] = float32(sample) / 32768.0
+	}
+	return float32Array, nil
+}
+
+func TestPCMToFloat32ArrayMatchesReader(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 2, 3, 320, 641, 1920, 4096} {
+		pcm := make([]byte, n)
+		rnd.Read(pcm)
+		got, err := pcmToFloat32Array(pcm)
+		want, wantErr := pcmToFloat32ArrayReader(pcm)
+		if (err != nil) != (wantErr != nil) {
+			t.Errorf("%d bytes: error %v, want %v", n, err, wantErr)
+			continue
+		}
+		if len(got) != len(want) {
+			t.Errorf("%d bytes: %d samples, want %d", n, len(got), len(want))
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%d bytes: sample %d = %v, want %v", n, i, got[i], want[i])
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkPCMToFloat32Array(b *testing.B) {
+	pcm := make([]byte, 640)
+	b.Run("reader", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			pcmToFloat32ArrayReader(pcm)
+		}
+	})
+	b.Run("direct", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			pcmToFloat32Array(pcm)
+		}
+	})
+}
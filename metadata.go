@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"go-ast-client/api"
+	"log"
+)
+
+// kindMetadata carries JSON encoded CallMetadata. It isn't part of the
+// AudioSocket protocol; a dialplan that wants per-call overrides sends it
+// right after the ID, e.g. built from channel variables.
+const kindMetadata = 0x20
+
+// CallMetadata overrides chat settings for a single call, so one dialplan
+// can route calls to different personas. Empty fields keep the settings
+// from the chat backend, which in turn fall back to the defaults.
+//
+// AudioSocket itself only identifies a call by its UUID, so the caller ID
+// and dialed number are only known if the dialplan sends them here, e.g.
+// from ${CALLERID(num)} and ${EXTEN}. They describe the call leg rather
+// than override settings.
+type CallMetadata struct {
+	Language     string `json:"language,omitempty"`
+	Model        string `json:"model,omitempty"`
+	Voice        string `json:"voice,omitempty"`
+	SystemPrompt string `json:"system_prompt,omitempty"`
+	CallerID     string `json:"caller_id,omitempty"`
+	CalledNumber string `json:"called_number,omitempty"`
+	// ChannelID is the ID of the Asterisk channel, e.g. from
+	// ${CHANNEL(uniqueid)}, needed to transfer inbound calls.
+	ChannelID string `json:"channel_id,omitempty"`
+}
+
+// parseCallMetadata decodes the payload of a kindMetadata message.
+func parseCallMetadata(payload []byte) (CallMetadata, error) {
+	var md CallMetadata
+	err := json.Unmarshal(payload, &md)
+	return md, err
+}
+
+// mergeMetadata returns s with the overrides in md applied.
+func mergeMetadata(s api.Settings, md CallMetadata) api.Settings {
+	if md.Language != "" {
+		s.STTSettings.Language = ptr(md.Language)
+	}
+	if md.Model != "" {
+		s.LLMSettings.Model = ptr(md.Model)
+	}
+	if md.SystemPrompt != "" {
+		s.LLMSettings.SystemPrompt = ptr(md.SystemPrompt)
+	}
+	if md.Voice != "" {
+		s.TTSSettings.Voice = md.Voice
+	}
+	return s
+}
+
+// applyMetadata applies the overrides in a kindMetadata payload to the
+// call. Invalid metadata is logged and ignored.
+func (c *Call) applyMetadata(payload []byte) {
+	md, err := parseCallMetadata(payload)
+	if err != nil {
+		log.Printf("call %s: ignoring invalid metadata: %v", c.ID, err)
+		return
+	}
+	log.Printf("call %s: applying metadata %+v", c.ID, md)
+	c.mu.Lock()
+	c.metadata = append(c.metadata, md)
+	if md.Language != "" {
+		c.language = md.Language
+	}
+	if md.CallerID != "" {
+		c.leg.CallerID = md.CallerID
+	}
+	if md.CalledNumber != "" {
+		c.leg.CalledNumber = md.CalledNumber
+	}
+	if md.ChannelID != "" {
+		c.channelID = md.ChannelID
+	}
+	leg := c.leg
+	c.mu.Unlock()
+	// md is recorded first so a concurrent refreshSettings merges it too;
+	// merging it twice changes nothing.
+	c.ChatStore.UpdateSettings(func(s api.Settings) api.Settings {
+		return mergeMetadata(s, md)
+	})
+	c.ChatStore.SetCallLeg(leg)
+}
+
+// Leg returns what is known about the call leg: the remote address of
+// the connection and whatever the dialplan reported in metadata.
+func (c *Call) Leg() api.CallLeg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leg
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/CyCoreSystems/audiosocket"
+
+	"go-ast-client/api"
+)
+
+// metadataMessage returns a kindMetadata message carrying payload.
+func metadataMessage(payload string) audiosocket.Message {
+	data := []byte{kindMetadata, byte(len(payload) >> 8), byte(len(payload))}
+	return audiosocket.MessageFromData(append(data, payload...))
+}
+
+func TestMergeMetadataPartial(t *testing.T) {
+	backend := testSettings(0.7)
+	backend.STTSettings.Language = ptr("en")
+
+	md, err := parseCallMetadata([]byte(`{"model":"persona-b","voice":"maria"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := mergeMetadata(backend, md)
+	if *merged.LLMSettings.Model != "persona-b" || merged.TTSSettings.Voice != "maria" {
+		t.Errorf("merged model %q, voice %q; want the overrides", *merged.LLMSettings.Model, merged.TTSSettings.Voice)
+	}
+	// What isn't overridden comes from the backend
+	if *merged.STTSettings.Language != "en" || *merged.LLMSettings.Temperature != 0.7 || merged.LLMSettings.SystemPrompt != nil {
+		t.Errorf("merged settings = %+v, want the backend's where not overridden", merged)
+	}
+	if *backend.LLMSettings.Model != "model" || backend.TTSSettings.Voice != "voice" {
+		t.Error("merging changed the backend settings")
+	}
+}
+
+func TestMergeMetadataEmpty(t *testing.T) {
+	backend := testSettings(0.7)
+	md, err := parseCallMetadata([]byte(`{"caller_id":"+15550100"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := mergeMetadata(backend, md)
+	if *merged.LLMSettings.Model != "model" || merged.TTSSettings.Voice != "voice" || merged.STTSettings.Language != nil {
+		t.Errorf("merged settings = %+v, want the backend's unchanged", merged)
+	}
+}
+
+func TestParseCallMetadataInvalid(t *testing.T) {
+	if _, err := parseCallMetadata([]byte(`{"model":`)); err == nil {
+		t.Error("truncated metadata parsed")
+	}
+}
+
+func TestCallAppliesMetadata(t *testing.T) {
+	s := testSettings(0.7)
+	s.STTSettings.Language = ptr("en")
+	id, _ := newTestCallChat(t, s)
+	events := withWebhookQueue(t)
+	stream := newTestStream(
+		audiosocket.IDMessage(id),
+		metadataMessage(`not json`),
+		metadataMessage(`{"language":"ru","system_prompt":"Be brief.","caller_id":"+15550100"}`),
+	)
+	stream.hold = true
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(context.Background(), stream)
+	}()
+	defer func() {
+		stream.Close()
+		<-done
+	}()
+
+	call := waitForCall(t, id.String(), stream)
+	// The chat is loaded once the call has started
+	for event := range events {
+		if event.Type == eventCallStarted {
+			break
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for call.ChatStore.Settings().LLMSettings.SystemPrompt == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("metadata never applied")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	got := call.ChatStore.Settings()
+	if *got.STTSettings.Language != "ru" || *got.LLMSettings.SystemPrompt != "Be brief." {
+		t.Errorf("settings = %+v, want the overrides applied", got)
+	}
+	if *got.LLMSettings.Model != "model" || got.TTSSettings.Voice != "voice" {
+		t.Errorf("settings = %+v, want the backend's where not overridden", got)
+	}
+	if call.Leg().CallerID != "+15550100" {
+		t.Errorf("caller ID = %q, want the one from the metadata", call.Leg().CallerID)
+	}
+	if call.Language() != "ru" {
+		t.Errorf("call language = %q, want the override", call.Language())
+	}
+}
+
+func TestParseCallMetadataLeg(t *testing.T) {
+	md, err := parseCallMetadata([]byte(`{"caller_id":"+15550100","called_number":"8000"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.CallerID != "+15550100" || md.CalledNumber != "8000" {
+		t.Errorf("metadata = %+v, want the caller ID and dialed number", md)
+	}
+}
+
+func TestCallLeg(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Unavailable.Message = "" })
+	events := withWebhookQueue(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := testSettings(0.7)
+	s.LLMSettings.SystemPrompt = ptr("Caller {{.CallerID}} dialed {{.CalledNumber}} via {{.RemoteAddr}}.")
+	ollama := &fakeOllama{reply: func(ctx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error) {
+		return api.OllamaChatResponse{}, errors.New("LLM down")
+	}}
+	_, store := newTestChat(t, "call", s, ollama)
+	call := NewCall("call", NewAudioSocketStream(conn), func() {})
+	call.SetChatStore(store)
+	if got := call.Leg(); got.RemoteAddr != client.LocalAddr().String() || got.CallerID != "" {
+		t.Errorf("leg before metadata = %+v, want only the remote address", got)
+	}
+
+	call.applyMetadata([]byte(`{"caller_id":"+15550100","called_number":"8000"}`))
+	want := api.CallLeg{CallerID: "+15550100", CalledNumber: "8000", RemoteAddr: client.LocalAddr().String()}
+	if got := call.Leg(); got != want {
+		t.Errorf("leg = %+v, want %+v", got, want)
+	}
+
+	handleTranscription(context.Background(), call, "hello")
+	if prompt := ollama.Requests()[0].Messages[0].Content; prompt != "Caller +15550100 dialed 8000 via "+want.RemoteAddr+"." {
+		t.Errorf("system prompt = %q, want the leg rendered", prompt)
+	}
+	for event := range events {
+		if event.Type == eventUtteranceTranscribed {
+			if event.Data["leg"] != want {
+				t.Errorf("utterance event leg = %+v, want %+v", event.Data["leg"], want)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxSpelledDigits is the longest whole number spelled out as a number;
+// longer ones are read digit by digit.
+const maxSpelledDigits = 12
+
+// currency holds the words for a currency in one language, as the forms
+// for one, few and many (see numberLanguage.plural).
+type currency struct {
+	major, minor       [3]string
+	majorFem, minorFem bool
+}
+
+// numberLanguage knows how numbers are spoken in a language.
+type numberLanguage struct {
+	// cardinal spells n, in the feminine form if fem is set.
+	cardinal func(n int64, fem bool) string
+	// ordinal spells the ordinal of n; nil if ordinal suffixes aren't
+	// recognized for the language.
+	ordinal func(n int64) string
+	// plural picks the form of a counted noun.
+	plural func(n int64, forms [3]string) string
+	// grouped matches numbers written with thousands separators.
+	grouped *regexp.Regexp
+	point   string
+	and     string
+	// currencies maps currency symbols to their words.
+	currencies map[string]currency
+}
+
+// numberLanguages are the languages NumberExpander supports.
+var numberLanguages = map[string]numberLanguage{
+	"en": {
+		cardinal: func(n int64, _ bool) string { return englishCardinal(n) },
+		ordinal:  englishOrdinal,
+		plural: func(n int64, forms [3]string) string {
+			if n == 1 {
+				return forms[0]
+			}
+			return forms[2]
+		},
+		grouped: regexp.MustCompile(`\d{1,3}(?:,\d{3})+`),
+		point:   "point",
+		and:     "and",
+		currencies: map[string]currency{
+			"$": {major: [3]string{"dollar", "dollars", "dollars"}, minor: [3]string{"cent", "cents", "cents"}},
+			"€": {major: [3]string{"euro", "euros", "euros"}, minor: [3]string{"cent", "cents", "cents"}},
+			"£": {major: [3]string{"pound", "pounds", "pounds"}, minor: [3]string{"penny", "pence", "pence"}},
+			"₽": {major: [3]string{"ruble", "rubles", "rubles"}, minor: [3]string{"kopeck", "kopecks", "kopecks"}},
+		},
+	},
+	"ru": {
+		cardinal: russianCardinal,
+		plural:   russianPlural,
+		grouped:  regexp.MustCompile(`\d{1,3}(?:[ \x{00A0}]\d{3})+`),
+		point:    "запятая",
+		currencies: map[string]currency{
+			"$": {major: [3]string{"доллар", "доллара", "долларов"}, minor: [3]string{"цент", "цента", "центов"}},
+			"€": {major: [3]string{"евро", "евро", "евро"}, minor: [3]string{"цент", "цента", "центов"}},
+			"£": {major: [3]string{"фунт", "фунта", "фунтов"}, minor: [3]string{"пенни", "пенни", "пенни"}},
+			"₽": {
+				major: [3]string{"рубль", "рубля", "рублей"}, minor: [3]string{"копейка", "копейки", "копеек"},
+				minorFem: true,
+			},
+		},
+	},
+}
+
+// Number patterns, matched in this order.
+var (
+	currencyBefore = regexp.MustCompile(`([$€£₽])\s?(\d+)(?:[.,](\d{2}))?`)
+	currencyAfter  = regexp.MustCompile(`(\d+)(?:[.,](\d{2}))?\s?(\$|€|£|₽|руб\.|р\.)`)
+	phoneNumber    = regexp.MustCompile(`\+\d[\d -]*\d|\d+(?:-\d+){2,}|\d{3}-\d{4}|0\d{4,}`)
+	ordinalNumber  = regexp.MustCompile(`(\d+)(?:st|nd|rd|th)`)
+	decimalNumber  = regexp.MustCompile(`(\d+)[.,](\d+)`)
+	wholeNumber    = regexp.MustCompile(`\d+`)
+)
+
+// currencySymbols maps written currency abbreviations to their symbols.
+var currencySymbols = map[string]string{"руб.": "₽", "р.": "₽"}
+
+// NumberExpander spells out numbers, amounts of money and ordinals in the
+// TTS language. Phone-number-like digit strings are read digit by digit.
+// Languages it doesn't know are left untouched.
+type NumberExpander struct{}
+
+// Normalize implements TextNormalizer.
+func (NumberExpander) Normalize(text, language string) string {
+	lang, ok := numberLanguages[language]
+	if !ok {
+		return text
+	}
+	text = replaceStandalone(currencyBefore, text, func(m []string) string {
+		return lang.money(m[1], m[2], m[3])
+	})
+	text = replaceStandalone(currencyAfter, text, func(m []string) string {
+		symbol := m[3]
+		if s, ok := currencySymbols[symbol]; ok {
+			symbol = s
+		}
+		return lang.money(symbol, m[1], m[2])
+	})
+	text = replaceStandalone(phoneNumber, text, func(m []string) string {
+		return lang.digits(m[0])
+	})
+	if lang.ordinal != nil {
+		text = replaceStandalone(ordinalNumber, text, func(m []string) string {
+			n, err := strconv.ParseInt(m[1], 10, 64)
+			if err != nil || len(m[1]) > maxSpelledDigits {
+				return m[0]
+			}
+			return lang.ordinal(n)
+		})
+	}
+	text = replaceStandalone(lang.grouped, text, func(m []string) string {
+		return lang.number(strings.Map(func(r rune) rune {
+			if unicode.IsDigit(r) {
+				return r
+			}
+			return -1
+		}, m[0]))
+	})
+	text = replaceStandalone(decimalNumber, text, func(m []string) string {
+		return lang.number(m[1]) + " " + lang.point + " " + lang.digits(m[2])
+	})
+	return replaceStandalone(wholeNumber, text, func(m []string) string {
+		return lang.number(m[0])
+	})
+}
+
+// number spells the digit string s, reading it digit by digit if it is
+// too long to be said as a number or has leading zeros.
+func (lang numberLanguage) number(s string) string {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || len(s) > maxSpelledDigits || (len(s) > 1 && s[0] == '0') {
+		return lang.digits(s)
+	}
+	return lang.cardinal(n, false)
+}
+
+// digits reads the digits in s one by one, pausing at separators.
+func (lang numberLanguage) digits(s string) string {
+	var words []string
+	for _, group := range strings.FieldsFunc(s, func(r rune) bool { return !unicode.IsDigit(r) }) {
+		var spelled []string
+		for _, d := range group {
+			spelled = append(spelled, lang.cardinal(int64(d-'0'), false))
+		}
+		words = append(words, strings.Join(spelled, " "))
+	}
+	return strings.Join(words, ", ")
+}
+
+// money spells an amount of the currency written as symbol.
+func (lang numberLanguage) money(symbol, major, minor string) string {
+	c, ok := lang.currencies[symbol]
+	if !ok {
+		return symbol + major
+	}
+	n, err := strconv.ParseInt(major, 10, 64)
+	if err != nil || len(major) > maxSpelledDigits {
+		return lang.digits(major) + " " + c.major[2]
+	}
+	spoken := lang.cardinal(n, c.majorFem) + " " + lang.plural(n, c.major)
+	if cents, _ := strconv.ParseInt(minor, 10, 64); cents > 0 {
+		if lang.and != "" {
+			spoken += " " + lang.and
+		}
+		spoken += " " + lang.cardinal(cents, c.minorFem) + " " + lang.plural(cents, c.minor)
+	}
+	return spoken
+}
+
+// replaceStandalone replaces the matches of re in text with the result of
+// fn, given the match and its groups. Matches running into a letter or
+// digit, like the 3 in "mp3", are left alone.
+func replaceStandalone(re *regexp.Regexp, text string, fn func([]string) string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range re.FindAllStringSubmatchIndex(text, -1) {
+		start, end := loc[0], loc[1]
+		if r, _ := utf8.DecodeLastRuneInString(text[:start]); start > 0 && isWordRune(r) {
+			continue
+		}
+		if r, _ := utf8.DecodeRuneInString(text[end:]); end < len(text) && isWordRune(r) {
+			continue
+		}
+		groups := make([]string, len(loc)/2)
+		for i := range groups {
+			if loc[2*i] >= 0 {
+				groups[i] = text[loc[2*i]:loc[2*i+1]]
+			}
+		}
+		b.WriteString(text[last:start])
+		b.WriteString(fn(groups))
+		last = end
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+var (
+	englishOnes = []string{"zero", "one", "two", "three", "four", "five", "six", "seven", "eight", "nine",
+		"ten", "eleven", "twelve", "thirteen", "fourteen", "fifteen", "sixteen", "seventeen", "eighteen", "nineteen"}
+	englishTens   = []string{"", "", "twenty", "thirty", "forty", "fifty", "sixty", "seventy", "eighty", "ninety"}
+	englishScales = []string{"", "thousand", "million", "billion"}
+)
+
+// englishCardinal spells n in English.
+func englishCardinal(n int64) string {
+	if n < 20 {
+		return englishOnes[n]
+	}
+	var parts []string
+	for scale := len(englishScales) - 1; scale >= 0; scale-- {
+		group := n / pow1000(scale) % 1000
+		if group == 0 {
+			continue
+		}
+		words := englishHundreds(group)
+		if englishScales[scale] != "" {
+			words += " " + englishScales[scale]
+		}
+		parts = append(parts, words)
+	}
+	return strings.Join(parts, " ")
+}
+
+// englishHundreds spells 1 <= n < 1000.
+func englishHundreds(n int64) string {
+	var parts []string
+	if n >= 100 {
+		parts = append(parts, englishOnes[n/100]+" hundred")
+		n %= 100
+	}
+	switch {
+	case n >= 20 && n%10 != 0:
+		parts = append(parts, englishTens[n/10]+"-"+englishOnes[n%10])
+	case n >= 20:
+		parts = append(parts, englishTens[n/10])
+	case n > 0:
+		parts = append(parts, englishOnes[n])
+	}
+	return strings.Join(parts, " ")
+}
+
+// englishIrregularOrdinals are the ordinals not formed by adding "th".
+var englishIrregularOrdinals = map[string]string{
+	"one": "first", "two": "second", "three": "third", "five": "fifth",
+	"eight": "eighth", "nine": "ninth", "twelve": "twelfth",
+}
+
+// englishOrdinal spells the English ordinal of n.
+func englishOrdinal(n int64) string {
+	words := englishCardinal(n)
+	i := strings.LastIndexAny(words, " -") + 1
+	last := words[i:]
+	switch {
+	case englishIrregularOrdinals[last] != "":
+		last = englishIrregularOrdinals[last]
+	case strings.HasSuffix(last, "y"):
+		last = strings.TrimSuffix(last, "y") + "ieth"
+	default:
+		last += "th"
+	}
+	return words[:i] + last
+}
+
+var (
+	russianOnes = []string{"ноль", "один", "два", "три", "четыре", "пять", "шесть", "семь", "восемь", "девять",
+		"десять", "одиннадцать", "двенадцать", "тринадцать", "четырнадцать", "пятнадцать", "шестнадцать",
+		"семнадцать", "восемнадцать", "девятнадцать"}
+	russianTens = []string{"", "", "двадцать", "тридцать", "сорок", "пятьдесят", "шестьдесят", "семьдесят",
+		"восемьдесят", "девяносто"}
+	russianHundredWords = []string{"", "сто", "двести", "триста", "четыреста", "пятьсот", "шестьсот", "семьсот",
+		"восемьсот", "девятьсот"}
+	russianScales = []struct {
+		forms [3]string
+		fem   bool
+	}{
+		{},
+		{[3]string{"тысяча", "тысячи", "тысяч"}, true},
+		{[3]string{"миллион", "миллиона", "миллионов"}, false},
+		{[3]string{"миллиард", "миллиарда", "миллиардов"}, false},
+	}
+)
+
+// russianCardinal spells n in Russian, in the feminine form if fem is set,
+// as needed to agree with a feminine noun.
+func russianCardinal(n int64, fem bool) string {
+	if n == 0 {
+		return russianOnes[0]
+	}
+	var parts []string
+	for scale := len(russianScales) - 1; scale >= 0; scale-- {
+		group := n / pow1000(scale) % 1000
+		if group == 0 {
+			continue
+		}
+		groupFem := russianScales[scale].fem || (scale == 0 && fem)
+		parts = append(parts, russianHundreds(group, groupFem))
+		if scale > 0 {
+			parts = append(parts, russianPlural(group, russianScales[scale].forms))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// russianHundreds spells 1 <= n < 1000.
+func russianHundreds(n int64, fem bool) string {
+	var parts []string
+	if n >= 100 {
+		parts = append(parts, russianHundredWords[n/100])
+		n %= 100
+	}
+	if n >= 20 {
+		parts = append(parts, russianTens[n/10])
+		n %= 10
+	}
+	if n > 0 {
+		word := russianOnes[n]
+		if fem && n == 1 {
+			word = "одна"
+		} else if fem && n == 2 {
+			word = "две"
+		}
+		parts = append(parts, word)
+	}
+	return strings.Join(parts, " ")
+}
+
+// russianPlural picks the form of a noun counted by n: one (1, 21),
+// few (2-4, 22-24) or many (5-20, 25).
+func russianPlural(n int64, forms [3]string) string {
+	switch n10, n100 := n%10, n%100; {
+	case n100 >= 11 && n100 <= 14:
+		return forms[2]
+	case n10 == 1:
+		return forms[0]
+	case n10 >= 2 && n10 <= 4:
+		return forms[1]
+	default:
+		return forms[2]
+	}
+}
+
+func pow1000(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 1000
+	}
+	return p
+}
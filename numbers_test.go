@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNumberExpanderEnglish(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"It costs $5.", "It costs five dollars."},
+		{"That's $12.50 in total", "That's twelve dollars and fifty cents in total"},
+		{"You are 3rd in line", "You are third in line"},
+		{"the 21st of May", "the twenty-first of May"},
+		{"We have 1,250 seats", "We have one thousand two hundred fifty seats"},
+		{"Pi is 3.14", "Pi is three point one four"},
+		{"Call 555-123-4567 today", "Call five five five, one two three, four five six seven today"},
+		{"Dial +1 800 555 0100", "Dial one, eight zero zero, five five five, zero one zero zero"},
+		// Digits inside words are left alone
+		{"play the mp3 file", "play the mp3 file"},
+	}
+	for _, tt := range tests {
+		if got := (NumberExpander{}).Normalize(tt.text, "en"); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestNumberExpanderRussian(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"У вас 5 заказов", "У вас пять заказов"},
+		{"Стоимость 21 руб.", "Стоимость двадцать один рубль"},
+		{"Итого 2,50 ₽", "Итого два рубля пятьдесят копеек"},
+		{"Всего 1 000 000 человек", "Всего один миллион человек"},
+		{"Звоните 8-800-555-35-35", "Звоните восемь, восемь ноль ноль, пять пять пять, три пять, три пять"},
+	}
+	for _, tt := range tests {
+		if got := (NumberExpander{}).Normalize(tt.text, "ru"); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestNumberExpanderUnknownLanguage(t *testing.T) {
+	if got := (NumberExpander{}).Normalize("Es kostet 5 €", "de"); got != "Es kostet 5 €" {
+		t.Errorf("Normalize() = %q, want text in an unknown language untouched", got)
+	}
+}
+
+func TestAbbreviationExpander(t *testing.T) {
+	e := NewAbbreviationExpander(map[string]map[string]string{"en": {"St.": "Street"}})
+	tests := []struct {
+		text, language, want string
+	}{
+		{"Dr. Smith is in.", "en", "Doctor Smith is in."},
+		{"Apples, pears etc.", "en", "Apples, pears et cetera"},
+		{"We're on Main St.", "en", "We're on Main Street"},
+		{"Мы на ул. Ленина", "ru", "Мы на улица Ленина"},
+		{"книги, журналы и т. д.", "ru", "книги, журналы и так далее"},
+		// Abbreviations of another language, or inside words, stay
+		{"Dr. Smith", "ru", "Dr. Smith"},
+		{"Drs. Smith", "en", "Drs. Smith"},
+	}
+	for _, tt := range tests {
+		if got := e.Normalize(tt.text, tt.language); got != tt.want {
+			t.Errorf("Normalize(%q, %s) = %q, want %q", tt.text, tt.language, got, tt.want)
+		}
+	}
+}
+
+// upperNormalizer is a deployment's own TextNormalizer.
+type upperNormalizer struct{}
+
+func (upperNormalizer) Normalize(text, language string) string { return strings.ToUpper(text) }
+
+func TestSpeakableRunsNormalizers(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ExpandNumbers = true
+		c.ExpandAbbreviations = true
+	})
+	saved := textNormalizers
+	t.Cleanup(func() { textNormalizers = saved })
+	textNormalizers = append(newTextNormalizers(config), upperNormalizer{})
+
+	if got := speakable("Dr. Who has 2 hearts", "en"); got != "DOCTOR WHO HAS TWO HEARTS" {
+		t.Errorf("speakable() = %q", got)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// pacedQueueFrames is how many frames a PacedWriter holds before Write
+// blocks, about a second of audio.
+const pacedQueueFrames = 50
+
+// PacedWriter releases audio to the underlying writer one frame every
+// audioFrameDuration, so a TTS burst doesn't overrun Asterisk's
+// jitter buffer. Frames wait in a queue in between. Canceling the context
+// given to NewPacedWriter, or calling Close, drops the queued audio and
+// stops the writer.
+type PacedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	size    int
+	queue   chan []byte
+	stop    chan struct{}
+	done    chan struct{}
+	pending []byte
+
+	mu      sync.Mutex
+	err     error
+	closed  bool
+	stopped bool
+}
+
+// NewPacedWriter starts pacing audio written to it into w, in frames of
+// frameSize bytes, until ctx is canceled or Flush or Close is called.
+func NewPacedWriter(ctx context.Context, w io.Writer, frameSize int) *PacedWriter {
+	p := &PacedWriter{
+		ctx:   ctx,
+		w:     w,
+		size:  frameSize,
+		queue: make(chan []byte, pacedQueueFrames),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go p.run(audioFrameDuration())
+	return p
+}
+
+func (p *PacedWriter) run(interval time.Duration) {
+	defer close(p.done)
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var frame []byte
+		select {
+		case f, ok := <-p.queue:
+			if !ok {
+				return
+			}
+			frame = f
+		case <-p.ctx.Done():
+			return
+		case <-p.stop:
+			return
+		}
+		select {
+		case <-ticker.C():
+		case <-p.ctx.Done():
+			return
+		case <-p.stop:
+			return
+		}
+		if _, err := p.w.Write(frame); err != nil {
+			p.mu.Lock()
+			p.err = err
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Write queues p, blocking while the queue is full. It fails once the
+// context is canceled or an earlier frame couldn't be written.
+func (p *PacedWriter) Write(b []byte) (int, error) {
+	p.pending = append(p.pending, b...)
+	for len(p.pending) >= p.size {
+		if err := p.enqueue(p.pending[:p.size:p.size]); err != nil {
+			return 0, err
+		}
+		p.pending = p.pending[p.size:]
+	}
+	p.pending = append(p.pending[:0:0], p.pending...)
+	return len(b), nil
+}
+
+func (p *PacedWriter) enqueue(frame []byte) error {
+	if err := p.Err(); err != nil {
+		return err
+	}
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case p.queue <- frame:
+		return nil
+	case <-p.done:
+		if err := p.Err(); err != nil {
+			return err
+		}
+		return p.ctx.Err()
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+// Flush pads held audio with silence to a whole frame, then waits until
+// every queued frame has been played or the context is canceled. The
+// writer can't be used afterwards.
+func (p *PacedWriter) Flush() error {
+	if len(p.pending) > 0 {
+		frame := make([]byte, p.size)
+		copy(frame, p.pending)
+		p.pending = nil
+		if err := p.enqueue(frame); err != nil {
+			return err
+		}
+	}
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-p.done:
+	case <-p.ctx.Done():
+	}
+	return p.Err()
+}
+
+// Close stops the writer, dropping any audio still queued, and waits for
+// it to finish. It is a no-op after Flush, so it can be deferred on every
+// path that might not reach it.
+func (p *PacedWriter) Close() error {
+	p.mu.Lock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.stop)
+	}
+	p.mu.Unlock()
+	<-p.done
+	return nil
+}
+
+// Err returns the error that stopped the writer, if any.
+func (p *PacedWriter) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// playbackWriter returns the writer TTS audio for the call behind aw is
+// streamed into during the playback governed by ctx.
+func playbackWriter(ctx context.Context, aw *AudioWriter) io.Writer {
+	if config.PacedPlayback {
+		return NewPacedWriter(ctx, aw, aw.frameSize)
+	}
+	return aw
+}
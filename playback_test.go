@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// frameRecorder records the frames written to it.
+type frameRecorder struct {
+	mu     sync.Mutex
+	frames [][]byte
+}
+
+func (r *frameRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frames = append(r.frames, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (r *frameRecorder) Frames() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]byte(nil), r.frames...)
+}
+
+func TestPacedWriterDrainsAtFrameRate(t *testing.T) {
+	withConfig(t, func(c *Config) { c.AudioFrameMs = 20 })
+	const frames, size = 10, 320
+	rec := &frameRecorder{}
+	w := NewPacedWriter(context.Background(), rec, size)
+
+	start := time.Now()
+	if _, err := w.Write(make([]byte, frames*size)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	if got := len(rec.Frames()); got != frames {
+		t.Fatalf("%d frames written, want %d", got, frames)
+	}
+	want := frames * 20 * time.Millisecond
+	if elapsed < want*8/10 || elapsed > want*2 {
+		t.Errorf("%d frames drained in %s, want about %s", frames, elapsed, want)
+	}
+}
+
+func TestPacedWriterFlushPadsPartialFrame(t *testing.T) {
+	withConfig(t, func(c *Config) { c.AudioFrameMs = 1 })
+	rec := &frameRecorder{}
+	w := NewPacedWriter(context.Background(), rec, 4)
+
+	if _, err := w.Write([]byte{1, 2, 3, 4, 5, 6}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got := rec.Frames()
+	if len(got) != 2 || !bytes.Equal(got[0], []byte{1, 2, 3, 4}) || !bytes.Equal(got[1], []byte{5, 6, 0, 0}) {
+		t.Errorf("frames = %v, want [1 2 3 4] [5 6 0 0]", got)
+	}
+}
+
+func TestPacedWriterCloseStopsWithoutFlush(t *testing.T) {
+	withConfig(t, func(c *Config) { c.AudioFrameMs = 20 })
+	rec := &frameRecorder{}
+	w := NewPacedWriter(context.Background(), rec, 320)
+	if _, err := w.Write(make([]byte, 20*320)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-w.done:
+	default:
+		t.Fatal("writer goroutine still running after Close")
+	}
+	if got := len(rec.Frames()); got >= 20 {
+		t.Errorf("%d frames written, want the queued audio dropped", got)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestPacedWriterCancel(t *testing.T) {
+	withConfig(t, func(c *Config) { c.AudioFrameMs = 20 })
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewPacedWriter(ctx, &frameRecorder{}, 320)
+	if _, err := w.Write(make([]byte, 20*320)); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	<-w.done
+	if _, err := w.Write(make([]byte, 320)); err != context.Canceled {
+		t.Errorf("Write after cancel = %v, want context.Canceled", err)
+	}
+}
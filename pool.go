@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Audio buffers are pooled to spare the GC the per-frame and per-utterance
+// allocations of busy calls. A buffer taken from a pool belongs to the
+// taker until it is put back, and may only be put back once nothing refers
+// to it anymore, including requests still in flight.
+
+// Buffers larger than these are left to the GC rather than pooled, so one
+// long utterance doesn't pin its memory for good.
+const (
+	maxPooledSamples = 1 << 20
+	maxPooledBytes   = 4 << 20
+)
+
+var float32Pool = sync.Pool{New: func() interface{} { return new([]float32) }}
+
+var bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// getFloat32s returns a slice of n samples, reusing pooled memory when it
+// is large enough. Its contents are undefined. A pooled slice too small for
+// n is dropped, so it can't keep shadowing the larger ones.
+func getFloat32s(n int) []float32 {
+	p := float32Pool.Get().(*[]float32)
+	if cap(*p) < n {
+		return make([]float32, n)
+	}
+	return (*p)[:n]
+}
+
+// putFloat32s returns s to the pool. Neither s nor any slice sharing its
+// memory may be used afterwards.
+func putFloat32s(s []float32) {
+	if cap(s) == 0 || cap(s) > maxPooledSamples {
+		return
+	}
+	s = s[:0]
+	float32Pool.Put(&s)
+}
+
+// getBuffer returns an empty buffer from the pool.
+func getBuffer() *bytes.Buffer {
+	b := bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+// putBuffer returns b to the pool. It may not be used afterwards.
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBytes {
+		return
+	}
+	bufferPool.Put(b)
+}
+
+// pooledBody is a request body reading a pooled buffer. The transport
+// closes the body once it is done sending it, even if the request fails,
+// which puts the buffer back.
+type pooledBody struct {
+	*bytes.Reader
+	buf  *bytes.Buffer
+	once sync.Once
+}
+
+func newPooledBody(buf *bytes.Buffer) *pooledBody {
+	return &pooledBody{Reader: bytes.NewReader(buf.Bytes()), buf: buf}
+}
+
+// Close implements io.Closer.
+func (b *pooledBody) Close() error {
+	b.once.Do(func() { putBuffer(b.buf) })
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go-ast-client/settings"
+)
+
+// newSampleEchoServer returns an STT server answering with the number of
+// float32 samples uploaded and the value of the first, scaled by 1000.
+func newSampleEchoServer(t testing.TB) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile("audio")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		audio, _ := ioutil.ReadAll(file)
+		first := 0
+		if len(audio) >= 4 {
+			first = int(math.Round(float64(math.Float32frombits(binary.LittleEndian.Uint32(audio))) * 1000))
+		}
+		json.NewEncoder(w).Encode(map[string]string{"transcription": fmt.Sprintf("%d:%d", len(audio)/4, first)})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func constantSamples(n int, value float32) []float32 {
+	samples := make([]float32, n)
+	for i := range samples {
+		samples[i] = value
+	}
+	return samples
+}
+
+func TestPooledUploadsKeepTheirAudio(t *testing.T) {
+	srv := newSampleEchoServer(t)
+	form := STTFormConfig{AudioField: "audio", SettingsField: "settings"}
+
+	var wg sync.WaitGroup
+	for g := 1; g <= 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				n := 1000 * g
+				got, err := sendFloat32ArrayToServer(context.Background(), http.DefaultClient, srv.URL, "call", constantSamples(n, float32(g)/10), settings.STTSettings{}, false, form, "transcription")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if want := fmt.Sprintf("%d:%d", n, g*100); got != want {
+					t.Errorf("upload %d of sender %d = %q, want %q", i, g, got, want)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestFloat32PoolReuse(t *testing.T) {
+	s := getFloat32s(100)
+	if len(s) != 100 {
+		t.Fatalf("len = %d, want 100", len(s))
+	}
+	putFloat32s(s)
+	if got := getFloat32s(10); len(got) != 10 {
+		t.Errorf("len = %d, want 10", len(got))
+	}
+	// Oversized buffers are left to the GC
+	putFloat32s(make([]float32, maxPooledSamples+1))
+}
+
+func TestDecodePCMIntoPooledBuffer(t *testing.T) {
+	pcm := make([]byte, 320)
+	for i := 0; i < len(pcm); i += 2 {
+		binary.LittleEndian.PutUint16(pcm[i:], uint16(int16(i*100)))
+	}
+	want, err := decodePCM(nil, pcm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		buf := getFloat32s(len(pcm) / 2)
+		for j := range buf {
+			buf[j] = -1 // stale contents must not leak into the result
+		}
+		got, err := decodePCM(buf, pcm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range want {
+			if got[j] != want[j] {
+				t.Fatalf("sample %d = %v, want %v", j, got[j], want[j])
+			}
+		}
+		putFloat32s(got)
+	}
+}
+
+func BenchmarkDecodePCM(b *testing.B) {
+	pcm := make([]byte, 640)
+	b.Run("alloc", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			decodePCM(nil, pcm)
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			samples, _ := decodePCM(getFloat32s(len(pcm)/2), pcm)
+			putFloat32s(samples)
+		}
+	})
+}
+
+func BenchmarkSendFloat32ArrayToServer(b *testing.B) {
+	srv := newSampleEchoServer(b)
+	form := STTFormConfig{AudioField: "audio", SettingsField: "settings"}
+	samples := constantSamples(16000, 0.5)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := sendFloat32ArrayToServer(context.Background(), http.DefaultClient, srv.URL, "call", samples, settings.STTSettings{}, false, form, "transcription"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CyCoreSystems/audiosocket"
+	"github.com/pkg/errors"
+)
+
+// utteranceQueueSize is how many finished utterances may wait while an
+// earlier one is still being processed.
+const utteranceQueueSize = 4
+
+// readMessage reads the next AudioSocket message from r. Unlike
+// audiosocket.NextMessage it keeps reading until the whole message has
+// arrived, so messages split across TCP segments aren't misparsed. A
+// connection closed mid-message yields io.ErrUnexpectedEOF.
+func readMessage(r io.Reader) (audiosocket.Message, error) {
+	hdr := make([]byte, 3)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, errors.Wrap(err, "failed to read header")
+	}
+	payloadLen := binary.BigEndian.Uint16(hdr[1:])
+	m := make([]byte, 3+int(payloadLen))
+	copy(m, hdr)
+	if _, err := io.ReadFull(r, m[3:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errors.Wrap(err, "failed to read payload")
+	}
+	return m, nil
+}
+
+// audiosocketError describes an AudioSocket error code and reports whether
+// the call can't go on after it. A hangup means the caller is gone, and a
+// memory error leaves Asterisk unable to carry the call reliably; a frame
+// Asterisk failed to forward only costs that frame.
+func audiosocketError(code audiosocket.ErrorCode) (description string, fatal bool) {
+	switch code {
+	case audiosocket.ErrNone:
+		return "no error", false
+	case audiosocket.ErrAstHangup:
+		return "caller hung up", true
+	case audiosocket.ErrAstFrameForwarding:
+		return "frame forwarding failed", false
+	case audiosocket.ErrAstMemory:
+		return "asterisk out of memory", true
+	default:
+		return "unknown error", false
+	}
+}
+
+// readMessages reads messages from s in its own goroutine so the call
+// keeps reacting to hangups and barge-in while utterances are processed.
+// The channel is closed once the stream ends, a read fails or ctx
+// is canceled.
+func readMessages(ctx context.Context, s MessageStream, callID string) <-chan audiosocket.Message {
+	messages := make(chan audiosocket.Message)
+	go func() {
+		defer close(messages)
+		for ctx.Err() == nil {
+			m, err := s.NextMessage()
+			if errors.Cause(err) == io.EOF {
+				log.Printf("call %s: audiosocket closed", callID)
+				return
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("call %s: failed to read message, ending call: %v", callID, err)
+				}
+				return
+			}
+			select {
+			case messages <- m:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return messages
+}
+
+// utterance is a finished utterance waiting to be processed.
+type utterance struct {
+	frames [][]float32
+	stream *utteranceStream
+}
+
+// Turn states. A pending turn may still be merged into the next utterance;
+// once committed its transcription has been sent to the LLM.
+const (
+	turnPending = iota
+	turnCommitted
+	turnReclaimed
+)
+
+// turn is an utterance submitted for processing.
+type turn struct {
+	utterance
+	ended  time.Time
+	cancel context.CancelFunc
+	state  int
+}
+
+// utteranceProcessor runs STT, the LLM and TTS for a call's utterances one
+// at a time, off the read loop.
+//
+// With a merge gap, speech resuming shortly after an utterance ended is
+// treated as a continuation: the read loop reclaims the previous turn's
+// audio with Reclaim, which cancels that turn unless it was already
+// committed, and transcribes it together with the new speech. Processing
+// waits in Commit until the gap has passed before anything reaches the LLM.
+type utteranceProcessor struct {
+	queue    chan *turn
+	wg       sync.WaitGroup
+	busy     int32
+	mergeGap time.Duration
+
+	mu      sync.Mutex
+	last    *turn
+	current *turn
+}
+
+// startUtteranceProcessor starts processing utterances for call until ctx
+// is canceled or Stop is called.
+func startUtteranceProcessor(ctx context.Context, call *Call, mergeGap time.Duration) *utteranceProcessor {
+	p := &utteranceProcessor{
+		queue:    make(chan *turn, utteranceQueueSize),
+		mergeGap: mergeGap,
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for t := range p.queue {
+			p.mu.Lock()
+			if t.state == turnReclaimed || ctx.Err() != nil {
+				p.mu.Unlock()
+				if t.stream != nil {
+					t.stream.Abort()
+				}
+				continue
+			}
+			turnCtx, cancel := context.WithCancel(ctx)
+			t.cancel = cancel
+			p.current = t
+			p.mu.Unlock()
+
+			atomic.StoreInt32(&p.busy, 1)
+			processUtterance(turnCtx, call, t.frames, t.stream)
+			atomic.StoreInt32(&p.busy, 0)
+			cancel()
+
+			p.mu.Lock()
+			p.current = nil
+			p.mu.Unlock()
+		}
+	}()
+	return p
+}
+
+// Submit queues u for processing. If the queue is full the utterance is
+// dropped rather than stalling the read loop.
+func (p *utteranceProcessor) Submit(u utterance) {
+	t := &turn{utterance: u, ended: clock.Now()}
+	select {
+	case p.queue <- t:
+		p.mu.Lock()
+		p.last = t
+		p.mu.Unlock()
+	default:
+		log.Println("utterance queue is full, dropping utterance")
+		if u.stream != nil {
+			u.stream.Abort()
+		}
+	}
+}
+
+// Reclaim takes back the audio of the last utterance if it ended within
+// the merge gap and hasn't been committed, canceling its processing. It
+// returns nil if there is nothing to merge.
+func (p *utteranceProcessor) Reclaim() [][]float32 {
+	if p.mergeGap <= 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := p.last
+	if t == nil || t.state != turnPending || since(t.ended) > p.mergeGap {
+		return nil
+	}
+	t.state = turnReclaimed
+	p.last = nil
+	if t.cancel != nil {
+		t.cancel()
+	}
+	if t.stream != nil {
+		t.stream.Abort()
+	}
+	return t.frames
+}
+
+// Commit is called before the current turn's transcription is sent to the
+// LLM. It waits out the merge gap and reports whether the turn may go on;
+// false means it was merged into a newer utterance and must be dropped.
+func (p *utteranceProcessor) Commit(ctx context.Context) bool {
+	if p == nil {
+		return true
+	}
+	p.mu.Lock()
+	t := p.current
+	p.mu.Unlock()
+	if t == nil {
+		return true
+	}
+
+	if wait := p.mergeGap - since(t.ended); wait > 0 {
+		select {
+		case <-clock.After(wait):
+		case <-ctx.Done():
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t.state == turnReclaimed || ctx.Err() != nil {
+		return false
+	}
+	t.state = turnCommitted
+	return true
+}
+
+// Busy reports whether an utterance is being processed.
+func (p *utteranceProcessor) Busy() bool {
+	if p == nil {
+		return false
+	}
+	return atomic.LoadInt32(&p.busy) == 1
+}
+
+// Stop waits for the processor to finish. Cancel its context first to
+// abandon queued and in-flight utterances.
+func (p *utteranceProcessor) Stop() {
+	close(p.queue)
+	p.wg.Wait()
+}
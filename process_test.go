@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/CyCoreSystems/audiosocket"
+	"github.com/pkg/errors"
+
+	"go-ast-client/api"
+)
+
+func TestReadMessageReassemblesSplitMessages(t *testing.T) {
+	frame := audiosocket.SlinMessage(bytes.Repeat([]byte{1, 2}, 160))
+	r := iotest.OneByteReader(bytes.NewReader(append(append([]byte(nil), frame...), audiosocket.HangupMessage()...)))
+
+	m, err := readMessage(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Kind() != audiosocket.KindSlin || !bytes.Equal(m.Payload(), frame[3:]) {
+		t.Errorf("message = kind 0x%02x with %d bytes, want the whole frame", byte(m.Kind()), len(m.Payload()))
+	}
+	if m, err = readMessage(r); err != nil || m.Kind() != audiosocket.KindHangup {
+		t.Errorf("next message = %v, %v, want the hangup", m, err)
+	}
+	if _, err = readMessage(r); errors.Cause(err) != io.EOF {
+		t.Errorf("read at the end = %v, want io.EOF", err)
+	}
+}
+
+func TestReadMessageTruncated(t *testing.T) {
+	frame := audiosocket.SlinMessage(make([]byte, 320))
+	for name, data := range map[string][]byte{
+		"payload": frame[:100],
+		"header":  frame[:2],
+	} {
+		_, err := readMessage(bytes.NewReader(data))
+		if err == nil || errors.Cause(err) == io.EOF {
+			t.Errorf("truncated %s read as %v, want an error other than io.EOF", name, err)
+		}
+	}
+	if _, err := readMessage(bytes.NewReader(frame[:100])); errors.Cause(err) != io.ErrUnexpectedEOF {
+		t.Errorf("truncated payload = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestHandleEndsOnTruncatedMessage(t *testing.T) {
+	id, _ := newTestCallChat(t, testSettings(0.7))
+	conn, asterisk := net.Pipe()
+	defer asterisk.Close()
+	go func() {
+		asterisk.Write(audiosocket.IDMessage(id))
+		for _, m := range silenceFrames(3) {
+			asterisk.Write(m)
+		}
+		// The connection drops halfway through a frame
+		asterisk.Write(audiosocket.SlinMessage(make([]byte, 320))[:100])
+		asterisk.Close()
+	}()
+	runHandle(t, context.Background(), NewAudioSocketStream(conn))
+}
+
+func TestHandleSkipsUnknownKind(t *testing.T) {
+	id, _ := newTestCallChat(t, testSettings(0.7))
+	script := []audiosocket.Message{audiosocket.IDMessage(id)}
+	script = append(script, silenceFrames(2)...)
+	script = append(script, audiosocket.Message{0x42, 0x00, 0x01, 0xff})
+	script = append(script, silenceFrames(2)...)
+	script = append(script, audiosocket.HangupMessage())
+	stream := newTestStream(script...)
+
+	runHandle(t, context.Background(), stream)
+	if stream.Read() != len(script) {
+		t.Errorf("call ended after %d of %d messages, want the unknown kind skipped", stream.Read(), len(script))
+	}
+}
+
+// turnsCall runs a call with the given merge gap whose LLM reports the
+// transcriptions it is asked about on asked. The LLM fails every turn, so
+// no reply is played.
+func turnsCall(t *testing.T, mergeGapMs int, script ...audiosocket.Message) (stt *sttServer, asked <-chan string, stream *testStream) {
+	t.Helper()
+	withConfig(t, func(c *Config) {
+		c.VAD.Backend = vadEnergy
+		c.UtteranceMergeGapMs = mergeGapMs
+		c.Unavailable.Message = ""
+		c.Unavailable.MaxFailures = 0
+	})
+	stt = newSTTServer(t, "hello")
+	s := testSettings(0.7)
+	s.AsteriskSettings.AsteriskSegment = "test"
+	id, _ := newTestCallChat(t, s)
+	questions := make(chan string, 16)
+	withOllama(t, &fakeOllama{reply: func(ctx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error) {
+		questions <- request.Messages[len(request.Messages)-1].Content
+		return api.OllamaChatResponse{}, errors.New("model offline")
+	}})
+
+	stream = newTestStream(append([]audiosocket.Message{audiosocket.IDMessage(id)}, script...)...)
+	stream.hold = true
+	stream.more = make(chan audiosocket.Message)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(context.Background(), stream)
+	}()
+	t.Cleanup(func() {
+		stream.Close()
+		<-done
+	})
+	return stt, questions, stream
+}
+
+// utteranceFrames is speech long enough to be transcribed, followed by
+// enough silence to end it.
+func utteranceFrames() []audiosocket.Message {
+	return append(voicedFrames(25), levelFrames(10, 0)...)
+}
+
+func waitForQuestion(t *testing.T, asked <-chan string) {
+	t.Helper()
+	select {
+	case <-asked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("LLM never asked")
+	}
+}
+
+func TestQuickFollowUpMerges(t *testing.T) {
+	// The second utterance starts right after the first one ends
+	script := append(utteranceFrames(), utteranceFrames()...)
+	stt, asked, _ := turnsCall(t, 300, script...)
+
+	waitForQuestion(t, asked)
+	select {
+	case <-asked:
+		t.Error("the follow-up got its own turn")
+	case <-time.After(600 * time.Millisecond):
+	}
+	// The merged turn transcribed both utterances together
+	var longest int
+drain:
+	for {
+		select {
+		case samples := <-stt.uploads:
+			if len(samples) > longest {
+				longest = len(samples)
+			}
+		default:
+			break drain
+		}
+	}
+	if longest < 50*320 {
+		t.Errorf("longest upload has %d samples, want both utterances", longest)
+	}
+}
+
+func TestLongGapStaysSeparate(t *testing.T) {
+	stt, asked, stream := turnsCall(t, 300, utteranceFrames()...)
+
+	// The first turn reaches the LLM only after the gap has passed
+	waitForQuestion(t, asked)
+	for _, m := range utteranceFrames() {
+		stream.more <- m
+	}
+	waitForQuestion(t, asked)
+	for i := 0; i < 2; i++ {
+		if samples := stt.Upload(t); len(samples) >= 50*320 {
+			t.Errorf("upload %d has %d samples, want the utterances apart", i, len(samples))
+		}
+	}
+}
+
+func TestAudiosocketErrorCodes(t *testing.T) {
+	tests := []struct {
+		code  audiosocket.ErrorCode
+		fatal bool
+	}{
+		{audiosocket.ErrNone, false},
+		{audiosocket.ErrAstHangup, true},
+		{audiosocket.ErrAstFrameForwarding, false},
+		{audiosocket.ErrAstMemory, true},
+		{audiosocket.ErrUnknown, false},
+	}
+	for _, tt := range tests {
+		description, fatal := audiosocketError(tt.code)
+		if fatal != tt.fatal || description == "" {
+			t.Errorf("audiosocketError(0x%02x) = %q, %v; want fatal %v", byte(tt.code), description, fatal, tt.fatal)
+		}
+	}
+}
+
+func TestHandleErrorCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    audiosocket.ErrorCode
+		ends    bool
+		hangsUp bool
+	}{
+		{"frame forwarding continues", audiosocket.ErrAstFrameForwarding, false, false},
+		{"unknown continues", audiosocket.ErrUnknown, false, false},
+		{"hangup ends", audiosocket.ErrAstHangup, true, false},
+		{"out of memory ends and hangs up", audiosocket.ErrAstMemory, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, _ := newTestCallChat(t, testSettings(0.7))
+			script := []audiosocket.Message{audiosocket.IDMessage(id)}
+			script = append(script, silenceFrames(2)...)
+			script = append(script, errorMessage(tt.code))
+			script = append(script, silenceFrames(2)...)
+			script = append(script, audiosocket.HangupMessage())
+			stream := newTestStream(script...)
+
+			runHandle(t, context.Background(), stream)
+			if ended := stream.Read() < len(script); ended != tt.ends {
+				t.Errorf("call ended after %d of %d messages, want ended on the error %v", stream.Read(), len(script), tt.ends)
+			}
+			// Asterisk hung up already after ErrAstHangup
+			if stream.HungUp() != tt.hangsUp {
+				t.Errorf("bridge hung up %v, want %v", stream.HungUp(), tt.hangsUp)
+			}
+		})
+	}
+}
+
+// silenceHints returns n AudioSocket silence messages.
+func silenceHints(n int) []audiosocket.Message {
+	hints := make([]audiosocket.Message, n)
+	for i := range hints {
+		hints[i] = audiosocket.MessageFromData([]byte{byte(audiosocket.KindSilence), 0, 0})
+	}
+	return hints
+}
+
+func TestSilenceHintsEndUtterance(t *testing.T) {
+	withConfig(t, func(c *Config) { c.VAD.SilenceHints = true })
+	stt, asked, _ := turnsCall(t, 0, append(voicedFrames(25), silenceHints(10)...)...)
+	stt.Upload(t)
+	waitForQuestion(t, asked)
+}
+
+func TestSilenceHintsIgnoredWhenDisabled(t *testing.T) {
+	withConfig(t, func(c *Config) { c.VAD.SilenceHints = false })
+	stt, _, stream := turnsCall(t, 0, append(voicedFrames(25), silenceHints(10)...)...)
+	select {
+	case <-stt.uploads:
+		t.Fatal("silence hints ended the utterance with hints disabled")
+	case <-time.After(300 * time.Millisecond):
+	}
+	// Silent audio still ends it
+	for _, m := range levelFrames(10, 0) {
+		stream.more <- m
+	}
+	stt.Upload(t)
+}
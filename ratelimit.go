@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimitPruneInterval is how often idle buckets are dropped.
+const rateLimitPruneInterval = time.Minute
+
+// RateLimitConfig limits how often utterances of one chat are processed.
+type RateLimitConfig struct {
+	// PerMinute is the sustained number of utterances allowed per chat.
+	// Zero disables the limit.
+	PerMinute float64 `json:"per_minute"`
+	// Burst is how many utterances may come in quick succession.
+	Burst int `json:"burst"`
+}
+
+// RateLimiter is a token bucket rate limiter with a bucket per key, so one
+// busy chat can't use up the allowance of others. A nil RateLimiter
+// allows everything.
+type RateLimiter struct {
+	mu         sync.Mutex
+	rate       float64 // tokens per second
+	burst      float64
+	buckets    map[string]*tokenBucket
+	lastPruned time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a RateLimiter allowing cfg.PerMinute events per
+// key, or nil if the limit is disabled.
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	if cfg.PerMinute <= 0 {
+		return nil
+	}
+	burst := cfg.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:       cfg.PerMinute / 60,
+		burst:      float64(burst),
+		buckets:    make(map[string]*tokenBucket),
+		lastPruned: clock.Now(),
+	}
+}
+
+// utteranceLimiter limits the utterances processed per chat, set up in
+// main.
+var utteranceLimiter *RateLimiter
+
+// Allow takes a token from the bucket of key and reports whether there
+// was one.
+func (l *RateLimiter) Allow(key string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := clock.Now()
+	if now.Sub(l.lastPruned) >= rateLimitPruneInterval {
+		l.prune(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune drops buckets that have refilled completely, which behave the same
+// as new ones. l.mu must be held.
+func (l *RateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPruned = now
+}
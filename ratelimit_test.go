@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterThrottlesBurst(t *testing.T) {
+	withClock(t, NewFakeClock(time.Unix(0, 0)))
+	l := NewRateLimiter(RateLimitConfig{PerMinute: 60, Burst: 3})
+	for i := 1; i <= 3; i++ {
+		if !l.Allow("chat") {
+			t.Fatalf("utterance %d of the burst throttled", i)
+		}
+	}
+	if l.Allow("chat") {
+		t.Error("utterance beyond the burst allowed")
+	}
+}
+
+func TestRateLimiterAllowsPacedUtterances(t *testing.T) {
+	fake := NewFakeClock(time.Unix(0, 0))
+	withClock(t, fake)
+	l := NewRateLimiter(RateLimitConfig{PerMinute: 60, Burst: 1})
+	for i := 0; i < 10; i++ {
+		if !l.Allow("chat") {
+			t.Fatalf("utterance %d throttled at the allowed pace", i)
+		}
+		fake.Advance(time.Second)
+	}
+
+	// Half the pace earns half a token
+	l.Allow("chat")
+	fake.Advance(500 * time.Millisecond)
+	if l.Allow("chat") {
+		t.Error("utterance allowed before its token refilled")
+	}
+}
+
+func TestRateLimiterPerChat(t *testing.T) {
+	withClock(t, NewFakeClock(time.Unix(0, 0)))
+	l := NewRateLimiter(RateLimitConfig{PerMinute: 60, Burst: 1})
+	l.Allow("noisy")
+	if l.Allow("noisy") {
+		t.Error("noisy chat not throttled")
+	}
+	if !l.Allow("quiet") {
+		t.Error("one chat's bursts throttled another")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{})
+	if l != nil {
+		t.Fatalf("NewRateLimiter() = %+v, want nil for no limit", l)
+	}
+	for i := 0; i < 100; i++ {
+		if !l.Allow("chat") {
+			t.Fatal("disabled limiter throttled")
+		}
+	}
+}
+
+func TestThrottledUtteranceSkipped(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Webhook.StateEvents = true })
+	events := withWebhookQueue(t)
+	withTTS(t, newTTSServer(t, make([]byte, 640), 320))
+	stt := newSTTServer(t, "hello")
+	ollama := &fakeOllama{}
+	s := testSettings(0.7)
+	s.AsteriskSettings.AsteriskSegment = "test"
+	_, store := newTestChat(t, "call", s, ollama)
+	call := NewCall("call", NewScriptedStream(), func() {})
+	call.SetChatStore(store)
+
+	saved := utteranceLimiter
+	t.Cleanup(func() { utteranceLimiter = saved })
+	utteranceLimiter = NewRateLimiter(RateLimitConfig{PerMinute: 1, Burst: 1})
+
+	frames := make([][]float32, 30)
+	for i := range frames {
+		frames[i] = sine(200, 16000, 0.02)
+	}
+	processUtterance(context.Background(), call, frames, nil)
+	stt.Upload(t)
+	waitForState(t, events, stateListening)
+
+	processUtterance(context.Background(), call, frames, nil)
+	select {
+	case <-stt.uploads:
+		t.Error("throttled utterance transcribed")
+	default:
+	}
+	if n := len(ollama.Requests()); n != 1 {
+		t.Errorf("%d LLM requests, want only the first utterance answered", n)
+	}
+}
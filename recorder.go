@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// recorderQueueSize is how many chunks may wait for the background writer
+// before new ones are dropped.
+const recorderQueueSize = 512
+
+// wavHeaderSize is the size of the canonical 16-bit PCM WAV header.
+const wavHeaderSize = 44
+
+// RecordingConfig enables capturing call audio to WAV files for debugging.
+type RecordingConfig struct {
+	Enabled bool   `json:"enabled"`
+	Dir     string `json:"dir"`
+	// Outbound also records the audio played to the caller, in a separate
+	// file.
+	Outbound bool `json:"outbound"`
+}
+
+// WAVRecorder writes 16-bit mono SLIN audio to a WAV file. Writes are
+// queued and done in the background so they never block the audio loop.
+// A nil WAVRecorder discards everything.
+type WAVRecorder struct {
+	f          *os.File
+	sampleRate int
+	queue      chan []byte
+	done       chan struct{}
+	dataBytes  uint32
+
+	mu      sync.Mutex
+	closed  bool
+	dropped int
+}
+
+// NewWAVRecorder creates the WAV file at path for audio at sampleRate.
+func NewWAVRecorder(path string, sampleRate int) (*WAVRecorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %v", err)
+	}
+	r := &WAVRecorder{
+		f:          f,
+		sampleRate: sampleRate,
+		queue:      make(chan []byte, recorderQueueSize),
+		done:       make(chan struct{}),
+	}
+	// The sizes are patched in on Close
+	if _, err := f.Write(wavHeader(sampleRate, 0)); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to write recording header: %v", err)
+	}
+	go r.run()
+	return r, nil
+}
+
+func (r *WAVRecorder) run() {
+	defer close(r.done)
+	for pcm := range r.queue {
+		n, err := r.f.Write(pcm)
+		r.dataBytes += uint32(n)
+		if err != nil {
+			log.Println("failed to write recording:", err)
+		}
+	}
+}
+
+// Write queues SLIN audio for the recording. It doesn't block; audio is
+// dropped if the writer falls behind.
+func (r *WAVRecorder) Write(pcm []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.queue <- append([]byte(nil), pcm...):
+	default:
+		r.dropped++
+	}
+}
+
+// SetSampleRate changes the rate written to the header, for recordings
+// started before the rate of a call's audio was known.
+func (r *WAVRecorder) SetSampleRate(sampleRate int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sampleRate = sampleRate
+}
+
+// Close flushes the queued audio and finalizes the WAV header. Later
+// writes are discarded.
+func (r *WAVRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.queue)
+	sampleRate := r.sampleRate
+	r.mu.Unlock()
+	<-r.done
+	if r.dropped > 0 {
+		log.Printf("recording %s dropped %d chunks", r.f.Name(), r.dropped)
+	}
+
+	if _, err := r.f.WriteAt(wavHeader(sampleRate, r.dataBytes), 0); err != nil {
+		r.f.Close()
+		return fmt.Errorf("failed to finalize recording: %v", err)
+	}
+	return r.f.Close()
+}
+
+// wavHeader returns the header of a 16-bit mono PCM WAV file holding
+// dataBytes of samples.
+func wavHeader(sampleRate int, dataBytes uint32) []byte {
+	const channels, bitsPerSample = 1, 16
+	h := make([]byte, wavHeaderSize)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], 36+dataBytes)
+	copy(h[8:], "WAVE")
+	copy(h[12:], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16) // fmt chunk size
+	binary.LittleEndian.PutUint16(h[20:], 1)  // PCM
+	binary.LittleEndian.PutUint16(h[22:], channels)
+	binary.LittleEndian.PutUint32(h[24:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(sampleRate*channels*bitsPerSample/8))
+	binary.LittleEndian.PutUint16(h[32:], channels*bitsPerSample/8)
+	binary.LittleEndian.PutUint16(h[34:], bitsPerSample)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], dataBytes)
+	return h
+}
+
+// recordingPath names a recording by call ID, start time and direction.
+func recordingPath(dir, callID string, start time.Time, direction string) string {
+	name := fmt.Sprintf("%s-%s-%s.wav", callID, start.Format("20060102T150405"), direction)
+	return filepath.Join(dir, name)
+}
+
+// startRecording opens the recorders configured for call.
+func startRecording(call *Call) {
+	if !config.Recording.Enabled {
+		return
+	}
+	start := clock.Now()
+	var err error
+	path := recordingPath(config.Recording.Dir, call.ID, start, "in")
+	if call.inRecording, err = NewWAVRecorder(path, config.InputSampleRate); err != nil {
+		log.Println(err)
+	}
+	if config.Recording.Outbound {
+		path = recordingPath(config.Recording.Dir, call.ID, start, "out")
+		if call.outRecording, err = NewWAVRecorder(path, config.InputSampleRate); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// wavFile is the content of a 16-bit PCM WAV file.
+type wavFile struct {
+	channels, bitsPerSample int
+	sampleRate, byteRate    int
+	data                    []byte
+}
+
+// readWAV parses the canonical WAV file at path, checking the sizes in its
+// header against the file.
+func readWAV(t *testing.T, path string) wavFile {
+	t.Helper()
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file) < wavHeaderSize || string(file[0:4]) != "RIFF" || string(file[8:12]) != "WAVE" || string(file[12:16]) != "fmt " || string(file[36:40]) != "data" {
+		t.Fatalf("%s is not a canonical WAV file", path)
+	}
+	le := binary.LittleEndian
+	if riff := le.Uint32(file[4:]); int(riff) != len(file)-8 {
+		t.Errorf("RIFF size %d, file has %d bytes after it", riff, len(file)-8)
+	}
+	if format := le.Uint16(file[20:]); format != 1 {
+		t.Errorf("audio format %d, want PCM", format)
+	}
+	data := file[wavHeaderSize:]
+	if size := le.Uint32(file[40:]); int(size) != len(data) {
+		t.Errorf("data size %d, file has %d bytes of data", size, len(data))
+	}
+	return wavFile{
+		channels:      int(le.Uint16(file[22:])),
+		sampleRate:    int(le.Uint32(file[24:])),
+		byteRate:      int(le.Uint32(file[28:])),
+		bitsPerSample: int(le.Uint16(file[34:])),
+		data:          data,
+	}
+}
+
+func TestWAVRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "call.wav")
+	r, err := NewWAVRecorder(path, 8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []byte
+	for i := 0; i < 5; i++ {
+		frame := pcm16(int16(i), -int16(i), 1000, -1000)
+		frame = append(frame, make([]byte, 312)...)
+		r.Write(frame)
+		want = append(want, frame...)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Audio written after the call ended is discarded
+	r.Write(make([]byte, 320))
+
+	wav := readWAV(t, path)
+	if wav.channels != 1 || wav.bitsPerSample != 16 || wav.sampleRate != 8000 || wav.byteRate != 16000 {
+		t.Errorf("format = %+v, want 16-bit mono at 8kHz", wav)
+	}
+	if samples := len(wav.data) / 2; samples != 5*160 {
+		t.Errorf("%d samples recorded, want %d", samples, 5*160)
+	}
+	if !bytes.Equal(wav.data, want) {
+		t.Error("recorded audio differs from what was written")
+	}
+}
+
+func TestWAVRecorderSampleRate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "call.wav")
+	r, err := NewWAVRecorder(path, 8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The call turned out to be slin16
+	r.SetSampleRate(16000)
+	r.Write(make([]byte, 640))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if wav := readWAV(t, path); wav.sampleRate != 16000 || wav.byteRate != 32000 || len(wav.data) != 640 {
+		t.Errorf("format = %d Hz, %d bytes/s with %d bytes, want 16kHz", wav.sampleRate, wav.byteRate, len(wav.data))
+	}
+}
+
+func TestNilWAVRecorder(t *testing.T) {
+	var r *WAVRecorder
+	r.Write(make([]byte, 320))
+	r.SetSampleRate(16000)
+	if err := r.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+}
+
+func TestStartRecording(t *testing.T) {
+	dir := t.TempDir()
+	withConfig(t, func(c *Config) {
+		c.Recording = RecordingConfig{Enabled: true, Dir: dir, Outbound: true}
+	})
+	call := NewCall("5c1f-call", NewScriptedStream(), func() {})
+	startRecording(call)
+	call.inRecording.Write(make([]byte, 320))
+	call.inRecording.Close()
+	call.outRecording.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("recordings %v, want inbound and outbound", files)
+	}
+	for _, file := range files {
+		name := filepath.Base(file)
+		if !strings.HasPrefix(name, "5c1f-call-") || !(strings.HasSuffix(name, "-in.wav") || strings.HasSuffix(name, "-out.wav")) {
+			t.Errorf("recording named %q, want the call ID, time and direction", name)
+		}
+		readWAV(t, file)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Policies for a call arriving with the ID of a call that is still active.
+const (
+	duplicateReject    = "reject"
+	duplicateSupersede = "supersede"
+)
+
+// supersedeTimeout bounds how long a superseding call waits for the call it
+// replaces to shut down.
+const supersedeTimeout = 5 * time.Second
+
+// CallRegistry tracks active calls by ID. It is safe for concurrent use.
+type CallRegistry struct {
+	mu    sync.Mutex
+	calls map[string]*Call
+}
+
+// NewCallRegistry creates an empty CallRegistry.
+func NewCallRegistry() *CallRegistry {
+	return &CallRegistry{calls: make(map[string]*Call)}
+}
+
+var calls = NewCallRegistry()
+
+// Register adds call unless another call with the same ID is active, in
+// which case that call is returned and the registry is left unchanged.
+func (r *CallRegistry) Register(call *Call) *Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.calls[call.ID]; ok {
+		return existing
+	}
+	r.calls[call.ID] = call
+	return nil
+}
+
+// Replace adds call, replacing any call registered with the same ID.
+func (r *CallRegistry) Replace(call *Call) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls[call.ID] = call
+}
+
+// Unregister removes call, unless it has already been replaced by another
+// call with the same ID, and marks it done.
+func (r *CallRegistry) Unregister(call *Call) {
+	r.mu.Lock()
+	if r.calls[call.ID] == call {
+		delete(r.calls, call.ID)
+	}
+	r.mu.Unlock()
+	call.finish()
+}
+
+// Get returns the active call with id, or nil.
+func (r *CallRegistry) Get(id string) *Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls[id]
+}
+
+// List returns the active calls, oldest first.
+func (r *CallRegistry) List() []*Call {
+	r.mu.Lock()
+	list := make([]*Call, 0, len(r.calls))
+	for _, call := range r.calls {
+		list = append(list, call)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+// admitCall registers call, resolving a collision with an active call of
+// the same ID according to Config.DuplicateCallPolicy. It returns false if
+// the new call was rejected.
+func admitCall(call *Call) bool {
+	existing := calls.Register(call)
+	if existing == nil {
+		return true
+	}
+
+	log.Printf("call %s is already active, policy %q", call.ID, config.DuplicateCallPolicy)
+	if config.DuplicateCallPolicy != duplicateSupersede {
+		call.Hangup()
+		return false
+	}
+
+	existing.Hangup()
+	select {
+	case <-existing.Done():
+	case <-clock.After(supersedeTimeout):
+		log.Printf("call %s: superseded call did not exit in %s", call.ID, supersedeTimeout)
+	}
+	calls.Replace(call)
+	return true
+}
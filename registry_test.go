@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/CyCoreSystems/audiosocket"
+	"github.com/gofrs/uuid"
+)
+
+// waitForCall waits until the active call with id runs on stream.
+func waitForCall(t *testing.T, id string, stream MessageStream) *Call {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if call := calls.Get(id); call != nil && call.Stream == stream {
+			return call
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("call %s never became active on its stream", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// startHeldCall runs Handle for a call with id that stays connected until
+// its stream is closed, and waits for it to become active. The returned
+// channel is closed once Handle returns.
+func startHeldCall(t *testing.T, id uuid.UUID) (*testStream, <-chan struct{}) {
+	t.Helper()
+	stream := newTestStream(audiosocket.IDMessage(id))
+	stream.hold = true
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(context.Background(), stream)
+	}()
+	waitForCall(t, id.String(), stream)
+	return stream, done
+}
+
+func TestDuplicateCallRejected(t *testing.T) {
+	withConfig(t, func(c *Config) { c.DuplicateCallPolicy = duplicateReject })
+	id, _ := newTestCallChat(t, testSettings(0.7))
+	first, firstDone := startHeldCall(t, id)
+
+	second := newTestStream(audiosocket.IDMessage(id))
+	runHandle(t, context.Background(), second)
+
+	if !second.HungUp() {
+		t.Error("duplicate call not hung up")
+	}
+	if first.HungUp() {
+		t.Error("active call hung up by its duplicate")
+	}
+	waitForCall(t, id.String(), first)
+
+	first.Close()
+	<-firstDone
+	if calls.Get(id.String()) != nil {
+		t.Error("call still registered after it ended")
+	}
+}
+
+func TestDuplicateCallSupersedes(t *testing.T) {
+	withConfig(t, func(c *Config) { c.DuplicateCallPolicy = duplicateSupersede })
+	id, _ := newTestCallChat(t, testSettings(0.7))
+	first, firstDone := startHeldCall(t, id)
+
+	second, secondDone := startHeldCall(t, id)
+	select {
+	case <-firstDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("superseded call still running")
+	}
+	if !first.HungUp() {
+		t.Error("superseded call not hung up")
+	}
+	if second.HungUp() {
+		t.Error("superseding call hung up")
+	}
+
+	second.Close()
+	<-secondDone
+	if calls.Get(id.String()) != nil {
+		t.Error("call still registered after it ended")
+	}
+}
+
+// listCalls fetches the active calls from the admin API served by srv.
+func listCalls(t *testing.T, srv *httptest.Server) []callStatus {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/calls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /calls: status %d", resp.StatusCode)
+	}
+	var statuses []callStatus
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		t.Fatal(err)
+	}
+	return statuses
+}
+
+func TestRegistryListsActiveCalls(t *testing.T) {
+	first, chats := newTestCallChat(t, testSettings(0.7))
+	second := uuid.Must(uuid.NewV4())
+	if _, err := chats.StartChat(second.String()); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(adminHandler(calls))
+	defer srv.Close()
+
+	firstStream, firstDone := startHeldCall(t, first)
+	secondStream, secondDone := startHeldCall(t, second)
+	waitForCall(t, first.String(), firstStream).heard("opening hours")
+
+	statuses := listCalls(t, srv)
+	if len(statuses) != 2 || statuses[0].ID != first.String() || statuses[1].ID != second.String() {
+		t.Fatalf("GET /calls = %+v, want both calls, oldest first", statuses)
+	}
+	if s := statuses[0]; s.Turns != 1 || s.LastTranscription != "opening hours" || s.LastActivity == nil {
+		t.Errorf("first call = %+v, want its turn reported", s)
+	}
+	if s := statuses[1]; s.Turns != 0 || s.LastActivity != nil || s.StartedAt.IsZero() {
+		t.Errorf("second call = %+v, want it started without turns", s)
+	}
+
+	firstStream.Close()
+	<-firstDone
+	if statuses := listCalls(t, srv); len(statuses) != 1 || statuses[0].ID != second.String() {
+		t.Errorf("GET /calls = %+v after the first call ended, want only the second", statuses)
+	}
+	secondStream.Close()
+	<-secondDone
+	if statuses := listCalls(t, srv); len(statuses) != 0 {
+		t.Errorf("GET /calls = %+v after all calls ended, want none", statuses)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "time"
+
+// RepromptConfig configures prompting a caller who has gone quiet, e.g.
+// "Are you still there?", before giving up on them.
+type RepromptConfig struct {
+	// AfterSeconds is how long the caller may stay silent before being
+	// reprompted. Zero disables reprompts.
+	AfterSeconds int `json:"after_seconds"`
+	// Message is spoken as the reprompt. Empty disables reprompts.
+	Message string `json:"message"`
+	// MaxReprompts is how often a caller is reprompted in a row; once
+	// they stay silent after the last one the call is hung up.
+	MaxReprompts int `json:"max_reprompts"`
+}
+
+// reprompter tracks the reprompts of a call since the caller last spoke.
+// A nil reprompter never reprompts.
+type reprompter struct {
+	after time.Duration
+	max   int
+	count int
+}
+
+// newReprompter returns a reprompter for cfg, or nil if reprompts are
+// disabled.
+func newReprompter(cfg RepromptConfig) *reprompter {
+	if cfg.AfterSeconds <= 0 || cfg.Message == "" {
+		return nil
+	}
+	return &reprompter{after: time.Duration(cfg.AfterSeconds) * time.Second, max: cfg.MaxReprompts}
+}
+
+// Check reports whether the caller should be reprompted after silence of
+// the given length, counting the reprompt, or hung up on because the
+// reprompts are used up. The silence should restart once a reprompt has
+// played.
+func (r *reprompter) Check(silence time.Duration) (reprompt, hangup bool) {
+	if r == nil || silence <= r.after {
+		return false, false
+	}
+	if r.count >= r.max {
+		return false, true
+	}
+	r.count++
+	return true, false
+}
+
+// Reset starts counting reprompts anew, once the caller speaks.
+func (r *reprompter) Reset() {
+	if r != nil {
+		r.count = 0
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CyCoreSystems/audiosocket"
+)
+
+func TestReprompter(t *testing.T) {
+	r := newReprompter(RepromptConfig{AfterSeconds: 5, Message: "Are you still there?", MaxReprompts: 2})
+	if reprompt, hangup := r.Check(5 * time.Second); reprompt || hangup {
+		t.Error("reprompted before the silence ran out")
+	}
+	for i := 1; i <= 2; i++ {
+		if reprompt, hangup := r.Check(6 * time.Second); !reprompt || hangup {
+			t.Fatalf("silence %d gave reprompt %v, hangup %v; want a reprompt", i, reprompt, hangup)
+		}
+	}
+	if reprompt, hangup := r.Check(6 * time.Second); reprompt || !hangup {
+		t.Errorf("silence after the last reprompt gave reprompt %v, hangup %v; want a hangup", reprompt, hangup)
+	}
+}
+
+func TestReprompterResetOnSpeech(t *testing.T) {
+	r := newReprompter(RepromptConfig{AfterSeconds: 5, Message: "Are you still there?", MaxReprompts: 1})
+	r.Check(6 * time.Second)
+	r.Reset()
+	if reprompt, hangup := r.Check(6 * time.Second); !reprompt || hangup {
+		t.Errorf("silence after speaking gave reprompt %v, hangup %v; want the reprompts counted anew", reprompt, hangup)
+	}
+}
+
+func TestReprompterDisabled(t *testing.T) {
+	for _, cfg := range []RepromptConfig{{Message: "Are you still there?", MaxReprompts: 2}, {AfterSeconds: 5, MaxReprompts: 2}} {
+		r := newReprompter(cfg)
+		if r != nil {
+			t.Errorf("reprompter created for %+v", cfg)
+		}
+		if reprompt, hangup := r.Check(time.Hour); reprompt || hangup {
+			t.Error("disabled reprompter reprompted or hung up")
+		}
+		r.Reset()
+	}
+}
+
+func TestCallRepromptsThenHangsUp(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.Reprompt = RepromptConfig{AfterSeconds: 1, Message: "Are you still there?", MaxReprompts: 2}
+		c.Webhook.StateEvents = true
+	})
+	events := withWebhookQueue(t)
+	tts := newTTSServer(t, make([]byte, 320), 320)
+	withTTS(t, tts)
+	id, _ := newTestCallChat(t, testSettings(0.7))
+	fake := NewFakeClock(time.Unix(0, 0))
+	withClock(t, fake)
+
+	stream := newTestStream(audiosocket.IDMessage(id))
+	stream.hold = true
+	stream.more = make(chan audiosocket.Message)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(context.Background(), stream)
+	}()
+	defer func() {
+		stream.Close()
+		<-done
+	}()
+	// silence sends a little over a second of silent frames
+	silence := func() {
+		for _, m := range silenceFrames(60) {
+			fake.Advance(20 * time.Millisecond)
+			select {
+			case stream.more <- m:
+			case <-done:
+				return
+			}
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		silence()
+		waitForState(t, events, stateSpeaking)
+		waitForState(t, events, stateListening)
+	}
+	silence()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("call not ended after the reprompts went unanswered")
+	}
+	if !stream.HungUp() {
+		t.Error("no hangup after the reprompts went unanswered")
+	}
+	requests := tts.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("%d synthesis requests, want the two reprompts", len(requests))
+	}
+	for _, request := range requests {
+		if request["message"] != "Are you still there?" {
+			t.Errorf("synthesized %v, want the reprompt", request["message"])
+		}
+	}
+}
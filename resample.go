@@ -0,0 +1,112 @@
+package main
+
+import "io"
+
+// Resampler converts a stream of samples between two sample rates using
+// linear interpolation. State is carried between calls to Process so chunk
+// boundaries don't introduce discontinuities.
+type Resampler struct {
+	from, to int
+	step     float64
+	pos      float64
+	prev     float32
+	primed   bool
+}
+
+// NewResampler creates a Resampler converting from one rate to another.
+func NewResampler(from, to int) *Resampler {
+	return &Resampler{
+		from: from,
+		to:   to,
+		step: float64(from) / float64(to),
+	}
+}
+
+// Converts reports whether the rates differ, in which case Process returns
+// new slices rather than its input.
+func (r *Resampler) Converts() bool {
+	return r.from != r.to
+}
+
+// Process resamples the next chunk of the stream.
+func (r *Resampler) Process(in []float32) []float32 {
+	if r.from == r.to || len(in) == 0 {
+		return in
+	}
+
+	// Interpolation between chunks needs the last sample of the previous one
+	buf := in
+	if r.primed {
+		buf = make([]float32, 0, len(in)+1)
+		buf = append(buf, r.prev)
+		buf = append(buf, in...)
+	}
+
+	out := make([]float32, 0, int(float64(len(buf))/r.step)+1)
+	last := float64(len(buf) - 1)
+	for r.pos < last {
+		i := int(r.pos)
+		frac := float32(r.pos - float64(i))
+		out = append(out, buf[i]+(buf[i+1]-buf[i])*frac)
+		r.pos += r.step
+	}
+
+	r.pos -= last
+	r.prev = buf[len(buf)-1]
+	r.primed = true
+	return out
+}
+
+// resample converts a complete buffer between sample rates.
+func resample(samples []float32, from, to int) []float32 {
+	return NewResampler(from, to).Process(samples)
+}
+
+// ResamplingWriter converts 16-bit SLIN audio written to it from one rate
+// to another before passing it on, e.g. TTS audio to the channel's rate.
+// Writes may split samples; a dangling byte is kept for the next Write.
+type ResamplingWriter struct {
+	w       io.Writer
+	r       *Resampler
+	pending []byte
+}
+
+// newTTSWriter returns w, converting TTS audio to the channel rate if
+// tts_sample_rate is set and differs from it.
+func newTTSWriter(w io.Writer, channelRate int) io.Writer {
+	if config.TTSSampleRate == 0 || config.TTSSampleRate == channelRate {
+		return w
+	}
+	return &ResamplingWriter{w: w, r: NewResampler(config.TTSSampleRate, channelRate)}
+}
+
+// Write implements io.Writer.
+func (rw *ResamplingWriter) Write(p []byte) (int, error) {
+	data := p
+	if len(rw.pending) > 0 {
+		data = append(rw.pending, p...)
+		rw.pending = nil
+	}
+	if len(data)%2 != 0 {
+		rw.pending = []byte{data[len(data)-1]}
+		data = data[:len(data)-1]
+	}
+	samples, err := decodePCM(nil, data)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeSamples(rw.w, rw.r.Process(samples), true); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush flushes the underlying writer if it holds back partial frames.
+func (rw *ResamplingWriter) Flush() error {
+	return flushAudio(rw.w)
+}
+
+// Close closes the underlying writer if it needs closing.
+func (rw *ResamplingWriter) Close() error {
+	return closeAudio(rw.w)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+)
+
+// sine returns seconds of a sine wave of freq Hz sampled at rate.
+func sine(freq float64, rate int, seconds float64) []float32 {
+	samples := make([]float32, int(float64(rate)*seconds))
+	for i := range samples {
+		samples[i] = float32(0.5 * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)))
+	}
+	return samples
+}
+
+// dominantFrequency estimates the frequency of a pure tone at rate from its
+// zero crossings.
+func dominantFrequency(samples []float32, rate int) float64 {
+	crossings := 0
+	for i := 1; i < len(samples); i++ {
+		if (samples[i-1] < 0) != (samples[i] < 0) {
+			crossings++
+		}
+	}
+	return float64(crossings) / 2 / (float64(len(samples)) / float64(rate))
+}
+
+func TestResampleLength(t *testing.T) {
+	tests := []struct{ from, to int }{
+		{8000, 16000},
+		{16000, 8000},
+		{8000, 48000},
+		{48000, 16000},
+		{22050, 16000},
+	}
+	for _, tt := range tests {
+		in := make([]float32, tt.from)
+		got := len(resample(in, tt.from, tt.to))
+		// Output past the last input sample waits for the next chunk
+		if tolerance := math.Ceil(float64(tt.to) / float64(tt.from)); math.Abs(float64(got-tt.to)) > tolerance {
+			t.Errorf("%d Hz to %d Hz: a second became %d samples, want %d", tt.from, tt.to, got, tt.to)
+		}
+	}
+}
+
+func TestResamplePassesMatchingRates(t *testing.T) {
+	in := sine(440, 16000, 0.1)
+	r := NewResampler(16000, 16000)
+	if r.Converts() {
+		t.Error("Converts() is true for equal rates")
+	}
+	if out := r.Process(in); &out[0] != &in[0] {
+		t.Error("samples copied although the rates match")
+	}
+}
+
+func TestResampleKeepsFrequency(t *testing.T) {
+	tests := []struct {
+		from, to int
+		freq     float64
+	}{
+		{8000, 16000, 1000},
+		{16000, 8000, 1000},
+		{16000, 48000, 440},
+	}
+	for _, tt := range tests {
+		out := resample(sine(tt.freq, tt.from, 1), tt.from, tt.to)
+		if got := dominantFrequency(out, tt.to); math.Abs(got-tt.freq) > tt.freq*0.01 {
+			t.Errorf("%v Hz tone at %d Hz resampled to %d Hz measures %.1f Hz", tt.freq, tt.from, tt.to, got)
+		}
+	}
+}
+
+func TestResamplerChunksMatchWholeBuffer(t *testing.T) {
+	in := sine(300, 8000, 0.5)
+	want := resample(in, 8000, 16000)
+
+	r := NewResampler(8000, 16000)
+	var got []float32
+	// 20 ms frames of slin8
+	for i := 0; i < len(in); i += 160 {
+		got = append(got, r.Process(in[i:i+160])...)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("chunked output has %d samples, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if math.Abs(float64(got[i]-want[i])) > 1e-6 {
+			t.Fatalf("sample %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestTTSWriterScalesLength(t *testing.T) {
+	tests := []struct {
+		tts, channel int
+	}{
+		{16000, 8000},
+		{24000, 8000},
+		{8000, 16000},
+		{22050, 8000},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(c *Config) { c.TTSSampleRate = tt.tts })
+		var out bytes.Buffer
+		w := newTTSWriter(&out, tt.channel)
+		if _, ok := w.(*ResamplingWriter); !ok {
+			t.Fatalf("%d to %d Hz: writer is %T, want a ResamplingWriter", tt.tts, tt.channel, w)
+		}
+		// One second of TTS audio, in chunks that split samples
+		pcm := float32ArrayToPCM(sine(440, tt.tts, 1))
+		for i := 0; i < len(pcm); i += 333 {
+			end := i + 333
+			if end > len(pcm) {
+				end = len(pcm)
+			}
+			if _, err := w.Write(pcm[i:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := out.Len() / 2; got < tt.channel-2 || got > tt.channel+2 {
+			t.Errorf("%d to %d Hz: one second became %d samples, want %d", tt.tts, tt.channel, got, tt.channel)
+		}
+	}
+}
+
+func TestTTSWriterSkipsMatchingRates(t *testing.T) {
+	var out bytes.Buffer
+	for _, rate := range []int{0, 8000} {
+		withConfig(t, func(c *Config) { c.TTSSampleRate = rate })
+		if w := newTTSWriter(&out, 8000); w != &out {
+			t.Errorf("TTS rate %d on an 8000 Hz channel: writer is %T, want the channel's", rate, w)
+		}
+	}
+}
+
+func TestTTSPlaybackResampled(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.TTSSampleRate = 16000
+		c.Webhook.StateEvents = true
+	})
+	events := withWebhookQueue(t)
+	// 200 ms of 16 kHz audio
+	withTTS(t, newTTSServer(t, float32ArrayToPCM(sine(440, 16000, 0.2)), 640))
+	stream := NewScriptedStream()
+	call := NewCall("call", stream, func() {})
+	call.setSampleRate(8000)
+
+	websocketSendReceive(context.Background(), websocketURI, map[string]interface{}{"message": "hello"}, call)
+	waitForState(t, events, stateListening)
+	written := 0
+	for _, frame := range stream.Written() {
+		written += len(frame)
+	}
+	// 200 ms at 8 kHz, give or take the frame the tail is padded to
+	if want := 3200; written < want-4 || written > want+call.frameBytes() {
+		t.Errorf("played %d bytes, want about %d", written, want)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// TranscriptRule replaces matches of a regular expression in
+// transcriptions, e.g. to fix a name the STT service keeps mishearing.
+type TranscriptRule struct {
+	// Pattern is an RE2 regular expression.
+	Pattern string `json:"pattern"`
+	// Replacement may refer to submatches as $1 or ${name}.
+	Replacement string `json:"replacement"`
+}
+
+// transcriptRewrite is a compiled TranscriptRule.
+type transcriptRewrite struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// transcriptRewrites are applied, in order, to every transcription before
+// it goes to the LLM. main compiles them from the config.
+var transcriptRewrites []transcriptRewrite
+
+// compileTranscriptRules compiles rules, failing on the first invalid
+// pattern.
+func compileTranscriptRules(rules []TranscriptRule) ([]transcriptRewrite, error) {
+	rewrites := make([]transcriptRewrite, 0, len(rules))
+	for i, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("transcript_rules[%d]: invalid pattern %q: %v", i, rule.Pattern, err)
+		}
+		rewrites = append(rewrites, transcriptRewrite{re: re, repl: rule.Replacement})
+	}
+	return rewrites, nil
+}
+
+// rewriteTranscript applies transcriptRewrites to text.
+func rewriteTranscript(text string) string {
+	for _, rw := range transcriptRewrites {
+		text = rw.re.ReplaceAllString(text, rw.repl)
+	}
+	return text
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// withTranscriptRules compiles rules into transcriptRewrites for the
+// test, restoring them after.
+func withTranscriptRules(t *testing.T, rules ...TranscriptRule) {
+	t.Helper()
+	rewrites, err := compileTranscriptRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := transcriptRewrites
+	t.Cleanup(func() { transcriptRewrites = saved })
+	transcriptRewrites = rewrites
+}
+
+func TestRewriteTranscript(t *testing.T) {
+	withTranscriptRules(t,
+		TranscriptRule{Pattern: `(?i)\bturn rain\b`, Replacement: "Turrain"},
+		TranscriptRule{Pattern: `order (\d+)`, Replacement: "order #$1"},
+		// Rules apply in order, so this sees the first one's output
+		TranscriptRule{Pattern: `Turrain support`, Replacement: "Turrain Support"},
+	)
+	got := rewriteTranscript("Turn Rain support, order 42 is late")
+	if want := "Turrain Support, order #42 is late"; got != want {
+		t.Errorf("rewriteTranscript() = %q, want %q", got, want)
+	}
+}
+
+func TestRewriteTranscriptNoMatch(t *testing.T) {
+	withTranscriptRules(t, TranscriptRule{Pattern: `turn rain`, Replacement: "Turrain"})
+	if got := rewriteTranscript("hello there"); got != "hello there" {
+		t.Errorf("rewriteTranscript() = %q, want the transcription unchanged", got)
+	}
+}
+
+func TestCompileTranscriptRulesInvalid(t *testing.T) {
+	_, err := compileTranscriptRules([]TranscriptRule{
+		{Pattern: `fine`, Replacement: "ok"},
+		{Pattern: `(unclosed`, Replacement: "x"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "transcript_rules[1]") || !strings.Contains(err.Error(), "(unclosed") {
+		t.Errorf("compileTranscriptRules() error = %v, want the invalid rule named", err)
+	}
+}
+
+func TestRewrittenTranscriptSentToLLM(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Webhook.StateEvents = true })
+	events := withWebhookQueue(t)
+	withTTS(t, newTTSServer(t, make([]byte, 640), 320))
+	withTranscriptRules(t, TranscriptRule{Pattern: `turn rain`, Replacement: "Turrain"})
+	ollama := &fakeOllama{}
+	_, store := newTestChat(t, "call", testSettings(0.7), ollama)
+	call := NewCall("call", NewScriptedStream(), func() {})
+	call.ChatStore = store
+
+	handleTranscription(context.Background(), call, "call turn rain please")
+	waitForState(t, events, stateListening)
+	requests := ollama.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("%d LLM requests, want 1", len(requests))
+	}
+	messages := requests[0].Messages
+	if got := messages[len(messages)-1].Content; got != "call Turrain please" {
+		t.Errorf("LLM asked %q, want the rewritten transcription", got)
+	}
+}
@@ -0,0 +1,54 @@
+package settings
+
+import "fmt"
+
+// Bounds of the values accepted by Clamp.
+const (
+	MaxLLMTemperature = 2.0
+	MaxTopK           = 100
+	MaxMirostat       = 2
+	MinNumCtx         = 512
+	MaxNumCtx         = 131072
+	MaxSTTTemperature = 1.0
+	MaxBeamSize       = 10
+)
+
+// Clamp brings the sampling settings into the ranges Ollama handles sanely
+// and returns a description of every value it changed.
+func (s *LLMSettings) Clamp() []string {
+	var clamped []string
+	clamp(&clamped, "temperature", &s.Temperature, 0, MaxLLMTemperature)
+	clamp(&clamped, "top_p", &s.TopP, 0, 1)
+	clamp(&clamped, "top_k", &s.TopK, 1, MaxTopK)
+	clamp(&clamped, "mirostat", &s.Mirostat, 0, MaxMirostat)
+	clamp(&clamped, "num_ctx", &s.NumCtx, MinNumCtx, MaxNumCtx)
+	return clamped
+}
+
+// Clamp brings the decoding settings into the ranges the STT service
+// handles sanely and returns a description of every value it changed.
+func (s *STTSettings) Clamp() []string {
+	var clamped []string
+	clamp(&clamped, "temperature", &s.Temperature, 0, MaxSTTTemperature)
+	clamp(&clamped, "beam_size", &s.BeamSize, 1, MaxBeamSize)
+	return clamped
+}
+
+// clamp bounds the value *p points to, if any, to [min, max]. The value is
+// replaced rather than modified, as it may be shared with other settings.
+func clamp[T int | float64](clamped *[]string, name string, p **T, min, max T) {
+	if *p == nil {
+		return
+	}
+	v := **p
+	switch {
+	case v < min:
+		v = min
+	case v > max:
+		v = max
+	default:
+		return
+	}
+	*clamped = append(*clamped, fmt.Sprintf("%s %v clamped to %v", name, **p, v))
+	*p = &v
+}
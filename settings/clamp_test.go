@@ -0,0 +1,70 @@
+package settings
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestLLMSettingsClampOutOfRange(t *testing.T) {
+	var s LLMSettings
+	if err := json.Unmarshal([]byte(`{"temperature":50,"top_p":-0.5,"top_k":0,"mirostat":7,"num_ctx":-1}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	clamped := s.Clamp()
+	if len(clamped) != 5 {
+		t.Errorf("Clamp() = %q, want every value clamped", clamped)
+	}
+	if *s.Temperature != MaxLLMTemperature || *s.TopP != 0 || *s.TopK != 1 || *s.Mirostat != MaxMirostat || *s.NumCtx != MinNumCtx {
+		data, _ := json.Marshal(s)
+		t.Errorf("clamped settings = %s", data)
+	}
+}
+
+func TestLLMSettingsClampInRange(t *testing.T) {
+	const sample = `{"model":"llama3","mirostat":2,"num_ctx":4096,"temperature":0.7,"top_k":40,"top_p":0.9}`
+	var s LLMSettings
+	if err := json.Unmarshal([]byte(sample), &s); err != nil {
+		t.Fatal(err)
+	}
+	if clamped := s.Clamp(); len(clamped) != 0 {
+		t.Errorf("Clamp() = %q, want nothing clamped", clamped)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameJSON(t, data, sample)
+
+	// Unset values stay unset
+	var empty LLMSettings
+	if clamped := empty.Clamp(); len(clamped) != 0 || empty.Temperature != nil {
+		t.Errorf("Clamp() of empty settings = %q", clamped)
+	}
+}
+
+func TestLLMSettingsClampKeepsSharedValue(t *testing.T) {
+	temperature := 5.0
+	a := LLMSettings{Temperature: &temperature}
+	b := a
+	a.Clamp()
+	if *b.Temperature != 5 || temperature != 5 {
+		t.Error("clamping one settings changed another sharing its value")
+	}
+}
+
+func TestSTTSettingsClamp(t *testing.T) {
+	var s STTSettings
+	if err := json.Unmarshal([]byte(`{"temperature":3,"beam_size":50}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	if clamped := s.Clamp(); len(clamped) != 2 || *s.Temperature != MaxSTTTemperature || *s.BeamSize != MaxBeamSize {
+		t.Errorf("Clamp() = %q, temperature %v, beam size %v", clamped, *s.Temperature, *s.BeamSize)
+	}
+
+	if err := json.Unmarshal([]byte(`{"temperature":0,"beam_size":5}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	if clamped := s.Clamp(); len(clamped) != 0 || *s.Temperature != 0 || *s.BeamSize != 5 {
+		t.Errorf("Clamp() = %q of in-range settings", clamped)
+	}
+}
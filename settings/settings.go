@@ -0,0 +1,37 @@
+// Package settings holds the per-chat STT and LLM settings shared by the
+// bridge and the chat backend client.
+package settings
+
+// STTSettings represents the settings for speech-to-text.
+type STTSettings struct {
+	Language                      *string  `json:"language,omitempty"`
+	BeamSize                      *int     `json:"beam_size,omitempty"`
+	BestOf                        *int     `json:"best_of,omitempty"`
+	Patience                      *float64 `json:"patience,omitempty"`
+	NoSpeechThreshold             *float64 `json:"no_speech_threshold,omitempty"`
+	Temperature                   *float64 `json:"temperature,omitempty"`
+	HallucinationSilenceThreshold *int     `json:"hallucination_silence_threshold,omitempty"`
+	Model                         *string  `json:"model,omitempty"`
+}
+
+// LLMSettings represents the settings for the language model.
+type LLMSettings struct {
+	Seed          *int     `json:"seed,omitempty"`
+	Model         *string  `json:"model,omitempty"`
+	SystemPrompt  *string  `json:"system_prompt,omitempty"`
+	Mirostat      *int     `json:"mirostat,omitempty"`
+	MirostatEta   *float64 `json:"mirostat_eta,omitempty"`
+	MirostatTau   *float64 `json:"mirostat_tau,omitempty"`
+	NumCtx        *int     `json:"num_ctx,omitempty"`
+	RepeatLastN   *int     `json:"repeat_last_n,omitempty"`
+	RepeatPenalty *float64 `json:"repeat_penalty,omitempty"`
+	Temperature   *float64 `json:"temperature,omitempty"`
+	TfsZ          *float64 `json:"tfs_z,omitempty"`
+	NumPredict    *int     `json:"num_predict,omitempty"`
+	TopK          *int     `json:"top_k,omitempty"`
+	TopP          *float64 `json:"top_p,omitempty"`
+	MinP          *float64 `json:"min_p,omitempty"`
+	// ExtraOptions holds Ollama options without a field of their own, e.g.
+	// "typical_p" or "stop", and is passed to Ollama as is.
+	ExtraOptions map[string]interface{} `json:"extra_options,omitempty"`
+}
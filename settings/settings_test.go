@@ -0,0 +1,77 @@
+package settings
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSTTSettingsJSON(t *testing.T) {
+	const sample = `{"language":"ru","beam_size":5,"best_of":3,"patience":1.5,"no_speech_threshold":0.6,"temperature":0,"hallucination_silence_threshold":2,"model":"large-v3"}`
+
+	var s STTSettings
+	if err := json.Unmarshal([]byte(sample), &s); err != nil {
+		t.Fatal(err)
+	}
+	if *s.Language != "ru" || *s.BeamSize != 5 || *s.Patience != 1.5 || *s.NoSpeechThreshold != 0.6 || *s.Model != "large-v3" {
+		t.Errorf("unmarshaled %+v", s)
+	}
+	// An explicit zero is kept apart from an unset field
+	if s.Temperature == nil || *s.Temperature != 0 {
+		t.Error("temperature 0 lost")
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameJSON(t, data, sample)
+}
+
+func TestLLMSettingsJSON(t *testing.T) {
+	const sample = `{"seed":42,"model":"llama3","system_prompt":"Be brief.","mirostat":2,"mirostat_eta":0.1,"mirostat_tau":5,"num_ctx":4096,"repeat_last_n":64,"repeat_penalty":1.1,"temperature":0.7,"tfs_z":1,"num_predict":128,"top_k":40,"top_p":0.9,"min_p":0.05,"extra_options":{"stop":["\n"],"typical_p":0.8}}`
+
+	var s LLMSettings
+	if err := json.Unmarshal([]byte(sample), &s); err != nil {
+		t.Fatal(err)
+	}
+	if *s.Seed != 42 || *s.Model != "llama3" || *s.TopK != 40 || *s.MinP != 0.05 {
+		t.Errorf("unmarshaled %+v", s)
+	}
+	if s.ExtraOptions["typical_p"] != 0.8 {
+		t.Errorf("extra options = %v", s.ExtraOptions)
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameJSON(t, data, sample)
+}
+
+func TestSettingsOmitUnsetFields(t *testing.T) {
+	for _, v := range []interface{}{STTSettings{}, LLMSettings{}} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "{}" {
+			t.Errorf("empty %T marshaled to %s", v, data)
+		}
+	}
+}
+
+// assertSameJSON fails unless data and want encode the same value.
+func assertSameJSON(t *testing.T, data []byte, want string) {
+	t.Helper()
+	var got, expected interface{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &expected); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("marshaled %s, want %s", data, want)
+	}
+}
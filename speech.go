@@ -0,0 +1,172 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Markdown constructs rewritten by stripMarkdown, applied in this order.
+var markdownRules = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// Code fences; the code itself is kept
+	{regexp.MustCompile("(?m)^[ \t]*```.*$\n?"), ""},
+	// Images and links keep only their text
+	{regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`), "$1"},
+	{regexp.MustCompile(`\[([^\]]+)\]\([^)]*\)`), "$1"},
+	{regexp.MustCompile("`([^`]*)`"), "$1"},
+	// Headings, block quotes, bullets and horizontal rules
+	{regexp.MustCompile(`(?m)^[ \t]*#{1,6}[ \t]+`), ""},
+	{regexp.MustCompile(`(?m)^[ \t]*>[ \t]?`), ""},
+	{regexp.MustCompile(`(?m)^[ \t]*(?:[-*_][ \t]*){3,}$`), ""},
+	{regexp.MustCompile(`(?m)^[ \t]*[-*+][ \t]+`), ""},
+	// Emphasis and strikethrough
+	{regexp.MustCompile(`(\*\*|__)(.+?)(\*\*|__)`), "$2"},
+	{regexp.MustCompile(`~~(.+?)~~`), "$1"},
+	{regexp.MustCompile(`(^|[^\w*])\*([^*\s](?:[^*\n]*[^*\s])?)\*($|[^\w*])`), "$1$2$3"},
+	{regexp.MustCompile(`\b_([^_\n]+)_\b`), "$1"},
+}
+
+// blankLines matches runs of blank lines left behind by removed markup.
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+// stripMarkdown turns markdown written by the LLM into plain text the TTS
+// engine can read, so it doesn't spell out asterisks, URLs or fences.
+func stripMarkdown(text string) string {
+	for _, rule := range markdownRules {
+		text = rule.re.ReplaceAllString(text, rule.repl)
+	}
+	text = blankLines.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
+
+// TextNormalizer rewrites text into a form the TTS engine pronounces well
+// in language.
+type TextNormalizer interface {
+	Normalize(text, language string) string
+}
+
+// textNormalizers run, in order, on all text before it is spoken. main
+// sets them up from the config; deployments may add their own.
+var textNormalizers []TextNormalizer
+
+// newTextNormalizers returns the normalizers enabled in cfg.
+func newTextNormalizers(cfg Config) []TextNormalizer {
+	var normalizers []TextNormalizer
+	if cfg.ExpandAbbreviations {
+		normalizers = append(normalizers, NewAbbreviationExpander(cfg.Abbreviations))
+	}
+	if cfg.ExpandNumbers {
+		normalizers = append(normalizers, NumberExpander{})
+	}
+	return normalizers
+}
+
+// defaultAbbreviations are expanded for each language unless overridden.
+var defaultAbbreviations = map[string]map[string]string{
+	"en": {
+		"Dr.": "Doctor", "Mr.": "Mister", "Mrs.": "Missus", "Ms.": "Miz",
+		"Jr.": "Junior", "Sr.": "Senior", "vs.": "versus", "etc.": "et cetera",
+		"e.g.": "for example", "i.e.": "that is", "approx.": "approximately",
+	},
+	"ru": {
+		"т.е.": "то есть", "т.д.": "так далее", "т.п.": "тому подобное",
+		"и т. д.": "и так далее", "др.": "другие", "ул.": "улица",
+		"тыс.": "тысяч", "млн": "миллионов", "млрд": "миллиардов",
+	},
+}
+
+// AbbreviationExpander replaces abbreviations with the words they stand
+// for, per language.
+type AbbreviationExpander struct {
+	rules map[string][]abbreviationRule
+}
+
+type abbreviationRule struct {
+	re        *regexp.Regexp
+	expansion string
+}
+
+// NewAbbreviationExpander expands the default abbreviations and those in
+// custom, which maps languages to abbreviations to their expansions and
+// takes precedence.
+func NewAbbreviationExpander(custom map[string]map[string]string) *AbbreviationExpander {
+	merged := make(map[string]map[string]string)
+	for _, abbreviations := range []map[string]map[string]string{defaultAbbreviations, custom} {
+		for language, abbrs := range abbreviations {
+			if merged[language] == nil {
+				merged[language] = make(map[string]string)
+			}
+			for abbr, expansion := range abbrs {
+				merged[language][abbr] = expansion
+			}
+		}
+	}
+
+	e := &AbbreviationExpander{rules: make(map[string][]abbreviationRule)}
+	for language, abbrs := range merged {
+		for abbr, expansion := range abbrs {
+			// Abbreviations must stand alone, "Dr." but not "Dr.s"
+			re := regexp.MustCompile(`(^|[^\p{L}\p{N}])` + regexp.QuoteMeta(abbr) + `($|[^\p{L}\p{N}])`)
+			e.rules[language] = append(e.rules[language], abbreviationRule{re, expansion})
+		}
+		// Longer abbreviations first, so "и т. д." wins over "т.д."
+		rules := e.rules[language]
+		sort.Slice(rules, func(i, j int) bool {
+			return len(rules[i].re.String()) > len(rules[j].re.String())
+		})
+	}
+	return e
+}
+
+// Normalize implements TextNormalizer.
+func (e *AbbreviationExpander) Normalize(text, language string) string {
+	for _, rule := range e.rules[language] {
+		text = rule.re.ReplaceAllString(text, "${1}"+strings.ReplaceAll(rule.expansion, "$", "$$")+"${2}")
+	}
+	return text
+}
+
+// speakable prepares text for synthesis in language according to the
+// config.
+func speakable(text, language string) string {
+	if config.StripMarkdown {
+		text = stripMarkdown(text)
+	}
+	for _, n := range textNormalizers {
+		text = n.Normalize(text, language)
+	}
+	return text
+}
+
+// truncateReply cuts text to at most max characters, at the end of the
+// last sentence that fits or, failing that, between words. truncated
+// reports whether anything was cut.
+func truncateReply(text string, max int) (result string, truncated bool) {
+	runes := []rune(text)
+	if max <= 0 || len(runes) <= max {
+		return text, false
+	}
+	cut := -1
+	for i := max - 1; i >= 0; i-- {
+		if strings.ContainsRune(".!?…", runes[i]) && unicode.IsSpace(runes[i+1]) {
+			cut = i + 1
+			break
+		}
+	}
+	if cut < 0 {
+		for i := max; i > 0; i-- {
+			if unicode.IsSpace(runes[i]) {
+				cut = i
+				break
+			}
+		}
+	}
+	if cut <= 0 {
+		cut = max
+	}
+	return strings.TrimSpace(string(runes[:cut])), true
+}
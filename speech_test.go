@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"go-ast-client/api"
+)
+
+func TestStripMarkdown(t *testing.T) {
+	tests := []struct {
+		name, text, want string
+	}{
+		{"bold", "This is **very** important.", "This is very important."},
+		{"italic", "Say it *softly* or _slowly_.", "Say it softly or slowly."},
+		{"strikethrough", "Open ~~Sunday~~ Monday.", "Open Sunday Monday."},
+		{"link", "See [our site](https://example.com/hours) for hours.", "See our site for hours."},
+		{"image", "![the map](map.png) shows it.", "the map shows it."},
+		{"inline code", "Dial `*72` first.", "Dial *72 first."},
+		{"heading", "## Opening hours\nWe open at nine.", "Opening hours\nWe open at nine."},
+		{"bullets", "You can:\n- pay online\n* pay by phone\n+ visit us", "You can:\npay online\npay by phone\nvisit us"},
+		{"numbered list", "Steps:\n1. Press one\n2. Wait", "Steps:\n1. Press one\n2. Wait"},
+		{"quote", "> Hello there", "Hello there"},
+		{"code block", "Run this:\n```go\nfmt.Println(\"hi\")\n```\nDone.", "Run this:\nfmt.Println(\"hi\")\nDone."},
+		{"rule", "Above\n\n---\n\nBelow", "Above\n\nBelow"},
+		// Arithmetic and snake_case identifiers aren't emphasis
+		{"plain asterisks", "2 * 3 * 4 is 24", "2 * 3 * 4 is 24"},
+		{"identifiers", "my_user_name", "my_user_name"},
+	}
+	for _, tt := range tests {
+		if got := stripMarkdown(tt.text); got != tt.want {
+			t.Errorf("%s: stripMarkdown(%q) = %q, want %q", tt.name, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSpeakableStripsMarkdown(t *testing.T) {
+	if DefaultConfig().StripMarkdown {
+		t.Error("markdown stripped by default")
+	}
+	withConfig(t, func(c *Config) { c.StripMarkdown = true })
+	if got := speakable("**Hello**", "en"); got != "Hello" {
+		t.Errorf("speakable() = %q, want the markdown stripped", got)
+	}
+	withConfig(t, func(c *Config) { c.StripMarkdown = false })
+	if got := speakable("**Hello**", "en"); got != "**Hello**" {
+		t.Errorf("speakable() = %q with stripping off, want the text as is", got)
+	}
+}
+
+func TestTruncateReply(t *testing.T) {
+	tests := []struct {
+		name, text string
+		max        int
+		want       string
+		truncated  bool
+	}{
+		{"short", "Sure, it opens at nine.", 40, "Sure, it opens at nine.", false},
+		{"exact", "Sure.", 5, "Sure.", false},
+		{"disabled", "One. Two. Three.", 0, "One. Two. Three.", false},
+		{"last sentence", "We open at nine. We close at five. On Sundays we are closed.", 40, "We open at nine. We close at five.", true},
+		{"question", "Is that all? I can also check your order status for you.", 30, "Is that all?", true},
+		{"between words", "We open at nine and close at five on weekdays", 20, "We open at nine and", true},
+		{"no space", "Supercalifragilistic", 5, "Super", true},
+		{"not mid-word", "Mr.Smith will call you back tomorrow", 12, "Mr.Smith", true},
+		{"runes", "Мы открыты с девяти. Закрываемся в пять.", 25, "Мы открыты с девяти.", true},
+	}
+	for _, tt := range tests {
+		got, truncated := truncateReply(tt.text, tt.max)
+		if got != tt.want || truncated != tt.truncated {
+			t.Errorf("%s: truncateReply(%q, %d) = %q, %v; want %q, %v", tt.name, tt.text, tt.max, got, truncated, tt.want, tt.truncated)
+		}
+	}
+}
+
+func TestLongReplyTruncatedBeforeSpeaking(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.MaxReplyChars = 40
+		c.Webhook.StateEvents = true
+	})
+	events := withWebhookQueue(t)
+	tts := newTTSServer(t, bytes.Repeat([]byte{0x22}, 640), 320)
+	withTTS(t, tts)
+	ollama := &fakeOllama{reply: func(ctx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error) {
+		content := "We open at nine. We close at five. On Sundays we are closed."
+		return api.OllamaChatResponse{Message: api.OllamaResponseMessage{Role: "assistant", Content: content}, Done: true}, nil
+	}}
+	_, store := newTestChat(t, "call", testSettings(0.7), ollama)
+	call := NewCall("call", NewScriptedStream(), func() {})
+	call.ChatStore = store
+
+	handleTranscription(context.Background(), call, "when are you open?")
+	waitForState(t, events, stateListening)
+	requests := tts.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("%d TTS requests, want 1", len(requests))
+	}
+	if got := requests[0]["message"]; got != "We open at nine. We close at five." {
+		t.Errorf("spoke %q, want the reply cut at its last sentence under the cap", got)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/CyCoreSystems/audiosocket"
+)
+
+// MessageStream is the AudioSocket side of a call. Handle only talks to
+// Asterisk through it, so calls can be driven by a ScriptedStream instead
+// of a live socket.
+type MessageStream interface {
+	// NextMessage blocks until the next message arrives. It returns io.EOF
+	// once the stream has ended.
+	NextMessage() (audiosocket.Message, error)
+	// WriteSlin sends one chunk of SLIN audio to the caller.
+	WriteSlin(pcm []byte) error
+	// WriteHangup asks Asterisk to hang up the call.
+	WriteHangup() error
+	Close() error
+}
+
+// audioSocketStream is the MessageStream of an AudioSocket connection.
+type audioSocketStream struct {
+	net.Conn
+}
+
+// NewAudioSocketStream returns the MessageStream of an AudioSocket
+// connection accepted from Asterisk.
+func NewAudioSocketStream(c net.Conn) MessageStream {
+	return audioSocketStream{Conn: c}
+}
+
+func (s audioSocketStream) NextMessage() (audiosocket.Message, error) {
+	return readMessage(s.Conn)
+}
+
+func (s audioSocketStream) WriteSlin(pcm []byte) error {
+	_, err := s.Write(audiosocket.SlinMessage(pcm))
+	return err
+}
+
+func (s audioSocketStream) WriteHangup() error {
+	_, err := s.Write(audiosocket.HangupMessage())
+	return err
+}
+
+// ScriptedStream is a MessageStream that plays back a fixed sequence of
+// messages and records what is written to it, for driving Handle without
+// Asterisk. Once the script is exhausted NextMessage returns io.EOF.
+type ScriptedStream struct {
+	mu       sync.Mutex
+	messages []audiosocket.Message
+	written  [][]byte
+	hangups  int
+	closed   bool
+}
+
+var _ MessageStream = (*ScriptedStream)(nil)
+
+// NewScriptedStream creates a ScriptedStream yielding messages in order.
+func NewScriptedStream(messages ...audiosocket.Message) *ScriptedStream {
+	return &ScriptedStream{messages: messages}
+}
+
+func (s *ScriptedStream) NextMessage() (audiosocket.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || len(s.messages) == 0 {
+		return nil, io.EOF
+	}
+	m := s.messages[0]
+	s.messages = s.messages[1:]
+	return m, nil
+}
+
+func (s *ScriptedStream) WriteSlin(pcm []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return io.ErrClosedPipe
+	}
+	s.written = append(s.written, append([]byte(nil), pcm...))
+	return nil
+}
+
+func (s *ScriptedStream) WriteHangup() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return io.ErrClosedPipe
+	}
+	s.hangups++
+	return nil
+}
+
+func (s *ScriptedStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// Written returns the SLIN chunks written so far.
+func (s *ScriptedStream) Written() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte(nil), s.written...)
+}
+
+// HungUp reports whether a hangup was requested.
+func (s *ScriptedStream) HungUp() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hangups > 0
+}
+
+// streamRemoteAddr returns the peer address of s, if it has one.
+func streamRemoteAddr(s MessageStream) string {
+	if c, ok := s.(interface{ RemoteAddr() net.Addr }); ok {
+		return c.RemoteAddr().String()
+	}
+	return ""
+}
+
+// interruptStream unblocks a NextMessage call in progress on s, if s
+// supports read deadlines.
+func interruptStream(s MessageStream) {
+	if c, ok := s.(interface{ SetReadDeadline(time.Time) error }); ok {
+		c.SetReadDeadline(time.Now())
+	}
+}
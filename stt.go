@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-ast-client/api"
+	"go-ast-client/settings"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Transcriber turns an utterance into text.
+type Transcriber interface {
+	// Transcribe returns the text spoken in samples. Canceling ctx aborts
+	// the request. samples may be reused once it returns, so it must not
+	// be kept.
+	Transcribe(ctx context.Context, samples []float32, sttSettings settings.STTSettings) (string, error)
+}
+
+// withEmotion prefixes transcription with the emotion the STT service
+// detected, if any, for the LLM to take into account. Every request
+// format goes through it, so switching formats doesn't change what the
+// LLM is sent.
+func withEmotion(transcription, emotion string) string {
+	if emotion == "" {
+		return transcription
+	}
+	log.Println("Emotion:", emotion)
+	return fmt.Sprintf("[**Emotion:** %s]\n%s", emotion, transcription)
+}
+
+// HTTPTranscriber is a Transcriber backed by an STT HTTP service.
+type HTTPTranscriber struct {
+	URL string
+	// Format is the request encoding, see Config.STTFormat.
+	Format string
+	// Model, if set, overrides the STT model requested by the chat settings.
+	Model string
+	// CallID is sent along as the request ID.
+	CallID string
+	// HTTPClient sends the requests; nil means the shared httpClient.
+	HTTPClient *http.Client
+	// Form names the parts of multipart and wav requests.
+	Form STTFormConfig
+	// ResponseKey selects the transcription in JSON responses, see
+	// Config.STTResponseKey.
+	ResponseKey string
+}
+
+// STTFormConfig lays out the multipart form of STT uploads, so services
+// expecting other field names can be used as they are.
+type STTFormConfig struct {
+	// AudioField is the name of the part holding the audio.
+	AudioField string `json:"audio_field"`
+	// FileName is the file name of the audio part. Empty means "audio.raw",
+	// or "audio.wav" for the wav format.
+	FileName string `json:"file_name"`
+	// ContentType is the content type of the audio part. Empty means
+	// "application/octet-stream", or "audio/wav" for the wav format.
+	ContentType string `json:"content_type"`
+	// SettingsField is the name of the part holding the STT settings as
+	// JSON.
+	SettingsField string `json:"settings_field"`
+	// SettingsInQuery sends the STT settings as query parameters instead
+	// of a form field.
+	SettingsInQuery bool `json:"settings_in_query"`
+}
+
+// validate checks that the form can be built.
+func (f STTFormConfig) validate() error {
+	if f.AudioField == "" {
+		return fmt.Errorf("audio_field must not be empty")
+	}
+	if f.SettingsField == "" && !f.SettingsInQuery {
+		return fmt.Errorf("settings_field must not be empty unless settings_in_query is set")
+	}
+	return nil
+}
+
+// Transcribe sends samples to the STT service and returns the transcription.
+func (t *HTTPTranscriber) Transcribe(ctx context.Context, samples []float32, sttSettings settings.STTSettings) (string, error) {
+	if t.Model != "" {
+		sttSettings.Model = ptr(t.Model)
+	}
+	release, err := sttLimiter.Acquire(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get an STT slot: %w", err)
+	}
+	defer release()
+	if t.Format == sttFormatProtobuf {
+		return sendProtobufToServer(ctx, t.client(), t.URL, t.CallID, samples, sttSettings)
+	}
+	return sendFloat32ArrayToServer(ctx, t.client(), t.URL, t.CallID, samples, sttSettings, t.Format == sttFormatWAV, t.Form, t.ResponseKey)
+}
+
+// client returns the client requests are sent with.
+func (t *HTTPTranscriber) client() *http.Client {
+	if t.HTTPClient != nil {
+		return t.HTTPClient
+	}
+	return httpClient
+}
+
+// STTSegmentConfig binds an STT endpoint to a segment of callers.
+type STTSegmentConfig struct {
+	// Numbers are the dialed numbers (DIDs) routed to this segment.
+	Numbers []string `json:"numbers"`
+	URL     string   `json:"url"`
+	Format  string   `json:"format"`
+	Model   string   `json:"model"`
+	// Form, if set, overrides Config.STTForm for this segment.
+	Form *STTFormConfig `json:"form"`
+	// ResponseKey, if set, overrides Config.STTResponseKey for this
+	// segment.
+	ResponseKey string `json:"response_key"`
+}
+
+// validateSTTSegments checks that every segment has a usable endpoint and
+// that no number is routed to more than one segment.
+func validateSTTSegments(segments map[string]STTSegmentConfig) error {
+	numbers := make(map[string]string)
+	for name, segment := range segments {
+		if _, err := url.ParseRequestURI(segment.URL); err != nil {
+			return fmt.Errorf("stt segment %q: invalid url: %v", name, err)
+		}
+		switch segment.Format {
+		case "", sttFormatMultipart, sttFormatWAV, sttFormatProtobuf:
+		default:
+			return fmt.Errorf("stt segment %q: unsupported format %q", name, segment.Format)
+		}
+		if segment.Form != nil {
+			if err := segment.Form.validate(); err != nil {
+				return fmt.Errorf("stt segment %q: form: %v", name, err)
+			}
+		}
+		if segment.ResponseKey != "" {
+			if err := validateJSONPath(segment.ResponseKey); err != nil {
+				return fmt.Errorf("stt segment %q: response_key: %v", name, err)
+			}
+		}
+		for _, number := range segment.Numbers {
+			if other, ok := numbers[number]; ok {
+				return fmt.Errorf("number %s is routed to both stt segments %q and %q", number, other, name)
+			}
+			numbers[number] = name
+		}
+	}
+	return nil
+}
+
+// transcriberFor resolves the Transcriber for a call. An explicit segment
+// in the chat settings wins over routing by dialed number; calls matching
+// no segment use the default STT service.
+func transcriberFor(settings api.AsteriskSettings) Transcriber {
+	if settings.AsteriskSegment != "" {
+		if segment, ok := config.STTSegments[settings.AsteriskSegment]; ok {
+			return segmentTranscriber(segment)
+		}
+		log.Printf("unknown stt segment %q, using default", settings.AsteriskSegment)
+	}
+	if settings.AsteriskNumber != "" {
+		for _, segment := range config.STTSegments {
+			for _, number := range segment.Numbers {
+				if number == settings.AsteriskNumber {
+					return segmentTranscriber(segment)
+				}
+			}
+		}
+	}
+	return &HTTPTranscriber{URL: transcribeURL, Format: config.STTFormat, Form: config.STTForm, ResponseKey: config.STTResponseKey}
+}
+
+func segmentTranscriber(segment STTSegmentConfig) *HTTPTranscriber {
+	format := segment.Format
+	if format == "" {
+		format = config.STTFormat
+	}
+	form := config.STTForm
+	if segment.Form != nil {
+		form = *segment.Form
+	}
+	responseKey := segment.ResponseKey
+	if responseKey == "" {
+		responseKey = config.STTResponseKey
+	}
+	return &HTTPTranscriber{URL: segment.URL, Format: format, Model: segment.Model, Form: form, ResponseKey: responseKey}
+}
+
+// streamerFor returns the StreamTranscriber used in streaming mode. A
+// transcriber that can stream is used as is; otherwise the configured
+// streaming endpoint is used, falling back to buffering for transcriber.
+func streamerFor(transcriber Transcriber) StreamTranscriber {
+	if streamer, ok := transcriber.(StreamTranscriber); ok {
+		return streamer
+	}
+	if config.STTStreamURL != "" {
+		return &WebSocketStreamTranscriber{URL: config.STTStreamURL}
+	}
+	return &BufferedStreamTranscriber{Transcriber: transcriber}
+}
+
+// validateJSONPath checks a selector for selectJSON.
+func validateJSONPath(path string) error {
+	for _, key := range strings.Split(path, ".") {
+		if key == "" {
+			return fmt.Errorf("%q has an empty element", path)
+		}
+	}
+	return nil
+}
+
+// selectJSON walks a decoded JSON value along a dot-separated path, e.g.
+// "results.0.text"; numeric elements index arrays. If an element is
+// missing the error lists the keys available at that level.
+func selectJSON(v interface{}, path string) (interface{}, error) {
+	walked := ""
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok {
+				keys := make([]string, 0, len(node))
+				for k := range node {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				return nil, fmt.Errorf("%q not found in response%s, available keys: %s", key, walkedSuffix(walked), strings.Join(keys, ", "))
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, fmt.Errorf("%q is no index into the %d elements of the response%s", key, len(node), walkedSuffix(walked))
+			}
+			v = node[i]
+		default:
+			return nil, fmt.Errorf("%q not found in response%s, which holds no object or array", key, walkedSuffix(walked))
+		}
+		if walked != "" {
+			walked += "."
+		}
+		walked += key
+	}
+	return v, nil
+}
+
+// walkedSuffix names the part of the response an error refers to.
+func walkedSuffix(walked string) string {
+	if walked == "" {
+		return ""
+	}
+	return fmt.Sprintf(" at %q", walked)
+}
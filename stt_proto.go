@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"go-ast-client/api"
+	"go-ast-client/settings"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+)
+
+// Protobuf wire types used by the STT schema in stt.proto.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// protoBuffer is a minimal protobuf encoder for the messages in stt.proto.
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) varint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	b.Write(tmp[:n])
+}
+
+func (b *protoBuffer) tag(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) bytesField(field int, p []byte) {
+	b.tag(field, wireBytes)
+	b.varint(uint64(len(p)))
+	b.Write(p)
+}
+
+func (b *protoBuffer) intField(field int, v *int) {
+	if v == nil {
+		return
+	}
+	b.tag(field, wireVarint)
+	// int32 fields are sign-extended to 64 bits on the wire.
+	b.varint(uint64(int64(int32(*v))))
+}
+
+func (b *protoBuffer) doubleField(field int, v *float64) {
+	if v == nil {
+		return
+	}
+	b.tag(field, wireFixed64)
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(*v))
+	b.Write(tmp[:])
+}
+
+func encodeSTTSettings(sttSettings settings.STTSettings) []byte {
+	var b protoBuffer
+	if sttSettings.Language != nil {
+		b.bytesField(1, []byte(*sttSettings.Language))
+	}
+	b.intField(2, sttSettings.BeamSize)
+	b.intField(3, sttSettings.BestOf)
+	b.doubleField(6, sttSettings.Temperature)
+	b.intField(7, sttSettings.HallucinationSilenceThreshold)
+	if sttSettings.Model != nil {
+		b.bytesField(8, []byte(*sttSettings.Model))
+	}
+	b.doubleField(9, sttSettings.Patience)
+	b.doubleField(10, sttSettings.NoSpeechThreshold)
+	return b.Bytes()
+}
+
+// encodeTranscribeRequest serializes a TranscribeRequest message.
+func encodeTranscribeRequest(samples []float32, sttSettings settings.STTSettings, sampleRate int) []byte {
+	audio := make([]byte, len(samples)*4)
+	for i, f := range samples {
+		binary.LittleEndian.PutUint32(audio[i*4:], math.Float32bits(f))
+	}
+
+	var b protoBuffer
+	b.bytesField(1, audio)
+	b.bytesField(2, encodeSTTSettings(sttSettings))
+	b.tag(3, wireVarint)
+	b.varint(uint64(sampleRate))
+	return b.Bytes()
+}
+
+// transcribeResponse mirrors the TranscribeResponse message.
+type transcribeResponse struct {
+	Transcription string
+	Emotion       string
+}
+
+// decodeTranscribeResponse parses a TranscribeResponse message, skipping
+// any fields it does not know about.
+func decodeTranscribeResponse(data []byte) (transcribeResponse, error) {
+	var res transcribeResponse
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return res, fmt.Errorf("malformed field tag")
+		}
+		data = data[n:]
+		field, wireType := int(key>>3), int(key&7)
+
+		switch wireType {
+		case wireVarint:
+			if _, n = binary.Uvarint(data); n <= 0 {
+				return res, fmt.Errorf("malformed varint in field %d", field)
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return res, fmt.Errorf("truncated fixed64 in field %d", field)
+			}
+			data = data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return res, fmt.Errorf("truncated fixed32 in field %d", field)
+			}
+			data = data[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return res, fmt.Errorf("truncated bytes in field %d", field)
+			}
+			value := string(data[n : n+int(size)])
+			data = data[n+int(size):]
+			switch field {
+			case 1:
+				res.Transcription = value
+			case 2:
+				res.Emotion = value
+			}
+		default:
+			return res, fmt.Errorf("unsupported wire type %d in field %d", wireType, field)
+		}
+	}
+	return res, nil
+}
+
+// sendProtobufToServer is the protobuf counterpart of sendFloat32ArrayToServer.
+func sendProtobufToServer(ctx context.Context, client *http.Client, serverAddress, callID string, float32Array []float32, sttSettings settings.STTSettings) (string, error) {
+	body := encodeTranscribeRequest(float32Array, sttSettings, config.STTSampleRate)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, serverAddress, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Accept", "application/x-protobuf")
+	setRequestID(req.Header, callID)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading response body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("transcription failed: received status code %d", resp.StatusCode)
+	}
+
+	result, err := decodeTranscribeResponse(respBody)
+	if err != nil {
+		return "", fmt.Errorf("error decoding protobuf response: %v", err)
+	}
+	if result.Transcription == "" {
+		return "", fmt.Errorf("transcription not found in response")
+	}
+	log.Println("Transcription:", api.Redact(result.Transcription))
+	return withEmotion(result.Transcription, result.Emotion), nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"go-ast-client/settings"
+)
+
+// protoField is a decoded protobuf field. Varint and fixed64 values are
+// kept in num, length-delimited ones in data.
+type protoField struct {
+	num  uint64
+	data []byte
+}
+
+// decodeProtoFields parses a message into its fields by number, as the
+// STT service would.
+func decodeProtoFields(t *testing.T, data []byte) map[int]protoField {
+	t.Helper()
+	fields := make(map[int]protoField)
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatal("malformed tag")
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				t.Fatalf("malformed varint in field %d", field)
+			}
+			fields[field] = protoField{num: v}
+			data = data[n:]
+		case wireFixed64:
+			fields[field] = protoField{num: binary.LittleEndian.Uint64(data)}
+			data = data[8:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			fields[field] = protoField{data: data[n : n+int(size)]}
+			data = data[n+int(size):]
+		default:
+			t.Fatalf("unexpected wire type %d in field %d", key&7, field)
+		}
+	}
+	return fields
+}
+
+func intPtr(i int) *int { return &i }
+
+func TestTranscribeRequestRoundTrip(t *testing.T) {
+	samples := []float32{0, 0.5, -0.25, 1}
+	sttSettings := settings.STTSettings{
+		Language:                      ptr("ru"),
+		BeamSize:                      intPtr(5),
+		BestOf:                        intPtr(-1),
+		Patience:                      float64Ptr(1.5),
+		NoSpeechThreshold:             float64Ptr(0.6),
+		Temperature:                   float64Ptr(0.2),
+		HallucinationSilenceThreshold: intPtr(2),
+		Model:                         ptr("large"),
+	}
+
+	request := decodeProtoFields(t, encodeTranscribeRequest(samples, sttSettings, 16000))
+	audio := request[1].data
+	if len(audio) != len(samples)*4 {
+		t.Fatalf("audio is %d bytes, want %d", len(audio), len(samples)*4)
+	}
+	for i, want := range samples {
+		if got := math.Float32frombits(binary.LittleEndian.Uint32(audio[i*4:])); got != want {
+			t.Errorf("sample %d = %v, want %v", i, got, want)
+		}
+	}
+	if got := request[3].num; got != 16000 {
+		t.Errorf("sample_rate = %d, want 16000", got)
+	}
+
+	fields := decodeProtoFields(t, request[2].data)
+	var got settings.STTSettings
+	for field, v := range fields {
+		switch field {
+		case 1:
+			got.Language = ptr(string(v.data))
+		case 2:
+			got.BeamSize = intPtr(int(int32(v.num)))
+		case 3:
+			got.BestOf = intPtr(int(int32(v.num)))
+		case 6:
+			got.Temperature = float64Ptr(math.Float64frombits(v.num))
+		case 7:
+			got.HallucinationSilenceThreshold = intPtr(int(int32(v.num)))
+		case 8:
+			got.Model = ptr(string(v.data))
+		case 9:
+			got.Patience = float64Ptr(math.Float64frombits(v.num))
+		case 10:
+			got.NoSpeechThreshold = float64Ptr(math.Float64frombits(v.num))
+		default:
+			t.Errorf("unexpected settings field %d", field)
+		}
+	}
+	if !reflect.DeepEqual(got, sttSettings) {
+		t.Errorf("settings round-tripped to %+v, want %+v", got, sttSettings)
+	}
+}
+
+func TestTranscribeRequestOmitsUnsetSettings(t *testing.T) {
+	request := decodeProtoFields(t, encodeTranscribeRequest(nil, settings.STTSettings{}, 8000))
+	if settings := request[2].data; len(settings) != 0 {
+		t.Errorf("settings encoded to %x, want nothing", settings)
+	}
+}
+
+func encodeTestResponse(transcription, emotion string) []byte {
+	var b protoBuffer
+	b.bytesField(1, []byte(transcription))
+	b.bytesField(2, []byte(emotion))
+	// A field from a newer schema is skipped
+	b.tag(3, wireVarint)
+	b.varint(7)
+	return b.Bytes()
+}
+
+func TestTranscribeResponseRoundTrip(t *testing.T) {
+	got, err := decodeTranscribeResponse(encodeTestResponse("привет", "neutral"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (transcribeResponse{Transcription: "привет", Emotion: "neutral"}); got != want {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+	if _, err := decodeTranscribeResponse([]byte{0x0a, 0x05, 'a'}); err == nil {
+		t.Error("truncated response decoded without an error")
+	}
+}
+
+func TestTranscribeResponseRoundTripWithoutEmotion(t *testing.T) {
+	got, err := decodeTranscribeResponse(encodeTestResponse("привет", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (transcribeResponse{Transcription: "привет"}); got != want {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+}
+
+func TestSendProtobufToServer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		audio := decodeProtoFields(t, body)[1].data
+		if len(audio) != 8 {
+			t.Errorf("audio is %d bytes, want 8", len(audio))
+		}
+		w.Write(encodeTestResponse("hello", "happy"))
+	}))
+	defer srv.Close()
+
+	got, err := sendProtobufToServer(context.Background(), http.DefaultClient, srv.URL, "call", []float32{0.1, 0.2}, settings.STTSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[**Emotion:** happy]\nhello"; got != want {
+		t.Errorf("transcription = %q, want %q", got, want)
+	}
+}
+
+func TestSendProtobufToServerWithoutEmotion(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(encodeTestResponse("hello", ""))
+	}))
+	defer srv.Close()
+
+	got, err := sendProtobufToServer(context.Background(), http.DefaultClient, srv.URL, "call", []float32{0.1, 0.2}, settings.STTSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As the multipart format gives it without an emotion
+	if got != "hello" {
+		t.Errorf("transcription = %q, want it without an emotion prefix", got)
+	}
+}
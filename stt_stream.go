@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"go-ast-client/api"
+	"go-ast-client/settings"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// streamFinishTimeout bounds how long we wait for the final transcript once
+// the utterance has ended.
+const streamFinishTimeout = 10 * time.Second
+
+// TranscriptResult is a partial or final transcript from a streaming STT
+// backend.
+type TranscriptResult struct {
+	Text  string
+	Final bool
+	Err   error
+}
+
+// StreamTranscriber is implemented by transcribers that accept audio while
+// it is being captured. Frames are sent on frames, which the caller closes
+// when the utterance ends; the returned channel yields partial results
+// followed by a final one, and is closed afterwards.
+type StreamTranscriber interface {
+	StreamTranscribe(ctx context.Context, frames <-chan []float32, sttSettings settings.STTSettings) (<-chan TranscriptResult, error)
+}
+
+// WebSocketStreamTranscriber streams audio to an STT service over a
+// websocket. It sends a JSON start message with the settings, then binary
+// little-endian float32 frames, then a JSON end message, and expects JSON
+// {"text": ..., "final": ...} results in return.
+type WebSocketStreamTranscriber struct {
+	URL string
+}
+
+// StreamTranscribe implements StreamTranscriber.
+func (t *WebSocketStreamTranscriber) StreamTranscribe(ctx context.Context, frames <-chan []float32, sttSettings settings.STTSettings) (<-chan TranscriptResult, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, t.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to streaming STT: %v", err)
+	}
+	start := map[string]interface{}{
+		"type":        "start",
+		"sample_rate": config.STTSampleRate,
+		"settings":    sttSettings,
+	}
+	if err := conn.WriteJSON(start); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start streaming STT: %v", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	go func() {
+		for frame := range frames {
+			data := make([]byte, len(frame)*4)
+			for i, f := range frame {
+				binary.LittleEndian.PutUint32(data[i*4:], math.Float32bits(f))
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+				return
+			}
+		}
+		conn.WriteJSON(map[string]string{"type": "end"})
+	}()
+
+	results := make(chan TranscriptResult, 16)
+	go func() {
+		defer close(results)
+		for {
+			var msg struct {
+				Text  string `json:"text"`
+				Final bool   `json:"final"`
+			}
+			if err := conn.ReadJSON(&msg); err != nil {
+				if ctx.Err() == nil {
+					results <- TranscriptResult{Err: fmt.Errorf("streaming STT failed: %v", err)}
+				}
+				return
+			}
+			results <- TranscriptResult{Text: msg.Text, Final: msg.Final}
+			if msg.Final {
+				return
+			}
+		}
+	}()
+	return results, nil
+}
+
+// BufferedStreamTranscriber adapts a batch Transcriber to the streaming
+// interface by collecting frames until the utterance ends. It produces a
+// single final result.
+type BufferedStreamTranscriber struct {
+	Transcriber Transcriber
+}
+
+// StreamTranscribe implements StreamTranscriber.
+func (t *BufferedStreamTranscriber) StreamTranscribe(ctx context.Context, frames <-chan []float32, sttSettings settings.STTSettings) (<-chan TranscriptResult, error) {
+	results := make(chan TranscriptResult, 1)
+	go func() {
+		defer close(results)
+		var samples []float32
+		for frame := range frames {
+			samples = append(samples, frame...)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		text, err := t.Transcriber.Transcribe(ctx, samples, sttSettings)
+		results <- TranscriptResult{Text: text, Final: true, Err: err}
+	}()
+	return results, nil
+}
+
+// utteranceStream is the streaming transcription of the utterance being
+// captured.
+type utteranceStream struct {
+	frames    chan []float32
+	results   <-chan TranscriptResult
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+// startUtteranceStream opens a stream on streamer for a new utterance.
+func startUtteranceStream(ctx context.Context, streamer StreamTranscriber, sttSettings settings.STTSettings) (*utteranceStream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	frames := make(chan []float32, 256)
+	results, err := streamer.StreamTranscribe(ctx, frames, sttSettings)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &utteranceStream{frames: frames, results: results, cancel: cancel}, nil
+}
+
+// Push sends frame to the transcriber without blocking the audio loop.
+func (s *utteranceStream) Push(frame []float32) {
+	select {
+	case s.frames <- frame:
+	default:
+		log.Println("streaming STT is falling behind, dropping frame")
+	}
+}
+
+func (s *utteranceStream) closeFrames() {
+	s.closeOnce.Do(func() { close(s.frames) })
+}
+
+// Finish ends the utterance and waits for the final transcript.
+func (s *utteranceStream) Finish() (string, error) {
+	s.closeFrames()
+	defer s.Abort()
+
+	timeout := clock.After(streamFinishTimeout)
+	var last string
+	for {
+		select {
+		case result, ok := <-s.results:
+			if !ok {
+				if last == "" {
+					return "", fmt.Errorf("stream ended without a transcript")
+				}
+				return last, nil
+			}
+			if result.Err != nil {
+				return "", result.Err
+			}
+			if result.Final {
+				return result.Text, nil
+			}
+			last = result.Text
+			log.Println("Partial transcription:", api.Redact(result.Text))
+		case <-timeout:
+			return "", fmt.Errorf("timed out waiting for final transcript")
+		}
+	}
+}
+
+// Abort cancels the stream and discards any pending results.
+func (s *utteranceStream) Abort() {
+	s.closeFrames()
+	s.cancel()
+	go func() {
+		for range s.results {
+		}
+	}()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"go-ast-client/settings"
+)
+
+// fakeStreamTranscriber is a StreamTranscriber reporting the number of
+// samples received so far as a partial result every few frames, and as the
+// final result once the frames end.
+type fakeStreamTranscriber struct {
+	// partialEvery is how many frames a partial result takes; zero sends
+	// none.
+	partialEvery int
+	// err, if set, is the final result.
+	err error
+	// noFinal ends the results without a final one.
+	noFinal bool
+
+	mu      sync.Mutex
+	samples int
+}
+
+func (f *fakeStreamTranscriber) StreamTranscribe(ctx context.Context, frames <-chan []float32, sttSettings settings.STTSettings) (<-chan TranscriptResult, error) {
+	results := make(chan TranscriptResult, 64)
+	go func() {
+		defer close(results)
+		n := 0
+		for frame := range frames {
+			n++
+			f.mu.Lock()
+			f.samples += len(frame)
+			samples := f.samples
+			f.mu.Unlock()
+			if f.partialEvery > 0 && n%f.partialEvery == 0 {
+				results <- TranscriptResult{Text: fmt.Sprint(samples)}
+			}
+		}
+		switch {
+		case f.err != nil:
+			results <- TranscriptResult{Err: f.err}
+		case !f.noFinal:
+			results <- TranscriptResult{Text: fmt.Sprintf("%d samples", f.Samples()), Final: true}
+		}
+	}()
+	return results, nil
+}
+
+// Samples returns the number of samples streamed.
+func (f *fakeStreamTranscriber) Samples() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.samples
+}
+
+// fakeTranscriber is a batch Transcriber reporting how many samples it got.
+type fakeTranscriber struct{}
+
+func (fakeTranscriber) Transcribe(ctx context.Context, samples []float32, sttSettings settings.STTSettings) (string, error) {
+	return fmt.Sprintf("%d samples", len(samples)), nil
+}
+
+func streamFrames(t *testing.T, streamer StreamTranscriber, n int) (string, error) {
+	t.Helper()
+	stream, err := startUtteranceStream(context.Background(), streamer, settings.STTSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		stream.Push(make([]float32, 320))
+	}
+	return stream.Finish()
+}
+
+func TestUtteranceStreamFinalResult(t *testing.T) {
+	streamer := &fakeStreamTranscriber{partialEvery: 2}
+	text, err := streamFrames(t, streamer, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "3200 samples" {
+		t.Errorf("transcript = %q, want the final result", text)
+	}
+}
+
+func TestUtteranceStreamWithoutFinalResult(t *testing.T) {
+	// The last partial result stands in for a missing final one
+	text, err := streamFrames(t, &fakeStreamTranscriber{partialEvery: 2, noFinal: true}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "1280" {
+		t.Errorf("transcript = %q, want the last partial result", text)
+	}
+
+	if _, err := streamFrames(t, &fakeStreamTranscriber{noFinal: true}, 5); err == nil {
+		t.Error("stream without any result gave no error")
+	}
+}
+
+func TestUtteranceStreamError(t *testing.T) {
+	failure := errors.New("recognizer crashed")
+	if _, err := streamFrames(t, &fakeStreamTranscriber{err: failure}, 3); !errors.Is(err, failure) {
+		t.Errorf("Finish() error = %v, want %v", err, failure)
+	}
+}
+
+// silentStreamer never returns a result.
+type silentStreamer struct{}
+
+func (silentStreamer) StreamTranscribe(ctx context.Context, frames <-chan []float32, sttSettings settings.STTSettings) (<-chan TranscriptResult, error) {
+	results := make(chan TranscriptResult)
+	go func() {
+		<-ctx.Done()
+		close(results)
+	}()
+	return results, nil
+}
+
+func TestUtteranceStreamFinishTimesOut(t *testing.T) {
+	fake := NewFakeClock(time.Unix(0, 0))
+	withClock(t, fake)
+	go func() {
+		fake.WaitForTimers(1)
+		fake.Advance(streamFinishTimeout)
+	}()
+	if _, err := streamFrames(t, silentStreamer{}, 1); err == nil {
+		t.Error("Finish() returned without a transcript or error")
+	}
+}
+
+func TestBufferedStreamTranscriber(t *testing.T) {
+	text, err := streamFrames(t, &BufferedStreamTranscriber{Transcriber: fakeTranscriber{}}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "1280 samples" {
+		t.Errorf("transcript = %q, want all frames transcribed at once", text)
+	}
+}
+
+func TestWebSocketStreamTranscriber(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var start map[string]interface{}
+		if err := conn.ReadJSON(&start); err != nil || start["type"] != "start" {
+			t.Errorf("start message = %v, %v", start, err)
+			return
+		}
+		samples := 0
+		for {
+			kind, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if kind == websocket.TextMessage {
+				break
+			}
+			samples += len(data) / 4
+			if samples == 320 && math.Float32frombits(binary.LittleEndian.Uint32(data)) != 0.5 {
+				t.Error("frame not sent as little-endian float32")
+			}
+			conn.WriteJSON(map[string]interface{}{"text": fmt.Sprint(samples)})
+		}
+		conn.WriteJSON(map[string]interface{}{"text": fmt.Sprintf("%d samples", samples), "final": true})
+	}))
+	defer srv.Close()
+
+	streamer := &WebSocketStreamTranscriber{URL: "ws" + strings.TrimPrefix(srv.URL, "http")}
+	stream, err := startUtteranceStream(context.Background(), streamer, settings.STTSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		stream.Push(constantSamples(320, 0.5))
+	}
+	text, err := stream.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "960 samples" {
+		t.Errorf("transcript = %q", text)
+	}
+}
+
+func TestStreamerFor(t *testing.T) {
+	// A transcriber that can stream is used as is
+	both := struct {
+		fakeTranscriber
+		*fakeStreamTranscriber
+	}{fakeTranscriber{}, &fakeStreamTranscriber{}}
+	if got := streamerFor(both); got != StreamTranscriber(both) {
+		t.Errorf("streamerFor() = %#v, want the transcriber itself", got)
+	}
+
+	if _, ok := streamerFor(fakeTranscriber{}).(*BufferedStreamTranscriber); !ok {
+		t.Error("batch transcriber not buffered")
+	}
+
+	withConfig(t, func(c *Config) { c.STTStreamURL = "ws://stt/stream" })
+	if got, ok := streamerFor(fakeTranscriber{}).(*WebSocketStreamTranscriber); !ok || got.URL != "ws://stt/stream" {
+		t.Errorf("streamerFor() = %#v, want the streaming endpoint", got)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go-ast-client/api"
+	"go-ast-client/settings"
+)
+
+func TestTranscriberForSegment(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.STTSegments = map[string]STTSegmentConfig{
+			"medical": {URL: "http://medical/stt", Model: "med-large", Numbers: []string{"100", "101"}},
+			"legal":   {URL: "http://legal/stt", Format: sttFormatWAV, Numbers: []string{"200"}},
+		}
+	})
+
+	tests := []struct {
+		name     string
+		settings api.AsteriskSettings
+		url      string
+		model    string
+	}{
+		{"segment by name", api.AsteriskSettings{AsteriskSegment: "legal"}, "http://legal/stt", ""},
+		{"segment by number", api.AsteriskSettings{AsteriskNumber: "101"}, "http://medical/stt", "med-large"},
+		{"name wins over number", api.AsteriskSettings{AsteriskSegment: "legal", AsteriskNumber: "100"}, "http://legal/stt", ""},
+		{"unknown name falls back to number", api.AsteriskSettings{AsteriskSegment: "retail", AsteriskNumber: "200"}, "http://legal/stt", ""},
+		{"unrouted number", api.AsteriskSettings{AsteriskNumber: "999"}, transcribeURL, ""},
+		{"no routing", api.AsteriskSettings{}, transcribeURL, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transcriber, ok := transcriberFor(tt.settings).(*HTTPTranscriber)
+			if !ok {
+				t.Fatalf("transcriber is %T", transcriberFor(tt.settings))
+			}
+			if transcriber.URL != tt.url || transcriber.Model != tt.model {
+				t.Errorf("got %s with model %q, want %s with model %q", transcriber.URL, transcriber.Model, tt.url, tt.model)
+			}
+		})
+	}
+
+	if got := transcriberFor(api.AsteriskSettings{AsteriskSegment: "legal"}).(*HTTPTranscriber).Format; got != sttFormatWAV {
+		t.Errorf("legal format = %q, want %q", got, sttFormatWAV)
+	}
+}
+
+func TestSegmentTranscriberUsesSegmentModel(t *testing.T) {
+	var model string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseMultipartForm(1 << 20)
+		var s settings.STTSettings
+		json.Unmarshal([]byte(r.FormValue("settings")), &s)
+		if s.Model != nil {
+			model = *s.Model
+		}
+		json.NewEncoder(w).Encode(map[string]string{"transcription": "ok"})
+	}))
+	defer srv.Close()
+	withConfig(t, func(c *Config) {
+		c.STTSegments = map[string]STTSegmentConfig{"medical": {URL: srv.URL, Model: "med-large"}}
+	})
+
+	transcriber := transcriberFor(api.AsteriskSettings{AsteriskSegment: "medical"})
+	got, err := transcriber.Transcribe(context.Background(), make([]float32, 160), settings.STTSettings{Model: ptr("general")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "ok" {
+		t.Errorf("transcription = %q", got)
+	}
+	if model != "med-large" {
+		t.Errorf("segment service asked for model %q, want med-large", model)
+	}
+}
+
+func TestValidateSTTSegments(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments map[string]STTSegmentConfig
+		valid    bool
+	}{
+		{"valid", map[string]STTSegmentConfig{"a": {URL: "http://a/stt", Numbers: []string{"1"}}, "b": {URL: "http://b/stt", Numbers: []string{"2"}}}, true},
+		{"bad url", map[string]STTSegmentConfig{"a": {URL: "not a url"}}, false},
+		{"bad format", map[string]STTSegmentConfig{"a": {URL: "http://a/stt", Format: "ogg"}}, false},
+		{"number in two segments", map[string]STTSegmentConfig{"a": {URL: "http://a/stt", Numbers: []string{"1"}}, "b": {URL: "http://b/stt", Numbers: []string{"1"}}}, false},
+		{"bad response key", map[string]STTSegmentConfig{"a": {URL: "http://a/stt", ResponseKey: "result..text"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSTTSegments(tt.segments); (err == nil) != tt.valid {
+				t.Errorf("validateSTTSegments() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestTranscriberUsesInjectedClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"transcription": "ok"})
+	}))
+	defer srv.Close()
+	withConfig(t, func(c *Config) {
+		c.STTSegments = map[string]STTSegmentConfig{"medical": {URL: srv.URL}}
+	})
+	transport := &recordingTransport{}
+	client := &http.Client{Transport: transport}
+
+	for _, format := range []string{sttFormatMultipart, sttFormatProtobuf} {
+		transcriber := transcriberFor(api.AsteriskSettings{AsteriskSegment: "medical"}).(*HTTPTranscriber)
+		transcriber.Format = format
+		transcriber.HTTPClient = client
+		transcriber.Transcribe(context.Background(), make([]float32, 160), settings.STTSettings{})
+	}
+	if n := len(transport.Paths()); n != 2 {
+		t.Errorf("%d uploads through the injected client, want one per format", n)
+	}
+}
+
+func TestTranscribeCanceledMidFlight(t *testing.T) {
+	started, aborted := make(chan struct{}), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client going away once the body is read
+		io.Copy(io.Discard, r.Body)
+		close(started)
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer srv.Close()
+
+	ctx, hangup := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		transcriber := &HTTPTranscriber{URL: srv.URL, Form: config.STTForm}
+		_, err := transcriber.Transcribe(ctx, make([]float32, 160), settings.STTSettings{})
+		errs <- err
+	}()
+	<-started
+	hangup()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Transcribe() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload kept running after the call was canceled")
+	}
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Error("STT request not aborted")
+	}
+}
+
+// upload is a multipart STT request as the service received it.
+type upload struct {
+	query url.Values
+	// parts maps the name of each part to its file name, content type
+	// and content.
+	parts map[string]uploadPart
+}
+
+type uploadPart struct {
+	fileName, contentType string
+	data                  []byte
+}
+
+// transcribeUpload sends samples with transcriber and returns the request
+// the service received.
+func transcribeUpload(t *testing.T, transcriber *HTTPTranscriber, samples []float32) upload {
+	t.Helper()
+	uploads := make(chan upload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := upload{query: r.URL.Query(), parts: map[string]uploadPart{}}
+		reader, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+			data, _ := io.ReadAll(part)
+			u.parts[part.FormName()] = uploadPart{part.FileName(), part.Header.Get("Content-Type"), data}
+		}
+		uploads <- u
+		json.NewEncoder(w).Encode(map[string]string{"transcription": "ok"})
+	}))
+	defer srv.Close()
+
+	transcriber.URL = srv.URL
+	if _, err := transcriber.Transcribe(context.Background(), samples, settings.STTSettings{Language: ptr("en")}); err != nil {
+		t.Fatal(err)
+	}
+	return <-uploads
+}
+
+func TestTranscribeWAV(t *testing.T) {
+	samples := []float32{0, 0.5, -0.5, 1}
+	u := transcribeUpload(t, &HTTPTranscriber{Format: sttFormatWAV, Form: config.STTForm, ResponseKey: config.STTResponseKey}, samples)
+	audio := u.parts["audio"]
+	if audio.fileName != "audio.wav" || audio.contentType != "audio/wav" {
+		t.Errorf("audio part is %q of type %q, want audio.wav of type audio/wav", audio.fileName, audio.contentType)
+	}
+
+	wav := audio.data
+	if len(wav) != wavHeaderSize+2*len(samples) {
+		t.Fatalf("uploaded %d bytes, want a header and %d samples", len(wav), len(samples))
+	}
+	le := binary.LittleEndian
+	if string(wav[0:4]) != "RIFF" || le.Uint32(wav[4:]) != uint32(len(wav)-8) || string(wav[8:16]) != "WAVEfmt " {
+		t.Errorf("RIFF header = % x", wav[:16])
+	}
+	if le.Uint16(wav[20:]) != 1 || le.Uint16(wav[22:]) != 1 || le.Uint16(wav[34:]) != 16 {
+		t.Errorf("format %d, %d channels, %d bits; want 16-bit mono PCM", le.Uint16(wav[20:]), le.Uint16(wav[22:]), le.Uint16(wav[34:]))
+	}
+	rate := uint32(config.STTSampleRate)
+	if le.Uint32(wav[24:]) != rate || le.Uint32(wav[28:]) != 2*rate || le.Uint16(wav[32:]) != 2 {
+		t.Errorf("rate %d, byte rate %d, block align %d; want %d Hz mono 16-bit", le.Uint32(wav[24:]), le.Uint32(wav[28:]), le.Uint16(wav[32:]), rate)
+	}
+	if string(wav[36:40]) != "data" || le.Uint32(wav[40:]) != uint32(2*len(samples)) {
+		t.Errorf("data chunk header = % x", wav[36:44])
+	}
+	if !bytes.Equal(wav[wavHeaderSize:], float32ArrayToPCM(samples)) {
+		t.Errorf("samples = % x, want % x", wav[wavHeaderSize:], float32ArrayToPCM(samples))
+	}
+}
+
+func TestTranscribeRawFloat32(t *testing.T) {
+	samples := []float32{0, 0.5, -0.5, 1}
+	u := transcribeUpload(t, &HTTPTranscriber{Format: sttFormatMultipart, Form: config.STTForm, ResponseKey: config.STTResponseKey}, samples)
+	audio := u.parts["audio"]
+	if audio.fileName != "audio.raw" || audio.contentType != "application/octet-stream" {
+		t.Errorf("audio part is %q of type %q, want audio.raw of type application/octet-stream", audio.fileName, audio.contentType)
+	}
+	want := make([]byte, 4*len(samples))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint32(want[4*i:], math.Float32bits(s))
+	}
+	if !bytes.Equal(audio.data, want) {
+		t.Errorf("samples = % x, want little-endian float32 % x", audio.data, want)
+	}
+}
+
+func TestTranscribeFormFields(t *testing.T) {
+	form := STTFormConfig{AudioField: "file", FileName: "speech.bin", ContentType: "audio/x-float32", SettingsField: "options"}
+	u := transcribeUpload(t, &HTTPTranscriber{Form: form, ResponseKey: config.STTResponseKey}, make([]float32, 4))
+	if len(u.parts) != 2 {
+		t.Errorf("parts = %v, want the audio and the settings", u.parts)
+	}
+	audio, ok := u.parts["file"]
+	if !ok {
+		t.Fatalf("no audio in the %q field", "file")
+	}
+	if audio.fileName != "speech.bin" || audio.contentType != "audio/x-float32" || len(audio.data) != 16 {
+		t.Errorf("audio part is %q of type %q with %d bytes", audio.fileName, audio.contentType, len(audio.data))
+	}
+	if got := string(u.parts["options"].data); got != `{"language":"en"}` {
+		t.Errorf("settings field = %q", got)
+	}
+}
+
+func TestTranscribeSettingsInQuery(t *testing.T) {
+	form := STTFormConfig{AudioField: "audio", SettingsInQuery: true}
+	u := transcribeUpload(t, &HTTPTranscriber{Form: form, ResponseKey: config.STTResponseKey}, make([]float32, 4))
+	if _, ok := u.parts["settings"]; ok || len(u.parts) != 1 {
+		t.Errorf("parts = %v, want only the audio", u.parts)
+	}
+	if got := u.query.Get("language"); got != "en" {
+		t.Errorf("language query parameter = %q, want en", got)
+	}
+}
+
+func TestTranscribeResponseKeys(t *testing.T) {
+	tests := []struct {
+		name, body, key string
+		want, wantErr   string
+	}{
+		{"default", `{"transcription":"hello"}`, "transcription", "hello", ""},
+		{"flat text", `{"text":"hello","language":"en"}`, "text", "hello", ""},
+		{"flat result", `{"result":"hello"}`, "result", "hello", ""},
+		{"nested object", `{"data":{"text":"hello"}}`, "data.text", "hello", ""},
+		{"nested array", `{"results":[{"alternatives":[{"transcript":"hello"}]}]}`, "results.0.alternatives.0.transcript", "hello", ""},
+		{"missing key", `{"text":"hello","language":"en"}`, "transcription", "", `"transcription" not found in response, available keys: language, text`},
+		{"missing nested key", `{"data":{"words":[]}}`, "data.text", "", `"text" not found in response at "data", available keys: words`},
+		{"index out of range", `{"results":[]}`, "results.0.text", "", `"0" is no index into the 0 elements`},
+		{"not a string", `{"text":{"value":"hello"}}`, "text", "", `transcription at "text" is no string`},
+		{"emotion", `{"transcription":"hello","emotion":"happy"}`, "transcription", "[**Emotion:** happy]\nhello", ""},
+		{"empty emotion", `{"transcription":"hello","emotion":""}`, "transcription", "hello", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			transcriber := &HTTPTranscriber{URL: srv.URL, Form: config.STTForm, ResponseKey: tt.key}
+			got, err := transcriber.Transcribe(context.Background(), make([]float32, 160), settings.STTSettings{})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Transcribe() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Transcribe() = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
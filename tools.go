@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-ast-client/api"
+	"time"
+)
+
+// ToolsConfig configures the tools the LLM may call.
+type ToolsConfig struct {
+	// Enabled lists the built-in tools offered to the LLM, see
+	// builtinTools.
+	Enabled []string `json:"enabled"`
+	// MaxCalls bounds the rounds of tool calls per utterance.
+	MaxCalls int `json:"max_calls"`
+}
+
+// builtinTools are the tools that can be enabled in the config.
+var builtinTools = map[string]api.Tool{
+	"current_time": {
+		Name:        "current_time",
+		Description: "Returns the current date and time.",
+		Parameters:  map[string]interface{}{"type": "object", "properties": map[string]interface{}{}},
+		Handler: func(context.Context, map[string]interface{}) (string, error) {
+			return clock.Now().Format(time.RFC1123), nil
+		},
+	},
+	"transfer_call": transferTool,
+}
+
+// tools holds the tools offered to the LLM, set up in main. More can be
+// registered by embedding code before calls are served.
+var tools = api.NewToolRegistry()
+
+// registerTools registers the built-in tools enabled in cfg.
+func registerTools(cfg ToolsConfig) {
+	for _, name := range cfg.Enabled {
+		tools.Register(builtinTools[name])
+	}
+}
+
+// validateTools checks that every enabled tool exists.
+func validateTools(cfg ToolsConfig) error {
+	for _, name := range cfg.Enabled {
+		if _, ok := builtinTools[name]; !ok {
+			return fmt.Errorf("unknown tool %q", name)
+		}
+	}
+	if cfg.MaxCalls < 0 {
+		return fmt.Errorf("tools.max_calls must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Span batching for the OTLP exporter.
+const (
+	traceQueueSize     = 1024
+	traceBatchSize     = 100
+	traceFlushInterval = 2 * time.Second
+)
+
+// TracingConfig configures tracing of calls through the STT, LLM and TTS
+// backends.
+type TracingConfig struct {
+	// OTLPEndpoint is the OTLP/HTTP traces URL spans are exported to, e.g.
+	// "http://collector:4318/v1/traces". Empty disables tracing.
+	OTLPEndpoint string `json:"otlp_endpoint"`
+	// ServiceName identifies the bridge in traces.
+	ServiceName string `json:"service_name"`
+}
+
+// Span is a timed operation within a call's trace.
+type Span struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	ParentID   [8]byte
+	Name       string
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes map[string]string
+
+	mu       sync.Mutex
+	exporter SpanExporter
+	ended    bool
+}
+
+// SpanExporter receives spans once they have ended.
+type SpanExporter interface {
+	ExportSpan(span *Span)
+}
+
+// spanExporter receives the spans of all calls. While it is nil tracing is
+// disabled and spans are never created.
+var spanExporter SpanExporter
+
+type spanKey struct{}
+
+// startSpan starts a span named name, a child of the span in ctx if there
+// is one. It returns a context carrying the new span. With tracing
+// disabled it returns ctx and a nil span, which is safe to use.
+func startSpan(ctx context.Context, name string) (context.Context, *Span) {
+	exporter := spanExporter
+	if exporter == nil {
+		return ctx, nil
+	}
+	span := &Span{Name: name, StartTime: clock.Now(), exporter: exporter}
+	if parent := spanFromContext(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		rand.Read(span.TraceID[:])
+	}
+	rand.Read(span.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// spanFromContext returns the span carried by ctx, or nil.
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// withSpanOf returns ctx carrying the span of from, so work detached from
+// from's cancellation still joins its trace.
+func withSpanOf(ctx, from context.Context) context.Context {
+	if span := spanFromContext(from); span != nil {
+		return context.WithValue(ctx, spanKey{}, span)
+	}
+	return ctx
+}
+
+// SetAttribute records a key/value pair on the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+// End ends the span and hands it to the exporter. Later calls do nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = clock.Now()
+	s.mu.Unlock()
+	s.exporter.ExportSpan(s)
+}
+
+// traceparent formats the W3C Trace Context header for s.
+func (s *Span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.TraceID[:]), hex.EncodeToString(s.SpanID[:]))
+}
+
+// traceHeader returns the headers that let a backend join the trace of
+// ctx, or nil if it has none.
+func traceHeader(ctx context.Context) http.Header {
+	span := spanFromContext(ctx)
+	if span == nil {
+		return nil
+	}
+	return http.Header{"Traceparent": []string{span.traceparent()}}
+}
+
+// traceTransport propagates the trace of each request's context to the
+// backend it is sent to.
+type traceTransport struct {
+	Base http.RoundTripper
+}
+
+func (t traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if span := spanFromContext(req.Context()); span != nil {
+		req = req.Clone(req.Context())
+		req.Header.Set("Traceparent", span.traceparent())
+	}
+	return t.Base.RoundTrip(req)
+}
+
+// OTLPExporter sends spans in batches to an OTLP/HTTP collector, encoded
+// as JSON. Spans are dropped if the collector can't keep up.
+type OTLPExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+	queue    chan *Span
+	wg       sync.WaitGroup
+}
+
+// NewOTLPExporter starts exporting spans to cfg.OTLPEndpoint.
+func NewOTLPExporter(cfg TracingConfig, client *http.Client) *OTLPExporter {
+	e := &OTLPExporter{
+		endpoint: cfg.OTLPEndpoint,
+		service:  cfg.ServiceName,
+		client:   client,
+		queue:    make(chan *Span, traceQueueSize),
+	}
+	e.wg.Add(1)
+	go e.run()
+	return e
+}
+
+// ExportSpan implements SpanExporter.
+func (e *OTLPExporter) ExportSpan(span *Span) {
+	select {
+	case e.queue <- span:
+	default:
+		log.Printf("trace queue is full, dropping span %s", span.Name)
+	}
+}
+
+// Close exports the queued spans and stops the exporter.
+func (e *OTLPExporter) Close() {
+	close(e.queue)
+	e.wg.Wait()
+}
+
+func (e *OTLPExporter) run() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case span, ok := <-e.queue:
+			if !ok {
+				e.export(batch)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		e.export(batch)
+		batch = nil
+	}
+}
+
+// export posts batch to the collector.
+func (e *OTLPExporter) export(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(otlpRequest(e.service, batch))
+	if err != nil {
+		log.Println("failed to encode spans:", err)
+		return
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println("failed to export spans:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Printf("failed to export spans: received status code %d", resp.StatusCode)
+	}
+}
+
+// otlpRequest builds the OTLP/JSON ExportTraceServiceRequest for spans.
+func otlpRequest(service string, spans []*Span) map[string]interface{} {
+	encoded := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		attrs := make([]map[string]interface{}, 0, len(s.Attributes))
+		for k, v := range s.Attributes {
+			attrs = append(attrs, otlpAttribute(k, v))
+		}
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.TraceID[:]),
+			"spanId":            hex.EncodeToString(s.SpanID[:]),
+			"name":              s.Name,
+			"kind":              1, // SPAN_KIND_INTERNAL
+			"startTimeUnixNano": strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			"attributes":        attrs,
+		}
+		if s.ParentID != ([8]byte{}) {
+			span["parentSpanId"] = hex.EncodeToString(s.ParentID[:])
+		}
+		s.mu.Unlock()
+		encoded = append(encoded, span)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{otlpAttribute("service.name", service)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "go-ast-client"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func otlpAttribute(key, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"key":   key,
+		"value": map[string]interface{}{"stringValue": value},
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CyCoreSystems/audiosocket"
+)
+
+// spanRecorder is a SpanExporter keeping the spans in memory.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (r *spanRecorder) ExportSpan(span *Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+// Named returns the ended spans named name.
+func (r *spanRecorder) Named(name string) []*Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var spans []*Span
+	for _, span := range r.spans {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// withSpanRecorder enables tracing into a spanRecorder for the test.
+func withSpanRecorder(t *testing.T) *spanRecorder {
+	t.Helper()
+	rec := &spanRecorder{}
+	saved := spanExporter
+	spanExporter = rec
+	t.Cleanup(func() { spanExporter = saved })
+	return rec
+}
+
+func TestUtteranceSpanHierarchy(t *testing.T) {
+	rec := withSpanRecorder(t)
+	withConfig(t, func(c *Config) {
+		c.VAD.Backend = vadEnergy
+		c.Webhook.StateEvents = true
+	})
+	events := withWebhookQueue(t)
+	newSTTServer(t, "hello")
+	withTTS(t, newTTSServer(t, make([]byte, 640), 320))
+	s := testSettings(0.7)
+	s.AsteriskSettings.AsteriskSegment = "test"
+	id, _ := newTestCallChat(t, s)
+
+	script := []audiosocket.Message{audiosocket.IDMessage(id)}
+	script = append(script, voicedFrames(25)...)
+	script = append(script, levelFrames(10, 0)...)
+	stream := newTestStream(script...)
+	stream.hold = true
+	stream.more = make(chan audiosocket.Message)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(context.Background(), stream)
+	}()
+	defer func() {
+		stream.Close()
+		<-done
+	}()
+	waitForState(t, events, stateSpeaking)
+	waitForState(t, events, stateListening)
+	stream.more <- audiosocket.HangupMessage()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("call did not end on hangup")
+	}
+
+	one := func(name string) *Span {
+		t.Helper()
+		spans := rec.Named(name)
+		if len(spans) != 1 {
+			t.Fatalf("%d %s spans, want 1", len(spans), name)
+		}
+		return spans[0]
+	}
+	call := one("call")
+	utterance := one("utterance")
+	if call.ParentID != ([8]byte{}) {
+		t.Error("call span has a parent")
+	}
+	if utterance.ParentID != call.SpanID {
+		t.Error("utterance span is not a child of the call span")
+	}
+	for _, name := range []string{"transcription", "llm", "synthesis"} {
+		span := one(name)
+		if span.ParentID != utterance.SpanID {
+			t.Errorf("%s span is not a child of the utterance span", name)
+		}
+		if span.TraceID != call.TraceID {
+			t.Errorf("%s span is in another trace", name)
+		}
+		if span.EndTime.Before(span.StartTime) {
+			t.Errorf("%s span ends before it starts", name)
+		}
+	}
+}
+
+func TestTraceTransportPropagates(t *testing.T) {
+	withSpanRecorder(t)
+	headers := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("Traceparent")
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: traceTransport{Base: http.DefaultTransport}}
+
+	ctx, span := startSpan(context.Background(), "call")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	header := <-headers
+	if header != span.traceparent() || !strings.HasPrefix(header, "00-") {
+		t.Errorf("Traceparent = %q, want %q", header, span.traceparent())
+	}
+	if req.Header.Get("Traceparent") != "" {
+		t.Error("caller's request modified")
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	saved := spanExporter
+	spanExporter = nil
+	t.Cleanup(func() { spanExporter = saved })
+
+	ctx, span := startSpan(context.Background(), "call")
+	if span != nil || spanFromContext(ctx) != nil || traceHeader(ctx) != nil {
+		t.Error("span created with tracing disabled")
+	}
+	// A nil span is safe to use
+	span.SetAttribute("key", "value")
+	span.End()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-ast-client/api"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// transferTimeout bounds the AMI requests of a transfer.
+const transferTimeout = 10 * time.Second
+
+// transferEndpointVar is the channel variable carrying the endpoint a
+// call is transferred to.
+const transferEndpointVar = "TRANSFER_ENDPOINT"
+
+// TransferConfig configures handing calls over to a human. A transfer is
+// requested by the LLM, through the transfer_call tool or a marker in its
+// reply; the reply is spoken first, then the channel is redirected through
+// AMI to Context and Extension with the target's endpoint in
+// TRANSFER_ENDPOINT, for the dialplan to dial, e.g.:
+//
+//	[audiosocket-transfer]
+//	exten = s,1,Dial(${TRANSFER_ENDPOINT})
+//	 same = n,Hangup()
+//
+// This needs the Asterisk channel's ID: originated calls have it, inbound
+// calls must send it as channel_id in their metadata.
+type TransferConfig struct {
+	// Targets maps the names the LLM may transfer to onto endpoints,
+	// e.g. {"sales": "PJSIP/200"}.
+	Targets map[string]string `json:"targets"`
+	// Default is the target used when the LLM names none.
+	Default string `json:"default"`
+	// Marker, if set, requests a transfer when a reply contains it in
+	// brackets, optionally naming the target: with "TRANSFER", "[TRANSFER]"
+	// or "[TRANSFER:sales]". The marker is removed before the reply is
+	// spoken.
+	Marker string `json:"marker"`
+	// Context and Extension locate the dialplan transferred calls
+	// continue in.
+	Context   string `json:"context"`
+	Extension string `json:"extension"`
+}
+
+// validate checks that the targets can be resolved.
+func (t TransferConfig) validate() error {
+	for name, endpoint := range t.Targets {
+		if endpoint == "" {
+			return fmt.Errorf("transfer target %q has no endpoint", name)
+		}
+	}
+	if _, ok := t.Targets[t.Default]; t.Default != "" && !ok {
+		return fmt.Errorf("transfer.default %q is not a target", t.Default)
+	}
+	if len(t.Targets) > 0 && (t.Context == "" || t.Extension == "") {
+		return fmt.Errorf("transfer.context and transfer.extension are required with transfer targets")
+	}
+	return nil
+}
+
+// transferEndpoint resolves a target named by the LLM to its endpoint,
+// using the default target if name is empty.
+func transferEndpoint(name string) (string, error) {
+	if name == "" {
+		name = config.Transfer.Default
+	}
+	if name == "" {
+		return "", fmt.Errorf("no transfer target named and no default configured")
+	}
+	endpoint, ok := config.Transfer.Targets[name]
+	if !ok {
+		return "", fmt.Errorf("unknown transfer target %q", name)
+	}
+	return endpoint, nil
+}
+
+// transferMarker matches the configured marker in a reply, see
+// TransferConfig.Marker. It is nil if no marker is configured.
+func transferMarker() *regexp.Regexp {
+	if config.Transfer.Marker == "" {
+		return nil
+	}
+	return regexp.MustCompile(`\[` + regexp.QuoteMeta(config.Transfer.Marker) + `(?::([^\]]*))?\]`)
+}
+
+// extractTransfer removes the transfer marker from reply and returns the
+// target it names; found reports whether there was one.
+func extractTransfer(reply string) (text, target string, found bool) {
+	marker := transferMarker()
+	if marker == nil {
+		return reply, "", false
+	}
+	match := marker.FindStringSubmatch(reply)
+	if match == nil {
+		return reply, "", false
+	}
+	return strings.TrimSpace(marker.ReplaceAllString(reply, "")), match[1], true
+}
+
+// transferTool lets the LLM request a transfer. It runs during SendMessage,
+// so the call comes from the turn's context.
+var transferTool = api.Tool{
+	Name:        "transfer_call",
+	Description: "Transfers the caller to a human after your reply. Only use it when the caller asks for a person or you can't help them.",
+	Parameters: map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"target": map[string]interface{}{
+				"type":        "string",
+				"description": "Who to transfer to; leave empty for the default.",
+			},
+		},
+	},
+	Handler: func(ctx context.Context, args map[string]interface{}) (string, error) {
+		call := callFrom(ctx)
+		if call == nil {
+			return "", fmt.Errorf("no call to transfer")
+		}
+		target, _ := args["target"].(string)
+		endpoint, err := transferEndpoint(target)
+		if err != nil {
+			return "", err
+		}
+		call.requestTransfer(endpoint)
+		return "The caller will be transferred once your reply has been spoken.", nil
+	},
+}
+
+// OnTransfer hands the channel of a call over to endpoint. It defaults to
+// redirecting the channel through AMI, see TransferConfig; embedding code
+// may replace it, e.g. to bridge channels through ARI in a Stasis setup.
+var OnTransfer = func(callID, endpoint string) error {
+	call := calls.Get(callID)
+	if call == nil {
+		return fmt.Errorf("call %s is not active", callID)
+	}
+	channel := call.ChannelID()
+	if channel == "" {
+		return fmt.Errorf("the Asterisk channel of call %s is unknown, send it as channel_id in the call metadata", callID)
+	}
+	client, err := amiClientFor(call.ChatStore.Settings().AsteriskSettings)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), transferTimeout)
+	defer cancel()
+	return client.Redirect(ctx, channel, config.Transfer.Context, config.Transfer.Extension, map[string]string{transferEndpointVar: endpoint})
+}
+
+// transferCall speaks reply and transfers the call to endpoint, ending its
+// AudioSocket leg. If the transfer fails the call goes on.
+func transferCall(call *Call, reply, endpoint string) {
+	if reply != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), closingMessageTimeout)
+		w := playbackWriter(ctx, &AudioWriter{stream: call.Stream, frameSize: call.frameBytes(), onFirst: call.startSpeaking, onWrite: call.played})
+		if err := playTTS(ctx, websocketURI, call.ID, call.ttsPayload(reply), w); err != nil {
+			log.Println("failed to play reply before transfer:", err)
+		}
+		cancel()
+	}
+	call.stopFiller()
+	if err := OnTransfer(call.ID, endpoint); err != nil {
+		log.Printf("call %s: failed to transfer to %s: %v", call.ID, endpoint, err)
+		return
+	}
+	log.Printf("call %s: transferred to %s", call.ID, endpoint)
+	webhooks.Emit(eventCallTransferred, call.ID, map[string]interface{}{"endpoint": endpoint})
+	call.Hangup()
+}
+
+// callKey is the context key of the call a turn belongs to.
+type callKey struct{}
+
+// withCall returns ctx carrying call, for tools acting on it.
+func withCall(ctx context.Context, call *Call) context.Context {
+	return context.WithValue(ctx, callKey{}, call)
+}
+
+// callFrom returns the call carried by ctx, or nil.
+func callFrom(ctx context.Context) *Call {
+	call, _ := ctx.Value(callKey{}).(*Call)
+	return call
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CyCoreSystems/audiosocket"
+
+	"go-ast-client/api"
+)
+
+// withTransferTargets configures a sales and a support target, sales being
+// the default, requested with the TRANSFER marker.
+func withTransferTargets(t *testing.T) {
+	t.Helper()
+	withConfig(t, func(c *Config) {
+		c.Transfer = TransferConfig{
+			Targets:   map[string]string{"sales": "PJSIP/200", "support": "PJSIP/300"},
+			Default:   "sales",
+			Marker:    "TRANSFER",
+			Context:   "audiosocket-transfer",
+			Extension: "s",
+		}
+	})
+}
+
+func TestExtractTransfer(t *testing.T) {
+	withTransferTargets(t)
+	tests := []struct {
+		reply, text, target string
+		found               bool
+	}{
+		{"Connecting you now. [TRANSFER]", "Connecting you now.", "", true},
+		{"One moment. [TRANSFER:support]", "One moment.", "support", true},
+		{"Happy to help.", "Happy to help.", "", false},
+		{"Say TRANSFER to be transferred.", "Say TRANSFER to be transferred.", "", false},
+	}
+	for _, tt := range tests {
+		text, target, found := extractTransfer(tt.reply)
+		if text != tt.text || target != tt.target || found != tt.found {
+			t.Errorf("extractTransfer(%q) = %q, %q, %v; want %q, %q, %v", tt.reply, text, target, found, tt.text, tt.target, tt.found)
+		}
+	}
+
+	withConfig(t, func(c *Config) { c.Transfer.Marker = "" })
+	if _, _, found := extractTransfer("[TRANSFER]"); found {
+		t.Error("transfer found without a marker configured")
+	}
+}
+
+func TestTransferEndpoint(t *testing.T) {
+	withTransferTargets(t)
+	if endpoint, err := transferEndpoint("support"); err != nil || endpoint != "PJSIP/300" {
+		t.Errorf("transferEndpoint(support) = %q, %v; want PJSIP/300", endpoint, err)
+	}
+	if endpoint, err := transferEndpoint(""); err != nil || endpoint != "PJSIP/200" {
+		t.Errorf("transferEndpoint() = %q, %v; want the default", endpoint, err)
+	}
+	if _, err := transferEndpoint("billing"); err == nil {
+		t.Error("unknown target resolved")
+	}
+	withConfig(t, func(c *Config) { c.Transfer.Default = "" })
+	if _, err := transferEndpoint(""); err == nil {
+		t.Error("no target resolved without a default")
+	}
+}
+
+func TestTransferToolRequestsTransfer(t *testing.T) {
+	withTransferTargets(t)
+	call := NewCall("call", NewScriptedStream(), func() {})
+	result, err := transferTool.Handler(withCall(context.Background(), call), map[string]interface{}{"target": "support"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == "" {
+		t.Error("tool gave the LLM no result")
+	}
+	if endpoint := call.takeTransfer(); endpoint != "PJSIP/300" {
+		t.Errorf("requested transfer to %q, want PJSIP/300", endpoint)
+	}
+	if _, err := transferTool.Handler(context.Background(), nil); err == nil {
+		t.Error("transfer requested outside a call")
+	}
+}
+
+// transferTurn runs a turn on a registered call on channel whose LLM
+// replies with reply, and returns the call's stream.
+func transferTurn(t *testing.T, channel, reply string) *ScriptedStream {
+	t.Helper()
+	withTTS(t, newTTSServer(t, bytes.Repeat([]byte{0x22}, 640), 320))
+	ollama := &fakeOllama{reply: func(ctx context.Context, request api.OllamaChatRequest) (api.OllamaChatResponse, error) {
+		return api.OllamaChatResponse{Message: api.OllamaResponseMessage{Role: "assistant", Content: reply}, Done: true}, nil
+	}}
+	_, store := newTestChat(t, "call", testSettings(0.7), ollama)
+	stream := NewScriptedStream()
+	call := NewCall("call", stream, func() {})
+	call.ChatStore = store
+	call.setChannelID(channel)
+	calls.Register(call)
+	t.Cleanup(func() { calls.Unregister(call) })
+
+	handleTranscription(context.Background(), call, "can I talk to someone?")
+	return stream
+}
+
+func TestTransferRedirectsThroughAMI(t *testing.T) {
+	withTransferTargets(t)
+	ami := newFakeAMI(t)
+	events := withWebhookQueue(t)
+
+	stream := transferTurn(t, "1700000000.42", "Let me put you through. [TRANSFER:support]")
+
+	actions := waitForActions(t, ami, 4)
+	if got := actionNames(actions); got != "Login Setvar Redirect Logoff" {
+		t.Fatalf("AMI actions = %s, want the endpoint set and the channel redirected", got)
+	}
+	if setvar := actions[1]; setvar["Channel"] != "1700000000.42" || setvar["Variable"] != transferEndpointVar || setvar["Value"] != "PJSIP/300" {
+		t.Errorf("setvar = %v, want the support endpoint set on the channel", setvar)
+	}
+	if redirect := actions[2]; redirect["Channel"] != "1700000000.42" || redirect["Context"] != "audiosocket-transfer" || redirect["Exten"] != "s" {
+		t.Errorf("redirect = %v, want the channel sent to the transfer context", redirect)
+	}
+	if len(stream.Written()) == 0 {
+		t.Error("reply not spoken before the transfer")
+	}
+	if !stream.HungUp() {
+		t.Error("AudioSocket leg not ended after the transfer")
+	}
+	for event := range events {
+		if event.Type == eventCallTransferred {
+			if event.Data["endpoint"] != "PJSIP/300" {
+				t.Errorf("transfer event endpoint = %v, want PJSIP/300", event.Data["endpoint"])
+			}
+			break
+		}
+	}
+}
+
+func TestTransferFailureKeepsCall(t *testing.T) {
+	withTransferTargets(t)
+	ami := newFakeAMI(t)
+	ami.Fail("Redirect", true)
+
+	stream := transferTurn(t, "1700000000.42", "Let me put you through. [TRANSFER]")
+
+	if actions := waitForActions(t, ami, 3); actions[1]["Value"] != "PJSIP/200" {
+		t.Errorf("AMI actions = %v, want a transfer to the default", actions)
+	}
+	if stream.HungUp() {
+		t.Error("call hung up although the transfer failed")
+	}
+}
+
+func TestTransferRefusedWithoutChannelID(t *testing.T) {
+	withTransferTargets(t)
+	ami := newFakeAMI(t)
+
+	// An inbound call whose dialplan sent no channel_id
+	stream := transferTurn(t, "", "Let me put you through. [TRANSFER]")
+
+	if actions := ami.Actions(); len(actions) != 0 {
+		t.Errorf("AMI actions = %s, want none without a channel ID", actionNames(actions))
+	}
+	if stream.HungUp() {
+		t.Error("call hung up although the transfer was refused")
+	}
+}
+
+func TestOriginatedCallHasChannelID(t *testing.T) {
+	id, _ := newTestCallChat(t, testSettings(0.7))
+	originated.Put(id.String(), testSettings(0.7), time.Minute)
+	stream := newTestStream(audiosocket.IDMessage(id))
+	stream.hold = true
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(context.Background(), stream)
+	}()
+	defer func() {
+		stream.Close()
+		<-done
+	}()
+
+	call := waitForCall(t, id.String(), stream)
+	deadline := time.Now().Add(5 * time.Second)
+	for call.ChannelID() != id.String() {
+		if time.Now().After(deadline) {
+			t.Fatalf("channel ID = %q, want the ID Originate gave the channel", call.ChannelID())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	_, store := newTestChat(t, "inbound", testSettings(0.7), &fakeOllama{})
+	inbound := NewCall("inbound", NewScriptedStream(), func() {})
+	inbound.SetChatStore(store)
+	if inbound.ChannelID() != "" {
+		t.Errorf("inbound channel ID = %q, want it unknown until reported", inbound.ChannelID())
+	}
+	inbound.applyMetadata([]byte(`{"channel_id":"1700000000.42"}`))
+	if inbound.ChannelID() != "1700000000.42" {
+		t.Errorf("channel ID = %q, want the one from the metadata", inbound.ChannelID())
+	}
+}
+
+func TestOnTransferOverride(t *testing.T) {
+	withTransferTargets(t)
+	saved := OnTransfer
+	t.Cleanup(func() { OnTransfer = saved })
+	var transferred []string
+	OnTransfer = func(callID, endpoint string) error {
+		transferred = append(transferred, callID+" "+endpoint)
+		return nil
+	}
+
+	stream := transferTurn(t, "1700000000.42", "Transferring. [TRANSFER:sales]")
+
+	if len(transferred) != 1 || transferred[0] != "call PJSIP/200" {
+		t.Errorf("OnTransfer calls = %v, want the call to sales", transferred)
+	}
+	if !stream.HungUp() {
+		t.Error("call not hung up after the transfer")
+	}
+}
+
+func TestTransferConfigValidate(t *testing.T) {
+	c := DefaultConfig()
+	c.Transfer.Targets = map[string]string{"sales": "PJSIP/200"}
+	if err := c.Validate(); err != nil {
+		t.Errorf("transfer targets with the default context rejected: %v", err)
+	}
+	c.Transfer.Context = ""
+	if err := c.Validate(); err == nil {
+		t.Error("transfer targets accepted without a dialplan context")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlMap holds values that are picked up once and expire if nobody does.
+type ttlMap[V any] struct {
+	mu      sync.Mutex
+	entries map[string]ttlEntry[V]
+}
+
+type ttlEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+func newTTLMap[V any]() *ttlMap[V] {
+	return &ttlMap[V]{entries: make(map[string]ttlEntry[V])}
+}
+
+// Put stores value under key, discarding it after ttl.
+func (m *ttlMap[V]) Put(key string, value V, ttl time.Duration) {
+	m.mu.Lock()
+	m.entries[key] = ttlEntry[V]{value: value, expires: clock.Now().Add(ttl)}
+	m.mu.Unlock()
+	time.AfterFunc(ttl, func() { m.expire(key) })
+}
+
+// Take removes and returns the value stored under key.
+func (m *ttlMap[V]) Take(key string) (V, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[key]
+	delete(m.entries, key)
+	if !ok || clock.Now().After(entry.expires) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// Get returns the value stored under key, leaving it in place.
+func (m *ttlMap[V]) Get(key string) (V, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[key]
+	if !ok || clock.Now().After(entry.expires) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// expire drops key if its entry has expired; it may have been replaced by
+// a newer one since the timer was set.
+func (m *ttlMap[V]) expire(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry, ok := m.entries[key]; ok && !clock.Now().Before(entry.expires) {
+		delete(m.entries, key)
+	}
+}
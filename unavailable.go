@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// unavailableRetry is how long rendering the unavailable message at a
+// sample rate waits after a failed attempt, so a TTS outage isn't hit
+// again on every failed turn.
+const unavailableRetry = 30 * time.Second
+
+// UnavailableConfig configures what a caller hears when a turn fails for
+// good, e.g. because STT, the LLM or TTS is down, instead of silence.
+type UnavailableConfig struct {
+	// File is a WAV or raw file of 16-bit mono SLIN at the call's sample
+	// rate, e.g. "Sorry, I'm having trouble right now". It is played
+	// without involving any backend.
+	File string `json:"file"`
+	// Message is synthesized through the TTS service and kept for later
+	// failures when no File is set. It is rendered for input_sample_rate
+	// at startup, or at a call's rate on its first failure, and retried
+	// at most every 30s while the TTS service is down.
+	Message string `json:"message"`
+	// MaxFailures hangs up after this many failed turns in a row. Zero
+	// never hangs up.
+	MaxFailures int `json:"max_failures"`
+}
+
+var (
+	// unavailableFile is the SLIN audio of the configured file, loaded in
+	// main.
+	unavailableFile []byte
+
+	// unavailableMu guards the rendered message, but is never held while
+	// rendering it.
+	unavailableMu sync.Mutex
+	// unavailableAudio holds the rendered message by sample rate.
+	unavailableAudio = make(map[int][]byte)
+	// unavailableRendering holds the sample rates being rendered.
+	unavailableRendering = make(map[int]bool)
+	// unavailableRetryAt is when rendering at a sample rate that failed
+	// is tried again.
+	unavailableRetryAt = make(map[int]time.Time)
+)
+
+// unavailableAudioFor returns the audio played for failed turns of a call
+// at rate: the configured file, or the message rendered at rate. The
+// message is rendered unless it is already, it is being rendered for
+// another call or rendering it failed recently; these get no audio.
+func unavailableAudioFor(rate int) []byte {
+	if unavailableFile != nil {
+		return unavailableFile
+	}
+	if config.Unavailable.Message == "" {
+		return nil
+	}
+	unavailableMu.Lock()
+	if audio, ok := unavailableAudio[rate]; ok {
+		unavailableMu.Unlock()
+		return audio
+	}
+	if unavailableRendering[rate] || clock.Now().Before(unavailableRetryAt[rate]) {
+		unavailableMu.Unlock()
+		return nil
+	}
+	unavailableRendering[rate] = true
+	unavailableMu.Unlock()
+
+	audio, err := renderUnavailableAudio(rate)
+
+	unavailableMu.Lock()
+	defer unavailableMu.Unlock()
+	delete(unavailableRendering, rate)
+	if err != nil {
+		log.Printf("failed to render the unavailable message at %d Hz, retrying in %s: %v", rate, unavailableRetry, err)
+		unavailableRetryAt[rate] = clock.Now().Add(unavailableRetry)
+		return nil
+	}
+	unavailableAudio[rate] = audio
+	return audio
+}
+
+// renderUnavailableAudio synthesizes the configured message at rate.
+func renderUnavailableAudio(rate int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), closingMessageTimeout)
+	defer cancel()
+	var buf bytes.Buffer
+	if err := playTTS(ctx, websocketURI, "", ttsPayload(config.Unavailable.Message, config.Language), newTTSWriter(&buf, rate)); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if buf.Len() == 0 {
+		return nil, errors.New("no audio")
+	}
+	return buf.Bytes(), nil
+}
+
+// turnFailed tells the caller that their turn failed, and hangs up once
+// too many turns in a row have. It is a no-op once the call is over.
+func turnFailed(ctx context.Context, call *Call) {
+	if ctx.Err() != nil {
+		return
+	}
+	failures := call.recordFailure()
+	audio := unavailableAudioFor(call.sampleRate())
+	if max := config.Unavailable.MaxFailures; max > 0 && failures >= max {
+		log.Printf("call %s: %d turns failed in a row, hanging up", call.ID, failures)
+		if audio != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), closingMessageTimeout)
+			playAudio(ctx, call, audio)
+			cancel()
+		}
+		call.Hangup()
+		return
+	}
+	if audio == nil {
+		call.stopFiller()
+		return
+	}
+	ctx, ready, done := call.Interrupter.StartPlayback(context.Background())
+	go func() {
+		defer func() {
+			done()
+			if !call.Interrupter.Playing() && !call.turns.Busy() {
+				call.setState(stateListening)
+			}
+		}()
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return
+		}
+		playAudio(ctx, call, audio)
+	}()
+}
+
+// playAudio plays SLIN audio to call until it ends or ctx is canceled.
+func playAudio(ctx context.Context, call *Call, audio []byte) {
+	w := playbackWriter(ctx, &AudioWriter{stream: call.Stream, frameSize: call.frameBytes(), onFirst: call.startSpeaking, onWrite: call.played, onError: call.writeFailed})
+	defer closeAudio(w)
+	_, err := w.Write(audio)
+	if err == nil {
+		err = flushAudio(w)
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Printf("call %s: failed to play audio: %v", call.ID, err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go-ast-client/settings"
+)
+
+// failingTranscriber is a Transcriber whose STT service is down.
+type failingTranscriber struct{}
+
+func (failingTranscriber) Transcribe(ctx context.Context, samples []float32, sttSettings settings.STTSettings) (string, error) {
+	return "", errors.New("STT down")
+}
+
+// withUnavailableFile has failed turns play audio as if loaded from a
+// file, restoring the configured audio when the test ends.
+func withUnavailableFile(t *testing.T, audio []byte) {
+	t.Helper()
+	saved := unavailableFile
+	t.Cleanup(func() { unavailableFile = saved })
+	unavailableFile = audio
+}
+
+// withUnavailableCache starts the test without any rendered message.
+func withUnavailableCache(t *testing.T) {
+	t.Helper()
+	withUnavailableFile(t, nil)
+	unavailableMu.Lock()
+	defer unavailableMu.Unlock()
+	saved, rendering, retryAt := unavailableAudio, unavailableRendering, unavailableRetryAt
+	t.Cleanup(func() {
+		unavailableMu.Lock()
+		defer unavailableMu.Unlock()
+		unavailableAudio, unavailableRendering, unavailableRetryAt = saved, rendering, retryAt
+	})
+	unavailableAudio = make(map[int][]byte)
+	unavailableRendering = make(map[int]bool)
+	unavailableRetryAt = make(map[int]time.Time)
+}
+
+// sttDownCall returns a call whose transcriptions fail.
+func sttDownCall(t *testing.T) (*Call, *ScriptedStream) {
+	t.Helper()
+	_, store := newTestChat(t, "call", testSettings(0.7), &fakeOllama{})
+	stream := NewScriptedStream()
+	call := NewCall("call", stream, func() {})
+	call.SetChatStore(store)
+	call.Transcriber = failingTranscriber{}
+	return call, stream
+}
+
+// writtenBytes returns the audio written to stream.
+func writtenBytes(stream *ScriptedStream) []byte {
+	return bytes.Join(stream.Written(), nil)
+}
+
+func TestSTTFailurePlaysUnavailableAudio(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.Unavailable.MaxFailures = 0
+		c.Webhook.StateEvents = true
+	})
+	events := withWebhookQueue(t)
+	audio := bytes.Repeat([]byte{0x33}, 960)
+	withUnavailableFile(t, audio)
+	call, stream := sttDownCall(t)
+
+	processUtterance(context.Background(), call, levelUtterance(0.05), nil)
+	waitForState(t, events, stateSpeaking)
+	waitForState(t, events, stateListening)
+
+	if got := writtenBytes(stream); !bytes.Equal(got, audio) {
+		t.Errorf("played %d bytes after the STT failure, want the %d of the unavailable audio", len(got), len(audio))
+	}
+	if stream.HungUp() {
+		t.Error("call hung up after one failed turn with no limit")
+	}
+}
+
+func TestUnavailableMessageRenderedOnce(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.Unavailable.Message = "Sorry, I'm having trouble right now."
+		c.Unavailable.MaxFailures = 0
+		c.Webhook.StateEvents = true
+	})
+	events := withWebhookQueue(t)
+	withUnavailableCache(t)
+	tts := newTTSServer(t, bytes.Repeat([]byte{0x44}, 640), 320)
+	withTTS(t, tts)
+	call, stream := sttDownCall(t)
+
+	for i := 0; i < 2; i++ {
+		processUtterance(context.Background(), call, levelUtterance(0.05), nil)
+		waitForState(t, events, stateSpeaking)
+		waitForState(t, events, stateListening)
+	}
+
+	requests := tts.Requests()
+	if len(requests) != 1 || requests[0]["message"] != "Sorry, I'm having trouble right now." {
+		t.Errorf("TTS requests = %v, want the message synthesized once", requests)
+	}
+	if got := writtenBytes(stream); !bytes.Equal(got, bytes.Repeat([]byte{0x44}, 1280)) {
+		t.Errorf("played %d bytes for two failed turns, want the message twice", len(got))
+	}
+}
+
+func TestHangupAfterMaxFailures(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.Unavailable.MaxFailures = 2
+		c.Webhook.StateEvents = true
+	})
+	events := withWebhookQueue(t)
+	audio := bytes.Repeat([]byte{0x33}, 640)
+	withUnavailableFile(t, audio)
+	call, stream := sttDownCall(t)
+
+	processUtterance(context.Background(), call, levelUtterance(0.05), nil)
+	waitForState(t, events, stateListening)
+	if stream.HungUp() {
+		t.Fatal("call hung up after the first failed turn")
+	}
+
+	processUtterance(context.Background(), call, levelUtterance(0.05), nil)
+	if !stream.HungUp() {
+		t.Error("call not hung up after the second failed turn in a row")
+	}
+	if got := writtenBytes(stream); !bytes.Equal(got, append(append([]byte(nil), audio...), audio...)) {
+		t.Errorf("played %d bytes, want the unavailable audio before each failure and the hangup", len(got))
+	}
+}
+
+func TestSuccessResetsFailures(t *testing.T) {
+	call := NewCall("call", NewScriptedStream(), func() {})
+	call.recordFailure()
+	call.recordFailure()
+	call.recordSuccess()
+	if failures := call.recordFailure(); failures != 1 {
+		t.Errorf("%d failures in a row after a success, want 1", failures)
+	}
+}
+
+func TestUnavailableMessageRenderedPerRate(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.Unavailable.Message = "Sorry, I'm having trouble right now."
+		c.TTSSampleRate = 16000
+	})
+	withUnavailableCache(t)
+	// 20 ms at the TTS rate
+	tts := newTTSServer(t, float32ArrayToPCM(sine(200, 16000, 0.02)), 640)
+	withTTS(t, tts)
+
+	if audio := unavailableAudioFor(8000); len(audio) != 320 {
+		t.Errorf("%d bytes rendered for an 8 kHz call, want 20 ms at 8 kHz", len(audio))
+	}
+	if audio := unavailableAudioFor(16000); len(audio) != 640 {
+		t.Errorf("%d bytes rendered for a 16 kHz call, want 20 ms at 16 kHz", len(audio))
+	}
+	unavailableAudioFor(8000)
+	if n := len(tts.Requests()); n != 2 {
+		t.Errorf("%d TTS requests, want one per sample rate", n)
+	}
+}
+
+func TestUnavailableRenderBacksOff(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Unavailable.Message = "Sorry, I'm having trouble right now." })
+	withUnavailableCache(t)
+	fake := NewFakeClock(time.Unix(0, 0))
+	withClock(t, fake)
+	// A TTS service answering without audio
+	tts := newTTSServer(t, nil, 320)
+	withTTS(t, tts)
+
+	if audio := unavailableAudioFor(8000); audio != nil {
+		t.Fatal("audio returned for a failed render")
+	}
+	fake.Advance(unavailableRetry - time.Second)
+	unavailableAudioFor(8000)
+	if n := len(tts.Requests()); n != 1 {
+		t.Errorf("%d TTS requests within the backoff, want 1", n)
+	}
+	fake.Advance(time.Second)
+	unavailableAudioFor(8000)
+	if n := len(tts.Requests()); n != 2 {
+		t.Errorf("%d TTS requests after the backoff, want 2", n)
+	}
+}
+
+func TestUnavailableRenderDoesNotBlock(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Unavailable.Message = "Sorry, I'm having trouble right now." })
+	withUnavailableCache(t)
+	tts := newTTSServer(t, make([]byte, 640), 320)
+	tts.delay = 500 * time.Millisecond
+	withTTS(t, tts)
+
+	rendered := make(chan []byte)
+	go func() { rendered <- unavailableAudioFor(8000) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tts.Requests()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("message never rendered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Other calls go on without the message rather than wait for it
+	start := time.Now()
+	if audio := unavailableAudioFor(8000); audio != nil {
+		t.Error("audio returned while it is still being rendered")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("waited %s for a render in progress", elapsed)
+	}
+	if audio := <-rendered; len(audio) != 640 {
+		t.Errorf("rendered %d bytes, want 640", len(audio))
+	}
+	if audio := unavailableAudioFor(8000); len(audio) != 640 {
+		t.Errorf("%d bytes once rendered, want the cached 640", len(audio))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// VAD backends selectable in VADConfig.
+const (
+	vadWebRTC = "webrtc"
+	vadEnergy = "energy"
+)
+
+// VoiceDetector decides whether a frame of SLIN audio contains speech.
+type VoiceDetector interface {
+	Process(rate int, frame []byte) (bool, error)
+}
+
+// VADConfig selects and tunes the voice activity detector.
+type VADConfig struct {
+	// Backend is "webrtc" (default) or "energy". The energy detector is
+	// also used whenever the webrtc backend can't be initialized.
+	Backend string `json:"backend"`
+	// Mode is the webrtc aggressiveness, 0 (least) to 3 (most).
+	Mode int `json:"mode"`
+	// EnergyThreshold is the RMS level (0-1) a frame needs to count as
+	// speech with the energy detector.
+	EnergyThreshold float64 `json:"energy_threshold"`
+	// MaxZeroCrossingRate rejects noise-like frames whose zero-crossing
+	// rate (crossings per sample) is above it.
+	MaxZeroCrossingRate float64 `json:"max_zero_crossing_rate"`
+	// PreRollFrames is how many frames preceding detected speech are
+	// prepended to the utterance so its onset isn't clipped.
+	PreRollFrames int `json:"pre_roll_frames"`
+	// HangoverFrames is how many non-speech frames after speech are kept
+	// as the utterance tail. It also delays finalizing the utterance.
+	HangoverFrames int `json:"hangover_frames"`
+	// FrameMs is the length of the frames the detector analyzes: 10, 20
+	// or 30. Inbound audio is re-framed to it whatever its chunk size.
+	FrameMs int `json:"frame_ms"`
+	// SilenceHints counts AudioSocket silence messages as silent frames,
+	// for gateways that signal silence explicitly instead of sending
+	// audio.
+	SilenceHints bool `json:"silence_hints"`
+}
+
+// vadActive reports whether any of frames contains speech.
+func vadActive(vad VoiceDetector, rate int, frames [][]byte) (bool, error) {
+	for _, frame := range frames {
+		active, err := vad.Process(rate, frame)
+		if err != nil || active {
+			return active, err
+		}
+	}
+	return false, nil
+}
+
+// FrameAligner cuts a stream of SLIN chunks of any size into frames of a
+// fixed size, holding the remainder until the next chunk.
+type FrameAligner struct {
+	size    int
+	pending []byte
+}
+
+// NewFrameAligner creates a FrameAligner producing frames of size bytes.
+func NewFrameAligner(size int) *FrameAligner {
+	return &FrameAligner{size: size}
+}
+
+// frameBytes is the size of a frameMs frame of 16-bit mono audio at rate.
+func frameBytes(rate, frameMs int) int {
+	return rate * frameMs / 1000 * 2
+}
+
+// Push adds chunk to the stream and returns the frames completed by it.
+func (a *FrameAligner) Push(chunk []byte) [][]byte {
+	a.pending = append(a.pending, chunk...)
+	var frames [][]byte
+	for len(a.pending) >= a.size {
+		frames = append(frames, a.pending[:a.size:a.size])
+		a.pending = a.pending[a.size:]
+	}
+	// Move the remainder to the front so pending doesn't keep growing
+	a.pending = append(a.pending[:0:0], a.pending...)
+	return frames
+}
+
+// newVoiceDetector creates the configured detector, falling back to the
+// energy detector if the webrtc backend is unavailable.
+func newVoiceDetector(cfg VADConfig) VoiceDetector {
+	if cfg.Backend == vadWebRTC {
+		vad, err := newWebRTCVAD(cfg.Mode)
+		if err == nil {
+			return vad
+		}
+		log.Println("webrtc VAD unavailable, using energy VAD:", err)
+	}
+	return &EnergyVAD{Threshold: cfg.EnergyThreshold, MaxZeroCrossingRate: cfg.MaxZeroCrossingRate}
+}
+
+// EnergyVAD is a pure-Go VoiceDetector based on frame energy and
+// zero-crossing rate.
+type EnergyVAD struct {
+	Threshold           float64
+	MaxZeroCrossingRate float64
+}
+
+// Process reports whether frame is loud enough, and tonal enough, to be
+// speech. rate is unused since both measures are rate independent.
+func (v *EnergyVAD) Process(rate int, frame []byte) (bool, error) {
+	samples, err := pcmToFloat32Array(frame)
+	if err != nil {
+		return false, fmt.Errorf("invalid frame: %v", err)
+	}
+	if len(samples) == 0 || rms(samples) < v.Threshold {
+		return false, nil
+	}
+
+	crossings := 0
+	for i := 1; i < len(samples); i++ {
+		if (samples[i-1] < 0) != (samples[i] < 0) {
+			crossings++
+		}
+	}
+	zcr := float64(crossings) / float64(len(samples))
+	return v.MaxZeroCrossingRate <= 0 || zcr <= v.MaxZeroCrossingRate, nil
+}
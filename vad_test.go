@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/CyCoreSystems/audiosocket"
+)
+
+// scaled returns samples multiplied by gain.
+func scaled(samples []float32, gain float32) []float32 {
+	out := make([]float32, len(samples))
+	for i, s := range samples {
+		out[i] = s * gain
+	}
+	return out
+}
+
+func TestEnergyVAD(t *testing.T) {
+	cfg := DefaultConfig().VAD
+	cfg.Backend = vadEnergy
+	vad := newVoiceDetector(cfg)
+	if _, ok := vad.(*EnergyVAD); !ok {
+		t.Fatalf("energy backend gave %T", vad)
+	}
+
+	// 20 ms frames at 16 kHz
+	voiced := sine(200, 16000, 0.02)
+	tests := []struct {
+		name   string
+		frame  []float32
+		speech bool
+	}{
+		{"voiced", voiced, true},
+		{"quiet voice", scaled(voiced, 0.2), true},
+		{"silence", make([]float32, 320), false},
+		{"below threshold", scaled(voiced, 0.02), false},
+		{"hiss", noiseFrames(8)(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := vad.Process(16000, float32ArrayToPCM(tt.frame))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.speech {
+				t.Errorf("Process() = %v, want %v", got, tt.speech)
+			}
+		})
+	}
+
+	if _, err := vad.Process(16000, []byte{1}); err == nil {
+		t.Error("odd-length frame accepted")
+	}
+}
+
+func TestEnergyVADWithoutZeroCrossingLimit(t *testing.T) {
+	vad := &EnergyVAD{Threshold: 0.02}
+	if active, _ := vad.Process(16000, float32ArrayToPCM(noiseFrames(9)())); !active {
+		t.Error("loud noise not taken for speech without a zero-crossing limit")
+	}
+}
+
+func TestVADActive(t *testing.T) {
+	vad := &EnergyVAD{Threshold: 0.02}
+	silent := float32ArrayToPCM(make([]float32, 320))
+	voiced := float32ArrayToPCM(sine(200, 16000, 0.02))
+
+	if active, _ := vadActive(vad, 16000, [][]byte{silent, silent}); active {
+		t.Error("silent frames active")
+	}
+	if active, _ := vadActive(vad, 16000, [][]byte{silent, voiced}); !active {
+		t.Error("speech in the last frame missed")
+	}
+	if active, _ := vadActive(vad, 16000, nil); active {
+		t.Error("no frames active")
+	}
+}
+
+// frameSizes is a VoiceDetector recording the size of each frame it sees.
+type frameSizes []int
+
+func (f *frameSizes) Process(rate int, frame []byte) (bool, error) {
+	*f = append(*f, len(frame))
+	return false, nil
+}
+
+func TestFrameAlignerMisalignedChunks(t *testing.T) {
+	for _, frameMs := range []int{10, 20, 30} {
+		size := frameBytes(16000, frameMs)
+		aligner := NewFrameAligner(size)
+		var in, out []byte
+		var seen frameSizes
+		for i, n := range []int{100, 700, 333, 1, 147, 2000, 57} {
+			chunk := make([]byte, n)
+			for j := range chunk {
+				chunk[j] = byte(len(in) + j)
+			}
+			in = append(in, chunk...)
+			frames := aligner.Push(chunk)
+			if _, err := vadActive(&seen, 16000, frames); err != nil {
+				t.Fatal(err)
+			}
+			for _, frame := range frames {
+				out = append(out, frame...)
+			}
+			// Only the remainder is held back
+			if held := len(in) - len(out); held < 0 || held >= size {
+				t.Errorf("%d ms: %d bytes held after chunk %d, want under one frame", frameMs, held, i)
+			}
+		}
+		for _, n := range seen {
+			if n != size {
+				t.Fatalf("%d ms: VAD saw a %d byte frame, want %d", frameMs, n, size)
+			}
+		}
+		if len(seen) != len(in)/size || !bytes.Equal(out, in[:len(out)]) {
+			t.Errorf("%d ms: frames don't match the input in order", frameMs)
+		}
+	}
+}
+
+// chunks returns n AudioSocket messages of 30 ms of slin16, each holding
+// samples.
+func chunks(n int, samples []float32) []audiosocket.Message {
+	messages := make([]audiosocket.Message, n)
+	for i := range messages {
+		messages[i] = audiosocket.SlinMessage(float32ArrayToPCM(samples))
+	}
+	return messages
+}
+
+func TestUtteranceWithMismatchedFrames(t *testing.T) {
+	// 30 ms reads feed 20 ms VAD frames; pre-roll and hangover count reads
+	withConfig(t, func(c *Config) {
+		c.AudioFrameMs = 30
+		c.VAD.Backend = vadEnergy
+		c.VAD.FrameMs = 20
+		c.VAD.PreRollFrames = 3
+		c.VAD.HangoverFrames = 4
+	})
+	stt := newSTTServer(t, "hello")
+	stt.hold = true
+	s := testSettings(0.7)
+	s.AsteriskSettings.AsteriskSegment = "test"
+	id, _ := newTestCallChat(t, s)
+
+	const chunk = 480
+	script := []audiosocket.Message{audiosocket.IDMessage(id)}
+	script = append(script, chunks(10, constantSamples(chunk, 0.004))...)
+	script = append(script, chunks(20, sine(200, 16000, 0.03))...)
+	script = append(script, chunks(10, constantSamples(chunk, 0.008))...)
+	stream := newTestStream(script...)
+	stream.hold = true
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(context.Background(), stream)
+	}()
+	defer func() {
+		stream.Close()
+		<-done
+	}()
+
+	samples := stt.Upload(t)
+	if want := (3 + 20 + 4) * chunk; len(samples) != want {
+		t.Fatalf("utterance has %d samples, want %d", len(samples), want)
+	}
+	if call := calls.Get(id.String()); call == nil || call.sampleRate() != 16000 {
+		t.Error("rate not detected from 30 ms frames")
+	}
+}
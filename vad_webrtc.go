@@ -0,0 +1,17 @@
+//go:build cgo
+
+package main
+
+import "github.com/maxhawkins/go-webrtcvad"
+
+// newWebRTCVAD creates a VoiceDetector backed by the webrtc VAD.
+func newWebRTCVAD(mode int) (VoiceDetector, error) {
+	vad, err := webrtcvad.New()
+	if err != nil {
+		return nil, err
+	}
+	if err := vad.SetMode(mode); err != nil {
+		return nil, err
+	}
+	return vad, nil
+}
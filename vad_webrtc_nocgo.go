@@ -0,0 +1,10 @@
+//go:build !cgo
+
+package main
+
+import "errors"
+
+// newWebRTCVAD reports that the webrtc VAD needs cgo.
+func newWebRTCVAD(mode int) (VoiceDetector, error) {
+	return nil, errors.New("webrtc VAD requires cgo")
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-ast-client/api"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Webhook event types. What callers said and what was answered is
+// redacted in events like in the logs, per api.Redact.
+const (
+	eventCallStarted          = "call_started"
+	eventUtteranceTranscribed = "utterance_transcribed"
+	eventAssistantResponded   = "assistant_responded"
+	eventCallEnded            = "call_ended"
+	eventStateChanged         = "state_changed"
+	eventCallTransferred      = "call_transferred"
+)
+
+// Assistant states reported by state_changed events.
+const (
+	stateListening = "listening"
+	stateThinking  = "thinking"
+	stateSpeaking  = "speaking"
+)
+
+// webhookBackoff is the delay before the first retry; it doubles with
+// every further attempt.
+const webhookBackoff = 500 * time.Millisecond
+
+// WebhookConfig configures call lifecycle notifications.
+type WebhookConfig struct {
+	// URL receives events as JSON POSTs. Empty disables webhooks.
+	URL string `json:"url"`
+	// QueueSize is how many events may wait for delivery; further events
+	// are dropped.
+	QueueSize int `json:"queue_size"`
+	// MaxRetries is how often a failed delivery is retried.
+	MaxRetries int `json:"max_retries"`
+	// TimeoutMs bounds each delivery attempt.
+	TimeoutMs int `json:"timeout_ms"`
+	// TranscriptWindow adds the last this many messages of the
+	// conversation, including the new one, to utterance_transcribed
+	// events. Their content is redacted unless log_level is debug. Zero
+	// leaves them out.
+	TranscriptWindow int `json:"transcript_window"`
+	// StateEvents also sends a state_changed event whenever the assistant
+	// starts listening, thinking or speaking.
+	StateEvents bool `json:"state_events"`
+}
+
+// WebhookEvent is the body POSTed to the webhook URL.
+type WebhookEvent struct {
+	Type   string                 `json:"type"`
+	CallID string                 `json:"call_id"`
+	Time   time.Time              `json:"time"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+}
+
+// TranscriptLine is a message in the transcript window of an event.
+type TranscriptLine struct {
+	Role    api.Sender `json:"role"`
+	Content string     `json:"content"`
+}
+
+// transcriptWindow returns the last n messages of history followed by
+// text, n lines in all, with their content redacted per api.Redact.
+func transcriptWindow(history []api.Message, text string, n int) []TranscriptLine {
+	if n <= 0 {
+		return nil
+	}
+	if len(history) > n-1 {
+		history = history[len(history)-(n-1):]
+	}
+	lines := make([]TranscriptLine, 0, len(history)+1)
+	for _, msg := range history {
+		lines = append(lines, TranscriptLine{Role: msg.Role, Content: api.Redact(msg.Content)})
+	}
+	return append(lines, TranscriptLine{Role: api.SenderUser, Content: api.Redact(text)})
+}
+
+// WebhookEmitter delivers events in the background so a slow receiver
+// never stalls a call. A nil WebhookEmitter drops all events.
+type WebhookEmitter struct {
+	config WebhookConfig
+	client *http.Client
+	queue  chan WebhookEvent
+	wg     sync.WaitGroup
+}
+
+// webhooks is the emitter for the configured webhook, set up in main.
+var webhooks *WebhookEmitter
+
+// NewWebhookEmitter starts delivering events to cfg.URL.
+func NewWebhookEmitter(cfg WebhookConfig, client *http.Client) *WebhookEmitter {
+	e := &WebhookEmitter{
+		config: cfg,
+		client: client,
+		queue:  make(chan WebhookEvent, cfg.QueueSize),
+	}
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		for event := range e.queue {
+			e.deliver(event)
+		}
+	}()
+	return e
+}
+
+// Emit queues an event of type eventType for callID. If the queue is full
+// the event is dropped.
+func (e *WebhookEmitter) Emit(eventType, callID string, data map[string]interface{}) {
+	if e == nil {
+		return
+	}
+	event := WebhookEvent{Type: eventType, CallID: callID, Time: clock.Now(), Data: data}
+	select {
+	case e.queue <- event:
+	default:
+		log.Printf("webhook queue is full, dropping %s event for call %s", eventType, callID)
+	}
+}
+
+// Close delivers the queued events and stops the emitter. Emit must not be
+// called afterwards.
+func (e *WebhookEmitter) Close() {
+	if e == nil {
+		return
+	}
+	close(e.queue)
+	e.wg.Wait()
+}
+
+// deliver posts event, retrying with exponential backoff.
+func (e *WebhookEmitter) deliver(event WebhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Println("failed to encode webhook event:", err)
+		return
+	}
+
+	backoff := webhookBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := e.post(body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= e.config.MaxRetries {
+			log.Printf("failed to deliver %s event for call %s: %v", event.Type, event.CallID, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends one delivery attempt. retry reports whether a failure may be
+// temporary.
+func (e *WebhookEmitter) post(body []byte) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(e.config.TimeoutMs)*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("received status code %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("received status code %d", resp.StatusCode)
+	}
+}
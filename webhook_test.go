@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CyCoreSystems/audiosocket"
+
+	"go-ast-client/api"
+)
+
+// webhookReceiver is a webhook endpoint recording the events it is sent.
+// The first failures deliveries are answered with status.
+type webhookReceiver struct {
+	*httptest.Server
+	failures int
+	status   int
+	// release, if set, holds every delivery until it is closed.
+	release chan struct{}
+
+	mu       sync.Mutex
+	attempts int
+	events   []WebhookEvent
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	t.Helper()
+	rcv := &webhookReceiver{}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rcv.release != nil {
+			<-rcv.release
+		}
+		var event WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("invalid webhook body: %v", err)
+		}
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.attempts++
+		if rcv.attempts <= rcv.failures {
+			w.WriteHeader(rcv.status)
+			return
+		}
+		rcv.events = append(rcv.events, event)
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+// Events returns the events delivered so far.
+func (rcv *webhookReceiver) Events() []WebhookEvent {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]WebhookEvent(nil), rcv.events...)
+}
+
+// Attempts returns the number of deliveries attempted.
+func (rcv *webhookReceiver) Attempts() int {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return rcv.attempts
+}
+
+func newTestEmitter(rcv *webhookReceiver, queueSize int) *WebhookEmitter {
+	return NewWebhookEmitter(WebhookConfig{URL: rcv.URL, QueueSize: queueSize, MaxRetries: 3, TimeoutMs: 5000}, &http.Client{})
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	rcv := newWebhookReceiver(t)
+	e := newTestEmitter(rcv, 16)
+	e.Emit(eventCallStarted, "call", map[string]interface{}{"number": "100"})
+	e.Emit(eventUtteranceTranscribed, "call", map[string]interface{}{"text": "hello"})
+	e.Emit(eventCallEnded, "call", nil)
+	e.Close()
+
+	events := rcv.Events()
+	if len(events) != 3 {
+		t.Fatalf("%d events delivered, want 3", len(events))
+	}
+	for i, want := range []string{eventCallStarted, eventUtteranceTranscribed, eventCallEnded} {
+		if events[i].Type != want || events[i].CallID != "call" || events[i].Time.IsZero() {
+			t.Errorf("event %d = %+v, want %s for the call", i, events[i], want)
+		}
+	}
+	if events[1].Data["text"] != "hello" {
+		t.Errorf("utterance data = %v", events[1].Data)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	rcv := newWebhookReceiver(t)
+	rcv.failures, rcv.status = 1, http.StatusServiceUnavailable
+	e := newTestEmitter(rcv, 16)
+	e.Emit(eventCallStarted, "call", nil)
+	e.Close()
+	if len(rcv.Events()) != 1 || rcv.Attempts() != 2 {
+		t.Errorf("%d events in %d attempts, want the event delivered on the retry", len(rcv.Events()), rcv.Attempts())
+	}
+}
+
+func TestWebhookClientErrorNotRetried(t *testing.T) {
+	rcv := newWebhookReceiver(t)
+	rcv.failures, rcv.status = 1, http.StatusBadRequest
+	e := newTestEmitter(rcv, 16)
+	e.Emit(eventCallStarted, "call", nil)
+	e.Close()
+	if rcv.Attempts() != 1 {
+		t.Errorf("%d attempts for a rejected event, want 1", rcv.Attempts())
+	}
+}
+
+func TestWebhookDropsOnOverflow(t *testing.T) {
+	rcv := newWebhookReceiver(t)
+	rcv.release = make(chan struct{})
+	e := newTestEmitter(rcv, 2)
+
+	// A stalled receiver doesn't stall the call
+	emitted := make(chan struct{})
+	go func() {
+		defer close(emitted)
+		for i := 0; i < 20; i++ {
+			e.Emit(eventStateChanged, "call", nil)
+		}
+	}()
+	select {
+	case <-emitted:
+	case <-time.After(time.Second):
+		t.Fatal("Emit blocked on a slow receiver")
+	}
+	close(rcv.release)
+	e.Close()
+	// The event being delivered and the queued ones get through
+	if n := len(rcv.Events()); n < 2 || n > 3 {
+		t.Errorf("%d events delivered, want the queue's worth", n)
+	}
+}
+
+func TestWebhookEventTimeFromClock(t *testing.T) {
+	withClock(t, NewFakeClock(time.Unix(1700000000, 0)))
+	events := withWebhookQueue(t)
+	webhooks.Emit(eventStateChanged, "call", nil)
+	if event := <-events; !event.Time.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("event time = %s, want the clock's", event.Time)
+	}
+}
+
+func TestWebhookCallLifecycle(t *testing.T) {
+	rcv := newWebhookReceiver(t)
+	saved := webhooks
+	webhooks = newTestEmitter(rcv, 16)
+	t.Cleanup(func() { webhooks = saved })
+	id, _ := newTestCallChat(t, testSettings(0.7))
+
+	script := append([]audiosocket.Message{audiosocket.IDMessage(id)}, silenceFrames(5)...)
+	runHandle(t, context.Background(), newTestStream(append(script, audiosocket.HangupMessage())...))
+	webhooks.Close()
+
+	events := rcv.Events()
+	if len(events) != 2 || events[0].Type != eventCallStarted || events[1].Type != eventCallEnded {
+		t.Fatalf("events = %+v, want call_started and call_ended", events)
+	}
+	for _, event := range events {
+		if event.CallID != id.String() {
+			t.Errorf("%s event for call %q, want %s", event.Type, event.CallID, id)
+		}
+	}
+	if _, ok := events[1].Data["duration_seconds"]; !ok {
+		t.Errorf("call_ended data = %v, want the duration", events[1].Data)
+	}
+}
+
+func TestStateEventsForTurn(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.Webhook.StateEvents = true
+		c.VAD.Backend = vadEnergy
+	})
+	events := withWebhookQueue(t)
+	stt := newSTTServer(t, "hello")
+	withTTS(t, newTTSServer(t, make([]byte, 640), 320))
+	s := testSettings(0.7)
+	s.AsteriskSettings.AsteriskSegment = "test"
+	id, _ := newTestCallChat(t, s)
+	stream := newTestStream(append([]audiosocket.Message{audiosocket.IDMessage(id)}, utteranceFrames()...)...)
+	stream.hold = true
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Handle(context.Background(), stream)
+	}()
+	defer func() {
+		stream.Close()
+		<-done
+	}()
+
+	stt.Upload(t)
+	var states []string
+	timeout := time.After(5 * time.Second)
+	for len(states) < 4 {
+		select {
+		case event := <-events:
+			if event.Type != eventStateChanged {
+				continue
+			}
+			if event.CallID != id.String() || event.Time.IsZero() {
+				t.Errorf("state event %+v, want the call ID and time", event)
+			}
+			states = append(states, event.Data["state"].(string))
+		case <-timeout:
+			t.Fatalf("states = %v, want a full turn", states)
+		}
+	}
+	want := []string{stateListening, stateThinking, stateSpeaking, stateListening}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("states = %v, want %v", states, want)
+	}
+}
+
+// withLogContent sets api.LogContent for the test, restoring it after.
+func withLogContent(t *testing.T, logContent bool) {
+	t.Helper()
+	saved := api.LogContent
+	t.Cleanup(func() { api.LogContent = saved })
+	api.LogContent = logContent
+}
+
+func TestTranscriptWindow(t *testing.T) {
+	withLogContent(t, true)
+	var history []api.Message
+	for i := 1; i <= 5; i++ {
+		role := api.SenderUser
+		if i%2 == 0 {
+			role = api.SenderAssistant
+		}
+		history = append(history, api.Message{Role: role, Content: fmt.Sprint("line ", i)})
+	}
+
+	got := transcriptWindow(history, "latest", 3)
+	want := []TranscriptLine{
+		{Role: api.SenderAssistant, Content: "line 4"},
+		{Role: api.SenderUser, Content: "line 5"},
+		{Role: api.SenderUser, Content: "latest"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("window of 3 = %+v, want %+v", got, want)
+	}
+	if got := transcriptWindow(history, "latest", 10); len(got) != 6 {
+		t.Errorf("window of 10 over 5 messages has %d lines, want 6", len(got))
+	}
+	if got := transcriptWindow(history, "latest", 1); len(got) != 1 || got[0].Content != "latest" {
+		t.Errorf("window of 1 = %+v, want only the latest line", got)
+	}
+	if got := transcriptWindow(history, "latest", 0); got != nil {
+		t.Errorf("window of 0 = %+v, want none", got)
+	}
+}
+
+func TestTranscriptWindowRedacted(t *testing.T) {
+	withLogContent(t, false)
+	history := []api.Message{{Role: api.SenderUser, Content: "my card is 4111"}}
+	for _, line := range transcriptWindow(history, "my PIN is 1234", 2) {
+		if strings.Contains(line.Content, "4111") || strings.Contains(line.Content, "1234") {
+			t.Errorf("window line %+v not redacted", line)
+		}
+	}
+}
+
+func TestUtteranceEventCarriesWindow(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.Webhook.StateEvents = true
+		c.Webhook.TranscriptWindow = 2
+	})
+	withLogContent(t, true)
+	events := withWebhookQueue(t)
+	withTTS(t, newTTSServer(t, make([]byte, 640), 320))
+	_, store := newTestChat(t, "call", testSettings(0.7), &fakeOllama{})
+	call := NewCall("call", NewScriptedStream(), func() {})
+	call.ChatStore = store
+
+	var windows [][]TranscriptLine
+	for _, text := range []string{"first", "second"} {
+		handleTranscription(context.Background(), call, text)
+		timeout := time.After(5 * time.Second)
+	wait:
+		for {
+			select {
+			case event := <-events:
+				if event.Type == eventUtteranceTranscribed {
+					windows = append(windows, event.Data["transcript"].([]TranscriptLine))
+				}
+				if event.Type == eventStateChanged && event.Data["state"] == stateListening {
+					break wait
+				}
+			case <-timeout:
+				t.Fatal("turn never finished")
+			}
+		}
+	}
+
+	want := []TranscriptLine{{Role: api.SenderAssistant, Content: "ok"}, {Role: api.SenderUser, Content: "second"}}
+	if len(windows) != 2 || !reflect.DeepEqual(windows[1], want) {
+		t.Errorf("windows = %+v, want the last reply and the new line", windows)
+	}
+}
+
+// turnEventTexts runs a turn answered with "ok" and returns the text of
+// its utterance_transcribed and assistant_responded events.
+func turnEventTexts(t *testing.T) (utterance, reply interface{}) {
+	t.Helper()
+	withConfig(t, func(c *Config) { c.Webhook.StateEvents = true })
+	events := withWebhookQueue(t)
+	withTTS(t, newTTSServer(t, make([]byte, 640), 320))
+	_, store := newTestChat(t, "call", testSettings(0.7), &fakeOllama{})
+	call := NewCall("call", NewScriptedStream(), func() {})
+	call.ChatStore = store
+
+	handleTranscription(context.Background(), call, "my card is 4111")
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			switch event.Type {
+			case eventUtteranceTranscribed:
+				utterance = event.Data["text"]
+			case eventAssistantResponded:
+				reply = event.Data["text"]
+			case eventStateChanged:
+				if event.Data["state"] == stateListening {
+					return utterance, reply
+				}
+			}
+		case <-timeout:
+			t.Fatal("turn never finished")
+			return nil, nil
+		}
+	}
+}
+
+func TestEventTextRedacted(t *testing.T) {
+	withLogContent(t, false)
+	utterance, reply := turnEventTexts(t)
+	if utterance != api.Redact("my card is 4111") || reply != api.Redact("ok") {
+		t.Errorf("event texts %q and %q, want them redacted", utterance, reply)
+	}
+}
+
+func TestEventTextAtDebug(t *testing.T) {
+	withLogContent(t, true)
+	utterance, reply := turnEventTexts(t)
+	if utterance != "my card is 4111" || reply != "ok" {
+		t.Errorf("event texts %q and %q, want them as said at debug", utterance, reply)
+	}
+}